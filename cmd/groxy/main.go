@@ -9,33 +9,68 @@ import (
 	"os"
 	"os/signal"
 	"runtime/debug"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/Semior001/groxy/pkg/admin"
 	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/adminprovider"
 	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/metrics"
 	"github.com/Semior001/groxy/pkg/proxy"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/Semior001/groxy/pkg/tlsx"
+	"github.com/Semior001/groxy/pkg/tracing"
 	"github.com/cappuccinotm/slogx"
 	"github.com/cappuccinotm/slogx/slogm"
 	"github.com/jessevdk/go-flags"
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-isatty"
 	"golang.org/x/sync/errgroup"
+	"gopkg.in/yaml.v3"
 )
 
 var opts struct {
-	Addr string `short:"a" long:"addr" env:"ADDR" default:":8080" description:"Address to listen on"`
+	Addr []string `short:"a" long:"addr" env:"ADDR" env-delim:"," default:":8080" description:"Address to listen on, either host:port or unix:///path/to/socket, may be repeated"`
 	File struct {
 		Name          string        `long:"name"           env:"NAME"           default:"groxy.yml" description:"Config file name"                  `
 		CheckInterval time.Duration `long:"check-interval" env:"CHECK_INTERVAL" default:"3s"        description:"Check interval for the config file"`
 		Delay         time.Duration `long:"delay"          env:"DELAY"          default:"500ms"     description:"Delay before applying the changes" `
 	} `group:"file" namespace:"file" env-namespace:"FILE"`
-	UseStdin   bool `long:"stdin"         env:"STDIN"            description:"Read configuration from stdin instead of file"`
-	Signature  bool `long:"signature"     env:"SIGNATURE"        description:"Enable gRoxy signature headers"`
-	Reflection bool `long:"reflection"    env:"REFLECTION"       description:"Enable gRPC reflection merger"`
-	JSON       bool `long:"json"          env:"JSON"             description:"Enable JSON logging"`
-	Debug      bool `long:"debug"         env:"DEBUG"            description:"Enable debug mode"`
+	Admin struct {
+		Addr        string `long:"addr"         env:"ADDR"                        description:"Address to serve the admin API on, disabled if empty"`
+		JournalSize int    `long:"journal-size" env:"JOURNAL_SIZE" default:"1000" description:"Max number of requests kept in the journal, disabled if zero"`
+	} `group:"admin" namespace:"admin" env-namespace:"ADMIN"`
+	Metrics struct {
+		Addr string `long:"addr" env:"ADDR" description:"Address to serve Prometheus metrics on, disabled if empty"`
+	} `group:"metrics" namespace:"metrics" env-namespace:"METRICS"`
+	Tracing struct {
+		Endpoint    string  `long:"endpoint"     env:"ENDPOINT"                  description:"OTLP/gRPC collector address to export traces to, disabled if empty"`
+		Insecure    bool    `long:"insecure"     env:"INSECURE"                  description:"Connect to the collector without TLS"`
+		SampleRatio float64 `long:"sample-ratio" env:"SAMPLE_RATIO" default:"1" description:"Ratio of sampled traces, which aren't sampled by the clients"`
+	} `group:"tracing" namespace:"tracing" env-namespace:"TRACING"`
+	TLS struct {
+		Cert          string        `long:"cert"           env:"CERT"                                       description:"Server certificate file, enables TLS if set"`
+		Key           string        `long:"key"            env:"KEY"                                        description:"Server private key file"`
+		ClientCA      string        `long:"client-ca"      env:"CLIENT_CA"                                  description:"CA file to verify client certificates"`
+		ClientAuth    string        `long:"client-auth"    env:"CLIENT_AUTH"    default:"require-and-verify" description:"Client certificate policy, applied if client CA is set: none, request, require-any, verify-if-given or require-and-verify"`
+		CheckInterval time.Duration `long:"check-interval" env:"CHECK_INTERVAL" default:"10s"                description:"Check interval for the certificate files"`
+		SelfSigned    bool          `long:"self-signed"    env:"SELF_SIGNED"                                description:"Generate an in-memory CA and a server certificate on startup, enables TLS"`
+		SANs          []string      `long:"san"            env:"SAN"            default:"localhost" default:"127.0.0.1" default:"::1" env-delim:"," description:"Host names and IPs of the self-signed certificate"`
+		CAOut         string        `long:"ca-out"         env:"CA_OUT"                                     description:"File to write the generated CA certificate to, for the clients to trust it"`
+	} `group:"tls" namespace:"tls" env-namespace:"TLS"`
+	SocketMode string   `long:"socket-mode"   env:"SOCKET_MODE"      description:"File mode of the unix sockets to listen on, e.g. 0660"`
+	Record     string   `long:"record"        env:"RECORD"           description:"Record forwarded requests as mock rules into the file on shutdown"`
+	UseStdin   bool     `long:"stdin"         env:"STDIN"            description:"Read configuration from stdin instead of file"`
+	Signature  bool     `long:"signature"     env:"SIGNATURE"        description:"Enable gRoxy signature headers"`
+	Reflection bool     `long:"reflection"    env:"REFLECTION"       description:"Enable gRPC reflection merger"`
+	Web        bool     `long:"web"           env:"WEB"              description:"Serve gRPC-Web, Connect and HTTP/JSON requests on the same addresses"`
+	Origins    []string `long:"origin"        env:"ORIGINS" env-delim:"," description:"Origin, allowed to make web requests from browsers, may be repeated, * allows any, localhost only if empty"`
+	JSON       bool     `long:"json"          env:"JSON"             description:"Enable JSON logging"`
+	Debug      bool     `long:"debug"         env:"DEBUG"            description:"Enable debug mode"`
 }
 
 var version = "unknown"
@@ -73,6 +108,63 @@ func main() {
 func run(ctx context.Context) error {
 	dsvc := &discovery.Service{}
 
+	proxyOpts := []proxy.Option{proxy.Version(getVersion())}
+
+	var rec *recorder.Recorder
+	if opts.Record != "" {
+		slog.Info("recording forwarded requests", slog.String("file", opts.Record))
+		rec = &recorder.Recorder{}
+		proxyOpts = append(proxyOpts, proxy.WithRecorder(rec))
+	}
+
+	var adminSrv *admin.Server
+	if opts.Admin.Addr != "" {
+		// rules, added via admin API, take precedence over the ones from the configuration
+		provider := &adminprovider.Admin{}
+		dsvc.Providers = append(dsvc.Providers, provider)
+		adminOpts := []admin.Option{admin.WithProvider(provider), admin.WithScenarios(dsvc)}
+
+		if rec != nil {
+			adminOpts = append(adminOpts, admin.WithRecorder(rec))
+		}
+
+		if opts.Admin.JournalSize > 0 {
+			j := journal.New(opts.Admin.JournalSize)
+			proxyOpts = append(proxyOpts, proxy.WithJournal(j))
+			adminOpts = append(adminOpts, admin.WithJournal(j))
+		}
+
+		adminSrv = admin.NewServer(adminOpts...)
+	}
+
+	var metricsSrv *metrics.Metrics
+	if opts.Metrics.Addr != "" {
+		metricsSrv = metrics.New(dsvc.Upstreams)
+		dsvc.OnReload = metricsSrv.ObserveReload
+		proxyOpts = append(proxyOpts, proxy.WithMetrics(metricsSrv))
+	}
+
+	if opts.Tracing.Endpoint != "" {
+		tp, err := tracing.NewProvider(ctx, tracing.Config{
+			Endpoint:    opts.Tracing.Endpoint,
+			Insecure:    opts.Tracing.Insecure,
+			SampleRatio: opts.Tracing.SampleRatio,
+			Version:     getVersion(),
+		})
+		if err != nil {
+			return fmt.Errorf("prepare tracing: %w", err)
+		}
+		defer func() {
+			// flush the spans, buffered before the shutdown
+			if err := tp.Shutdown(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("failed to shutdown tracer provider", slogx.Error(err))
+			}
+		}()
+
+		slog.Info("tracing enabled", slog.String("endpoint", opts.Tracing.Endpoint))
+		proxyOpts = append(proxyOpts, proxy.WithTracing(tp, tracing.Propagator()))
+	}
+
 	switch {
 	case opts.UseStdin:
 		slog.Info("reading configuration from stdin")
@@ -87,7 +179,6 @@ func run(ctx context.Context) error {
 		})
 	}
 
-	proxyOpts := []proxy.Option{proxy.Version(getVersion())}
 	if opts.Debug {
 		proxyOpts = append(proxyOpts, proxy.Debug())
 	}
@@ -95,13 +186,46 @@ func run(ctx context.Context) error {
 		slog.Info("gRPC reflection merger enabled")
 		proxyOpts = append(proxyOpts, proxy.WithReflection())
 	}
+
+	if opts.Web {
+		slog.Info("gRPC-Web, Connect and HTTP/JSON enabled")
+		proxyOpts = append(proxyOpts, proxy.WithWeb(), proxy.WithAllowedOrigins(opts.Origins...))
+	}
 	if opts.Signature {
 		proxyOpts = append(proxyOpts, proxy.WithSignature())
 	}
 
+	var certs *tlsx.Server
+	if opts.TLS.Cert != "" || opts.TLS.SelfSigned {
+		var err error
+		if certs, err = serverCerts(); err != nil {
+			return fmt.Errorf("prepare TLS: %w", err)
+		}
+		slog.Info("TLS enabled",
+			slog.String("cert", opts.TLS.Cert),
+			slog.String("client_ca", opts.TLS.ClientCA))
+		proxyOpts = append(proxyOpts, proxy.WithTLS(certs.Config()))
+	}
+
+	if opts.SocketMode != "" {
+		mode, err := strconv.ParseUint(opts.SocketMode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("parse socket mode %q: %w", opts.SocketMode, err)
+		}
+		proxyOpts = append(proxyOpts, proxy.WithSocketMode(os.FileMode(mode)))
+	}
+
 	srv := proxy.NewServer(dsvc, proxyOpts...)
 
 	ewg, ctx := errgroup.WithContext(ctx)
+	if certs != nil {
+		ewg.Go(func() error {
+			if err := certs.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+				return fmt.Errorf("TLS certificates reloader: %w", err)
+			}
+			return nil
+		})
+	}
 	ewg.Go(func() error {
 		if err := dsvc.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
 			return fmt.Errorf("discovery service: %w", err)
@@ -109,21 +233,119 @@ func run(ctx context.Context) error {
 		return nil
 	})
 	ewg.Go(func() error {
-		if err := srv.Listen(opts.Addr); err != nil {
+		if err := srv.Listen(opts.Addr...); err != nil {
 			return fmt.Errorf("proxy server: %w", err)
 		}
 		return nil
 	})
+	if adminSrv != nil {
+		ewg.Go(func() error {
+			if err := adminSrv.Listen(opts.Admin.Addr); err != nil {
+				return fmt.Errorf("admin server: %w", err)
+			}
+			return nil
+		})
+	}
+	if metricsSrv != nil {
+		ewg.Go(func() error {
+			if err := metricsSrv.Listen(opts.Metrics.Addr); err != nil {
+				return fmt.Errorf("metrics server: %w", err)
+			}
+			return nil
+		})
+	}
 	ewg.Go(func() error {
 		<-ctx.Done()
 		srv.Close()
+		if adminSrv != nil {
+			if err := adminSrv.Close(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("failed to close admin server", slogx.Error(err))
+			}
+		}
+		if metricsSrv != nil {
+			if err := metricsSrv.Close(context.WithoutCancel(ctx)); err != nil {
+				slog.Warn("failed to close metrics server", slogx.Error(err))
+			}
+		}
 		return nil
 	})
 
-	if err := ewg.Wait(); err != nil {
-		return err
+	err := ewg.Wait()
+
+	if rec != nil {
+		if serr := saveRecordings(opts.Record, rec); serr != nil {
+			err = errors.Join(err, serr)
+		}
+	}
+
+	return err
+}
+
+// serverCerts loads the server certificates, as configured by the TLS flags.
+func serverCerts() (*tlsx.Server, error) {
+	certs := &tlsx.Server{
+		CertFile:      opts.TLS.Cert,
+		KeyFile:       opts.TLS.Key,
+		ClientCAFile:  opts.TLS.ClientCA,
+		CheckInterval: opts.TLS.CheckInterval,
+		HTTP1:         opts.Web,
+	}
+
+	if opts.TLS.ClientCA != "" {
+		auth, err := tlsx.ParseClientAuth(opts.TLS.ClientAuth)
+		if err != nil {
+			return nil, err
+		}
+		certs.ClientAuth = auth
+	}
+
+	if opts.TLS.SelfSigned {
+		if opts.TLS.Cert != "" {
+			return nil, errors.New("self-signed certificate can't be used along with the certificate files")
+		}
+
+		ca, err := tlsx.NewCA("groxy development CA")
+		if err != nil {
+			return nil, fmt.Errorf("generate CA: %w", err)
+		}
+
+		cert, err := ca.Issue("groxy", opts.TLS.SANs...)
+		if err != nil {
+			return nil, fmt.Errorf("issue server certificate: %w", err)
+		}
+		certs.Certificate = &cert
+
+		slog.Info("generated self-signed certificate", slog.Any("sans", opts.TLS.SANs))
+
+		if opts.TLS.CAOut != "" {
+			if err = os.WriteFile(opts.TLS.CAOut, ca.PEM(), 0o644); err != nil {
+				return nil, fmt.Errorf("write CA certificate: %w", err)
+			}
+			slog.Info("saved CA certificate", slog.String("file", opts.TLS.CAOut))
+		}
+	}
+
+	if err := certs.Load(); err != nil {
+		return nil, fmt.Errorf("load certificates: %w", err)
+	}
+
+	return certs, nil
+}
+
+// saveRecordings writes the recorded rules into the file.
+func saveRecordings(file string, rec *recorder.Recorder) error {
+	cfg := rec.Config()
+
+	bts, err := yaml.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("marshal recordings: %w", err)
+	}
+
+	if err = os.WriteFile(file, bts, 0o644); err != nil {
+		return fmt.Errorf("write recordings: %w", err)
 	}
 
+	slog.Info("saved recordings", slog.String("file", file), slog.Int("rules", len(cfg.Rules)))
 	return nil
 }
 
@@ -32,6 +32,18 @@ func main() {
 	schema.Version = opts.SchemaVersion
 	schema.Type = "object"
 
+	// TLS of the upstream may be set either as a boolean or as an object
+	if def, ok := schema.Definitions["UpstreamTLS"]; ok {
+		obj := *def
+		*def = jsonschema.Schema{OneOf: []*jsonschema.Schema{{Type: "boolean"}, &obj}}
+	}
+
+	// endpoint of the upstream may be set either as an address or as an object with the weight
+	if def, ok := schema.Definitions["Endpoint"]; ok {
+		obj := *def
+		*def = jsonschema.Schema{OneOf: []*jsonschema.Schema{{Type: "string"}, &obj}}
+	}
+
 	bts, err := json.MarshalIndent(schema, "", "  ")
 	if err != nil {
 		log.Fatalf("failed to marshal schema: %v", err)
@@ -0,0 +1,254 @@
+// Package admin provides an HTTP API to manage gRoxy at runtime.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/adminprovider"
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/cappuccinotm/slogx"
+	"gopkg.in/yaml.v3"
+)
+
+// Server is an HTTP server of the admin API.
+// Requests accept both JSON and YAML bodies, responses are encoded in JSON,
+// except the recordings, which are rendered as a YAML configuration file.
+type Server struct {
+	provider  *adminprovider.Admin
+	journal   *journal.Journal
+	recorder  *recorder.Recorder
+	scenarios *discovery.Service
+	http      *http.Server
+}
+
+// NewServer creates a new admin server.
+func NewServer(opts ...Option) *Server {
+	s := &Server{}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	s.http = &http.Server{
+		Handler:           s.routes(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	return s
+}
+
+// Listen starts the server on the given address.
+// Blocking call.
+func (s *Server) Listen(addr string) (err error) {
+	slog.Info("starting admin server", slog.String("addr", addr))
+	defer slog.Warn("admin server stopped", slogx.Error(err))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("register listener: %w", err)
+	}
+
+	if err = s.http.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the server.
+func (s *Server) Close(ctx context.Context) error { return s.http.Shutdown(ctx) }
+
+func (s *Server) routes() http.Handler {
+	mux := http.NewServeMux()
+	if s.provider != nil {
+		mux.HandleFunc("GET /api/v1/rules", s.listRules)
+		mux.HandleFunc("POST /api/v1/rules", s.addRule)
+		mux.HandleFunc("PUT /api/v1/rules", s.setRules)
+		mux.HandleFunc("DELETE /api/v1/rules", s.deleteRules)
+		mux.HandleFunc("GET /api/v1/rules/{name}", s.getRule)
+		mux.HandleFunc("PUT /api/v1/rules/{name}", s.putRule)
+		mux.HandleFunc("DELETE /api/v1/rules/{name}", s.deleteRule)
+		mux.HandleFunc("GET /api/v1/upstreams", s.listUpstreams)
+		mux.HandleFunc("GET /api/v1/upstreams/{name}", s.getUpstream)
+		mux.HandleFunc("PUT /api/v1/upstreams/{name}", s.putUpstream)
+		mux.HandleFunc("DELETE /api/v1/upstreams/{name}", s.deleteUpstream)
+	}
+	if s.journal != nil {
+		mux.HandleFunc("GET /api/v1/journal", s.listJournal)
+		mux.HandleFunc("POST /api/v1/journal/find", s.findJournal)
+		mux.HandleFunc("POST /api/v1/journal/count", s.countJournal)
+		mux.HandleFunc("DELETE /api/v1/journal", s.clearJournal)
+	}
+	if s.recorder != nil {
+		mux.HandleFunc("GET /api/v1/recordings", s.getRecordings)
+		mux.HandleFunc("DELETE /api/v1/recordings", s.clearRecordings)
+	}
+	if s.scenarios != nil {
+		mux.HandleFunc("GET /api/v1/scenarios", s.listScenarios)
+		mux.HandleFunc("POST /api/v1/scenarios/reset", s.resetScenarios)
+		mux.HandleFunc("POST /api/v1/scenarios/{name}/reset", s.resetScenario)
+	}
+	return mux
+}
+
+func (s *Server) listRules(w http.ResponseWriter, _ *http.Request) {
+	renderJSON(w, http.StatusOK, s.provider.Rules())
+}
+
+func (s *Server) addRule(w http.ResponseWriter, r *http.Request) {
+	var rule fileprovider.Rule
+	if !decode(w, r, &rule) {
+		return
+	}
+
+	rule, err := s.provider.AddRule(r.Context(), rule)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusCreated, rule)
+}
+
+func (s *Server) setRules(w http.ResponseWriter, r *http.Request) {
+	var rules []fileprovider.Rule
+	if !decode(w, r, &rules) {
+		return
+	}
+
+	rules, err := s.provider.SetRules(r.Context(), rules)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, rules)
+}
+
+func (s *Server) deleteRules(w http.ResponseWriter, r *http.Request) {
+	if _, err := s.provider.SetRules(r.Context(), nil); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) getRule(w http.ResponseWriter, r *http.Request) {
+	rule, err := s.provider.Rule(r.PathValue("name"))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) putRule(w http.ResponseWriter, r *http.Request) {
+	var rule fileprovider.Rule
+	if !decode(w, r, &rule) {
+		return
+	}
+
+	rule, err := s.provider.PutRule(r.Context(), r.PathValue("name"), rule)
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, rule)
+}
+
+func (s *Server) deleteRule(w http.ResponseWriter, r *http.Request) {
+	if err := s.provider.DeleteRule(r.Context(), r.PathValue("name")); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listUpstreams(w http.ResponseWriter, _ *http.Request) {
+	renderJSON(w, http.StatusOK, s.provider.Upstreams())
+}
+
+func (s *Server) getUpstream(w http.ResponseWriter, r *http.Request) {
+	u, err := s.provider.Upstream(r.PathValue("name"))
+	if err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, u)
+}
+
+func (s *Server) putUpstream(w http.ResponseWriter, r *http.Request) {
+	var u fileprovider.Upstream
+	if !decode(w, r, &u) {
+		return
+	}
+
+	if err := s.provider.PutUpstream(r.Context(), r.PathValue("name"), u); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	renderJSON(w, http.StatusOK, u)
+}
+
+func (s *Server) deleteUpstream(w http.ResponseWriter, r *http.Request) {
+	if err := s.provider.DeleteUpstream(r.Context(), r.PathValue("name")); err != nil {
+		renderError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// decode decodes the request body, which may be either in JSON or YAML,
+// as JSON is a subset of YAML. Renders an error and returns false on failure.
+func decode(w http.ResponseWriter, r *http.Request, v any) bool {
+	if err := yaml.NewDecoder(r.Body).Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		renderJSON(w, http.StatusBadRequest, errResponse{Error: fmt.Sprintf("decode request body: %v", err)})
+		return false
+	}
+	return true
+}
+
+type errResponse struct {
+	Error string `json:"error"`
+}
+
+func renderError(w http.ResponseWriter, r *http.Request, err error) {
+	code := http.StatusBadRequest
+	switch {
+	case errors.Is(err, adminprovider.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, adminprovider.ErrConflict):
+		code = http.StatusConflict
+	}
+
+	slog.DebugContext(r.Context(), "admin request failed",
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slogx.Error(err))
+
+	renderJSON(w, code, errResponse{Error: err.Error()})
+}
+
+func renderJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("failed to encode admin response", slogx.Error(err))
+	}
+}
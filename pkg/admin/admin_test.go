@@ -0,0 +1,235 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/adminprovider"
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_Rules(t *testing.T) {
+	provider := &adminprovider.Admin{}
+	ts := httptest.NewServer(NewServer(WithProvider(provider)).routes())
+	defer ts.Close()
+
+	t.Run("add rule in yaml", func(t *testing.T) {
+		resp := do(t, http.MethodPost, ts.URL+"/api/v1/rules", `
+name: unary
+match: { uri: "/test.Service/Unary" }
+respond:
+  status: { code: "NOT_FOUND", message: "not found" }
+`)
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+		var rule fileprovider.Rule
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rule))
+		assert.Equal(t, "unary", rule.Name)
+		assert.Equal(t, "/test.Service/Unary", rule.Match.URI)
+	})
+
+	t.Run("add duplicate rule", func(t *testing.T) {
+		resp := do(t, http.MethodPost, ts.URL+"/api/v1/rules",
+			`{"name": "unary", "match": {"uri": "/test.Service/Unary"}, "respond": {"status": {"code": "NOT_FOUND", "message": ""}}}`)
+		assert.Equal(t, http.StatusConflict, resp.StatusCode)
+	})
+
+	t.Run("add invalid rule", func(t *testing.T) {
+		resp := do(t, http.MethodPost, ts.URL+"/api/v1/rules", `{"match": {"uri": "/test.Service/Unary"}}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, readAll(t, resp), "empty rule")
+	})
+
+	t.Run("replace rule in json", func(t *testing.T) {
+		resp := do(t, http.MethodPut, ts.URL+"/api/v1/rules/unary",
+			`{"match": {"uri": "/test.Service/Unary"}, "respond": {"status": {"code": "INTERNAL", "message": "internal"}}}`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = do(t, http.MethodGet, ts.URL+"/api/v1/rules/unary", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rule fileprovider.Rule
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rule))
+		assert.Equal(t, "unary", rule.Name)
+		assert.Equal(t, "INTERNAL", rule.Respond.Status.Code)
+	})
+
+	t.Run("list rules", func(t *testing.T) {
+		resp := do(t, http.MethodGet, ts.URL+"/api/v1/rules", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		var rules []fileprovider.Rule
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&rules))
+		require.Len(t, rules, 1)
+		assert.Equal(t, "unary", rules[0].Name)
+	})
+
+	t.Run("delete rule", func(t *testing.T) {
+		resp := do(t, http.MethodDelete, ts.URL+"/api/v1/rules/unary", "")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+		resp = do(t, http.MethodDelete, ts.URL+"/api/v1/rules/unary", "")
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Empty(t, provider.Rules())
+	})
+
+	t.Run("set and delete all rules", func(t *testing.T) {
+		resp := do(t, http.MethodPut, ts.URL+"/api/v1/rules", `
+- match: { uri: "/test.Service/First" }
+  respond: { status: { code: "NOT_FOUND", message: "" } }
+- match: { uri: "/test.Service/Second" }
+  respond: { status: { code: "NOT_FOUND", message: "" } }
+`)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Len(t, provider.Rules(), 2)
+
+		resp = do(t, http.MethodDelete, ts.URL+"/api/v1/rules", "")
+		assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+		assert.Empty(t, provider.Rules())
+	})
+}
+
+func TestServer_Upstreams(t *testing.T) {
+	provider := &adminprovider.Admin{}
+	ts := httptest.NewServer(NewServer(WithProvider(provider)).routes())
+	defer ts.Close()
+
+	resp := do(t, http.MethodPut, ts.URL+"/api/v1/upstreams/backend", `{"address": "localhost:9090"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(t, http.MethodGet, ts.URL+"/api/v1/upstreams", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"backend": {"address": "localhost:9090", "tls": false, "serve-reflection": false}}`, readAll(t, resp))
+
+	resp = do(t, http.MethodGet, ts.URL+"/api/v1/upstreams/backend", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	resp = do(t, http.MethodDelete, ts.URL+"/api/v1/upstreams/backend", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp = do(t, http.MethodGet, ts.URL+"/api/v1/upstreams/backend", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func do(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	return resp
+}
+
+func readAll(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	bts, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(bts)
+}
+
+func TestServer_Journal(t *testing.T) {
+	j := journal.New(10)
+	j.Add(journal.Entry{Method: "/example.Service/Create", Messages: []journal.Message{{Body: json.RawMessage(`{"name": "first"}`)}}})
+	j.Add(journal.Entry{Method: "/example.Service/Create", Messages: []journal.Message{{Body: json.RawMessage(`{"name": "second"}`)}}})
+	j.Add(journal.Entry{Method: "/example.Service/Delete"})
+
+	ts := httptest.NewServer(NewServer(WithJournal(j)).routes())
+	defer ts.Close()
+
+	resp := do(t, http.MethodGet, ts.URL+"/api/v1/journal", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var entries []journal.Entry
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	assert.Len(t, entries, 3)
+
+	resp = do(t, http.MethodPost, ts.URL+"/api/v1/journal/find", `
+method: "Create$"
+body: { name: second }
+`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&entries))
+	require.Len(t, entries, 1)
+	assert.Equal(t, uint64(2), entries[0].ID)
+
+	resp = do(t, http.MethodPost, ts.URL+"/api/v1/journal/count", `{"method": "/example.Service/Create"}`)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.JSONEq(t, `{"count": 2}`, readAll(t, resp))
+
+	resp = do(t, http.MethodPost, ts.URL+"/api/v1/journal/count", `{"method": "("}`)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(t, http.MethodDelete, ts.URL+"/api/v1/journal", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, j.List(journal.Filter{}))
+}
+
+func TestServer_Scenarios(t *testing.T) {
+	rules := []*discovery.Rule{
+		{Name: "flaky", Scenario: &discovery.Scenario{Name: "flaky", NewState: "ready"}},
+		{Name: "login", Scenario: &discovery.Scenario{Name: "auth", NewState: "logged-in"}},
+	}
+
+	events := make(chan string, 1)
+	events <- "initial"
+	svc := &discovery.Service{Providers: []discovery.Provider{&discovery.ProviderMock{
+		NameFunc:   func() string { return "test" },
+		EventsFunc: func(context.Context) <-chan string { return events },
+		StateFunc:  func(context.Context) (*discovery.State, error) { return &discovery.State{Rules: rules}, nil },
+	}}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() { _ = svc.Run(ctx) }()
+	require.Eventually(t, func() bool { return len(svc.Rules()) == 2 }, time.Second, 10*time.Millisecond)
+
+	ts := httptest.NewServer(NewServer(WithScenarios(svc)).routes())
+	defer ts.Close()
+
+	scenarios := func() string {
+		resp := do(t, http.MethodGet, ts.URL+"/api/v1/scenarios", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return readAll(t, resp)
+	}
+
+	assert.JSONEq(t, `{"flaky": "started", "auth": "started"}`, scenarios())
+
+	svc.AdvanceScenario(rules[0], nil)
+	svc.AdvanceScenario(rules[1], nil)
+	assert.JSONEq(t, `{"flaky": "ready", "auth": "logged-in"}`, scenarios())
+
+	resp := do(t, http.MethodPost, ts.URL+"/api/v1/scenarios/auth/reset", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `{"flaky": "ready", "auth": "started"}`, scenarios())
+
+	resp = do(t, http.MethodPost, ts.URL+"/api/v1/scenarios/unknown/reset", "")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = do(t, http.MethodPost, ts.URL+"/api/v1/scenarios/reset", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.JSONEq(t, `{"flaky": "started", "auth": "started"}`, scenarios())
+}
+
+func TestServer_Recordings(t *testing.T) {
+	ts := httptest.NewServer(NewServer(WithRecorder(&recorder.Recorder{})).routes())
+	defer ts.Close()
+
+	resp := do(t, http.MethodGet, ts.URL+"/api/v1/recordings", "")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/yaml", resp.Header.Get("Content-Type"))
+	assert.YAMLEq(t, `{version: "1", rules: []}`, readAll(t, resp))
+
+	resp = do(t, http.MethodDelete, ts.URL+"/api/v1/recordings", "")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
@@ -0,0 +1,50 @@
+package admin
+
+import (
+	"net/http"
+
+	"github.com/Semior001/groxy/pkg/journal"
+)
+
+func (s *Server) listJournal(w http.ResponseWriter, _ *http.Request) {
+	renderJSON(w, http.StatusOK, s.journal.List(journal.Filter{}))
+}
+
+func (s *Server) findJournal(w http.ResponseWriter, r *http.Request) {
+	f, ok := decodeFilter(w, r)
+	if !ok {
+		return
+	}
+
+	renderJSON(w, http.StatusOK, s.journal.List(f))
+}
+
+func (s *Server) countJournal(w http.ResponseWriter, r *http.Request) {
+	f, ok := decodeFilter(w, r)
+	if !ok {
+		return
+	}
+
+	renderJSON(w, http.StatusOK, struct {
+		Count int `json:"count"`
+	}{Count: s.journal.Count(f)})
+}
+
+func (s *Server) clearJournal(w http.ResponseWriter, _ *http.Request) {
+	s.journal.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func decodeFilter(w http.ResponseWriter, r *http.Request) (journal.Filter, bool) {
+	var f journal.Filter
+	if !decode(w, r, &f) {
+		return journal.Filter{}, false
+	}
+
+	if err := f.Compile(); err != nil {
+		renderError(w, r, err)
+		return journal.Filter{}, false
+	}
+
+	return f, true
+}
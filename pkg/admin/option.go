@@ -0,0 +1,23 @@
+package admin
+
+import (
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/adminprovider"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/recorder"
+)
+
+// Option is a functional option for the server.
+type Option func(*Server)
+
+// WithProvider enables the management of rules and upstreams in the provider.
+func WithProvider(p *adminprovider.Admin) Option { return func(s *Server) { s.provider = p } }
+
+// WithJournal enables querying of the request journal.
+func WithJournal(j *journal.Journal) Option { return func(s *Server) { s.journal = j } }
+
+// WithRecorder enables exporting of the recorded rules.
+func WithRecorder(r *recorder.Recorder) Option { return func(s *Server) { s.recorder = r } }
+
+// WithScenarios enables listing and resetting of the scenarios.
+func WithScenarios(svc *discovery.Service) Option { return func(s *Server) { s.scenarios = svc } }
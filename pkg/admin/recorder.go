@@ -0,0 +1,30 @@
+package admin
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/cappuccinotm/slogx"
+	"gopkg.in/yaml.v3"
+)
+
+// getRecordings renders the recorded rules in YAML,
+// to be saved as a configuration file as is.
+func (s *Server) getRecordings(w http.ResponseWriter, _ *http.Request) {
+	bts, err := yaml.Marshal(s.recorder.Config())
+	if err != nil {
+		renderJSON(w, http.StatusInternalServerError, errResponse{Error: err.Error()})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	if _, err = w.Write(bts); err != nil {
+		slog.Warn("failed to write admin response", slogx.Error(err))
+	}
+}
+
+func (s *Server) clearRecordings(w http.ResponseWriter, _ *http.Request) {
+	s.recorder.Clear()
+	w.WriteHeader(http.StatusNoContent)
+}
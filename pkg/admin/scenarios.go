@@ -0,0 +1,28 @@
+package admin
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Semior001/groxy/pkg/discovery/adminprovider"
+)
+
+func (s *Server) listScenarios(w http.ResponseWriter, _ *http.Request) {
+	renderJSON(w, http.StatusOK, s.scenarios.Scenarios())
+}
+
+func (s *Server) resetScenarios(w http.ResponseWriter, _ *http.Request) {
+	s.scenarios.ResetScenarios()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) resetScenario(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := s.scenarios.Scenarios()[name]; !ok {
+		renderError(w, r, fmt.Errorf("scenario %q: %w", name, adminprovider.ErrNotFound))
+		return
+	}
+
+	s.scenarios.ResetScenarios(name)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,270 @@
+// Package adminprovider provides a discovery provider, which rules
+// and upstreams are managed at runtime.
+package adminprovider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sync"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/cappuccinotm/slogx"
+	"github.com/google/uuid"
+)
+
+var (
+	// ErrNotFound is returned when the requested rule or upstream doesn't exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when the rule with the same name already exists.
+	ErrConflict = errors.New("already exists")
+)
+
+// Admin keeps the rules and upstreams, mutated at runtime,
+// and notifies the discovery service on every mutation.
+// Rules and upstreams are described in the same format as
+// in the configuration file.
+// Zero value is ready to use.
+type Admin struct {
+	mu        sync.RWMutex
+	rules     []fileprovider.Rule
+	upstreams map[string]fileprovider.Upstream
+
+	emu    sync.Mutex
+	events []chan string
+}
+
+// Name returns the name of the provider.
+func (a *Admin) Name() string { return "admin" }
+
+// Events returns a channel, that receives an event on every mutation.
+func (a *Admin) Events(ctx context.Context) <-chan string {
+	res := make(chan string, 1)
+
+	a.emu.Lock()
+	a.events = append(a.events, res)
+	a.emu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		a.emu.Lock()
+		defer a.emu.Unlock()
+
+		a.events = slices.DeleteFunc(a.events, func(ch chan string) bool { return ch == res })
+		close(res)
+	}()
+
+	return res
+}
+
+// State builds the current state of the provider.
+func (a *Admin) State(ctx context.Context) (*discovery.State, error) {
+	a.mu.RLock()
+	cfg := a.config(a.rules, a.upstreams)
+	a.mu.RUnlock()
+
+	return fileprovider.BuildState(ctx, a.Name(), cfg)
+}
+
+// Rules returns the list of rules in the order of their addition.
+func (a *Admin) Rules() []fileprovider.Rule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return append([]fileprovider.Rule{}, a.rules...)
+}
+
+// Rule returns the rule with the given name.
+func (a *Admin) Rule(name string) (fileprovider.Rule, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	idx := a.ruleIndex(name)
+	if idx < 0 {
+		return fileprovider.Rule{}, fmt.Errorf("rule %q: %w", name, ErrNotFound)
+	}
+
+	return a.rules[idx], nil
+}
+
+// AddRule adds a new rule. If the rule has no name, a random one is assigned.
+// Returns ErrConflict if the rule with the same name already exists.
+func (a *Admin) AddRule(ctx context.Context, r fileprovider.Rule) (fileprovider.Rule, error) {
+	if r.Name == "" {
+		r.Name = uuid.NewString()
+	}
+
+	err := a.mutate(ctx, func(c *fileprovider.Config) error {
+		if a.ruleIndex(r.Name) >= 0 {
+			return fmt.Errorf("rule %q: %w", r.Name, ErrConflict)
+		}
+		c.Rules = append(c.Rules, r)
+		return nil
+	})
+	if err != nil {
+		return fileprovider.Rule{}, err
+	}
+
+	return r, nil
+}
+
+// PutRule replaces the rule with the given name, or adds it, if it doesn't exist.
+func (a *Admin) PutRule(ctx context.Context, name string, r fileprovider.Rule) (fileprovider.Rule, error) {
+	r.Name = name
+
+	err := a.mutate(ctx, func(c *fileprovider.Config) error {
+		if idx := a.ruleIndex(name); idx >= 0 {
+			c.Rules[idx] = r
+			return nil
+		}
+		c.Rules = append(c.Rules, r)
+		return nil
+	})
+	if err != nil {
+		return fileprovider.Rule{}, err
+	}
+
+	return r, nil
+}
+
+// SetRules replaces all rules with the given ones.
+// Rules without names are assigned random ones.
+func (a *Admin) SetRules(ctx context.Context, rules []fileprovider.Rule) ([]fileprovider.Rule, error) {
+	rules = slices.Clone(rules)
+	seen := make(map[string]struct{}, len(rules))
+	for idx := range rules {
+		if rules[idx].Name == "" {
+			rules[idx].Name = uuid.NewString()
+		}
+		if _, ok := seen[rules[idx].Name]; ok {
+			return nil, fmt.Errorf("rule %q: %w", rules[idx].Name, ErrConflict)
+		}
+		seen[rules[idx].Name] = struct{}{}
+	}
+
+	err := a.mutate(ctx, func(c *fileprovider.Config) error {
+		c.Rules = rules
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// DeleteRule deletes the rule with the given name.
+func (a *Admin) DeleteRule(ctx context.Context, name string) error {
+	return a.mutate(ctx, func(c *fileprovider.Config) error {
+		idx := a.ruleIndex(name)
+		if idx < 0 {
+			return fmt.Errorf("rule %q: %w", name, ErrNotFound)
+		}
+		c.Rules = slices.Delete(c.Rules, idx, idx+1)
+		return nil
+	})
+}
+
+// Upstreams returns the upstreams by their names.
+func (a *Admin) Upstreams() map[string]fileprovider.Upstream {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	res := make(map[string]fileprovider.Upstream, len(a.upstreams))
+	maps.Copy(res, a.upstreams)
+	return res
+}
+
+// Upstream returns the upstream with the given name.
+func (a *Admin) Upstream(name string) (fileprovider.Upstream, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	u, ok := a.upstreams[name]
+	if !ok {
+		return fileprovider.Upstream{}, fmt.Errorf("upstream %q: %w", name, ErrNotFound)
+	}
+
+	return u, nil
+}
+
+// PutUpstream replaces the upstream with the given name, or adds it, if it doesn't exist.
+func (a *Admin) PutUpstream(ctx context.Context, name string, u fileprovider.Upstream) error {
+	return a.mutate(ctx, func(c *fileprovider.Config) error {
+		c.Upstreams[name] = u
+		return nil
+	})
+}
+
+// DeleteUpstream deletes the upstream with the given name.
+// Fails if any rule still forwards requests to the upstream.
+func (a *Admin) DeleteUpstream(ctx context.Context, name string) error {
+	return a.mutate(ctx, func(c *fileprovider.Config) error {
+		if _, ok := c.Upstreams[name]; !ok {
+			return fmt.Errorf("upstream %q: %w", name, ErrNotFound)
+		}
+		delete(c.Upstreams, name)
+		return nil
+	})
+}
+
+// mutate applies the mutation to the copy of the current config,
+// validates the result and, if it's valid, stores it and notifies the listeners.
+func (a *Admin) mutate(ctx context.Context, fn func(*fileprovider.Config) error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	cfg := a.config(slices.Clone(a.rules), maps.Clone(a.upstreams))
+	if cfg.Upstreams == nil {
+		cfg.Upstreams = map[string]fileprovider.Upstream{}
+	}
+
+	if err := fn(&cfg); err != nil {
+		return err
+	}
+
+	// build the state to check that rules and upstreams are valid
+	st, err := fileprovider.BuildState(ctx, a.Name(), cfg)
+	if err != nil {
+		return fmt.Errorf("invalid state: %w", err)
+	}
+
+	for _, u := range st.Upstreams {
+		if err = u.Close(); err != nil {
+			slog.WarnContext(ctx, "failed to close validated upstream connection",
+				slog.String("upstream", u.Name()),
+				slogx.Error(err))
+		}
+	}
+
+	a.rules, a.upstreams = cfg.Rules, cfg.Upstreams
+	a.notify()
+
+	return nil
+}
+
+func (a *Admin) notify() {
+	a.emu.Lock()
+	defer a.emu.Unlock()
+
+	for _, ch := range a.events {
+		select {
+		case ch <- a.Name():
+		default: // there is already a pending event
+		}
+	}
+}
+
+func (a *Admin) config(rules []fileprovider.Rule, ups map[string]fileprovider.Upstream) fileprovider.Config {
+	return fileprovider.Config{Version: "1", Rules: rules, Upstreams: ups}
+}
+
+// ruleIndex returns the index of the rule with the given name, or -1.
+// Must be called under the lock.
+func (a *Admin) ruleIndex(name string) int {
+	return slices.IndexFunc(a.rules, func(r fileprovider.Rule) bool { return r.Name == name })
+}
@@ -0,0 +1,135 @@
+package adminprovider
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestAdmin_Rules(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	a := &Admin{}
+	events := a.Events(ctx)
+
+	rule, err := a.AddRule(ctx, mustRule(t, `
+name: unary
+match: { uri: "/test.Service/Unary" }
+respond: { status: { code: "NOT_FOUND", message: "not found" } }
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "unary", rule.Name)
+	assert.Equal(t, "admin", waitEvent(t, events))
+
+	_, err = a.AddRule(ctx, rule)
+	require.ErrorIs(t, err, ErrConflict)
+
+	unnamed, err := a.AddRule(ctx, mustRule(t, `
+match: { uri: "/test.Service/Stream" }
+respond: { status: { code: "UNAVAILABLE", message: "unavailable" } }
+`))
+	require.NoError(t, err)
+	assert.NotEmpty(t, unnamed.Name)
+	waitEvent(t, events)
+
+	_, err = a.PutRule(ctx, "unary", mustRule(t, `
+match: { uri: "/test.Service/Unary" }
+respond: { status: { code: "INTERNAL", message: "internal" } }
+`))
+	require.NoError(t, err)
+	waitEvent(t, events)
+
+	st, err := a.State(ctx)
+	require.NoError(t, err)
+	require.Len(t, st.Rules, 2)
+	assert.Equal(t, "unary", st.Rules[0].Name)
+	assert.Equal(t, "internal", st.Rules[0].Mock.Status.Message())
+	assert.Equal(t, unnamed.Name, st.Rules[1].Name)
+
+	require.NoError(t, a.DeleteRule(ctx, "unary"))
+	waitEvent(t, events)
+	require.ErrorIs(t, a.DeleteRule(ctx, "unary"), ErrNotFound)
+
+	_, err = a.Rule("unary")
+	require.ErrorIs(t, err, ErrNotFound)
+	assert.Equal(t, []fileprovider.Rule{unnamed}, a.Rules())
+
+	t.Run("invalid rule is not stored", func(t *testing.T) {
+		_, err := a.AddRule(ctx, mustRule(t, `match: { uri: "/test.Service/Unary" }`))
+		require.ErrorContains(t, err, "empty rule")
+		assert.Len(t, a.Rules(), 1)
+		select {
+		case ev := <-events:
+			t.Fatalf("unexpected event %q", ev)
+		default:
+		}
+	})
+
+	t.Run("set rules", func(t *testing.T) {
+		rules, err := a.SetRules(ctx, nil)
+		require.NoError(t, err)
+		assert.Empty(t, rules)
+		assert.Empty(t, a.Rules())
+		waitEvent(t, events)
+	})
+}
+
+func TestAdmin_Upstreams(t *testing.T) {
+	ctx := context.Background()
+	a := &Admin{}
+
+	require.NoError(t, a.PutUpstream(ctx, "backend", fileprovider.Upstream{Addr: "localhost:9090"}))
+
+	_, err := a.AddRule(ctx, mustRule(t, `
+match: { uri: "/test.Service/Unary" }
+forward: { upstream: backend }
+`))
+	require.NoError(t, err)
+
+	_, err = a.AddRule(ctx, mustRule(t, `
+match: { uri: "/test.Service/Unary" }
+forward: { upstream: unknown }
+`))
+	require.ErrorContains(t, err, `upstream "unknown" not found`)
+
+	st, err := a.State(ctx)
+	require.NoError(t, err)
+	require.Len(t, st.Upstreams, 1)
+	assert.Equal(t, "localhost:9090", st.Upstreams[0].Target())
+	require.Len(t, st.Rules[0].Forward.Targets, 1)
+	assert.Equal(t, st.Upstreams[0], st.Rules[0].Forward.Targets[0].Upstream)
+	require.NoError(t, st.Upstreams[0].Close())
+
+	// upstream is still referenced by the rule
+	require.ErrorContains(t, a.DeleteUpstream(ctx, "backend"), `upstream "backend" not found`)
+	assert.Equal(t, map[string]fileprovider.Upstream{"backend": {Addr: "localhost:9090"}}, a.Upstreams())
+
+	require.NoError(t, a.DeleteRule(ctx, a.Rules()[0].Name))
+	require.NoError(t, a.DeleteUpstream(ctx, "backend"))
+	require.ErrorIs(t, a.DeleteUpstream(ctx, "backend"), ErrNotFound)
+	assert.Empty(t, a.Upstreams())
+}
+
+func mustRule(t *testing.T, s string) fileprovider.Rule {
+	t.Helper()
+	var r fileprovider.Rule
+	require.NoError(t, yaml.Unmarshal([]byte(s), &r))
+	return r
+}
+
+func waitEvent(t *testing.T, events <-chan string) string {
+	t.Helper()
+	select {
+	case ev := <-events:
+		return ev
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for event")
+		return ""
+	}
+}
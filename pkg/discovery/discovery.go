@@ -3,16 +3,24 @@ package discovery
 
 import (
 	"context"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/protoadapt"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
 // Provider provides routing rules for the Service.
@@ -47,6 +55,70 @@ type Mock struct {
 	Trailer metadata.MD
 	Body    protodef.Template
 	Status  *status.Status
+
+	// Stream contains the ordered list of messages to be sent
+	// to the downstream, used to mock server-streaming methods.
+	// If Status is set, it is returned after all messages are sent.
+	Stream []StreamMessage
+
+	// OnMessage contains the reactions to each message received from
+	// the downstream, used to mock client-streaming and bidirectional methods.
+	// If set, Body or Stream are sent after the downstream closes its side of the stream.
+	OnMessage []Reaction
+}
+
+// Streams reports whether the mock reads the stream of messages
+// from the client and whether it sends the stream of messages back.
+func (m *Mock) Streams() (client, server bool) {
+	client, server = len(m.OnMessage) > 0, len(m.Stream) > 0
+	for _, reaction := range m.OnMessage {
+		server = server || len(reaction.Reply) > 0
+	}
+	return client, server
+}
+
+// Reaction describes how the mock reacts to a message received from the downstream.
+type Reaction struct {
+	// Match is an optional matcher for the received message.
+	// If nil, the reaction is triggered on any message.
+	Match protodef.Template
+
+	// Reply contains the messages to send back to the downstream.
+	// May be empty, in which case the message is consumed silently.
+	Reply []StreamMessage
+}
+
+// StreamMessage is a single message of the server-streaming mock.
+type StreamMessage struct {
+	// Wait is the delay before sending the message.
+	Wait time.Duration
+
+	// Body is the message to send.
+	Body protodef.Template
+
+	// Repeat is an optional expression that evaluates
+	// the number of times the message should be sent.
+	// If nil, the message is sent once.
+	Repeat *vm.Program
+}
+
+// Count evaluates the number of times the message should be sent.
+func (m StreamMessage) Count(data map[string]any) (int, error) {
+	if m.Repeat == nil {
+		return 1, nil
+	}
+
+	out, err := expr.Run(m.Repeat, data)
+	if err != nil {
+		return 0, fmt.Errorf("evaluate repeat expression: %w", err)
+	}
+
+	n, ok := out.(int)
+	if !ok {
+		return 0, fmt.Errorf("repeat expression returned %T, not int", out)
+	}
+
+	return n, nil
 }
 
 // Rule is a routing rule for the Service.
@@ -63,14 +135,249 @@ type Rule struct {
 
 	// Forward specifies the upstream to forward the request.
 	Forward *Forward
+
+	// Scenario binds the rule to a stateful scenario.
+	Scenario *Scenario
+
+	// Fault describes the faults, injected into the matched requests.
+	Fault *Fault
+
+	// Throttle limits the rate of the messages of the matched requests.
+	Throttle *Throttle
+
+	// RateLimit limits the rate and the concurrency of the matched requests.
+	RateLimit *RateLimit
+
+	// Mirror sends the copies of the matched requests to the shadow upstream.
+	Mirror *Mirror
+
+	// Compare makes the rule both respond with the mock and forward
+	// the request, to compare the responses of the two.
+	Compare *Compare
+}
+
+// MockTypes returns the types of the request and the response of the
+// mocked method, as defined by the rule, if any. The request type is taken
+// from the body matcher, the response type from the mocked messages.
+func (r *Rule) MockTypes(ctx context.Context) (input, output protoreflect.MessageDescriptor) {
+	if r.Match.Message != nil {
+		input = r.Match.Message.Descriptor(ctx)
+	}
+
+	if r.Mock == nil {
+		return input, nil
+	}
+
+	for _, reaction := range r.Mock.OnMessage {
+		if input == nil && reaction.Match != nil {
+			input = reaction.Match.Descriptor(ctx)
+		}
+		for _, reply := range reaction.Reply {
+			if output == nil && reply.Body != nil {
+				output = reply.Body.Descriptor(ctx)
+			}
+		}
+	}
+
+	if r.Mock.Body != nil {
+		output = r.Mock.Body.Descriptor(ctx)
+	}
+
+	for _, msg := range r.Mock.Stream {
+		if output == nil && msg.Body != nil {
+			output = msg.Body.Descriptor(ctx)
+		}
+	}
+
+	return input, output
+}
+
+// Throttle limits the rate of the messages, received from and sent to the
+// downstream, either mocked or forwarded, to emulate a slow network.
+type Throttle struct {
+	Requests  *ThrottleLimits // limits of the messages, received from the downstream
+	Responses *ThrottleLimits // limits of the messages, sent to the downstream
+}
+
+// ThrottleLimits contains the limits of the messages in a single direction.
+// Zero values mean no limit.
+type ThrottleLimits struct {
+	// BytesPerSecond is the bandwidth, each message takes
+	// the time to be transferred according to its size.
+	BytesPerSecond int
+
+	// MessagesPerSecond is the maximum rate of the messages.
+	MessagesPerSecond float64
+
+	// Delay is the latency, added to every message.
+	Delay time.Duration
+}
+
+// ScenarioStarted is the initial state of every scenario.
+const ScenarioStarted = "started"
+
+// Scenario describes the participation of the rule in a stateful scenario.
+type Scenario struct {
+	// Name is the name of the scenario.
+	Name string
+
+	// RequiredState is the state of the scenario in which the rule can be matched.
+	// If empty, the rule is matched in any state.
+	RequiredState string
+
+	// NewState is the state to which the scenario transitions
+	// when the rule is matched. If empty, the state is not changed.
+	NewState string
 }
 
-// Forward specifies the upstream to forward the request and the parameters
+// Matches returns true if the scenario is in the state required by the rule.
+func (s *Scenario) Matches(state string) bool {
+	return s == nil || s.RequiredState == "" || s.RequiredState == state
+}
+
+// Forward specifies the upstreams to forward the request and the parameters
 // to invoke the upstream.
 type Forward struct {
-	Rewrite  string
+	Rewrite string
+	Header  metadata.MD
+
+	// Targets are the upstreams to split the requests between by their weights.
+	Targets []ForwardTarget
+
+	// HashKey is the metadata key, which value picks the target, so that
+	// the requests with the same value are forwarded to the same upstream.
+	// If empty or absent in the request, the target is picked at random.
+	HashKey string
+
+	// Retry, if set, retries the calls to the upstream, failed with
+	// the retryable codes, or hedges them.
+	Retry *Retry
+}
+
+// Retry specifies the policy of retrying the forwarded calls.
+type Retry struct {
+	// MaxAttempts is the number of the attempts, including the first one.
+	MaxAttempts int
+
+	// Codes are the status codes, which the failed attempts are retried on.
+	Codes []codes.Code
+
+	// PerTryTimeout limits the duration of each attempt, zero means no limit.
+	// Attempts, timed out before the client's deadline, are retried regardless
+	// of the codes.
+	PerTryTimeout time.Duration
+
+	// Backoff is the delay before the second attempt, doubled with each
+	// next one up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+
+	// HedgeDelay, if set, makes the attempts hedged: the next attempt is
+	// started if none of the previous ones responded within the delay,
+	// or as soon as one of them fails with the retryable code.
+	HedgeDelay time.Duration
+}
+
+// Retryable reports whether the attempt, failed with the code, may be retried.
+func (r *Retry) Retryable(code codes.Code) bool {
+	return slices.Contains(r.Codes, code)
+}
+
+// Delay returns the delay before the attempt with the given number, starting
+// from 1. The delay grows exponentially and is jittered to spread the retries
+// of the concurrent calls, e.g. the ones, failed at once with a failing upstream.
+func (r *Retry) Delay(attempt int) time.Duration {
+	if attempt <= 1 || r.Backoff <= 0 {
+		return 0
+	}
+
+	d := r.Backoff
+	for i := 2; i < attempt && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if r.MaxBackoff > 0 {
+		d = min(d, r.MaxBackoff)
+	}
+
+	return d/2 + rand.N(d/2+1)
+}
+
+// ForwardTarget is the upstream with the share of the requests to forward to it.
+type ForwardTarget struct {
 	Upstream Upstream
-	Header   metadata.MD
+	Weight   int
+}
+
+// Pick picks the upstream to forward the request with the metadata to.
+// As long as the targets don't change, the requests with the same value
+// of the hash key are always forwarded to the same upstream.
+func (f *Forward) Pick(md metadata.MD) Upstream {
+	if len(f.Targets) == 1 {
+		return f.Targets[0].Upstream
+	}
+
+	total := 0
+	for _, t := range f.Targets {
+		total += max(t.Weight, 0)
+	}
+
+	if total == 0 {
+		return f.Targets[0].Upstream
+	}
+
+	var n int
+	if vals := md.Get(f.HashKey); f.HashKey != "" && len(vals) > 0 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(strings.Join(vals, ",")))
+		n = int(h.Sum64() % uint64(total))
+	} else {
+		n = rand.IntN(total)
+	}
+
+	for _, t := range f.Targets {
+		if n -= max(t.Weight, 0); n < 0 {
+			return t.Upstream
+		}
+	}
+
+	return f.Targets[len(f.Targets)-1].Upstream // unreachable
+}
+
+// Mirror specifies the shadow upstream to send the copies of the requests to.
+// Responses of the shadow upstream are compared to the ones, sent to the
+// client, and discarded.
+type Mirror struct {
+	Upstream Upstream
+
+	// Percentage is the share of the requests to mirror, in percents.
+	Percentage float64
+
+	// Timeout limits the duration of the mirrored call.
+	Timeout time.Duration
+}
+
+// Samples reports whether the request is to be mirrored.
+func (m *Mirror) Samples() bool {
+	return m.Percentage >= 100 || rand.Float64()*100 < m.Percentage
+}
+
+// Sources of the response in the compare mode.
+const (
+	CompareReturnUpstream = "upstream" // the client gets the response of the upstream
+	CompareReturnMock     = "mock"     // the client gets the response of the mock
+)
+
+// Compare specifies the rule, which both responds with the mock and forwards
+// the request to the upstream. The client gets the response of one of them,
+// while the other one handles the copy of the request in the background, and
+// the differences between their responses are reported.
+type Compare struct {
+	// Return is the source of the response to the client,
+	// either CompareReturnUpstream or CompareReturnMock.
+	Return string
+
+	// Timeout limits the duration of the handling of the copy of the request.
+	Timeout time.Duration
 }
 
 // String returns the name of the rule.
@@ -2,8 +2,10 @@ package discovery
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/Semior001/groxy/pkg/protodef"
 	"github.com/stretchr/testify/assert"
@@ -60,3 +62,69 @@ func TestRequestMatcher_Matches(t *testing.T) {
 		assert.False(t, rm.Matches("any-uri", md), "should not match on wrong order")
 	})
 }
+
+func TestForward_Pick(t *testing.T) {
+	f := &Forward{Targets: []ForwardTarget{
+		{Upstream: ClientConn{ConnName: "stable"}, Weight: 3},
+		{Upstream: ClientConn{ConnName: "disabled"}, Weight: 0},
+		{Upstream: ClientConn{ConnName: "canary"}, Weight: 1},
+	}}
+
+	t.Run("random", func(t *testing.T) {
+		counts := map[string]int{}
+		for range 4000 {
+			counts[f.Pick(nil).Name()]++
+		}
+		assert.Zero(t, counts["disabled"])
+		assert.InDelta(t, 3000, counts["stable"], 200)
+		assert.InDelta(t, 1000, counts["canary"], 200)
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		f := *f
+		f.HashKey = "x-user-id"
+
+		counts := map[string]int{}
+		for i := range 4000 {
+			md := metadata.Pairs("x-user-id", strconv.Itoa(i))
+			name := f.Pick(md).Name()
+			for range 3 {
+				assert.Equal(t, name, f.Pick(md).Name(), "same key must pick the same upstream")
+			}
+			counts[name]++
+		}
+		assert.Zero(t, counts["disabled"])
+		assert.InDelta(t, 3000, counts["stable"], 200)
+		assert.InDelta(t, 1000, counts["canary"], 200)
+	})
+
+	t.Run("single", func(t *testing.T) {
+		f := &Forward{Targets: []ForwardTarget{{Upstream: ClientConn{ConnName: "backend"}}}}
+		assert.Equal(t, "backend", f.Pick(nil).Name())
+	})
+}
+
+func TestRetry_Delay(t *testing.T) {
+	r := &Retry{Backoff: 100 * time.Millisecond, MaxBackoff: 300 * time.Millisecond}
+
+	tbl := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 1, min: 0, max: 0},
+		{attempt: 2, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{attempt: 3, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{attempt: 4, min: 150 * time.Millisecond, max: 300 * time.Millisecond},
+		{attempt: 10, min: 150 * time.Millisecond, max: 300 * time.Millisecond},
+	}
+
+	for _, tt := range tbl {
+		t.Run(strconv.Itoa(tt.attempt), func(t *testing.T) {
+			for range 100 {
+				d := r.Delay(tt.attempt)
+				assert.GreaterOrEqual(t, d, tt.min)
+				assert.LessOrEqual(t, d, tt.max)
+			}
+		})
+	}
+}
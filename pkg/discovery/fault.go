@@ -0,0 +1,196 @@
+package discovery
+
+import (
+	"math"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/status"
+)
+
+// Fault describes the faults, injected into the requests matched by the rule,
+// either mocked or forwarded. Each fault is rolled independently, with its
+// own probability, on every request.
+type Fault struct {
+	// Abort replies with the status instead of handling the request.
+	Abort *FaultAbort
+
+	// Delay delays the request by the latency, sampled from the distribution.
+	Delay *FaultDelay
+
+	// Reset resets the connection of the client in the middle of the response.
+	Reset *FaultReset
+
+	// DropTrailers is the percentage of requests, which connection
+	// is closed once the response is sent, without the trailers.
+	DropTrailers float64
+
+	// Rand is the source of randomness of the faults.
+	// Seed it to reproduce the faults. If nil, the global source is used.
+	Rand *rand.Rand
+	mu   sync.Mutex
+}
+
+// FaultAbort replies with the status instead of handling the request.
+type FaultAbort struct {
+	Percentage float64
+	Status     *status.Status
+}
+
+// FaultDelay delays the request by the latency, sampled from the distribution.
+type FaultDelay struct {
+	Percentage float64
+	Latency    Latency
+}
+
+// FaultReset resets the connection of the client after the given number
+// of messages are sent to the client. If the response has fewer messages,
+// the connection is reset instead of sending the status.
+type FaultReset struct {
+	Percentage float64
+	After      int
+}
+
+// Aborts rolls the abort and returns its status, or nil, if the request is not aborted.
+func (f *Fault) Aborts() *status.Status {
+	if f.Abort == nil || !f.roll(f.Abort.Percentage) {
+		return nil
+	}
+	return f.Abort.Status
+}
+
+// Latency rolls the delay and samples its latency.
+// It returns zero, if the request is not delayed.
+func (f *Fault) Latency() time.Duration {
+	if f.Delay == nil || f.Delay.Latency == nil || !f.roll(f.Delay.Percentage) {
+		return 0
+	}
+	return max(f.Delay.Latency.Sample(f), 0)
+}
+
+// ResetsAfter rolls the reset and returns the number of messages
+// to send before resetting the connection.
+func (f *Fault) ResetsAfter() (n int, ok bool) {
+	if f.Reset == nil || !f.roll(f.Reset.Percentage) {
+		return 0, false
+	}
+	return f.Reset.After, true
+}
+
+// DropsTrailers rolls whether the connection is closed without the trailers.
+func (f *Fault) DropsTrailers() bool { return f.roll(f.DropTrailers) }
+
+// Float64 returns a random number in [0.0, 1.0).
+func (f *Fault) Float64() float64 {
+	if f.Rand == nil {
+		return rand.Float64()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Rand.Float64()
+}
+
+// NormFloat64 returns a normally distributed random number
+// with the mean of 0 and the standard deviation of 1.
+func (f *Fault) NormFloat64() float64 {
+	if f.Rand == nil {
+		return rand.NormFloat64()
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.Rand.NormFloat64()
+}
+
+// roll reports whether the event with the probability, in percents, happens.
+func (f *Fault) roll(percentage float64) bool {
+	switch {
+	case percentage <= 0:
+		return false
+	case percentage >= 100:
+		return true
+	default:
+		return f.Float64()*100 < percentage
+	}
+}
+
+// Random is a source of random numbers.
+type Random interface {
+	Float64() float64
+	NormFloat64() float64
+}
+
+// Latency is a distribution of the latency.
+type Latency interface {
+	Sample(Random) time.Duration
+}
+
+// FixedLatency is always the same latency.
+type FixedLatency time.Duration
+
+// Sample returns the latency.
+func (l FixedLatency) Sample(Random) time.Duration { return time.Duration(l) }
+
+// UniformLatency is distributed uniformly between Min and Max.
+type UniformLatency struct {
+	Min, Max time.Duration
+}
+
+// Sample returns a random latency in [Min, Max).
+func (l UniformLatency) Sample(r Random) time.Duration {
+	return l.Min + time.Duration(r.Float64()*float64(l.Max-l.Min))
+}
+
+// NormalLatency is distributed normally around Mean. Negative samples are cut to zero.
+type NormalLatency struct {
+	Mean, StdDev time.Duration
+}
+
+// Sample returns a random latency.
+func (l NormalLatency) Sample(r Random) time.Duration {
+	return l.Mean + time.Duration(r.NormFloat64()*float64(l.StdDev))
+}
+
+// Percentile is the latency, which the given percentage of requests doesn't exceed.
+type Percentile struct {
+	Percentile float64 // in (0, 100]
+	Latency    time.Duration
+}
+
+// PercentileLatency is distributed according to the percentiles, with
+// the latency interpolated linearly between them. Latencies below the
+// first percentile start from zero, latencies above the last one are
+// equal to it.
+type PercentileLatency []Percentile
+
+// NewPercentileLatency sorts the percentiles and makes the distribution of them.
+func NewPercentileLatency(ps ...Percentile) PercentileLatency {
+	res := PercentileLatency(append([]Percentile(nil), ps...))
+	sort.Slice(res, func(i, j int) bool { return res[i].Percentile < res[j].Percentile })
+	return res
+}
+
+// Sample returns a random latency.
+func (l PercentileLatency) Sample(r Random) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+
+	p := r.Float64() * 100
+	prev := Percentile{}
+	for _, curr := range l {
+		if p <= curr.Percentile {
+			frac := (p - prev.Percentile) / (curr.Percentile - prev.Percentile)
+			if math.IsNaN(frac) {
+				return curr.Latency
+			}
+			return prev.Latency + time.Duration(frac*float64(curr.Latency-prev.Latency))
+		}
+		prev = curr
+	}
+
+	return l[len(l)-1].Latency
+}
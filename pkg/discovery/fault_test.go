@@ -0,0 +1,113 @@
+package discovery
+
+import (
+	"math/rand/v2"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fixedRandom returns the same numbers on every call.
+type fixedRandom struct{ float, norm float64 }
+
+func (r fixedRandom) Float64() float64     { return r.float }
+func (r fixedRandom) NormFloat64() float64 { return r.norm }
+
+func TestFault(t *testing.T) {
+	newFault := func(seed uint64) *Fault {
+		return &Fault{
+			Abort:        &FaultAbort{Percentage: 30, Status: status.New(codes.Unavailable, "injected")},
+			Delay:        &FaultDelay{Percentage: 100, Latency: UniformLatency{Min: time.Second, Max: 2 * time.Second}},
+			Reset:        &FaultReset{Percentage: 50, After: 2},
+			DropTrailers: 10,
+			Rand:         rand.New(rand.NewPCG(seed, seed)),
+		}
+	}
+
+	t.Run("reproducible with the same seed", func(t *testing.T) {
+		roll := func(f *Fault) (res []any) {
+			for range 50 {
+				n, ok := f.ResetsAfter()
+				res = append(res, f.Aborts(), f.Latency(), n, ok, f.DropsTrailers())
+			}
+			return res
+		}
+		assert.Equal(t, roll(newFault(42)), roll(newFault(42)))
+		assert.NotEqual(t, roll(newFault(42)), roll(newFault(43)))
+	})
+
+	t.Run("probabilities", func(t *testing.T) {
+		f := newFault(42)
+		aborted, reset, dropped := 0, 0, 0
+		for range 10000 {
+			if st := f.Aborts(); st != nil {
+				assert.Equal(t, codes.Unavailable, st.Code())
+				aborted++
+			}
+			if n, ok := f.ResetsAfter(); ok {
+				assert.Equal(t, 2, n)
+				reset++
+			}
+			if f.DropsTrailers() {
+				dropped++
+			}
+			d := f.Latency()
+			assert.True(t, d >= time.Second && d < 2*time.Second, "latency %s is out of range", d)
+		}
+		assert.InDelta(t, 3000, aborted, 300)
+		assert.InDelta(t, 5000, reset, 300)
+		assert.InDelta(t, 1000, dropped, 300)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		f := &Fault{}
+		assert.Nil(t, f.Aborts())
+		assert.Zero(t, f.Latency())
+		_, ok := f.ResetsAfter()
+		assert.False(t, ok)
+		assert.False(t, f.DropsTrailers())
+	})
+}
+
+func TestLatency(t *testing.T) {
+	percentiles := NewPercentileLatency(
+		Percentile{Percentile: 99, Latency: time.Second},
+		Percentile{Percentile: 50, Latency: 100 * time.Millisecond},
+		Percentile{Percentile: 90, Latency: 500 * time.Millisecond},
+	)
+
+	tbl := []struct {
+		name    string
+		latency Latency
+		random  fixedRandom
+		want    time.Duration
+	}{
+		{name: "fixed", latency: FixedLatency(time.Second), want: time.Second},
+		{
+			name:    "uniform",
+			latency: UniformLatency{Min: time.Second, Max: 3 * time.Second},
+			random:  fixedRandom{float: 0.25},
+			want:    1500 * time.Millisecond,
+		},
+		{
+			name:    "normal",
+			latency: NormalLatency{Mean: time.Second, StdDev: 100 * time.Millisecond},
+			random:  fixedRandom{norm: -2},
+			want:    800 * time.Millisecond,
+		},
+		{name: "below the first percentile", latency: percentiles, random: fixedRandom{float: 0.25}, want: 50 * time.Millisecond},
+		{name: "at the percentile", latency: percentiles, random: fixedRandom{float: 0.9}, want: 500 * time.Millisecond},
+		{name: "between the percentiles", latency: percentiles, random: fixedRandom{float: 0.7}, want: 300 * time.Millisecond},
+		{name: "above the last percentile", latency: percentiles, random: fixedRandom{float: 0.995}, want: time.Second},
+		{name: "no percentiles", latency: PercentileLatency{}, random: fixedRandom{float: 0.5}, want: 0},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.InDelta(t, tt.want, tt.latency.Sample(tt.random), float64(time.Microsecond))
+		})
+	}
+}
@@ -1,48 +1,334 @@
 package fileprovider
 
+import (
+	"bytes"
+	"encoding/json"
+
+	"gopkg.in/yaml.v3"
+)
+
 // Config defines a set of rules for the proxy to use.
 type Config struct {
-	Version    string              `yaml:"version"               jsonschema:"title=Config Version,description=The version of the config schema."`
-	NotMatched *Respond            `yaml:"not-matched,omitempty" jsonschema:"title=Default Response,description=The default response to return when no rules match."`
-	Rules      []Rule              `yaml:"rules"                 jsonschema:"title=Rules,description=A list of rules to match incoming requests against."`
-	Upstreams  map[string]Upstream `yaml:"upstreams,omitempty"   jsonschema:"title=Upstreams,description=A map of upstream services that can be forwarded to."`
+	Version    string              `yaml:"version"               json:"version"               jsonschema:"title=Config Version,description=The version of the config schema."`
+	NotMatched *Respond            `yaml:"not-matched,omitempty" json:"not-matched,omitempty" jsonschema:"title=Default Response,description=The default response to return when no rules match."`
+	Rules      []Rule              `yaml:"rules"                 json:"rules"                 jsonschema:"title=Rules,description=A list of rules to match incoming requests against."`
+	Upstreams  map[string]Upstream `yaml:"upstreams,omitempty"   json:"upstreams,omitempty"   jsonschema:"title=Upstreams,description=A map of upstream services that can be forwarded to."`
+	Protos     *Protos             `yaml:"protos,omitempty"      json:"protos,omitempty"      jsonschema:"title=Protos,description=Proto files and descriptor sets to look up the message types in."`
+}
+
+// Protos specifies the sources of message types, which can be referenced
+// in rules by their full names, or imported in snippets.
+type Protos struct {
+	ImportPaths    []string `yaml:"import-paths,omitempty"    json:"import-paths,omitempty"    jsonschema:"title=Import Paths,description=Directories to look up the proto files and their imports in. If omitted\\, files are looked up relative to the working directory."`
+	Files          []string `yaml:"files,omitempty"           json:"files,omitempty"           jsonschema:"title=Files,description=Proto files to parse\\, relative to the import paths."`
+	DescriptorSets []string `yaml:"descriptor-sets,omitempty" json:"descriptor-sets,omitempty" jsonschema:"title=Descriptor Sets,description=Files with serialized FileDescriptorSet messages (protosets)\\, e.g. produced by protoc with --descriptor_set_out and --include_imports."`
+	Upstreams      []string `yaml:"upstreams,omitempty"       json:"upstreams,omitempty"       jsonschema:"title=Upstreams,description=Names of the upstreams to resolve the message types\\, not declared in the files\\, via gRPC reflection. Types are resolved on the first use and cached until the config is reloaded."`
 }
 
 // Upstream specifies a service to forward requests to.
 type Upstream struct {
-	Addr            string `yaml:"address"          jsonschema:"title=Address,description=The address of the upstream service, in the format host:port."`
-	TLS             bool   `yaml:"tls"              jsonschema:"title=TLS,description=Whether to use TLS when connecting to the upstream service."`
-	ServeReflection bool   `yaml:"serve-reflection" jsonschema:"title=Serve Reflection,description=Whether to include the reflection from the upstream service."`
+	Addr            string       `yaml:"address,omitempty"      json:"address"                jsonschema:"title=Address,description=The address of the upstream service\\, in the format host:port. DNS names are resolved to all of their addresses. Mutually exclusive with 'addresses'."`
+	Addrs           []Endpoint   `yaml:"addresses,omitempty"    json:"addresses,omitempty"    jsonschema:"title=Addresses,description=The addresses of the replicas of the upstream service. Each one is either an address or an object with the address and its weight. Mutually exclusive with 'address'."`
+	Balancing       string       `yaml:"balancing,omitempty"    json:"balancing,omitempty"    jsonschema:"title=Balancing,description=The policy to balance the requests between the addresses. Defaults to 'pick-first' for a single 'address' without 'health-check' and to 'round-robin' otherwise.,enum=pick-first,enum=round-robin,enum=least-requests,enum=weighted"`
+	HealthCheck     *HealthCheck `yaml:"health-check,omitempty" json:"health-check,omitempty" jsonschema:"title=Health Check,description=Enables checking the health of each address via grpc.health.v1. Unhealthy addresses are ejected from the balancing until they become healthy again."`
+	TLS             UpstreamTLS  `yaml:"tls,omitempty"          json:"tls"                    jsonschema:"title=TLS,description=Whether and how to use TLS when connecting to the upstream service. Either a boolean to use TLS with the system roots or an object with the TLS parameters."`
+	ServeReflection bool         `yaml:"serve-reflection"       json:"serve-reflection"       jsonschema:"title=Serve Reflection,description=Whether to include the reflection from the upstream service."`
+}
+
+// Endpoint specifies a single address of the upstream. In the config it may be
+// set either as a string with the address or as an object with the weight.
+type Endpoint struct {
+	Addr   string `yaml:"address"          json:"address"          jsonschema:"title=Address,description=The address of the replica\\, in the format host:port."`
+	Weight int    `yaml:"weight,omitempty" json:"weight,omitempty" jsonschema:"title=Weight,description=The weight of the replica for the 'weighted' balancing. Defaults to 1.,minimum=1"`
+}
+
+// UnmarshalYAML decodes either a string with the address or an object with the weight.
+func (e *Endpoint) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*e = Endpoint{}
+		return node.Decode(&e.Addr)
+	}
+
+	type plain Endpoint
+	return node.Decode((*plain)(e))
+}
+
+// MarshalYAML encodes the endpoint as a string, if the weight is not set.
+func (e Endpoint) MarshalYAML() (any, error) {
+	if e.Weight == 0 {
+		return e.Addr, nil
+	}
+
+	type plain Endpoint
+	return plain(e), nil
+}
+
+// UnmarshalJSON decodes either a string with the address or an object with the weight.
+func (e *Endpoint) UnmarshalJSON(bts []byte) error {
+	if b := bytes.TrimSpace(bts); len(b) > 0 && b[0] != '{' {
+		*e = Endpoint{}
+		return json.Unmarshal(bts, &e.Addr)
+	}
+
+	type plain Endpoint
+	return json.Unmarshal(bts, (*plain)(e))
+}
+
+// MarshalJSON encodes the endpoint as a string, if the weight is not set.
+func (e Endpoint) MarshalJSON() ([]byte, error) {
+	if e.Weight == 0 {
+		return json.Marshal(e.Addr)
+	}
+
+	type plain Endpoint
+	return json.Marshal(plain(e))
+}
+
+// HealthCheck specifies how to check the health of the upstream addresses.
+type HealthCheck struct {
+	Service string `yaml:"service,omitempty" json:"service,omitempty" jsonschema:"title=Service,description=The name of the service to check the health of. If omitted\\, the overall health of the server is checked."`
+}
+
+// UpstreamTLS specifies the TLS parameters to connect to the upstream.
+// In the config it may be set either as a boolean, to use TLS with
+// the system roots, or as an object, which enables TLS with the given parameters.
+type UpstreamTLS struct {
+	Enabled            bool     `yaml:"-"                              json:"-"`
+	CAFile             string   `yaml:"ca-file,omitempty"              json:"ca-file,omitempty"              jsonschema:"title=CA File,description=PEM file with the CAs to verify the upstream certificate. If omitted\\, the system roots are used."`
+	CertFile           string   `yaml:"cert-file,omitempty"            json:"cert-file,omitempty"            jsonschema:"title=Certificate File,description=PEM file with the client certificate to present to the upstream. Requires 'key-file'."`
+	KeyFile            string   `yaml:"key-file,omitempty"             json:"key-file,omitempty"             jsonschema:"title=Key File,description=PEM file with the private key of the client certificate. Requires 'cert-file'."`
+	ServerName         string   `yaml:"server-name,omitempty"          json:"server-name,omitempty"          jsonschema:"title=Server Name,description=The server name to send via SNI and to verify the upstream certificate against. Defaults to the host of the address."`
+	ALPN               []string `yaml:"alpn,omitempty"                 json:"alpn,omitempty"                 jsonschema:"title=ALPN,description=Application protocols to negotiate in addition to 'h2'."`
+	InsecureSkipVerify bool     `yaml:"insecure-skip-verify,omitempty" json:"insecure-skip-verify,omitempty" jsonschema:"title=Insecure Skip Verify,description=Whether to skip the verification of the upstream certificate. Use only for development."`
+}
+
+// IsZero returns true if TLS is disabled.
+func (t UpstreamTLS) IsZero() bool { return !t.Enabled }
+
+// UnmarshalYAML decodes either a boolean or an object with the TLS parameters.
+func (t *UpstreamTLS) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*t = UpstreamTLS{}
+		return node.Decode(&t.Enabled)
+	}
+
+	type plain UpstreamTLS
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.Enabled = true
+	return nil
+}
+
+// MarshalYAML encodes the parameters as a boolean, if none of them are set.
+func (t UpstreamTLS) MarshalYAML() (any, error) {
+	if t.plain() {
+		return t.Enabled, nil
+	}
+
+	type plain UpstreamTLS
+	return plain(t), nil
+}
+
+// UnmarshalJSON decodes either a boolean or an object with the TLS parameters.
+func (t *UpstreamTLS) UnmarshalJSON(bts []byte) error {
+	if b := bytes.TrimSpace(bts); len(b) > 0 && b[0] != '{' {
+		*t = UpstreamTLS{}
+		return json.Unmarshal(bts, &t.Enabled)
+	}
+
+	type plain UpstreamTLS
+	if err := json.Unmarshal(bts, (*plain)(t)); err != nil {
+		return err
+	}
+	t.Enabled = true
+	return nil
+}
+
+// MarshalJSON encodes the parameters as a boolean, if none of them are set.
+func (t UpstreamTLS) MarshalJSON() ([]byte, error) {
+	if t.plain() {
+		return json.Marshal(t.Enabled)
+	}
+
+	type plain UpstreamTLS
+	return json.Marshal(plain(t))
+}
+
+// plain returns true if none of the parameters are set.
+func (t UpstreamTLS) plain() bool {
+	return t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" &&
+		t.ServerName == "" && len(t.ALPN) == 0 && !t.InsecureSkipVerify
 }
 
 // Rule specifies a route matching rule.
 type Rule struct {
+	Name  string `yaml:"name,omitempty" json:"name,omitempty" jsonschema:"title=Name,description=An optional name of the rule. Defaults to the URI to match against."`
 	Match struct {
-		URI    string            `yaml:"uri"    jsonschema:"title=URI,description=The URI to match against."`
-		Header map[string]string `yaml:"header,omitempty" jsonschema:"title=Header,description=A map of headers to match against."`
-		Body   *string           `yaml:"body,omitempty"   jsonschema:"title=Body,description=The body to match against."`
-	} `yaml:"match" jsonschema:"title=Match,description=The criteria to match incoming requests against."`
-	Respond *Respond `yaml:"respond,omitempty" jsonschema:"title=Respond,description=How to respond to the request if it matches. Mutually exclusive with 'forward'."`
-	Forward *Forward `yaml:"forward,omitempty" jsonschema:"title=Forward,description=How to forward the request if it matches. Mutually exclusive with 'respond'."`
+		URI    string            `yaml:"uri"              json:"uri"              jsonschema:"title=URI,description=The URI to match against."`
+		Header map[string]string `yaml:"header,omitempty" json:"header,omitempty" jsonschema:"title=Header,description=A map of headers to match against."`
+		Type   *string           `yaml:"type,omitempty"   json:"type,omitempty"   jsonschema:"title=Type,description=The full name of the request message type\\, declared in 'protos'. If set\\, 'body' and reaction matchers are values of this type in YAML or JSON instead of protobuf snippets."`
+		Body   *string           `yaml:"body,omitempty"   json:"body,omitempty"   jsonschema:"title=Body,description=The body to match against."`
+	} `yaml:"match" json:"match" jsonschema:"title=Match,description=The criteria to match incoming requests against."`
+	Respond   *Respond   `yaml:"respond,omitempty"    json:"respond,omitempty"    jsonschema:"title=Respond,description=How to respond to the request if it matches. Mutually exclusive with 'forward'\\, unless 'compare' is set."`
+	Forward   *Forward   `yaml:"forward,omitempty"    json:"forward,omitempty"    jsonschema:"title=Forward,description=How to forward the request if it matches. Mutually exclusive with 'respond'\\, unless 'compare' is set."`
+	Scenario  *Scenario  `yaml:"scenario,omitempty"   json:"scenario,omitempty"   jsonschema:"title=Scenario,description=Binds the rule to a stateful scenario."`
+	Fault     *Fault     `yaml:"fault,omitempty"      json:"fault,omitempty"      jsonschema:"title=Fault,description=Faults to inject into the matched requests\\, either responded or forwarded."`
+	Throttle  *Throttle  `yaml:"throttle,omitempty"   json:"throttle,omitempty"   jsonschema:"title=Throttle,description=Limits the rate of the messages of the matched requests\\, either responded or forwarded\\, to emulate a slow network."`
+	RateLimit *RateLimit `yaml:"rate-limit,omitempty" json:"rate-limit,omitempty" jsonschema:"title=Rate Limit,description=Limits the rate and the concurrency of the matched requests."`
+	Mirror    *Mirror    `yaml:"mirror,omitempty"     json:"mirror,omitempty"     jsonschema:"title=Mirror,description=Sends the copies of the matched requests\\, either responded or forwarded\\, to the shadow upstream and compares its responses to the ones\\, sent to the client."`
+	Compare   *Compare   `yaml:"compare,omitempty"    json:"compare,omitempty"    jsonschema:"title=Compare,description=Makes the rule both respond with the mock and forward the request to the upstream\\, to report the differences between their responses. Requires both 'respond' and 'forward'."`
+}
+
+// Compare specifies how to compare the mock with the upstream.
+type Compare struct {
+	Return  string  `yaml:"return,omitempty"  json:"return,omitempty"  jsonschema:"title=Return,description=Whose response to return to the client. Defaults to 'upstream'.,enum=upstream,enum=mock"`
+	Timeout *string `yaml:"timeout,omitempty" json:"timeout,omitempty" jsonschema:"title=Timeout,description=The timeout of the handling of the copy of the request\\, which response is not returned. Defaults to 10s."`
+}
+
+// Mirror specifies the shadow upstream to send the copies of the requests to.
+type Mirror struct {
+	Upstream   string   `yaml:"upstream"             json:"upstream"             jsonschema:"title=Upstream,description=The name of the upstream service to send the copies of the requests to."`
+	Percentage *float64 `yaml:"percentage,omitempty" json:"percentage,omitempty" jsonschema:"title=Percentage,description=The percentage of the requests to mirror. Defaults to 100.,minimum=0,maximum=100"`
+	Timeout    *string  `yaml:"timeout,omitempty"    json:"timeout,omitempty"    jsonschema:"title=Timeout,description=The timeout of the mirrored call. Defaults to 10s."`
+}
+
+// RateLimit specifies the limits of the rate and the concurrency of the requests.
+type RateLimit struct {
+	Key           string  `yaml:"key,omitempty"            json:"key,omitempty"            jsonschema:"title=Key,description=Which requests share the limits: 'method'\\, 'peer' for the host of the client or 'header:<name>' for the value of the header. Defaults to 'method'."`
+	Rate          float64 `yaml:"rate,omitempty"           json:"rate,omitempty"           jsonschema:"title=Rate,description=The number of requests per second. If omitted\\, the rate is not limited.,minimum=0"`
+	Burst         int     `yaml:"burst,omitempty"          json:"burst,omitempty"          jsonschema:"title=Burst,description=The number of requests allowed at once. Defaults to the rate\\, rounded up.,minimum=0"`
+	MaxConcurrent int     `yaml:"max-concurrent,omitempty" json:"max-concurrent,omitempty" jsonschema:"title=Max Concurrent,description=The number of requests handled at the same time. If omitted\\, the concurrency is not limited.,minimum=0"`
+	RetryAfter    *string `yaml:"retry-after,omitempty"    json:"retry-after,omitempty"    jsonschema:"title=Retry After,description=An optional duration to report in the RetryInfo details. If omitted\\, the time until the next request is allowed by the rate is reported."`
+	Status        *Status `yaml:"status,omitempty"         json:"status,omitempty"         jsonschema:"title=Status,description=The gRPC status to return when the limit is exceeded. Defaults to RESOURCE_EXHAUSTED."`
+}
+
+// Throttle specifies the limits of the messages, received from and sent to the client.
+type Throttle struct {
+	Requests  *ThrottleLimits `yaml:"requests,omitempty"  json:"requests,omitempty"  jsonschema:"title=Requests,description=Limits of the messages\\, received from the client."`
+	Responses *ThrottleLimits `yaml:"responses,omitempty" json:"responses,omitempty" jsonschema:"title=Responses,description=Limits of the messages\\, sent to the client."`
+}
+
+// ThrottleLimits specifies the limits of the messages in a single direction.
+type ThrottleLimits struct {
+	BytesPerSecond    int     `yaml:"bytes-per-second,omitempty"    json:"bytes-per-second,omitempty"    jsonschema:"title=Bytes Per Second,description=The bandwidth. Each message takes the time to be transferred according to its size.,minimum=0"`
+	MessagesPerSecond float64 `yaml:"messages-per-second,omitempty" json:"messages-per-second,omitempty" jsonschema:"title=Messages Per Second,description=The maximum rate of the messages.,minimum=0"`
+	Delay             *string `yaml:"delay,omitempty"               json:"delay,omitempty"               jsonschema:"title=Delay,description=An optional duration to delay every message by."`
+}
+
+// Fault specifies the faults, injected into the matched requests.
+type Fault struct {
+	Seed         *uint64            `yaml:"seed,omitempty"          json:"seed,omitempty"          jsonschema:"title=Seed,description=An optional seed of the random generator to reproduce the faults. If omitted\\, the faults are random on every run."`
+	Abort        *FaultAbort        `yaml:"abort,omitempty"         json:"abort,omitempty"         jsonschema:"title=Abort,description=Replies with the status instead of handling the request."`
+	Delay        *FaultDelay        `yaml:"delay,omitempty"         json:"delay,omitempty"         jsonschema:"title=Delay,description=Delays the request by the latency\\, sampled from the distribution."`
+	Reset        *FaultReset        `yaml:"reset,omitempty"         json:"reset,omitempty"         jsonschema:"title=Reset,description=Resets the connection of the client in the middle of the response."`
+	DropTrailers *FaultDropTrailers `yaml:"drop-trailers,omitempty" json:"drop-trailers,omitempty" jsonschema:"title=Drop Trailers,description=Closes the connection of the client once the response is sent\\, without the trailers."`
+}
+
+// FaultAbort specifies the status to abort the requests with.
+type FaultAbort struct {
+	Percentage *float64 `yaml:"percentage,omitempty" json:"percentage,omitempty" jsonschema:"title=Percentage,description=The percentage of the requests to abort. Defaults to 100.,minimum=0,maximum=100"`
+	Status     Status   `yaml:"status"               json:"status"               jsonschema:"title=Status,description=The gRPC status to abort the requests with."`
+}
+
+// FaultDelay specifies the distribution of the latency to delay the requests by.
+// Exactly one of the distributions must be set.
+type FaultDelay struct {
+	Percentage  *float64          `yaml:"percentage,omitempty"  json:"percentage,omitempty"  jsonschema:"title=Percentage,description=The percentage of the requests to delay. Defaults to 100.,minimum=0,maximum=100"`
+	Fixed       *string           `yaml:"fixed,omitempty"       json:"fixed,omitempty"       jsonschema:"title=Fixed,description=A fixed latency."`
+	Uniform     *UniformLatency   `yaml:"uniform,omitempty"     json:"uniform,omitempty"     jsonschema:"title=Uniform,description=A latency\\, distributed uniformly between the bounds."`
+	Normal      *NormalLatency    `yaml:"normal,omitempty"      json:"normal,omitempty"      jsonschema:"title=Normal,description=A latency\\, distributed normally around the mean. Negative samples are cut to zero."`
+	Percentiles map[string]string `yaml:"percentiles,omitempty" json:"percentiles,omitempty" jsonschema:"title=Percentiles,description=A latency\\, distributed according to the percentiles\\, e.g. 'p50: 10ms' and 'p99: 1s'. The latency is interpolated linearly between the percentiles."`
+}
+
+// UniformLatency specifies the bounds of the uniformly distributed latency.
+type UniformLatency struct {
+	Min string `yaml:"min" json:"min" jsonschema:"title=Min,description=The lower bound of the latency."`
+	Max string `yaml:"max" json:"max" jsonschema:"title=Max,description=The upper bound of the latency."`
+}
+
+// NormalLatency specifies the parameters of the normally distributed latency.
+type NormalLatency struct {
+	Mean   string `yaml:"mean"   json:"mean"   jsonschema:"title=Mean,description=The mean latency."`
+	StdDev string `yaml:"stddev" json:"stddev" jsonschema:"title=Standard Deviation,description=The standard deviation of the latency."`
+}
+
+// FaultReset specifies when to reset the connection of the client.
+type FaultReset struct {
+	Percentage *float64 `yaml:"percentage,omitempty" json:"percentage,omitempty" jsonschema:"title=Percentage,description=The percentage of the requests to reset the connection of. Defaults to 100.,minimum=0,maximum=100"`
+	After      int      `yaml:"after,omitempty"      json:"after,omitempty"      jsonschema:"title=After,description=The number of messages to send to the client before resetting the connection. If the response has fewer messages\\, the connection is reset instead of sending the status.,minimum=0"`
+}
+
+// FaultDropTrailers specifies how often to close the connection without the trailers.
+type FaultDropTrailers struct {
+	Percentage *float64 `yaml:"percentage,omitempty" json:"percentage,omitempty" jsonschema:"title=Percentage,description=The percentage of the requests to close the connection of. Defaults to 100.,minimum=0,maximum=100"`
+}
+
+// Scenario specifies the participation of the rule in a stateful scenario.
+type Scenario struct {
+	Name          string `yaml:"name"                     json:"name"                     jsonschema:"title=Name,description=The name of the scenario."`
+	RequiredState string `yaml:"required-state,omitempty" json:"required-state,omitempty" jsonschema:"title=Required State,description=The state of the scenario in which the rule can be matched. Every scenario starts in the 'started' state. If omitted\\, the rule is matched in any state."`
+	NewState      string `yaml:"new-state,omitempty"      json:"new-state,omitempty"      jsonschema:"title=New State,description=The state to which the scenario transitions when the rule is matched. If omitted\\, the state is not changed."`
 }
 
 // Forward specifies how the service should forward the request.
 type Forward struct {
-	Rewrite  *string           `yaml:"rewrite,omitempty"  jsonschema:"title=Rewrite,description=An optional URI to rewrite the request to when forwarding. Uses regexp replace syntax."`
-	Upstream string            `yaml:"upstream" jsonschema:"title=Upstream,description=The name of the upstream service to forward the request to."`
-	Header   map[string]string `yaml:"header,omitempty"   jsonschema:"title=Header,description=A map of headers to add to the request when forwarding."`
+	Rewrite   *string           `yaml:"rewrite,omitempty"   json:"rewrite,omitempty"   jsonschema:"title=Rewrite,description=An optional URI to rewrite the request to when forwarding. Uses regexp replace syntax."`
+	Upstream  string            `yaml:"upstream,omitempty"  json:"upstream,omitempty"  jsonschema:"title=Upstream,description=The name of the upstream service to forward the request to. Mutually exclusive with 'upstreams'."`
+	Upstreams []ForwardTarget   `yaml:"upstreams,omitempty" json:"upstreams,omitempty" jsonschema:"title=Upstreams,description=The upstream services to split the requests between by their weights. Mutually exclusive with 'upstream'."`
+	HashKey   string            `yaml:"hash-key,omitempty"  json:"hash-key,omitempty"  jsonschema:"title=Hash Key,description=The header\\, which value picks the upstream out of 'upstreams'\\, so that the requests with the same value are forwarded to the same upstream. If omitted or absent in the request\\, the upstream is picked at random."`
+	Header    map[string]string `yaml:"header,omitempty"    json:"header,omitempty"    jsonschema:"title=Header,description=A map of headers to add to the request when forwarding."`
+	Retry     *Retry            `yaml:"retry,omitempty"     json:"retry,omitempty"     jsonschema:"title=Retry,description=Retries or hedges the failed calls to the upstream. Requests are buffered until the client closes its side of the stream\\, so it's meant for unary and client-streaming methods."`
+}
+
+// Retry specifies the policy of retrying the forwarded calls.
+type Retry struct {
+	Attempts      *int     `yaml:"attempts,omitempty"        json:"attempts,omitempty"        jsonschema:"title=Attempts,description=The number of the attempts\\, including the first one. Defaults to 3.,minimum=1"`
+	Codes         []string `yaml:"codes,omitempty"           json:"codes,omitempty"           jsonschema:"title=Codes,description=The gRPC status codes to retry the attempts on. Defaults to UNAVAILABLE."`
+	PerTryTimeout *string  `yaml:"per-try-timeout,omitempty" json:"per-try-timeout,omitempty" jsonschema:"title=Per Try Timeout,description=An optional timeout of each attempt. Timed out attempts are retried regardless of the codes."`
+	Backoff       *string  `yaml:"backoff,omitempty"         json:"backoff,omitempty"         jsonschema:"title=Backoff,description=The delay before the second attempt\\, doubled with each next one and jittered. Defaults to 100ms."`
+	MaxBackoff    *string  `yaml:"max-backoff,omitempty"     json:"max-backoff,omitempty"     jsonschema:"title=Max Backoff,description=The upper bound of the delay between the attempts. Defaults to 1s."`
+	HedgeDelay    *string  `yaml:"hedge-delay,omitempty"     json:"hedge-delay,omitempty"     jsonschema:"title=Hedge Delay,description=If set\\, the attempts are hedged instead of retried: the next attempt is started if none of the previous ones responded within the delay\\, and the first response wins."`
+}
+
+// ForwardTarget specifies the upstream and its share of the requests.
+type ForwardTarget struct {
+	Upstream string `yaml:"upstream"         json:"upstream"         jsonschema:"title=Upstream,description=The name of the upstream service to forward the request to."`
+	Weight   *int   `yaml:"weight,omitempty" json:"weight,omitempty" jsonschema:"title=Weight,description=The share of the requests to forward to the upstream\\, relative to the weights of the other upstreams. Zero disables the upstream. Defaults to 1.,minimum=0"`
 }
 
 // Respond specifies how the service should respond to the request.
 type Respond struct {
-	Wait     *string `yaml:"wait,omitempty" jsonschema:"title=Wait,description=An optional duration to wait before sending the response."`
-	Body     *string `yaml:"body,omitempty" jsonschema:"title=Body,description=The body to include in the response."`
-	Metadata *struct {
-		Header  map[string]string `yaml:"header"  jsonschema:"title=Header,description=A map of headers to include in the response."`
-		Trailer map[string]string `yaml:"trailer" jsonschema:"title=Trailer,description=A map of trailers to include in the response."`
-	} `yaml:"metadata,omitempty" jsonschema:"title=Metadata,description=Additional metadata to include in the response."`
-	Status *struct {
-		Code    string `yaml:"code" jsonschema:"title=Code,description=The gRPC status code to include in the response."`
-		Message string `yaml:"message" jsonschema:"title=Message,description=The gRPC status message to include in the response."`
-	} `yaml:"status,omitempty" jsonschema:"title=Status,description=The gRPC status to include in the response. Mutually exclusive with 'body'."`
+	Wait      *string         `yaml:"wait,omitempty"       json:"wait,omitempty"       jsonschema:"title=Wait,description=An optional duration to wait before sending the response."`
+	Type      *string         `yaml:"type,omitempty"       json:"type,omitempty"       jsonschema:"title=Type,description=The full name of the response message type\\, declared in 'protos'. If set\\, 'body'\\, 'stream' and reaction replies are values of this type in YAML or JSON instead of protobuf snippets."`
+	Body      *string         `yaml:"body,omitempty"       json:"body,omitempty"       jsonschema:"title=Body,description=The body to include in the response."`
+	Metadata  *Metadata       `yaml:"metadata,omitempty"   json:"metadata,omitempty"   jsonschema:"title=Metadata,description=Additional metadata to include in the response."`
+	Status    *Status         `yaml:"status,omitempty"     json:"status,omitempty"     jsonschema:"title=Status,description=The gRPC status to include in the response. Mutually exclusive with 'body'. If 'stream' is set\\, the status is returned after all messages are sent."`
+	Stream    []StreamMessage `yaml:"stream,omitempty"     json:"stream,omitempty"     jsonschema:"title=Stream,description=An ordered list of messages to send to the client in a server-streaming response. Mutually exclusive with 'body'."`
+	OnMessage []Reaction      `yaml:"on-message,omitempty" json:"on-message,omitempty" jsonschema:"title=On Message,description=Reactions to each message received from the client in client-streaming and bidirectional methods. 'body' and 'stream' are sent after the client closes its side of the stream."`
+}
+
+// Metadata specifies the metadata to include in the response.
+type Metadata struct {
+	Header  map[string]string `yaml:"header,omitempty"  json:"header,omitempty"  jsonschema:"title=Header,description=A map of headers to include in the response."`
+	Trailer map[string]string `yaml:"trailer,omitempty" json:"trailer,omitempty" jsonschema:"title=Trailer,description=A map of trailers to include in the response."`
+}
+
+// Status specifies the gRPC status to include in the response.
+type Status struct {
+	Code    string `yaml:"code"    json:"code"    jsonschema:"title=Code,description=The gRPC status code to include in the response."`
+	Message string `yaml:"message" json:"message" jsonschema:"title=Message,description=The gRPC status message to include in the response."`
+}
+
+// Reaction specifies how the service should react to a message received from the client.
+type Reaction struct {
+	Match *string         `yaml:"match,omitempty" json:"match,omitempty" jsonschema:"title=Match,description=An optional protobuf snippet to match the received message against. If omitted\\, the reaction is triggered on any message."`
+	Reply []StreamMessage `yaml:"reply,omitempty" json:"reply,omitempty" jsonschema:"title=Reply,description=An ordered list of messages to send to the client in reply to the received message."`
+}
+
+// StreamMessage specifies a single message of the server-streaming response.
+type StreamMessage struct {
+	Wait   *string `yaml:"wait,omitempty"   json:"wait,omitempty"   jsonschema:"title=Wait,description=An optional duration to wait before sending the message."`
+	Body   string  `yaml:"body"             json:"body"             jsonschema:"title=Body,description=The body of the message."`
+	Repeat *string `yaml:"repeat,omitempty" json:"repeat,omitempty" jsonschema:"title=Repeat,description=An optional number or expression evaluating the number of times the message is sent. Request fields are available as variables."`
 }
@@ -0,0 +1,110 @@
+package fileprovider
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestUpstreamTLS(t *testing.T) {
+	full := UpstreamTLS{
+		Enabled:            true,
+		CAFile:             "ca.pem",
+		CertFile:           "cert.pem",
+		KeyFile:            "key.pem",
+		ServerName:         "backend.internal",
+		ALPN:               []string{"h2"},
+		InsecureSkipVerify: true,
+	}
+
+	tests := []struct {
+		name     string
+		yaml     string
+		json     string
+		expected UpstreamTLS
+	}{
+		{name: "omitted", yaml: `address: localhost:9090`, json: `{"address": "localhost:9090"}`},
+		{name: "false", yaml: `tls: false`, json: `{"tls": false}`},
+		{name: "true", yaml: `tls: true`, json: `{"tls": true}`, expected: UpstreamTLS{Enabled: true}},
+		{name: "empty object", yaml: `tls: {}`, json: `{"tls": {}}`, expected: UpstreamTLS{Enabled: true}},
+		{
+			name: "object",
+			yaml: `
+tls:
+  ca-file: ca.pem
+  cert-file: cert.pem
+  key-file: key.pem
+  server-name: backend.internal
+  alpn: [h2]
+  insecure-skip-verify: true`,
+			json: `{"tls": {"ca-file": "ca.pem", "cert-file": "cert.pem", "key-file": "key.pem",
+				"server-name": "backend.internal", "alpn": ["h2"], "insecure-skip-verify": true}}`,
+			expected: full,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fromYAML, fromJSON Upstream
+			require.NoError(t, yaml.Unmarshal([]byte(tt.yaml), &fromYAML))
+			require.NoError(t, json.Unmarshal([]byte(tt.json), &fromJSON))
+			assert.Equal(t, tt.expected, fromYAML.TLS)
+			assert.Equal(t, tt.expected, fromJSON.TLS)
+
+			bts, err := yaml.Marshal(fromYAML)
+			require.NoError(t, err)
+			var back Upstream
+			require.NoError(t, yaml.Unmarshal(bts, &back))
+			assert.Equal(t, tt.expected, back.TLS)
+
+			bts, err = json.Marshal(fromJSON)
+			require.NoError(t, err)
+			back = Upstream{}
+			require.NoError(t, json.Unmarshal(bts, &back))
+			assert.Equal(t, tt.expected, back.TLS)
+		})
+	}
+
+	t.Run("plain values are encoded as booleans", func(t *testing.T) {
+		bts, err := json.Marshal(Upstream{TLS: UpstreamTLS{Enabled: true}})
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"address": "", "tls": true, "serve-reflection": false}`, string(bts))
+
+		bts, err = yaml.Marshal(Upstream{Addr: "localhost:9090"})
+		require.NoError(t, err)
+		assert.Equal(t, "address: localhost:9090\nserve-reflection: false\n", string(bts))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		var u Upstream
+		assert.Error(t, yaml.Unmarshal([]byte(`tls: maybe`), &u))
+		assert.Error(t, json.Unmarshal([]byte(`{"tls": "maybe"}`), &u))
+	})
+}
+
+func TestEndpoint(t *testing.T) {
+	var u Upstream
+	require.NoError(t, yaml.Unmarshal([]byte(`
+addresses:
+  - localhost:9090
+  - address: localhost:9091
+    weight: 3
+`), &u))
+	expected := []Endpoint{{Addr: "localhost:9090"}, {Addr: "localhost:9091", Weight: 3}}
+	assert.Equal(t, expected, u.Addrs)
+
+	u = Upstream{}
+	require.NoError(t, json.Unmarshal([]byte(`{"addresses": ["localhost:9090", {"address": "localhost:9091", "weight": 3}]}`), &u))
+	assert.Equal(t, expected, u.Addrs)
+
+	bts, err := json.Marshal(u.Addrs)
+	require.NoError(t, err)
+	assert.JSONEq(t, `["localhost:9090", {"address": "localhost:9091", "weight": 3}]`, string(bts))
+
+	bts, err = yaml.Marshal(u.Addrs)
+	require.NoError(t, err)
+	assert.Equal(t, "- localhost:9090\n- address: localhost:9091\n  weight: 3\n", string(bts))
+}
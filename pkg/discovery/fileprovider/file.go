@@ -4,11 +4,18 @@ package fileprovider
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"log/slog"
+	"math"
+	"math/rand/v2"
+	"net"
 	"os"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -18,11 +25,19 @@ import (
 	"github.com/Semior001/groxy/pkg/grpcx"
 	"github.com/Semior001/groxy/pkg/protodef"
 	"github.com/cappuccinotm/slogx"
+	"github.com/expr-lang/expr"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/samber/lo"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer/leastrequest"
+	"google.golang.org/grpc/balancer/roundrobin"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	_ "google.golang.org/grpc/health" // enables the health checks of the upstreams
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 	"google.golang.org/grpc/status"
 	"gopkg.in/yaml.v3"
 )
@@ -32,6 +47,8 @@ type File struct {
 	FileName      string
 	CheckInterval time.Duration
 	Delay         time.Duration
+
+	definer *protodef.Definer // built from the protos of the config, if any
 }
 
 // Name returns the name of the provider.
@@ -112,18 +129,32 @@ func (d *File) State(ctx context.Context) (*discovery.State, error) {
 		return nil, fmt.Errorf("unsupported version: %s", cfg.Version)
 	}
 
+	return BuildState(ctx, d.Name(), cfg)
+}
+
+// BuildState builds the discovery state with the given name from the config.
+// It doesn't check the version of the config.
+func BuildState(ctx context.Context, name string, cfg Config) (*discovery.State, error) {
+	d := &File{}
+
 	upstreams, err := d.upstreams(ctx, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("get upstreams: %w", err)
 	}
 
+	if cfg.Protos != nil {
+		if d.definer, err = definer(*cfg.Protos, upstreams); err != nil {
+			return nil, fmt.Errorf("load protos: %w", err)
+		}
+	}
+
 	rules, err := d.rules(cfg, upstreams)
 	if err != nil {
 		return nil, fmt.Errorf("get rules: %w", err)
 	}
 
 	return &discovery.State{
-		Name:      d.Name(),
+		Name:      name,
 		Rules:     rules,
 		Upstreams: upstreams,
 	}, nil
@@ -142,7 +173,7 @@ func (d *File) rules(cfg Config, upstreams []discovery.Upstream) ([]*discovery.R
 	}
 
 	if cfg.NotMatched != nil {
-		mock, err := d.parseRespond(cfg.NotMatched)
+		mock, err := d.parseRespond(cfg.NotMatched, nil)
 		if err != nil {
 			return nil, fmt.Errorf("parse respond: %w", err)
 		}
@@ -161,35 +192,35 @@ func (d *File) upstreams(ctx context.Context, cfg Config) ([]discovery.Upstream,
 	res := make([]discovery.Upstream, 0, len(cfg.Upstreams))
 	for name, u := range cfg.Upstreams {
 		cred := insecure.NewCredentials()
-		if u.TLS {
-			cred = credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		if u.TLS.Enabled {
+			cfg, err := tlsConfig(u.TLS)
+			if err != nil {
+				return nil, fmt.Errorf("build TLS config for upstream %q: %w", name, err)
+			}
+			cred = credentials.NewTLS(cfg)
 		}
 
-		tmpl, err := template.New("").
-			Funcs(template.FuncMap{"env": os.Getenv}).
-			Parse(u.Addr)
-		if err != nil {
-			return nil, fmt.Errorf("parse address template for upstream %q: %w", name, err)
+		opts := []grpc.DialOption{
+			grpc.WithTransportCredentials(cred),
+			grpc.WithStreamInterceptor(grpcx.ClientLogInterceptor(slog.Default())),
 		}
 
-		addr := &strings.Builder{}
-		if err = tmpl.Execute(addr, nil); err != nil {
-			return nil, fmt.Errorf("execute address template for upstream %q: %w", name, err)
+		target, balancing, err := resolve(u, &opts)
+		if err != nil {
+			return nil, fmt.Errorf("resolve upstream %q: %w", name, err)
 		}
 
-		if addr.String() == "" {
-			return nil, fmt.Errorf("empty address in upstream %q", name)
+		if svcCfg := serviceConfig(balancing, u.HealthCheck); svcCfg != "" {
+			opts = append(opts, grpc.WithDefaultServiceConfig(svcCfg))
 		}
 
 		slog.DebugContext(ctx, "dialing upstream",
 			slog.String("upstream", name),
-			slog.String("address", addr.String()),
-			slog.Bool("tls", u.TLS))
+			slog.String("address", target),
+			slog.String("balancing", balancing),
+			slog.Bool("tls", u.TLS.Enabled))
 
-		cc, err := grpc.NewClient(addr.String(),
-			grpc.WithTransportCredentials(cred),
-			grpc.WithStreamInterceptor(grpcx.ClientLogInterceptor(slog.Default())),
-		)
+		cc, err := grpc.NewClient(target, opts...)
 		if err != nil {
 			return nil, fmt.Errorf("dial upstream %q: %w", name, err)
 		}
@@ -206,6 +237,157 @@ func (d *File) upstreams(ctx context.Context, cfg Config) ([]discovery.Upstream,
 	return res, nil
 }
 
+// Policies to balance the requests between the addresses of the upstream.
+const (
+	balancingPickFirst     = "pick-first"
+	balancingRoundRobin    = "round-robin"
+	balancingLeastRequests = "least-requests"
+	balancingWeighted      = "weighted"
+)
+
+// resolve returns the target to dial the upstream and its balancing policy.
+// Multiple addresses are resolved by the resolver, added to the dial options.
+func resolve(u Upstream, opts *[]grpc.DialOption) (target, balancing string, err error) {
+	switch u.Balancing {
+	case "", balancingPickFirst, balancingRoundRobin, balancingLeastRequests, balancingWeighted:
+	default:
+		return "", "", fmt.Errorf("unknown balancing %q", u.Balancing)
+	}
+
+	// pick-first ignores the health checks, the other policies apply them
+	if u.HealthCheck != nil && u.Balancing == balancingPickFirst {
+		return "", "", fmt.Errorf("health checks are not supported by the pick-first balancing")
+	}
+
+	switch {
+	case u.Addr != "" && len(u.Addrs) > 0:
+		return "", "", fmt.Errorf("can't set both address and addresses")
+	case u.Addr != "":
+		if target, err = renderAddress(u.Addr); err != nil {
+			return "", "", err
+		}
+		balancing = u.Balancing
+		if balancing == "" {
+			balancing = lo.Ternary(u.HealthCheck == nil, balancingPickFirst, balancingRoundRobin)
+		}
+		return target, balancing, nil
+	case len(u.Addrs) == 0:
+		return "", "", fmt.Errorf("empty address")
+	}
+
+	balancing = lo.Ternary(u.Balancing == "", balancingRoundRobin, u.Balancing)
+
+	rendered := make([]string, 0, len(u.Addrs))
+	addrs := make([]resolver.Address, 0, len(u.Addrs))
+	for _, e := range u.Addrs {
+		addr, err := renderAddress(e.Addr)
+		if err != nil {
+			return "", "", err
+		}
+
+		switch {
+		case e.Weight < 0:
+			return "", "", fmt.Errorf("negative weight of %q", addr)
+		case e.Weight > 0 && balancing != balancingWeighted:
+			return "", "", fmt.Errorf("weight of %q requires the weighted balancing", addr)
+		}
+
+		// verify the certificate of each replica against its own host
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return "", "", fmt.Errorf("invalid address %q: %w", addr, err)
+		}
+
+		rendered = append(rendered, addr)
+		addrs = append(addrs, grpcx.WithWeight(resolver.Address{Addr: addr, ServerName: host}, e.Weight))
+	}
+
+	r := manual.NewBuilderWithScheme("groxy")
+	r.InitialState(resolver.State{Addresses: addrs})
+	*opts = append(*opts, grpc.WithResolvers(r))
+
+	return "groxy:///" + strings.Join(rendered, ","), balancing, nil
+}
+
+// renderAddress executes the template of the address.
+func renderAddress(tmpl string) (string, error) {
+	t, err := template.New("").
+		Funcs(template.FuncMap{"env": os.Getenv}).
+		Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("parse address template: %w", err)
+	}
+
+	addr := &strings.Builder{}
+	if err = t.Execute(addr, nil); err != nil {
+		return "", fmt.Errorf("execute address template: %w", err)
+	}
+
+	if addr.String() == "" {
+		return "", fmt.Errorf("empty address")
+	}
+
+	return addr.String(), nil
+}
+
+// serviceConfig returns the gRPC service config with the balancing
+// policy and the health checks, or an empty string for the defaults.
+func serviceConfig(balancing string, hc *HealthCheck) string {
+	policies := map[string]string{
+		balancingPickFirst:     "pick_first",
+		balancingRoundRobin:    roundrobin.Name,
+		balancingLeastRequests: leastrequest.Name,
+		balancingWeighted:      grpcx.WeightedBalancer,
+	}
+
+	if balancing == balancingPickFirst && hc == nil {
+		return ""
+	}
+
+	cfg := map[string]any{"loadBalancingConfig": []map[string]any{{policies[balancing]: map[string]any{}}}}
+	if hc != nil {
+		cfg["healthCheckConfig"] = map[string]any{"serviceName": hc.Service}
+	}
+
+	bts, _ := json.Marshal(cfg) // can't fail on maps of strings
+	return string(bts)
+}
+
+// tlsConfig builds the TLS configuration to connect to the upstream.
+func tlsConfig(u UpstreamTLS) (*tls.Config, error) {
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         u.ServerName,
+		NextProtos:         u.ALPN,
+		InsecureSkipVerify: u.InsecureSkipVerify, //nolint:gosec // explicitly requested by user
+	}
+
+	if u.CAFile != "" {
+		bts, err := os.ReadFile(u.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read CA file: %w", err)
+		}
+
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(bts) {
+			return nil, fmt.Errorf("no certificates found in CA file %q", u.CAFile)
+		}
+	}
+
+	switch {
+	case u.CertFile != "" && u.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(u.CertFile, u.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	case u.CertFile != "" || u.KeyFile != "":
+		return nil, fmt.Errorf("both cert-file and key-file must be set")
+	}
+
+	return cfg, nil
+}
+
 func (d *File) getModifTime(ctx context.Context) (modif time.Time, ok bool) {
 	fi, err := os.Stat(d.FileName)
 	if err != nil {
@@ -229,7 +411,11 @@ func (d *File) parseRule(r Rule, upstreams []discovery.Upstream) (result discove
 		return discovery.Rule{}, fmt.Errorf("empty URI in rule")
 	}
 
-	result.Name = r.Match.URI
+	result.Name = r.Name
+	if result.Name == "" {
+		result.Name = r.Match.URI
+	}
+
 	if result.Match.URI, err = regexp.Compile(r.Match.URI); err != nil {
 		return discovery.Rule{}, fmt.Errorf("compile URI regexp: %w", err)
 	}
@@ -246,34 +432,54 @@ func (d *File) parseRule(r Rule, upstreams []discovery.Upstream) (result discove
 	}
 
 	if r.Match.Body != nil {
-		if result.Match.Message, err = protodef.BuildMessage(*r.Match.Body); err != nil {
+		if result.Match.Message, err = d.buildMessage(r.Match.Type, *r.Match.Body); err != nil {
 			return discovery.Rule{}, fmt.Errorf("build request matcher message: %w", err)
 		}
 	}
 
-	if r.Forward != nil {
-		result.Forward = &discovery.Forward{Header: metadata.New(r.Forward.Header)}
-		if r.Forward.Rewrite != nil {
-			result.Forward.Rewrite = *r.Forward.Rewrite
-		}
+	if result.Forward, err = parseForward(r.Forward, upstreams); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse forward: %w", err)
+	}
 
-		for _, up := range upstreams {
-			if up.Name() == r.Forward.Upstream {
-				result.Forward.Upstream = up
-				break
-			}
+	if r.Scenario != nil {
+		if r.Scenario.Name == "" {
+			return discovery.Rule{}, fmt.Errorf("empty scenario name")
 		}
-		if result.Forward.Upstream == nil {
-			return discovery.Rule{}, fmt.Errorf("upstream %q not found", r.Forward.Upstream)
+		result.Scenario = &discovery.Scenario{
+			Name:          r.Scenario.Name,
+			RequiredState: r.Scenario.RequiredState,
+			NewState:      r.Scenario.NewState,
 		}
 	}
 
-	if result.Mock, err = d.parseRespond(r.Respond); err != nil {
+	if result.Mock, err = d.parseRespond(r.Respond, r.Match.Type); err != nil {
 		return discovery.Rule{}, fmt.Errorf("parse respond: %w", err)
 	}
 
+	if result.Fault, err = parseFault(r.Fault); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse fault: %w", err)
+	}
+
+	if result.Throttle, err = parseThrottle(r.Throttle); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse throttle: %w", err)
+	}
+
+	if result.RateLimit, err = parseRateLimit(r.RateLimit); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse rate limit: %w", err)
+	}
+
+	if result.Mirror, err = parseMirror(r.Mirror, upstreams); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse mirror: %w", err)
+	}
+
+	if result.Compare, err = parseCompare(r.Compare); err != nil {
+		return discovery.Rule{}, fmt.Errorf("parse compare: %w", err)
+	}
+
 	switch {
-	case result.Mock != nil && result.Forward != nil:
+	case result.Compare != nil && (result.Mock == nil || result.Forward == nil):
+		return discovery.Rule{}, fmt.Errorf("compare requires both respond and forward in rule")
+	case result.Compare == nil && result.Mock != nil && result.Forward != nil:
 		return discovery.Rule{}, fmt.Errorf("can't set both mock and forward in rule")
 	case result.Mock == nil && result.Forward == nil:
 		return discovery.Rule{}, fmt.Errorf("empty rule")
@@ -282,7 +488,173 @@ func (d *File) parseRule(r Rule, upstreams []discovery.Upstream) (result discove
 	return result, nil
 }
 
-func (d *File) parseRespond(r *Respond) (result *discovery.Mock, err error) {
+// parseForward parses the forwarding of the request to the upstreams.
+func parseForward(f *Forward, upstreams []discovery.Upstream) (*discovery.Forward, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	result := &discovery.Forward{
+		Header:  metadata.New(f.Header),
+		HashKey: strings.ToLower(f.HashKey),
+	}
+	if f.Rewrite != nil {
+		result.Rewrite = *f.Rewrite
+	}
+
+	targets := f.Upstreams
+	switch {
+	case f.Upstream != "" && len(f.Upstreams) > 0:
+		return nil, fmt.Errorf("can't set both upstream and upstreams")
+	case f.Upstream != "":
+		targets = []ForwardTarget{{Upstream: f.Upstream}}
+	case len(f.Upstreams) == 0:
+		return nil, fmt.Errorf("empty upstream")
+	}
+
+	total := 0
+	for _, t := range targets {
+		idx := slices.IndexFunc(upstreams, func(u discovery.Upstream) bool { return u.Name() == t.Upstream })
+		if idx < 0 {
+			return nil, fmt.Errorf("upstream %q not found", t.Upstream)
+		}
+
+		weight := 1
+		if t.Weight != nil {
+			weight = *t.Weight
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("negative weight of upstream %q", t.Upstream)
+		}
+
+		total += weight
+		result.Targets = append(result.Targets, discovery.ForwardTarget{Upstream: upstreams[idx], Weight: weight})
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("all upstreams have zero weight")
+	}
+
+	var err error
+	if result.Retry, err = parseRetry(f.Retry); err != nil {
+		return nil, fmt.Errorf("parse retry: %w", err)
+	}
+
+	return result, nil
+}
+
+// Defaults of the retry policy.
+const (
+	defaultRetryAttempts   = 3
+	defaultRetryBackoff    = 100 * time.Millisecond
+	defaultRetryMaxBackoff = time.Second
+)
+
+// parseRetry parses the policy of retrying the forwarded calls.
+func parseRetry(r *Retry) (*discovery.Retry, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	result := &discovery.Retry{
+		MaxAttempts: defaultRetryAttempts,
+		Codes:       []codes.Code{codes.Unavailable},
+		Backoff:     defaultRetryBackoff,
+		MaxBackoff:  defaultRetryMaxBackoff,
+	}
+
+	if r.Attempts != nil {
+		if *r.Attempts < 1 {
+			return nil, fmt.Errorf("attempts must be positive")
+		}
+		result.MaxAttempts = *r.Attempts
+	}
+
+	if len(r.Codes) > 0 {
+		result.Codes = make([]codes.Code, 0, len(r.Codes))
+		for _, c := range r.Codes {
+			var code codes.Code
+			if err := code.UnmarshalJSON([]byte(fmt.Sprintf("%q", c))); err != nil {
+				return nil, fmt.Errorf("unmarshal code: %w", err)
+			}
+			if code == codes.OK {
+				return nil, fmt.Errorf("code must not be OK")
+			}
+			result.Codes = append(result.Codes, code)
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value *string
+		dst   *time.Duration
+	}{
+		{name: "per-try timeout", value: r.PerTryTimeout, dst: &result.PerTryTimeout},
+		{name: "backoff", value: r.Backoff, dst: &result.Backoff},
+		{name: "max backoff", value: r.MaxBackoff, dst: &result.MaxBackoff},
+		{name: "hedge delay", value: r.HedgeDelay, dst: &result.HedgeDelay},
+	}
+
+	for _, d := range durations {
+		if d.value == nil {
+			continue
+		}
+
+		var err error
+		if *d.dst, err = time.ParseDuration(*d.value); err != nil {
+			return nil, fmt.Errorf("parse %s: %w", d.name, err)
+		}
+		if *d.dst <= 0 {
+			return nil, fmt.Errorf("%s must be positive", d.name)
+		}
+	}
+
+	if result.MaxBackoff < result.Backoff {
+		return nil, fmt.Errorf("max backoff %s is less than backoff %s", result.MaxBackoff, result.Backoff)
+	}
+
+	return result, nil
+}
+
+// defaultMirrorTimeout is the timeout of the mirrored call, if not set.
+const defaultMirrorTimeout = 10 * time.Second
+
+// parseMirror parses the mirroring of the requests to the shadow upstream.
+func parseMirror(m *Mirror, upstreams []discovery.Upstream) (*discovery.Mirror, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	idx := slices.IndexFunc(upstreams, func(u discovery.Upstream) bool { return u.Name() == m.Upstream })
+	if idx < 0 {
+		return nil, fmt.Errorf("upstream %q not found", m.Upstream)
+	}
+
+	result := &discovery.Mirror{Upstream: upstreams[idx], Percentage: 100, Timeout: defaultMirrorTimeout}
+
+	if m.Percentage != nil {
+		if *m.Percentage < 0 || *m.Percentage > 100 {
+			return nil, fmt.Errorf("percentage %v is out of [0, 100]", *m.Percentage)
+		}
+		result.Percentage = *m.Percentage
+	}
+
+	if m.Timeout != nil {
+		var err error
+		if result.Timeout, err = time.ParseDuration(*m.Timeout); err != nil {
+			return nil, fmt.Errorf("parse timeout: %w", err)
+		}
+		if result.Timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be positive")
+		}
+	}
+
+	return result, nil
+}
+
+// parseRespond parses the response. Request type is used to parse
+// the matchers of the reactions, if set.
+func (d *File) parseRespond(r *Respond, reqType *string) (result *discovery.Mock, err error) {
 	if r == nil {
 		return nil, nil
 	}
@@ -300,22 +672,396 @@ func (d *File) parseRespond(r *Respond) (result *discovery.Mock, err error) {
 		}
 	}
 
-	switch {
-	case r.Status != nil && r.Body != nil:
-		return nil, fmt.Errorf("can't set both status and body in rule")
-	case r.Status != nil:
+	if r.Status != nil {
 		var code codes.Code
 		if err = code.UnmarshalJSON([]byte(fmt.Sprintf("%q", r.Status.Code))); err != nil {
 			return nil, fmt.Errorf("unmarshal status code: %w", err)
 		}
 		result.Status = status.New(code, r.Status.Message)
+	}
+
+	switch {
+	case r.Status != nil && r.Body != nil:
+		return nil, fmt.Errorf("can't set both status and body in rule")
+	case r.Body != nil && len(r.Stream) > 0:
+		return nil, fmt.Errorf("can't set both body and stream in rule")
 	case r.Body != nil:
-		if result.Body, err = protodef.BuildMessage(*r.Body); err != nil {
+		if result.Body, err = d.buildMessage(r.Type, *r.Body); err != nil {
 			return nil, fmt.Errorf("build respond message: %w", err)
 		}
-	default:
+	case len(r.Stream) > 0:
+		if result.Stream, err = d.parseStream(r.Stream, r.Type); err != nil {
+			return nil, fmt.Errorf("parse stream: %w", err)
+		}
+	case r.Status == nil && len(r.OnMessage) == 0:
 		return nil, fmt.Errorf("empty response in rule")
 	}
 
+	for idx, reaction := range r.OnMessage {
+		var parsed discovery.Reaction
+		if reaction.Match != nil {
+			if parsed.Match, err = d.buildMessage(reqType, *reaction.Match); err != nil {
+				return nil, fmt.Errorf("build matcher message of reaction #%d: %w", idx, err)
+			}
+		}
+
+		if parsed.Reply, err = d.parseStream(reaction.Reply, r.Type); err != nil {
+			return nil, fmt.Errorf("parse reply of reaction #%d: %w", idx, err)
+		}
+
+		result.OnMessage = append(result.OnMessage, parsed)
+	}
+
+	return result, nil
+}
+
+// parseFault parses the faults. Percentages default to 100.
+func parseFault(f *Fault) (*discovery.Fault, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	percentage := func(p *float64) (float64, error) {
+		switch {
+		case p == nil:
+			return 100, nil
+		case *p < 0 || *p > 100:
+			return 0, fmt.Errorf("percentage %v is out of [0, 100]", *p)
+		default:
+			return *p, nil
+		}
+	}
+
+	result := &discovery.Fault{}
+	var err error
+
+	if f.Seed != nil {
+		result.Rand = rand.New(rand.NewPCG(*f.Seed, *f.Seed))
+	}
+
+	if f.Abort != nil {
+		result.Abort = &discovery.FaultAbort{}
+		if result.Abort.Percentage, err = percentage(f.Abort.Percentage); err != nil {
+			return nil, fmt.Errorf("abort: %w", err)
+		}
+
+		var code codes.Code
+		if err = code.UnmarshalJSON([]byte(fmt.Sprintf("%q", f.Abort.Status.Code))); err != nil {
+			return nil, fmt.Errorf("unmarshal abort status code: %w", err)
+		}
+		if code == codes.OK {
+			return nil, fmt.Errorf("abort status code must not be OK")
+		}
+		result.Abort.Status = status.New(code, f.Abort.Status.Message)
+	}
+
+	if f.Delay != nil {
+		result.Delay = &discovery.FaultDelay{}
+		if result.Delay.Percentage, err = percentage(f.Delay.Percentage); err != nil {
+			return nil, fmt.Errorf("delay: %w", err)
+		}
+		if result.Delay.Latency, err = parseLatency(*f.Delay); err != nil {
+			return nil, fmt.Errorf("delay: %w", err)
+		}
+	}
+
+	if f.Reset != nil {
+		if f.Reset.After < 0 {
+			return nil, fmt.Errorf("reset: negative number of messages")
+		}
+		result.Reset = &discovery.FaultReset{After: f.Reset.After}
+		if result.Reset.Percentage, err = percentage(f.Reset.Percentage); err != nil {
+			return nil, fmt.Errorf("reset: %w", err)
+		}
+	}
+
+	if f.DropTrailers != nil {
+		if result.DropTrailers, err = percentage(f.DropTrailers.Percentage); err != nil {
+			return nil, fmt.Errorf("drop trailers: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// parseLatency parses the distribution of the latency, exactly one of which must be set.
+func parseLatency(d FaultDelay) (discovery.Latency, error) {
+	set := 0
+	for _, ok := range []bool{d.Fixed != nil, d.Uniform != nil, d.Normal != nil, len(d.Percentiles) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("exactly one of fixed, uniform, normal or percentiles must be set")
+	}
+
+	durations := func(ss ...string) ([]time.Duration, error) {
+		res := make([]time.Duration, 0, len(ss))
+		for _, s := range ss {
+			dur, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, err
+			}
+			if dur < 0 {
+				return nil, fmt.Errorf("negative duration %s", s)
+			}
+			res = append(res, dur)
+		}
+		return res, nil
+	}
+
+	switch {
+	case d.Fixed != nil:
+		ds, err := durations(*d.Fixed)
+		if err != nil {
+			return nil, fmt.Errorf("parse fixed latency: %w", err)
+		}
+		return discovery.FixedLatency(ds[0]), nil
+	case d.Uniform != nil:
+		ds, err := durations(d.Uniform.Min, d.Uniform.Max)
+		if err != nil {
+			return nil, fmt.Errorf("parse uniform latency: %w", err)
+		}
+		if ds[0] > ds[1] {
+			return nil, fmt.Errorf("min latency %s is greater than max %s", ds[0], ds[1])
+		}
+		return discovery.UniformLatency{Min: ds[0], Max: ds[1]}, nil
+	case d.Normal != nil:
+		ds, err := durations(d.Normal.Mean, d.Normal.StdDev)
+		if err != nil {
+			return nil, fmt.Errorf("parse normal latency: %w", err)
+		}
+		return discovery.NormalLatency{Mean: ds[0], StdDev: ds[1]}, nil
+	default:
+		ps := make([]discovery.Percentile, 0, len(d.Percentiles))
+		for k, v := range d.Percentiles {
+			p, err := strconv.ParseFloat(strings.TrimPrefix(k, "p"), 64)
+			if err != nil || p <= 0 || p > 100 {
+				return nil, fmt.Errorf("invalid percentile %q, expected e.g. p50 or p99.9", k)
+			}
+			ds, err := durations(v)
+			if err != nil {
+				return nil, fmt.Errorf("parse latency of percentile %q: %w", k, err)
+			}
+			ps = append(ps, discovery.Percentile{Percentile: p, Latency: ds[0]})
+		}
+
+		latency := discovery.NewPercentileLatency(ps...)
+		for i := 1; i < len(latency); i++ {
+			if latency[i].Latency < latency[i-1].Latency {
+				return nil, fmt.Errorf("latency of p%v is less than of p%v", latency[i].Percentile, latency[i-1].Percentile)
+			}
+		}
+		return latency, nil
+	}
+}
+
+// parseThrottle parses the limits of the messages in both directions.
+func parseThrottle(t *Throttle) (*discovery.Throttle, error) {
+	if t == nil {
+		return nil, nil
+	}
+
+	parse := func(l *ThrottleLimits) (*discovery.ThrottleLimits, error) {
+		if l == nil {
+			return nil, nil
+		}
+
+		if l.BytesPerSecond < 0 || l.MessagesPerSecond < 0 {
+			return nil, fmt.Errorf("negative limit")
+		}
+
+		res := &discovery.ThrottleLimits{BytesPerSecond: l.BytesPerSecond, MessagesPerSecond: l.MessagesPerSecond}
+		if l.Delay != nil {
+			var err error
+			if res.Delay, err = time.ParseDuration(*l.Delay); err != nil {
+				return nil, fmt.Errorf("parse delay: %w", err)
+			}
+		}
+
+		return res, nil
+	}
+
+	result := &discovery.Throttle{}
+	var err error
+
+	if result.Requests, err = parse(t.Requests); err != nil {
+		return nil, fmt.Errorf("requests: %w", err)
+	}
+
+	if result.Responses, err = parse(t.Responses); err != nil {
+		return nil, fmt.Errorf("responses: %w", err)
+	}
+
+	return result, nil
+}
+
+// parseRateLimit parses the limits. The burst defaults to the rate, rounded up.
+func parseRateLimit(l *RateLimit) (*discovery.RateLimit, error) {
+	if l == nil {
+		return nil, nil
+	}
+
+	switch {
+	case l.Rate < 0 || l.Burst < 0 || l.MaxConcurrent < 0:
+		return nil, fmt.Errorf("negative limit")
+	case l.Rate == 0 && l.MaxConcurrent == 0:
+		return nil, fmt.Errorf("neither rate nor max-concurrent is set")
+	}
+
+	result := &discovery.RateLimit{
+		Rate:          l.Rate,
+		Burst:         l.Burst,
+		MaxConcurrent: l.MaxConcurrent,
+	}
+
+	if result.Burst == 0 {
+		result.Burst = int(math.Ceil(l.Rate))
+	}
+
+	switch by, header, _ := strings.Cut(l.Key, ":"); by {
+	case "", discovery.RateLimitByMethod:
+		result.Key = discovery.RateLimitKey{By: discovery.RateLimitByMethod}
+	case discovery.RateLimitByPeer:
+		result.Key = discovery.RateLimitKey{By: discovery.RateLimitByPeer}
+	case discovery.RateLimitByHeader:
+		if header == "" {
+			return nil, fmt.Errorf("empty header name in key %q", l.Key)
+		}
+		result.Key = discovery.RateLimitKey{By: discovery.RateLimitByHeader, Header: strings.ToLower(header)}
+	default:
+		return nil, fmt.Errorf("unknown key %q, expected method, peer or header:<name>", l.Key)
+	}
+
+	if l.RetryAfter != nil {
+		var err error
+		if result.RetryAfter, err = time.ParseDuration(*l.RetryAfter); err != nil {
+			return nil, fmt.Errorf("parse retry-after duration: %w", err)
+		}
+	}
+
+	if l.Status != nil {
+		var code codes.Code
+		if err := code.UnmarshalJSON([]byte(fmt.Sprintf("%q", l.Status.Code))); err != nil {
+			return nil, fmt.Errorf("unmarshal status code: %w", err)
+		}
+		if code == codes.OK {
+			return nil, fmt.Errorf("status code must not be OK")
+		}
+		result.Status = status.New(code, l.Status.Message)
+	}
+
+	return result, nil
+}
+
+func (d *File) parseStream(msgs []StreamMessage, typ *string) ([]discovery.StreamMessage, error) {
+	result := make([]discovery.StreamMessage, 0, len(msgs))
+	for idx, m := range msgs {
+		var msg discovery.StreamMessage
+		var err error
+
+		if m.Wait != nil {
+			if msg.Wait, err = time.ParseDuration(*m.Wait); err != nil {
+				return nil, fmt.Errorf("parse wait duration of message #%d: %w", idx, err)
+			}
+		}
+
+		if m.Repeat != nil {
+			if msg.Repeat, err = expr.Compile(*m.Repeat, expr.AsInt(), expr.AllowUndefinedVariables()); err != nil {
+				return nil, fmt.Errorf("compile repeat expression of message #%d: %w", idx, err)
+			}
+		}
+
+		if msg.Body, err = d.buildMessage(typ, m.Body); err != nil {
+			return nil, fmt.Errorf("build message #%d: %w", idx, err)
+		}
+
+		result = append(result, msg)
+	}
+
+	return result, nil
+}
+
+// buildMessage builds the message template from the protobuf snippet or,
+// if the type is set, from the value of the message of this type.
+func (d *File) buildMessage(typ *string, body string) (protodef.Template, error) {
+	definer := d.definer
+	if definer == nil {
+		definer = protodef.NewDefiner()
+	}
+
+	if typ == nil {
+		return definer.BuildTarget(body)
+	}
+
+	return definer.BuildType(*typ, body)
+}
+
+// definer makes a definer, which looks up the message types in the proto
+// files and descriptor sets, and resolves the rest via the upstreams' reflection.
+func definer(p Protos, upstreams []discovery.Upstream) (*protodef.Definer, error) {
+	var fds []*desc.FileDescriptor
+	if len(p.Files) > 0 {
+		parsed, err := protodef.ParseFiles(p.ImportPaths, p.Files...)
+		if err != nil {
+			return nil, err
+		}
+		fds = append(fds, parsed...)
+	}
+
+	sets, err := protodef.LoadDescriptorSets(p.DescriptorSets...)
+	if err != nil {
+		return nil, err
+	}
+	fds = append(fds, sets...)
+
+	opts := []protodef.Option{protodef.WithFiles(fds...)}
+
+	if len(p.Upstreams) > 0 {
+		conns := make([]grpc.ClientConnInterface, 0, len(p.Upstreams))
+		for _, name := range p.Upstreams {
+			idx := slices.IndexFunc(upstreams, func(u discovery.Upstream) bool { return u.Name() == name })
+			if idx < 0 {
+				return nil, fmt.Errorf("upstream %q not found", name)
+			}
+			conns = append(conns, upstreams[idx])
+		}
+		opts = append(opts, protodef.WithResolver(protodef.NewReflectionResolver(conns...)))
+	}
+
+	return protodef.NewDefiner(opts...), nil
+}
+
+// defaultCompareTimeout is the timeout of the replayed call in the compare mode, if not set.
+const defaultCompareTimeout = 10 * time.Second
+
+// parseCompare parses the comparison of the mock with the upstream.
+func parseCompare(c *Compare) (*discovery.Compare, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	result := &discovery.Compare{Return: discovery.CompareReturnUpstream, Timeout: defaultCompareTimeout}
+
+	switch c.Return {
+	case "", discovery.CompareReturnUpstream:
+	case discovery.CompareReturnMock:
+		result.Return = discovery.CompareReturnMock
+	default:
+		return nil, fmt.Errorf("unknown return %q, must be either %q or %q",
+			c.Return, discovery.CompareReturnUpstream, discovery.CompareReturnMock)
+	}
+
+	if c.Timeout != nil {
+		var err error
+		if result.Timeout, err = time.ParseDuration(*c.Timeout); err != nil {
+			return nil, fmt.Errorf("parse timeout: %w", err)
+		}
+		if result.Timeout <= 0 {
+			return nil, fmt.Errorf("timeout must be positive")
+		}
+	}
+
 	return result, nil
 }
@@ -2,18 +2,32 @@ package fileprovider
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	_ "embed"
+	"encoding/pem"
+	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
 	"time"
 
 	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/tlsx"
+	"github.com/samber/lo"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
 )
 
 func TestFile_Events(t *testing.T) {
@@ -183,3 +197,693 @@ func TestFile_Upstreams(t *testing.T) {
 		assert.Equal(t, up.reflection, state.Upstreams[idx].Reflection())
 	}
 }
+
+func TestFile_upstreamsBalancing(t *testing.T) {
+	start := func(t *testing.T, st healthpb.HealthCheckResponse_ServingStatus) (addr string, srv *grpctest.Server) {
+		gs := grpc.NewServer()
+		srv = &grpctest.Server{UnaryFunc: func(context.Context, *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			return &grpctest.StreamResponse{}, nil
+		}}
+		grpctest.RegisterExampleServiceServer(gs, srv)
+		hs := health.NewServer()
+		hs.SetServingStatus("", st)
+		healthpb.RegisterHealthServer(gs, hs)
+		t.Cleanup(gs.Stop)
+		return grpctest.StartServer(t, gs), srv
+	}
+
+	call := func(t *testing.T, u Upstream, n int) {
+		ups, err := (&File{}).upstreams(context.Background(), Config{Upstreams: map[string]Upstream{"backend": u}})
+		require.NoError(t, err)
+		require.Len(t, ups, 1)
+		defer ups[0].Close()
+
+		cl := grpctest.NewExampleServiceClient(ups[0])
+		for range n {
+			_, err = cl.Unary(context.Background(), &grpctest.StreamRequest{}, grpc.WaitForReady(true))
+			require.NoError(t, err)
+		}
+	}
+
+	t.Run("round-robin", func(t *testing.T) {
+		addr1, srv1 := start(t, healthpb.HealthCheckResponse_SERVING)
+		addr2, srv2 := start(t, healthpb.HealthCheckResponse_SERVING)
+
+		call(t, Upstream{Addrs: []Endpoint{{Addr: addr1}, {Addr: addr2}}}, 20)
+		assert.Positive(t, srv1.Counts().Unary)
+		assert.Positive(t, srv2.Counts().Unary)
+		assert.Equal(t, 20, srv1.Counts().Unary+srv2.Counts().Unary)
+	})
+
+	t.Run("unhealthy endpoints are ejected", func(t *testing.T) {
+		addr1, srv1 := start(t, healthpb.HealthCheckResponse_SERVING)
+		addr2, srv2 := start(t, healthpb.HealthCheckResponse_NOT_SERVING)
+
+		call(t, Upstream{
+			Addrs:       []Endpoint{{Addr: addr1}, {Addr: addr2}},
+			HealthCheck: &HealthCheck{},
+		}, 10)
+		assert.Equal(t, 10, srv1.Counts().Unary)
+		assert.Zero(t, srv2.Counts().Unary)
+	})
+
+	t.Run("single unhealthy address", func(t *testing.T) {
+		addr, srv := start(t, healthpb.HealthCheckResponse_NOT_SERVING)
+
+		var opts []grpc.DialOption
+		_, balancing, err := resolve(Upstream{Addr: addr, HealthCheck: &HealthCheck{}}, &opts)
+		require.NoError(t, err)
+		assert.Equal(t, "round-robin", balancing, "health checks must switch the default policy")
+
+		ups, err := (&File{}).upstreams(context.Background(), Config{Upstreams: map[string]Upstream{
+			"backend": {Addr: addr, HealthCheck: &HealthCheck{}},
+		}})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = ups[0].Close() })
+
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err = grpctest.NewExampleServiceClient(ups[0]).Unary(ctx, &grpctest.StreamRequest{}, grpc.WaitForReady(true))
+		assert.Error(t, err, "unhealthy address must not be called")
+		assert.Zero(t, srv.Counts().Unary)
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		addr1, srv1 := start(t, healthpb.HealthCheckResponse_SERVING)
+
+		call(t, Upstream{Addrs: []Endpoint{{Addr: addr1, Weight: 2}}, Balancing: "weighted"}, 3)
+		assert.Equal(t, 3, srv1.Counts().Unary)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for name, tt := range map[string]struct {
+			upstream Upstream
+			err      string
+		}{
+			"both addresses": {
+				upstream: Upstream{Addr: "localhost:9090", Addrs: []Endpoint{{Addr: "localhost:9091"}}},
+				err:      "can't set both address and addresses",
+			},
+			"no address": {
+				upstream: Upstream{},
+				err:      "empty address",
+			},
+			"unknown balancing": {
+				upstream: Upstream{Addr: "localhost:9090", Balancing: "random"},
+				err:      `unknown balancing "random"`,
+			},
+			"weight without weighted balancing": {
+				upstream: Upstream{Addrs: []Endpoint{{Addr: "localhost:9090", Weight: 2}}},
+				err:      `weight of "localhost:9090" requires the weighted balancing`,
+			},
+			"negative weight": {
+				upstream: Upstream{Addrs: []Endpoint{{Addr: "localhost:9090", Weight: -1}}, Balancing: "weighted"},
+				err:      `negative weight of "localhost:9090"`,
+			},
+			"health check with pick-first": {
+				upstream: Upstream{Addr: "localhost:9090", Balancing: "pick-first", HealthCheck: &HealthCheck{}},
+				err:      "health checks are not supported by the pick-first balancing",
+			},
+			"address without port": {
+				upstream: Upstream{Addrs: []Endpoint{{Addr: "localhost"}}},
+				err:      `invalid address "localhost"`,
+			},
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := (&File{}).upstreams(context.Background(), Config{Upstreams: map[string]Upstream{"backend": tt.upstream}})
+				assert.ErrorContains(t, err, `resolve upstream "backend": `+tt.err)
+			})
+		}
+	})
+}
+
+func TestServiceConfig(t *testing.T) {
+	assert.Empty(t, serviceConfig("pick-first", nil))
+	assert.JSONEq(t, `{"loadBalancingConfig": [{"round_robin": {}}]}`, serviceConfig("round-robin", nil))
+	assert.JSONEq(t, `{
+		"loadBalancingConfig": [{"least_request_experimental": {}}],
+		"healthCheckConfig": {"serviceName": "pkg.Service"}
+	}`, serviceConfig("least-requests", &HealthCheck{Service: "pkg.Service"}))
+}
+
+func TestFile_parseRespond(t *testing.T) {
+	t.Run("stream", func(t *testing.T) {
+		var r Respond
+		require.NoError(t, yaml.Unmarshal([]byte(`
+stream:
+  - body: |
+      message Tick {
+        option (groxypb.target) = true;
+        string value = 1 [(groxypb.value) = "first"];
+      }
+  - wait: 100ms
+    repeat: n * 2
+    body: |
+      message Tick {
+        option (groxypb.target) = true;
+        string value = 1 [(groxypb.value) = "{{.Index}}"];
+      }
+status: { code: "ABORTED", message: "stream ended" }
+`), &r))
+
+		mock, err := (&File{}).parseRespond(&r, nil)
+		require.NoError(t, err)
+		require.Len(t, mock.Stream, 2)
+		assert.Equal(t, status.New(codes.Aborted, "stream ended"), mock.Status)
+		assert.Nil(t, mock.Body)
+
+		assert.Zero(t, mock.Stream[0].Wait)
+		n, err := mock.Stream[0].Count(nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		assert.Equal(t, 100*time.Millisecond, mock.Stream[1].Wait)
+		n, err = mock.Stream[1].Count(map[string]any{"n": int32(3)})
+		require.NoError(t, err)
+		assert.Equal(t, 6, n)
+	})
+
+	t.Run("on message", func(t *testing.T) {
+		var r Respond
+		require.NoError(t, yaml.Unmarshal([]byte(`
+on-message:
+  - match: |
+      message Ping {
+        option (groxypb.target) = true;
+        string value = 1 [(groxypb.value) = "ping"];
+      }
+    reply:
+      - body: |
+          message Pong {
+            option (groxypb.target) = true;
+            string value = 1 [(groxypb.value) = "pong"];
+          }
+  - {}
+`), &r))
+
+		mock, err := (&File{}).parseRespond(&r, nil)
+		require.NoError(t, err)
+		require.Len(t, mock.OnMessage, 2)
+		assert.NotNil(t, mock.OnMessage[0].Match)
+		assert.Len(t, mock.OnMessage[0].Reply, 1)
+		assert.Nil(t, mock.OnMessage[1].Match)
+		assert.Empty(t, mock.OnMessage[1].Reply)
+		assert.Nil(t, mock.Body)
+		assert.Nil(t, mock.Status)
+	})
+
+	t.Run("body and stream", func(t *testing.T) {
+		_, err := (&File{}).parseRespond(&Respond{
+			Body:   lo.ToPtr("message A { option (groxypb.target) = true; }"),
+			Stream: []StreamMessage{{Body: "message A { option (groxypb.target) = true; }"}},
+		}, nil)
+		require.ErrorContains(t, err, "can't set both body and stream")
+	})
+}
+
+func TestFile_parseRule(t *testing.T) {
+	t.Run("name", func(t *testing.T) {
+		var r Rule
+		require.NoError(t, yaml.Unmarshal([]byte(`
+match: { uri: "/test.Service/Method" }
+respond: { status: { code: "NOT_FOUND", message: "not found" } }
+`), &r))
+
+		rule, err := (&File{}).parseRule(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "/test.Service/Method", rule.Name, "defaults to URI")
+
+		r.Name = "not found"
+		rule, err = (&File{}).parseRule(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, "not found", rule.Name)
+	})
+
+	t.Run("scenario", func(t *testing.T) {
+		var r Rule
+		require.NoError(t, yaml.Unmarshal([]byte(`
+match: { uri: "/test.Service/Method" }
+scenario: { name: "flaky", required-state: "started", new-state: "ready" }
+respond: { status: { code: "UNAVAILABLE", message: "try again" } }
+`), &r))
+
+		rule, err := (&File{}).parseRule(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Scenario{Name: "flaky", RequiredState: "started", NewState: "ready"}, rule.Scenario)
+	})
+
+	t.Run("scenario without name", func(t *testing.T) {
+		var r Rule
+		require.NoError(t, yaml.Unmarshal([]byte(`
+match: { uri: "/test.Service/Method" }
+scenario: { new-state: "ready" }
+respond: { status: { code: "UNAVAILABLE", message: "try again" } }
+`), &r))
+
+		_, err := (&File{}).parseRule(r, nil)
+		require.ErrorContains(t, err, "empty scenario name")
+	})
+
+	t.Run("throttle", func(t *testing.T) {
+		var r Rule
+		require.NoError(t, yaml.Unmarshal([]byte(`
+match: { uri: "/test.Service/Method" }
+respond: { status: { code: "UNAVAILABLE", message: "try again" } }
+throttle:
+  requests: { bytes-per-second: 1024 }
+  responses: { messages-per-second: 0.5, delay: 100ms }
+`), &r))
+
+		rule, err := (&File{}).parseRule(r, nil)
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Throttle{
+			Requests:  &discovery.ThrottleLimits{BytesPerSecond: 1024},
+			Responses: &discovery.ThrottleLimits{MessagesPerSecond: 0.5, Delay: 100 * time.Millisecond},
+		}, rule.Throttle)
+
+		r.Throttle.Requests.BytesPerSecond = -1
+		_, err = (&File{}).parseRule(r, nil)
+		require.ErrorContains(t, err, "requests: negative limit")
+	})
+}
+
+func TestParseFault(t *testing.T) {
+	t.Run("all faults", func(t *testing.T) {
+		var r Rule
+		require.NoError(t, yaml.Unmarshal([]byte(`
+match: { uri: "/test.Service/Method" }
+forward: { upstream: "backend" }
+fault:
+  seed: 42
+  abort: { percentage: 10, status: { code: "UNAVAILABLE", message: "injected" } }
+  delay: { percentage: 50, percentiles: { p50: 10ms, p99: 1s, p90: 100ms } }
+  reset: { after: 2 }
+  drop-trailers: { percentage: 5 }
+`), &r))
+
+		rule, err := (&File{}).parseRule(r, []discovery.Upstream{discovery.ClientConn{ConnName: "backend"}})
+		require.NoError(t, err)
+		require.NotNil(t, rule.Fault)
+
+		f := rule.Fault
+		assert.NotNil(t, f.Rand)
+		assert.Equal(t, &discovery.FaultAbort{Percentage: 10, Status: status.New(codes.Unavailable, "injected")}, f.Abort)
+		assert.Equal(t, &discovery.FaultDelay{Percentage: 50, Latency: discovery.PercentileLatency{
+			{Percentile: 50, Latency: 10 * time.Millisecond},
+			{Percentile: 90, Latency: 100 * time.Millisecond},
+			{Percentile: 99, Latency: time.Second},
+		}}, f.Delay)
+		assert.Equal(t, &discovery.FaultReset{Percentage: 100, After: 2}, f.Reset, "percentage defaults to 100")
+		assert.Equal(t, 5.0, f.DropTrailers)
+	})
+
+	t.Run("distributions", func(t *testing.T) {
+		tbl := []struct {
+			delay string
+			want  discovery.Latency
+		}{
+			{delay: `{ fixed: 1s }`, want: discovery.FixedLatency(time.Second)},
+			{delay: `{ uniform: { min: 1s, max: 2s } }`, want: discovery.UniformLatency{Min: time.Second, Max: 2 * time.Second}},
+			{delay: `{ normal: { mean: 1s, stddev: 100ms } }`, want: discovery.NormalLatency{Mean: time.Second, StdDev: 100 * time.Millisecond}},
+		}
+
+		for _, tt := range tbl {
+			var f Fault
+			require.NoError(t, yaml.Unmarshal([]byte("delay: "+tt.delay), &f))
+
+			got, err := parseFault(&f)
+			require.NoError(t, err)
+			assert.Nil(t, got.Rand, "random without seed")
+			assert.Equal(t, tt.want, got.Delay.Latency)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			fault string
+			err   string
+		}{
+			{fault: `abort: { percentage: 150, status: { code: "INTERNAL" } }`, err: "out of [0, 100]"},
+			{fault: `abort: { status: { code: "OK" } }`, err: "must not be OK"},
+			{fault: `delay: { fixed: 1s, normal: { mean: 1s, stddev: 1s } }`, err: "exactly one of"},
+			{fault: `delay: {}`, err: "exactly one of"},
+			{fault: `delay: { uniform: { min: 2s, max: 1s } }`, err: "greater than max"},
+			{fault: `delay: { percentiles: { median: 1s } }`, err: "invalid percentile"},
+			{fault: `delay: { percentiles: { p50: 1s, p99: 10ms } }`, err: "latency of p99 is less than of p50"},
+			{fault: `delay: { fixed: -1s }`, err: "negative duration"},
+			{fault: `reset: { after: -1 }`, err: "negative number of messages"},
+		}
+
+		for _, tt := range tbl {
+			var f Fault
+			require.NoError(t, yaml.Unmarshal([]byte(tt.fault), &f))
+
+			_, err := parseFault(&f)
+			assert.ErrorContains(t, err, tt.err, tt.fault)
+		}
+	})
+}
+
+func TestParseRateLimit(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		var l RateLimit
+		require.NoError(t, yaml.Unmarshal([]byte(`
+key: "header:X-User-Id"
+rate: 2.5
+max-concurrent: 3
+retry-after: 2s
+status: { code: "UNAVAILABLE", message: "slow down" }
+`), &l))
+
+		got, err := parseRateLimit(&l)
+		require.NoError(t, err)
+		assert.Equal(t, discovery.RateLimitKey{By: discovery.RateLimitByHeader, Header: "x-user-id"}, got.Key)
+		assert.Equal(t, 2.5, got.Rate)
+		assert.Equal(t, 3, got.Burst, "defaults to the rate, rounded up")
+		assert.Equal(t, 3, got.MaxConcurrent)
+		assert.Equal(t, 2*time.Second, got.RetryAfter)
+		assert.Equal(t, status.New(codes.Unavailable, "slow down"), got.Status)
+	})
+
+	t.Run("default key", func(t *testing.T) {
+		got, err := parseRateLimit(&RateLimit{MaxConcurrent: 1})
+		require.NoError(t, err)
+		assert.Equal(t, discovery.RateLimitKey{By: discovery.RateLimitByMethod}, got.Key)
+		assert.Zero(t, got.Burst)
+		assert.Nil(t, got.Status)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			limit RateLimit
+			err   string
+		}{
+			{limit: RateLimit{}, err: "neither rate nor max-concurrent"},
+			{limit: RateLimit{Rate: -1}, err: "negative limit"},
+			{limit: RateLimit{Rate: 1, Key: "client"}, err: "unknown key"},
+			{limit: RateLimit{Rate: 1, Key: "header:"}, err: "empty header name"},
+			{limit: RateLimit{Rate: 1, RetryAfter: lo.ToPtr("soon")}, err: "parse retry-after"},
+			{limit: RateLimit{Rate: 1, Status: &Status{Code: "OK"}}, err: "must not be OK"},
+		}
+
+		for _, tt := range tbl {
+			_, err := parseRateLimit(&tt.limit)
+			assert.ErrorContains(t, err, tt.err)
+		}
+	})
+}
+
+func TestParseForward(t *testing.T) {
+	stable, canary := discovery.ClientConn{ConnName: "stable"}, discovery.ClientConn{ConnName: "canary"}
+	upstreams := []discovery.Upstream{stable, canary}
+
+	t.Run("single upstream", func(t *testing.T) {
+		got, err := parseForward(&Forward{Upstream: "stable", Rewrite: lo.ToPtr("/$1")}, upstreams)
+		require.NoError(t, err)
+		assert.Equal(t, []discovery.ForwardTarget{{Upstream: stable, Weight: 1}}, got.Targets)
+		assert.Equal(t, "/$1", got.Rewrite)
+	})
+
+	t.Run("weighted upstreams", func(t *testing.T) {
+		var f Forward
+		require.NoError(t, yaml.Unmarshal([]byte(`
+upstreams:
+  - { upstream: stable, weight: 9 }
+  - { upstream: canary }
+hash-key: X-User-Id
+`), &f))
+
+		got, err := parseForward(&f, upstreams)
+		require.NoError(t, err)
+		assert.Equal(t, []discovery.ForwardTarget{{Upstream: stable, Weight: 9}, {Upstream: canary, Weight: 1}}, got.Targets)
+		assert.Equal(t, "x-user-id", got.HashKey)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			forward Forward
+			err     string
+		}{
+			{forward: Forward{}, err: "empty upstream"},
+			{forward: Forward{Upstream: "stable", Upstreams: []ForwardTarget{{Upstream: "canary"}}}, err: "can't set both"},
+			{forward: Forward{Upstream: "unknown"}, err: `upstream "unknown" not found`},
+			{forward: Forward{Upstreams: []ForwardTarget{{Upstream: "stable", Weight: lo.ToPtr(-1)}}}, err: "negative weight"},
+			{forward: Forward{Upstreams: []ForwardTarget{{Upstream: "stable", Weight: lo.ToPtr(0)}}}, err: "zero weight"},
+		}
+
+		for _, tt := range tbl {
+			_, err := parseForward(&tt.forward, upstreams)
+			assert.ErrorContains(t, err, tt.err)
+		}
+	})
+}
+
+func TestParseRetry(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		got, err := parseRetry(&Retry{})
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Retry{
+			MaxAttempts: 3,
+			Codes:       []codes.Code{codes.Unavailable},
+			Backoff:     100 * time.Millisecond,
+			MaxBackoff:  time.Second,
+		}, got)
+	})
+
+	t.Run("all fields", func(t *testing.T) {
+		var r Retry
+		require.NoError(t, yaml.Unmarshal([]byte(`
+attempts: 5
+codes: [UNAVAILABLE, RESOURCE_EXHAUSTED]
+per-try-timeout: 200ms
+backoff: 10ms
+max-backoff: 50ms
+hedge-delay: 30ms
+`), &r))
+
+		got, err := parseRetry(&r)
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Retry{
+			MaxAttempts:   5,
+			Codes:         []codes.Code{codes.Unavailable, codes.ResourceExhausted},
+			PerTryTimeout: 200 * time.Millisecond,
+			Backoff:       10 * time.Millisecond,
+			MaxBackoff:    50 * time.Millisecond,
+			HedgeDelay:    30 * time.Millisecond,
+		}, got)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			retry Retry
+			err   string
+		}{
+			{retry: Retry{Attempts: lo.ToPtr(0)}, err: "attempts must be positive"},
+			{retry: Retry{Codes: []string{"BROKEN"}}, err: "unmarshal code"},
+			{retry: Retry{Codes: []string{"OK"}}, err: "must not be OK"},
+			{retry: Retry{PerTryTimeout: lo.ToPtr("soon")}, err: "parse per-try timeout"},
+			{retry: Retry{HedgeDelay: lo.ToPtr("0s")}, err: "hedge delay must be positive"},
+			{retry: Retry{Backoff: lo.ToPtr("2s")}, err: "max backoff 1s is less than backoff 2s"},
+		}
+
+		for _, tt := range tbl {
+			_, err := parseRetry(&tt.retry)
+			assert.ErrorContains(t, err, tt.err)
+		}
+	})
+}
+
+func TestParseMirror(t *testing.T) {
+	shadow := discovery.ClientConn{ConnName: "shadow"}
+	upstreams := []discovery.Upstream{shadow}
+
+	t.Run("defaults", func(t *testing.T) {
+		got, err := parseMirror(&Mirror{Upstream: "shadow"}, upstreams)
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Mirror{Upstream: shadow, Percentage: 100, Timeout: 10 * time.Second}, got)
+	})
+
+	t.Run("all fields", func(t *testing.T) {
+		got, err := parseMirror(&Mirror{Upstream: "shadow", Percentage: lo.ToPtr(12.5), Timeout: lo.ToPtr("2s")}, upstreams)
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Mirror{Upstream: shadow, Percentage: 12.5, Timeout: 2 * time.Second}, got)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			mirror Mirror
+			err    string
+		}{
+			{mirror: Mirror{Upstream: "unknown"}, err: `upstream "unknown" not found`},
+			{mirror: Mirror{Upstream: "shadow", Percentage: lo.ToPtr(101.0)}, err: "out of [0, 100]"},
+			{mirror: Mirror{Upstream: "shadow", Timeout: lo.ToPtr("soon")}, err: "parse timeout"},
+			{mirror: Mirror{Upstream: "shadow", Timeout: lo.ToPtr("0s")}, err: "must be positive"},
+		}
+
+		for _, tt := range tbl {
+			_, err := parseMirror(&tt.mirror, upstreams)
+			assert.ErrorContains(t, err, tt.err)
+		}
+	})
+}
+
+func TestParseCompare(t *testing.T) {
+	t.Run("defaults", func(t *testing.T) {
+		got, err := parseCompare(&Compare{})
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Compare{Return: discovery.CompareReturnUpstream, Timeout: 10 * time.Second}, got)
+	})
+
+	t.Run("all fields", func(t *testing.T) {
+		got, err := parseCompare(&Compare{Return: "mock", Timeout: lo.ToPtr("2s")})
+		require.NoError(t, err)
+		assert.Equal(t, &discovery.Compare{Return: discovery.CompareReturnMock, Timeout: 2 * time.Second}, got)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		tbl := []struct {
+			compare Compare
+			err     string
+		}{
+			{compare: Compare{Return: "both"}, err: `unknown return "both"`},
+			{compare: Compare{Timeout: lo.ToPtr("soon")}, err: "parse timeout"},
+			{compare: Compare{Timeout: lo.ToPtr("0s")}, err: "must be positive"},
+		}
+
+		for _, tt := range tbl {
+			_, err := parseCompare(&tt.compare)
+			assert.ErrorContains(t, err, tt.err)
+		}
+	})
+}
+
+func TestBuildState_protos(t *testing.T) {
+	var cfg Config
+	require.NoError(t, yaml.Unmarshal([]byte(`
+version: "1"
+protos:
+  import-paths: [testdata/protos]
+  files: [orders.proto]
+rules:
+  - match:
+      uri: "/acme.orders.v1.OrderService/GetOrder"
+      type: acme.orders.v1.GetOrderRequest
+      body: '{"id": "42"}'
+    respond:
+      type: acme.orders.v1.GetOrderResponse
+      body: |
+        id: "{{ .id }}"
+        createdAt: "2024-01-02T03:04:05Z"
+  - match:
+      uri: "/acme.orders.v1.OrderService/GetOrder"
+      body: |
+        message Req {
+          option (groxypb.target) = true;
+          string id = 1 [(groxypb.value) = "43"];
+        }
+    respond:
+      body: |
+        import "orders.proto";
+        message Resp {
+          option (groxypb.target) = true;
+          acme.orders.v1.GetOrderResponse order = 1 [(groxypb.value) = '{"id": "43"}'];
+        }
+`), &cfg))
+
+	state, err := BuildState(context.Background(), "test", cfg)
+	require.NoError(t, err)
+	require.Len(t, state.Rules, 2)
+
+	ctx := context.Background()
+	req, err := proto.Marshal(&grpctest.StreamRequest{Value: "42"}) // same wire format as GetOrderRequest
+	require.NoError(t, err)
+
+	ok, err := state.Rules[0].Match.Message.Matches(ctx, req)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	resp, err := state.Rules[0].Mock.Body.Generate(ctx, map[string]any{"id": "42"})
+	require.NoError(t, err)
+	assert.Equal(t, "acme.orders.v1.GetOrderResponse", string(resp.ProtoReflect().Descriptor().FullName()))
+	bts, err := protojson.Marshal(resp)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"id": "42", "createdAt": "2024-01-02T03:04:05Z"}`, string(bts))
+
+	cfg.Rules[0].Match.Type = lo.ToPtr("acme.orders.v1.Unknown")
+	_, err = BuildState(ctx, "test", cfg)
+	assert.ErrorContains(t, err, `message type "acme.orders.v1.Unknown" not found`)
+
+	cfg.Protos.Upstreams = []string{"unknown"}
+	_, err = BuildState(ctx, "test", cfg)
+	assert.ErrorContains(t, err, `upstream "unknown" not found`)
+
+	cfg.Protos.Files = []string{"unknown.proto"}
+	_, err = BuildState(ctx, "test", cfg)
+	assert.ErrorContains(t, err, "load protos")
+}
+
+func TestTLSConfig(t *testing.T) {
+	ca, err := tlsx.NewCA("test CA")
+	require.NoError(t, err)
+
+	cert, err := ca.Issue("client")
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	caFile, certFile, keyFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.PEM(), 0o600))
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+
+	t.Run("system roots", func(t *testing.T) {
+		cfg, err := tlsConfig(UpstreamTLS{Enabled: true})
+		require.NoError(t, err)
+		assert.Equal(t, uint16(tls.VersionTLS12), cfg.MinVersion)
+		assert.Nil(t, cfg.RootCAs)
+		assert.Empty(t, cfg.Certificates)
+		assert.False(t, cfg.InsecureSkipVerify)
+	})
+
+	t.Run("all parameters", func(t *testing.T) {
+		cfg, err := tlsConfig(UpstreamTLS{
+			Enabled:            true,
+			CAFile:             caFile,
+			CertFile:           certFile,
+			KeyFile:            keyFile,
+			ServerName:         "backend.internal",
+			ALPN:               []string{"custom"},
+			InsecureSkipVerify: true,
+		})
+		require.NoError(t, err)
+		assert.True(t, cfg.RootCAs.Equal(ca.Pool()))
+		require.Len(t, cfg.Certificates, 1)
+		assert.Equal(t, cert.Certificate[0], cfg.Certificates[0].Certificate[0])
+		assert.Equal(t, "backend.internal", cfg.ServerName)
+		assert.Equal(t, []string{"custom"}, cfg.NextProtos)
+		assert.True(t, cfg.InsecureSkipVerify)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := tlsConfig(UpstreamTLS{Enabled: true, CertFile: certFile})
+		assert.EqualError(t, err, "both cert-file and key-file must be set")
+
+		_, err = tlsConfig(UpstreamTLS{Enabled: true, CAFile: filepath.Join(dir, "unknown.pem")})
+		assert.ErrorContains(t, err, "read CA file")
+
+		_, err = tlsConfig(UpstreamTLS{Enabled: true, CAFile: keyFile})
+		assert.EqualError(t, err, fmt.Sprintf("no certificates found in CA file %q", keyFile))
+
+		_, err = tlsConfig(UpstreamTLS{Enabled: true, CertFile: certFile, KeyFile: caFile})
+		assert.ErrorContains(t, err, "load client certificate")
+	})
+
+	t.Run("validated in upstreams", func(t *testing.T) {
+		_, err := (&File{}).upstreams(context.Background(), Config{Upstreams: map[string]Upstream{
+			"backend": {Addr: "localhost:9090", TLS: UpstreamTLS{Enabled: true, KeyFile: keyFile}},
+		}})
+		assert.EqualError(t, err, `build TLS config for upstream "backend": both cert-file and key-file must be set`)
+	})
+}
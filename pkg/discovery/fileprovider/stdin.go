@@ -51,21 +51,5 @@ func (s *Stdin) State(ctx context.Context) (*discovery.State, error) {
 
 	slog.DebugContext(ctx, "parsed configuration from stdin")
 
-	file := &File{}
-
-	upstreams, err := file.upstreams(ctx, cfg)
-	if err != nil {
-		return nil, fmt.Errorf("get upstreams: %w", err)
-	}
-
-	rules, err := file.rules(cfg, upstreams)
-	if err != nil {
-		return nil, fmt.Errorf("get rules: %w", err)
-	}
-
-	return &discovery.State{
-		Name:      s.Name(),
-		Rules:     rules,
-		Upstreams: upstreams,
-	}, nil
+	return BuildState(ctx, s.Name(), cfg)
 }
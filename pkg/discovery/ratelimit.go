@@ -0,0 +1,157 @@
+package discovery
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Sources of the keys of the rate limits.
+const (
+	RateLimitByMethod = "method" // requests to the same method share the limits
+	RateLimitByPeer   = "peer"   // requests from the same client host share the limits
+	RateLimitByHeader = "header" // requests with the same value of the header share the limits
+)
+
+// maxRateLimitKeys is the number of keys, after which
+// the idle keys of the rate limit are forgotten.
+const maxRateLimitKeys = 10000
+
+// RateLimit limits the rate and the number of concurrent requests, matched
+// by the rule, separately for each key. The state of the limits is kept
+// in the rule and is reset whenever the rule is reloaded.
+type RateLimit struct {
+	Key RateLimitKey
+
+	// Rate is the number of requests per second, refilling the token
+	// bucket of the key, and Burst is the size of the bucket.
+	// Zero rate means no limit.
+	Rate  float64
+	Burst int
+
+	// MaxConcurrent is the number of requests of the key,
+	// handled at the same time. Zero means no limit.
+	MaxConcurrent int
+
+	// Status is returned when the limit is exceeded.
+	// If nil, RESOURCE_EXHAUSTED is returned.
+	Status *status.Status
+
+	// RetryAfter is reported to the client in the RetryInfo details.
+	// If zero, the time until the next token is reported for the rate
+	// limit, and nothing is reported for the concurrency limit.
+	RetryAfter time.Duration
+
+	mu       sync.Mutex
+	buckets  map[string]*rate.Limiter
+	inflight map[string]int
+}
+
+// RateLimitKey tells which requests share the limits.
+type RateLimitKey struct {
+	By     string // one of RateLimitByMethod, RateLimitByPeer or RateLimitByHeader
+	Header string // the name of the header, if the key is taken from the header
+}
+
+// Of returns the key of the request.
+func (k RateLimitKey) Of(method string, md metadata.MD, addr net.Addr) string {
+	switch k.By {
+	case RateLimitByPeer:
+		if addr == nil {
+			return ""
+		}
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			return host
+		}
+		return addr.String()
+	case RateLimitByHeader:
+		return strings.Join(md.Get(k.Header), ",")
+	default:
+		return method
+	}
+}
+
+// Acquire takes a token from the bucket of the key and a slot of the
+// concurrent requests. It returns the function to release the slot once
+// the request is handled, or the status error, if any limit is exceeded.
+func (l *RateLimit) Acquire(key string) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.buckets == nil {
+		l.buckets, l.inflight = map[string]*rate.Limiter{}, map[string]int{}
+	}
+
+	now := time.Now()
+
+	if l.MaxConcurrent > 0 && l.inflight[key] >= l.MaxConcurrent {
+		return nil, l.exceeded("concurrency limit exceeded", l.RetryAfter)
+	}
+
+	if l.Rate > 0 {
+		bucket, ok := l.buckets[key]
+		if !ok {
+			l.forgetIdle(now)
+			bucket = rate.NewLimiter(rate.Limit(l.Rate), max(l.Burst, 1))
+			l.buckets[key] = bucket
+		}
+
+		if !bucket.AllowN(now, 1) {
+			retry := l.RetryAfter
+			if retry == 0 {
+				retry = time.Duration((1 - bucket.TokensAt(now)) / l.Rate * float64(time.Second))
+			}
+			return nil, l.exceeded("rate limit exceeded", retry)
+		}
+	}
+
+	l.inflight[key]++
+	return sync.OnceFunc(func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.inflight[key]--; l.inflight[key] <= 0 {
+			delete(l.inflight, key)
+		}
+	}), nil
+}
+
+// exceeded returns the error of the exceeded limit with the retry delay, if any.
+func (l *RateLimit) exceeded(msg string, retry time.Duration) error {
+	st := l.Status
+	if st == nil {
+		st = status.New(codes.ResourceExhausted, "{groxy} "+msg)
+	}
+
+	if retry <= 0 {
+		return st.Err()
+	}
+
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(retry)})
+	if err != nil {
+		return st.Err()
+	}
+
+	return detailed.Err()
+}
+
+// forgetIdle forgets the full buckets without the requests in flight,
+// once there are too many of them, as they are identical to the new ones.
+func (l *RateLimit) forgetIdle(now time.Time) {
+	if len(l.buckets) < maxRateLimitKeys {
+		return
+	}
+
+	for key, bucket := range l.buckets {
+		if l.inflight[key] == 0 && bucket.TokensAt(now) >= float64(bucket.Burst()) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package discovery
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestRateLimit_Acquire(t *testing.T) {
+	retryDelay := func(t *testing.T, err error) time.Duration {
+		st := status.Convert(err)
+		require.Len(t, st.Details(), 1)
+		info, ok := st.Details()[0].(*errdetails.RetryInfo)
+		require.True(t, ok)
+		return info.RetryDelay.AsDuration()
+	}
+
+	t.Run("rate", func(t *testing.T) {
+		l := &RateLimit{Rate: 1, Burst: 2}
+
+		for range 2 {
+			release, err := l.Acquire("key")
+			require.NoError(t, err)
+			release()
+		}
+
+		_, err := l.Acquire("key")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Equal(t, "{groxy} rate limit exceeded", status.Convert(err).Message())
+		assert.InDelta(t, time.Second, retryDelay(t, err), float64(100*time.Millisecond))
+
+		_, err = l.Acquire("another key")
+		assert.NoError(t, err, "keys have their own buckets")
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		l := &RateLimit{MaxConcurrent: 2, Status: status.New(codes.Unavailable, "busy"), RetryAfter: time.Second}
+
+		first, err := l.Acquire("key")
+		require.NoError(t, err)
+		_, err = l.Acquire("key")
+		require.NoError(t, err)
+
+		_, err = l.Acquire("key")
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Equal(t, "busy", status.Convert(err).Message())
+		assert.Equal(t, time.Second, retryDelay(t, err))
+
+		first()
+		first() // released only once
+		_, err = l.Acquire("key")
+		require.NoError(t, err)
+
+		_, err = l.Acquire("key")
+		assert.Error(t, err)
+	})
+
+	t.Run("concurrency without retry delay", func(t *testing.T) {
+		l := &RateLimit{MaxConcurrent: 1}
+		_, err := l.Acquire("key")
+		require.NoError(t, err)
+
+		_, err = l.Acquire("key")
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+		assert.Empty(t, status.Convert(err).Details())
+	})
+}
+
+func TestRateLimitKey_Of(t *testing.T) {
+	md := metadata.Pairs("x-user-id", "42")
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5000}
+
+	assert.Equal(t, "/pkg.Service/Method", RateLimitKey{By: RateLimitByMethod}.Of("/pkg.Service/Method", md, addr))
+	assert.Equal(t, "10.0.0.1", RateLimitKey{By: RateLimitByPeer}.Of("/pkg.Service/Method", md, addr))
+	assert.Equal(t, "42", RateLimitKey{By: RateLimitByHeader, Header: "x-user-id"}.Of("/pkg.Service/Method", md, addr))
+	assert.Empty(t, RateLimitKey{By: RateLimitByHeader, Header: "x-other"}.Of("/pkg.Service/Method", md, addr))
+}
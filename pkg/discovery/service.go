@@ -3,6 +3,7 @@ package discovery
 import (
 	"context"
 	"log/slog"
+	"slices"
 	"sort"
 	"sync"
 
@@ -21,9 +22,21 @@ type Service struct {
 	Providers   []Provider
 	StopOnError bool
 
+	// OnReload, if set, is called after every reload of the rules
+	// with the error of the reload, if any.
+	OnReload func(error)
+
 	upstreams []Upstream
 	rules     []*Rule
 	mu        sync.RWMutex
+
+	scenarios map[string]scenarioState
+	smu       sync.Mutex
+}
+
+type scenarioState struct {
+	state string
+	data  map[string]any
 }
 
 // Run starts a blocking loop that updates the routing rules
@@ -49,6 +62,10 @@ func (s *Service) Run(ctx context.Context) (err error) {
 			slog.DebugContext(ctx, "new event update received", slog.String("event", ev))
 
 			rules, upstreams, err := s.mergeStates(ctx)
+			if s.OnReload != nil {
+				s.OnReload(err)
+			}
+
 			if err != nil {
 				if s.StopOnError {
 					return fmt.Errorf("merge states: %w", err)
@@ -56,6 +73,12 @@ func (s *Service) Run(ctx context.Context) (err error) {
 				slog.WarnContext(ctx, "failed to merge states", slogx.Error(err))
 			}
 			s.mu.Lock()
+			// scenarios, whose rules have changed, may not have the current
+			// state anymore, thus, start them over, the rest keep their states
+			if changed := changedScenarios(s.rules, rules); len(changed) > 0 {
+				slog.DebugContext(ctx, "resetting changed scenarios", slog.Any("scenarios", changed))
+				s.ResetScenarios(changed...)
+			}
 			s.rules = rules
 			s.closeUpstreams(ctx)
 			s.upstreams = upstreams
@@ -86,13 +109,17 @@ func (s *Service) mergeStates(ctx context.Context) ([]*Rule, []Upstream, error)
 	// sort rules by the following order:
 	// 1. rules with more metadata to match
 	// 2. rules with request bodies to match
-	// 3. rest of the rules
-	sort.Slice(rules, func(i, j int) bool {
+	// 3. rules that require a specific scenario state
+	// 4. rest of the rules
+	sort.SliceStable(rules, func(i, j int) bool {
 		ri, rj := rules[i].Match, rules[j].Match
 		if len(ri.IncomingMetadata) != len(rj.IncomingMetadata) {
 			return len(ri.IncomingMetadata) > len(rj.IncomingMetadata)
 		}
-		return ri.Message != nil && rj.Message == nil
+		if (ri.Message != nil) != (rj.Message != nil) {
+			return ri.Message != nil
+		}
+		return requiresState(rules[i]) && !requiresState(rules[j])
 	})
 
 	return rules, upstreams, errs
@@ -105,14 +132,146 @@ func (s *Service) MatchMetadata(uri string, md metadata.MD) Matches {
 
 	var matches Matches
 	for _, r := range s.rules {
-		if r.Match.Matches(uri, md) {
-			matches = append(matches, r)
+		if !r.Match.Matches(uri, md) {
+			continue
 		}
+
+		if r.Scenario != nil && !r.Scenario.Matches(s.scenarioState(r.Scenario.Name).state) {
+			continue
+		}
+
+		matches = append(matches, r)
 	}
 
 	return matches
 }
 
+// AdvanceScenario transitions the scenario of the rule to the new state,
+// storing the provided request data in it, if the rule defines a new state.
+// It returns the data stored in the scenario, that can be used in templates.
+func (s *Service) AdvanceScenario(r *Rule, data map[string]any) map[string]any {
+	if r.Scenario == nil {
+		return nil
+	}
+
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	st := s.scenarioStateLocked(r.Scenario.Name)
+	if r.Scenario.NewState == "" {
+		return st.data
+	}
+
+	// the scenario might have been advanced by a concurrent request
+	if !r.Scenario.Matches(st.state) {
+		slog.Warn("scenario state has changed concurrently, skipping transition",
+			slog.String("scenario", r.Scenario.Name),
+			slog.String("state", st.state),
+			slog.String("rule", r.Name))
+		return st.data
+	}
+
+	if s.scenarios == nil {
+		s.scenarios = map[string]scenarioState{}
+	}
+
+	if data == nil { // keep the data from the previous transitions
+		data = st.data
+	}
+
+	s.scenarios[r.Scenario.Name] = scenarioState{state: r.Scenario.NewState, data: data}
+	return data
+}
+
+// ResetScenarios sets the scenarios with the given names to the initial state.
+// If no names are provided, all scenarios are reset.
+func (s *Service) ResetScenarios(names ...string) {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+
+	if len(names) == 0 {
+		s.scenarios = nil
+		return
+	}
+
+	for _, name := range names {
+		delete(s.scenarios, name)
+	}
+}
+
+// Scenarios returns the current states of all scenarios, described by the rules.
+func (s *Service) Scenarios() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := map[string]string{}
+	for _, r := range s.rules {
+		if r.Scenario != nil {
+			res[r.Scenario.Name] = s.scenarioState(r.Scenario.Name).state
+		}
+	}
+
+	return res
+}
+
+// changedScenarios returns the names of the scenarios, whose transitions
+// differ between the old and the new set of rules, or that were removed.
+func changedScenarios(old, upd []*Rule) []string {
+	prev, curr := scenarioTransitions(old), scenarioTransitions(upd)
+
+	var res []string
+	for name, transitions := range prev {
+		if !slices.Equal(transitions, curr[name]) {
+			res = append(res, name)
+		}
+	}
+
+	sort.Strings(res)
+	return res
+}
+
+// scenarioTransitions describes each scenario by the rules, taking part in it.
+func scenarioTransitions(rules []*Rule) map[string][]string {
+	res := map[string][]string{}
+	for _, r := range rules {
+		if r.Scenario == nil {
+			continue
+		}
+		res[r.Scenario.Name] = append(res[r.Scenario.Name], fmt.Sprintf("%s %v %s->%s",
+			r.Name, r.Match.URI, r.Scenario.RequiredState, r.Scenario.NewState))
+	}
+
+	for _, transitions := range res {
+		sort.Strings(transitions)
+	}
+
+	return res
+}
+
+func (s *Service) scenarioState(name string) scenarioState {
+	s.smu.Lock()
+	defer s.smu.Unlock()
+	return s.scenarioStateLocked(name)
+}
+
+func (s *Service) scenarioStateLocked(name string) scenarioState {
+	st, ok := s.scenarios[name]
+	if !ok {
+		return scenarioState{state: ScenarioStarted}
+	}
+	return st
+}
+
+func requiresState(r *Rule) bool { return r.Scenario != nil && r.Scenario.RequiredState != "" }
+
+// Rules returns the list of routing rules.
+func (s *Service) Rules() []*Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.rules
+}
+
 // Upstreams returns the list of upstream connections.
 func (s *Service) Upstreams() []Upstream {
 	s.mu.RLock()
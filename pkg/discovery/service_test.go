@@ -53,6 +53,50 @@ func TestService_MatchMetadata(t *testing.T) {
 	assert.Equal(t, Matches(svc.rules[1:]), matches)
 }
 
+func TestService_Scenarios(t *testing.T) {
+	svc := &Service{
+		rules: []*Rule{
+			{Name: "unavailable", Match: RequestMatcher{URI: regexp.MustCompile("Get")},
+				Scenario: &Scenario{Name: "flaky", RequiredState: ScenarioStarted, NewState: "ready"}},
+			{Name: "success", Match: RequestMatcher{URI: regexp.MustCompile("Get")},
+				Scenario: &Scenario{Name: "flaky", RequiredState: "ready"}},
+			{Name: "any state", Match: RequestMatcher{URI: regexp.MustCompile("Get")},
+				Scenario: &Scenario{Name: "flaky"}},
+		},
+	}
+
+	names := func(m Matches) []string {
+		res := make([]string, 0, len(m))
+		for _, r := range m {
+			res = append(res, r.Name)
+		}
+		return res
+	}
+
+	matches := svc.MatchMetadata("Get", nil)
+	assert.Equal(t, []string{"unavailable", "any state"}, names(matches))
+
+	data := svc.AdvanceScenario(matches[0], map[string]any{"id": "1"})
+	assert.Equal(t, map[string]any{"id": "1"}, data)
+	assert.Equal(t, map[string]string{"flaky": "ready"}, svc.Scenarios())
+
+	matches = svc.MatchMetadata("Get", nil)
+	assert.Equal(t, []string{"success", "any state"}, names(matches))
+
+	// rule without a new state doesn't change the scenario, but returns its data
+	data = svc.AdvanceScenario(matches[0], map[string]any{"id": "2"})
+	assert.Equal(t, map[string]any{"id": "1"}, data)
+
+	// concurrently advanced scenario is not transitioned again
+	data = svc.AdvanceScenario(svc.rules[0], map[string]any{"id": "3"})
+	assert.Equal(t, map[string]any{"id": "1"}, data)
+	assert.Equal(t, map[string]string{"flaky": "ready"}, svc.Scenarios())
+
+	svc.ResetScenarios("flaky")
+	assert.Equal(t, map[string]string{"flaky": ScenarioStarted}, svc.Scenarios())
+	assert.Equal(t, []string{"unavailable", "any state"}, names(svc.MatchMetadata("Get", nil)))
+}
+
 func TestMatches_MatchMessage(t *testing.T) {
 	t.Run("match", func(t *testing.T) {
 		r, ok := Matches{
@@ -179,9 +223,64 @@ func TestService_Run(t *testing.T) {
 			StateFunc: func(context.Context) (*State, error) { return nil, failure },
 		}
 
-		svc := &Service{Providers: []Provider{p1, p2, p3}, StopOnError: true}
+		var reloadErr error
+		svc := &Service{
+			Providers:   []Provider{p1, p2, p3},
+			StopOnError: true,
+			OnReload:    func(err error) { reloadErr = err },
+		}
 		err := svc.Run(context.Background()) // run indefinitely
 		assert.ErrorIs(t, err, failure)
+		assert.ErrorIs(t, reloadErr, failure, "reload failure must be reported")
+	})
+
+	t.Run("keep states of unchanged scenarios", func(t *testing.T) {
+		flaky := &Rule{Name: "flaky", Match: RequestMatcher{URI: regexp.MustCompile("Get")},
+			Scenario: &Scenario{Name: "flaky", RequiredState: ScenarioStarted, NewState: "ready"}}
+		login := &Rule{Name: "login", Match: RequestMatcher{URI: regexp.MustCompile("Login")},
+			Scenario: &Scenario{Name: "auth", NewState: "logged-in"}}
+
+		events, states := make(chan string), make(chan []*Rule, 1)
+		p := &ProviderMock{
+			NameFunc:   func() string { return "p" },
+			EventsFunc: func(context.Context) <-chan string { return events },
+			StateFunc:  func(context.Context) (*State, error) { return &State{Rules: <-states}, nil },
+		}
+
+		svc := &Service{Providers: []Provider{p}}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() { _ = svc.Run(ctx) }()
+
+		reload := func(rules ...*Rule) {
+			states <- rules
+			events <- "reload"
+			require.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual(rules, svc.Rules())
+			}, time.Second, 10*time.Millisecond)
+		}
+
+		reload(flaky, login)
+		svc.AdvanceScenario(flaky, nil)
+		svc.AdvanceScenario(login, nil)
+		assert.Equal(t, map[string]string{"flaky": "ready", "auth": "logged-in"}, svc.Scenarios())
+
+		// a rule without a scenario is added, both scenarios keep their states
+		reload(flaky, login, &Rule{Name: "other", Match: RequestMatcher{URI: regexp.MustCompile("List")}})
+		assert.Equal(t, map[string]string{"flaky": "ready", "auth": "logged-in"}, svc.Scenarios())
+
+		// the transition of the "auth" scenario has changed, so it starts over
+		reload(flaky, &Rule{Name: "login", Match: RequestMatcher{URI: regexp.MustCompile("Login")},
+			Scenario: &Scenario{Name: "auth", NewState: "admin"}})
+		assert.Equal(t, map[string]string{"flaky": "ready", "auth": ScenarioStarted}, svc.Scenarios())
+
+		// removed scenario is forgotten and starts over, once added back
+		admin := svc.Rules()[1]
+		svc.AdvanceScenario(admin, nil)
+		reload(admin)
+		assert.Equal(t, map[string]string{"auth": "admin"}, svc.Scenarios())
+		reload(flaky, admin)
+		assert.Equal(t, map[string]string{"flaky": ScenarioStarted, "auth": "admin"}, svc.Scenarios())
 	})
 }
 
@@ -0,0 +1,87 @@
+package grpcx
+
+import (
+	"sort"
+	"sync"
+
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/resolver"
+)
+
+// WeightedBalancer is the name of the balancing policy, which picks
+// the ready addresses in the smooth weighted round-robin order.
+// Weights of the addresses are set with WithWeight.
+const WeightedBalancer = "groxy_weighted_round_robin"
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(WeightedBalancer, weightedPickerBuilder{}, base.Config{HealthCheck: true}))
+}
+
+type weightKey struct{}
+
+// WithWeight sets the weight of the address for the weighted balancer.
+func WithWeight(addr resolver.Address, weight int) resolver.Address {
+	addr.BalancerAttributes = addr.BalancerAttributes.WithValue(weightKey{}, weight)
+	return addr
+}
+
+// weightOf returns the weight of the address, 1 by default.
+func weightOf(addr resolver.Address) int {
+	if w, ok := addr.BalancerAttributes.Value(weightKey{}).(int); ok && w > 0 {
+		return w
+	}
+	return 1
+}
+
+type weightedPickerBuilder struct{}
+
+// Build makes the picker of the ready addresses, ordered by the address,
+// so that the order of the picks doesn't depend on the order of the connection.
+func (weightedPickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	if len(info.ReadySCs) == 0 {
+		return base.NewErrPicker(balancer.ErrNoSubConnAvailable)
+	}
+
+	p := &weightedPicker{}
+	for sc, sci := range info.ReadySCs {
+		p.conns = append(p.conns, &weightedConn{sc: sc, addr: sci.Address.Addr, weight: weightOf(sci.Address)})
+	}
+	sort.Slice(p.conns, func(i, j int) bool { return p.conns[i].addr < p.conns[j].addr })
+
+	return p
+}
+
+// weightedPicker picks the connections in the smooth weighted round-robin
+// order, which interleaves the connections instead of picking the heaviest
+// one several times in a row.
+type weightedPicker struct {
+	mu    sync.Mutex
+	conns []*weightedConn
+}
+
+type weightedConn struct {
+	sc      balancer.SubConn
+	addr    string
+	weight  int
+	current int
+}
+
+// Pick picks the connection with the highest current weight.
+func (p *weightedPicker) Pick(balancer.PickInfo) (balancer.PickResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	total := 0
+	var best *weightedConn
+	for _, c := range p.conns {
+		c.current += c.weight
+		total += c.weight
+		if best == nil || c.current > best.current {
+			best = c
+		}
+	}
+
+	best.current -= total
+	return balancer.PickResult{SubConn: best.sc}, nil
+}
@@ -0,0 +1,82 @@
+package grpcx
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
+)
+
+func TestWeightedBalancer(t *testing.T) {
+	var addrs []resolver.Address
+	for idx, weight := range []int{3, 1} {
+		srv := grpc.NewServer()
+		grpctest.RegisterExampleServiceServer(srv, &grpctest.Server{
+			UnaryFunc: func(context.Context, *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+				return &grpctest.StreamResponse{Value: fmt.Sprintf("backend %d", idx)}, nil
+			},
+		})
+		addrs = append(addrs, WithWeight(resolver.Address{Addr: grpctest.StartServer(t, srv)}, weight))
+		t.Cleanup(srv.Stop)
+	}
+
+	r := manual.NewBuilderWithScheme("test")
+	r.InitialState(resolver.State{Addresses: addrs})
+
+	cc, err := grpc.NewClient("test:///backends",
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithResolvers(r),
+		grpc.WithDefaultServiceConfig(fmt.Sprintf(`{"loadBalancingConfig": [{%q: {}}]}`, WeightedBalancer)),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	cl := grpctest.NewExampleServiceClient(cc)
+	call := func() string {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{})
+		require.NoError(t, err)
+		return resp.Value
+	}
+
+	// wait for both backends to get connected
+	seen := map[string]bool{}
+	for i := 0; len(seen) < 2 && i < 100; i++ {
+		seen[call()] = true
+	}
+	require.Len(t, seen, 2)
+
+	counts := map[string]int{}
+	for range 8 {
+		counts[call()]++
+	}
+	assert.Equal(t, map[string]int{"backend 0": 6, "backend 1": 2}, counts)
+}
+
+func TestWeightedPicker(t *testing.T) {
+	p := &weightedPicker{conns: []*weightedConn{
+		{sc: &namedSubConn{name: "a"}, weight: 5},
+		{sc: &namedSubConn{name: "b"}, weight: 1},
+		{sc: &namedSubConn{name: "c"}, weight: 1},
+	}}
+
+	var picked string
+	for range 7 {
+		res, err := p.Pick(balancer.PickInfo{})
+		require.NoError(t, err)
+		picked += res.SubConn.(*namedSubConn).name
+	}
+	assert.Equal(t, "aabacaa", picked)
+}
+
+type namedSubConn struct {
+	balancer.SubConn
+	name string
+}
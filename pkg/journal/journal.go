@@ -0,0 +1,229 @@
+// Package journal provides a bounded in-memory journal of the requests,
+// handled by the proxy, to be queried and verified in tests.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/metadata"
+)
+
+// Entry is a single request, recorded in the journal.
+type Entry struct {
+	ID       uint64        `json:"id"`
+	Time     time.Time     `json:"time"`
+	Duration time.Duration `json:"duration"`
+	Method   string        `json:"method"`
+	Header   metadata.MD   `json:"header,omitempty"`
+	Rule     string        `json:"rule,omitempty"` // name of the matched rule, empty if not matched
+	Messages []Message     `json:"messages,omitempty"`
+	Status   Status        `json:"status"`
+
+	// Truncated is set if the request had more messages than an entry keeps.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// Message is a single message, received from the client.
+type Message struct {
+	// Body is the message, decoded to JSON by the descriptor of the matched rule.
+	Body json.RawMessage `json:"body,omitempty"`
+	// Raw is the message as received, set only if it couldn't be decoded.
+	Raw []byte `json:"raw,omitempty"`
+}
+
+// Status is the gRPC status, returned to the client.
+type Status struct {
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// Journal is a bounded journal of requests.
+// Once the journal is full, the oldest entries are evicted.
+type Journal struct {
+	size int
+
+	mu      sync.RWMutex
+	entries []Entry // ring buffer
+	head    int     // index of the oldest entry
+	seq     uint64
+}
+
+// New makes a new journal, which keeps at most size entries.
+func New(size int) *Journal {
+	return &Journal{size: size, entries: make([]Entry, 0, size)}
+}
+
+// Add records the entry in the journal and returns its ID.
+func (j *Journal) Add(e Entry) uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.seq++
+	e.ID = j.seq
+
+	if j.size <= 0 {
+		return e.ID
+	}
+
+	if len(j.entries) < j.size {
+		j.entries = append(j.entries, e)
+		return e.ID
+	}
+
+	j.entries[j.head] = e
+	j.head = (j.head + 1) % j.size
+	return e.ID
+}
+
+// List returns the entries that match the filter, from the oldest to the newest.
+func (j *Journal) List(f Filter) []Entry {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	res := []Entry{}
+	for i := range j.entries {
+		e := j.entries[(j.head+i)%len(j.entries)]
+		if f.Matches(e) {
+			res = append(res, e)
+		}
+	}
+
+	return res
+}
+
+// Count returns the number of entries that match the filter.
+func (j *Journal) Count(f Filter) int { return len(j.List(f)) }
+
+// Clear removes all entries from the journal.
+func (j *Journal) Clear() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.entries = j.entries[:0]
+	j.head = 0
+}
+
+// Filter selects the entries of the journal.
+// Zero value matches any entry.
+type Filter struct {
+	// Method is a regular expression to match the method against.
+	Method string `json:"method,omitempty" yaml:"method,omitempty"`
+	// Header is a map of regular expressions to match the header values against.
+	Header map[string]string `json:"header,omitempty" yaml:"header,omitempty"`
+	// Rule is the name of the matched rule.
+	Rule string `json:"rule,omitempty" yaml:"rule,omitempty"`
+	// Body is an object, which must be a subset of any message of the entry,
+	// encoded to JSON.
+	Body any `json:"body,omitempty" yaml:"body,omitempty"`
+
+	method *regexp.Regexp
+	header map[string]*regexp.Regexp
+	body   any
+}
+
+// Compile validates the filter and prepares it for matching.
+func (f *Filter) Compile() (err error) {
+	if f.Method != "" {
+		if f.method, err = regexp.Compile(f.Method); err != nil {
+			return fmt.Errorf("compile method regexp: %w", err)
+		}
+	}
+
+	f.header = make(map[string]*regexp.Regexp, len(f.Header))
+	for k, v := range f.Header {
+		if f.header[strings.ToLower(k)], err = regexp.Compile(v); err != nil {
+			return fmt.Errorf("compile header %q regexp: %w", k, err)
+		}
+	}
+
+	if f.Body != nil {
+		// normalize the body to the same types as the decoded messages
+		bts, err := json.Marshal(f.Body)
+		if err != nil {
+			return fmt.Errorf("marshal body: %w", err)
+		}
+		if err = json.Unmarshal(bts, &f.body); err != nil {
+			return fmt.Errorf("unmarshal body: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// Matches returns true if the entry matches the filter.
+// The filter must be compiled first.
+func (f Filter) Matches(e Entry) bool {
+	if f.method != nil && !f.method.MatchString(e.Method) {
+		return false
+	}
+
+	if f.Rule != "" && f.Rule != e.Rule {
+		return false
+	}
+
+	for k, re := range f.header {
+		vals := e.Header.Get(k)
+		if len(vals) == 0 || !re.MatchString(strings.Join(vals, ",")) {
+			return false
+		}
+	}
+
+	if f.body == nil {
+		return true
+	}
+
+	for _, msg := range e.Messages {
+		if len(msg.Body) == 0 {
+			continue
+		}
+
+		var got any
+		if err := json.Unmarshal(msg.Body, &got); err != nil {
+			continue
+		}
+
+		if subset(f.body, got) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// subset returns true if want is a subset of got: every field of want
+// objects is present in got objects and matches recursively, arrays are
+// of the same length and match element-wise, and other values are equal.
+func subset(want, got any) bool {
+	switch want := want.(type) {
+	case map[string]any:
+		got, ok := got.(map[string]any)
+		if !ok {
+			return false
+		}
+		for k, v := range want {
+			gv, ok := got[k]
+			if !ok || !subset(v, gv) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		got, ok := got.([]any)
+		if !ok || len(got) != len(want) {
+			return false
+		}
+		for i := range want {
+			if !subset(want[i], got[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return want == got
+	}
+}
@@ -0,0 +1,70 @@
+package journal
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestJournal_Add(t *testing.T) {
+	j := New(2)
+	for _, mtd := range []string{"/first", "/second", "/third"} {
+		j.Add(Entry{Method: mtd})
+	}
+
+	entries := j.List(Filter{})
+	require.Len(t, entries, 2)
+	assert.Equal(t, Entry{ID: 2, Method: "/second"}, entries[0])
+	assert.Equal(t, Entry{ID: 3, Method: "/third"}, entries[1])
+
+	j.Clear()
+	assert.Empty(t, j.List(Filter{}))
+
+	assert.Equal(t, uint64(4), j.Add(Entry{Method: "/fourth"}))
+	assert.Equal(t, 1, j.Count(Filter{}))
+}
+
+func TestFilter_Matches(t *testing.T) {
+	entry := Entry{
+		Method: "/example.Service/Create",
+		Header: metadata.Pairs("x-request-id", "42"),
+		Rule:   "create",
+		Messages: []Message{
+			{Raw: []byte("unknown")},
+			{Body: json.RawMessage(`{"name": "first", "tags": ["a", "b"], "owner": {"id": "1", "name": "john"}}`)},
+		},
+	}
+
+	tests := []struct {
+		name   string
+		filter Filter
+		want   bool
+	}{
+		{name: "empty", filter: Filter{}, want: true},
+		{name: "method", filter: Filter{Method: "Create$"}, want: true},
+		{name: "method mismatch", filter: Filter{Method: "Delete$"}, want: false},
+		{name: "header", filter: Filter{Header: map[string]string{"X-Request-ID": "^42$"}}, want: true},
+		{name: "missing header", filter: Filter{Header: map[string]string{"x-user-id": ".*"}}, want: false},
+		{name: "rule", filter: Filter{Rule: "create"}, want: true},
+		{name: "rule mismatch", filter: Filter{Rule: "delete"}, want: false},
+		{name: "body subset", filter: Filter{Body: map[string]any{"owner": map[string]any{"id": "1"}}}, want: true},
+		{name: "body array", filter: Filter{Body: map[string]any{"tags": []any{"a", "b"}}}, want: true},
+		{name: "body array mismatch", filter: Filter{Body: map[string]any{"tags": []any{"a"}}}, want: false},
+		{name: "body mismatch", filter: Filter{Body: map[string]any{"name": "second"}}, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, tt.filter.Compile())
+			assert.Equal(t, tt.want, tt.filter.Matches(entry))
+		})
+	}
+
+	t.Run("invalid regexp", func(t *testing.T) {
+		f := Filter{Method: "("}
+		assert.ErrorContains(t, f.Compile(), "compile method regexp")
+	})
+}
@@ -0,0 +1,245 @@
+// Package metrics provides Prometheus metrics of the handled requests,
+// upstream connections and configuration reloads.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/cappuccinotm/slogx"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+)
+
+// Actions, taken by the proxy on the request.
+const (
+	ActionMock      = "mock"      // the request is replied by the mock
+	ActionForward   = "forward"   // the request is forwarded to the upstream
+	ActionUnmatched = "unmatched" // the request didn't match any rule
+)
+
+// MethodUnknown is the method of the requests, which didn't match any rule,
+// as clients may call arbitrary methods, each of them would make a new series.
+const MethodUnknown = "unknown"
+
+// Directions of the messages.
+const (
+	DirectionReceived = "received" // the message is received from the client
+	DirectionSent     = "sent"     // the message is sent to the client
+)
+
+// Results of the comparison of the responses.
+const (
+	ResultMatch    = "match"     // the responses are the same
+	ResultMismatch = "mismatch"  // the responses differ
+	ResultError    = "error"     // the request couldn't be made
+	ResultTooLarge = "too_large" // the responses are too large to be compared
+)
+
+// Request describes the handled request.
+type Request struct {
+	Method   string
+	Rule     string // name of the matched rule, if any
+	Action   string
+	Code     codes.Code
+	Duration time.Duration
+}
+
+// Message describes a single message of the handled request.
+type Message struct {
+	Method    string
+	Rule      string
+	Action    string
+	Direction string
+	Size      int
+}
+
+// Mirror describes the mirrored request.
+type Mirror struct {
+	Method   string
+	Rule     string
+	Upstream string // name of the shadow upstream
+	Result   string
+}
+
+// Compare describes the request, handled both by the mock and the upstream.
+type Compare struct {
+	Method string
+	Rule   string
+	Result string
+}
+
+// Metrics collects the metrics and serves them over HTTP.
+type Metrics struct {
+	registry *prometheus.Registry
+	http     *http.Server
+
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+	reloads  *prometheus.CounterVec
+	mirrors  *prometheus.CounterVec
+	compares *prometheus.CounterVec
+}
+
+// New creates the metrics. Upstreams, if set, reports the upstream
+// connections, which states are collected on every scrape.
+func New(upstreams func() []discovery.Upstream) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "groxy_requests_total",
+			Help: "Number of handled requests.",
+		}, []string{"method", "rule", "action", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "groxy_request_duration_seconds",
+			Help:    "Duration of handled requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"method", "rule", "action", "code"}),
+		size: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "groxy_message_size_bytes",
+			Help:    "Size of the messages, received from and sent to the clients.",
+			Buckets: prometheus.ExponentialBuckets(64, 4, 10), // 64B to 16MB
+		}, []string{"method", "rule", "action", "direction"}),
+		reloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "groxy_config_reloads_total",
+			Help: "Number of configuration reloads by their result.",
+		}, []string{"result"}),
+		mirrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "groxy_mirrored_requests_total",
+			Help: "Number of mirrored requests by the result of the comparison of the responses.",
+		}, []string{"method", "rule", "upstream", "result"}),
+		compares: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "groxy_compared_requests_total",
+			Help: "Number of requests, handled both by the mock and the upstream, by the result of the comparison of the responses.",
+		}, []string{"method", "rule", "result"}),
+	}
+
+	m.registry.MustRegister(
+		m.requests, m.duration, m.size, m.reloads, m.mirrors, m.compares,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	if upstreams != nil {
+		m.registry.MustRegister(upstreamCollector(upstreams))
+	}
+
+	// expose the reload results from the start
+	m.reloads.WithLabelValues("success")
+	m.reloads.WithLabelValues("failure")
+
+	m.http = &http.Server{
+		Handler:           m.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+
+	return m
+}
+
+// ObserveRequest records the handled request.
+func (m *Metrics) ObserveRequest(r Request) {
+	code := r.Code.String()
+	m.requests.WithLabelValues(r.Method, r.Rule, r.Action, code).Inc()
+	m.duration.WithLabelValues(r.Method, r.Rule, r.Action, code).Observe(r.Duration.Seconds())
+}
+
+// ObserveMessage records the size of the message.
+func (m *Metrics) ObserveMessage(msg Message) {
+	m.size.WithLabelValues(msg.Method, msg.Rule, msg.Action, msg.Direction).Observe(float64(msg.Size))
+}
+
+// ObserveMirror records the result of the mirrored request.
+func (m *Metrics) ObserveMirror(r Mirror) {
+	m.mirrors.WithLabelValues(r.Method, r.Rule, r.Upstream, r.Result).Inc()
+}
+
+// ObserveCompare records the result of the comparison of the mock with the upstream.
+func (m *Metrics) ObserveCompare(r Compare) {
+	m.compares.WithLabelValues(r.Method, r.Rule, r.Result).Inc()
+}
+
+// ObserveReload records the result of the configuration reload.
+func (m *Metrics) ObserveReload(err error) {
+	if err != nil {
+		m.reloads.WithLabelValues("failure").Inc()
+		return
+	}
+	m.reloads.WithLabelValues("success").Inc()
+}
+
+// Handler returns the HTTP handler, serving the metrics in the Prometheus format.
+func (m *Metrics) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	return mux
+}
+
+// Listen serves the metrics on the given address.
+// Blocking call.
+func (m *Metrics) Listen(addr string) (err error) {
+	slog.Info("starting metrics server", slog.String("addr", addr))
+	defer slog.Warn("metrics server stopped", slogx.Error(err))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("register listener: %w", err)
+	}
+
+	if err = m.http.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("serve: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the metrics server.
+func (m *Metrics) Close(ctx context.Context) error { return m.http.Shutdown(ctx) }
+
+// upstreamCollector reports the connectivity states of the upstreams.
+type upstreamCollector func() []discovery.Upstream
+
+var upstreamStateDesc = prometheus.NewDesc(
+	"groxy_upstream_state",
+	"Connectivity state of the upstream connection, 1 for the current state.",
+	[]string{"upstream", "target", "state"}, nil,
+)
+
+// states are the reported connectivity states.
+var states = []connectivity.State{
+	connectivity.Idle,
+	connectivity.Connecting,
+	connectivity.Ready,
+	connectivity.TransientFailure,
+	connectivity.Shutdown,
+}
+
+func (c upstreamCollector) Describe(ch chan<- *prometheus.Desc) { ch <- upstreamStateDesc }
+
+func (c upstreamCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, up := range c() {
+		conn, ok := up.(interface{ GetState() connectivity.State })
+		if !ok {
+			continue
+		}
+
+		current := conn.GetState()
+		for _, st := range states {
+			value := 0.0
+			if st == current {
+				value = 1
+			}
+			ch <- prometheus.MustNewConstMetric(upstreamStateDesc, prometheus.GaugeValue, value,
+				up.Name(), up.Target(), st.String())
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestMetrics(t *testing.T) {
+	cc, err := grpc.NewClient("localhost:1", grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+
+	m := New(func() []discovery.Upstream {
+		return []discovery.Upstream{discovery.ClientConn{ConnName: "backend", ClientConn: cc}}
+	})
+
+	m.ObserveRequest(Request{
+		Method:   "/pkg.Service/Method",
+		Rule:     "rule",
+		Action:   ActionMock,
+		Code:     codes.OK,
+		Duration: 10 * time.Millisecond,
+	})
+	msg := Message{Method: "/pkg.Service/Method", Rule: "rule", Action: ActionMock, Direction: DirectionReceived, Size: 100}
+	m.ObserveMessage(msg)
+	msg.Direction, msg.Size = DirectionSent, 10
+	m.ObserveMessage(msg)
+	msg.Size = 20
+	m.ObserveMessage(msg)
+	m.ObserveReload(nil)
+	m.ObserveMirror(Mirror{Method: "/pkg.Service/Method", Rule: "rule", Upstream: "shadow", Result: ResultMismatch})
+	m.ObserveCompare(Compare{Method: "/pkg.Service/Method", Rule: "rule", Result: ResultMatch})
+	m.ObserveReload(errors.New("failed"))
+	m.ObserveReload(errors.New("failed"))
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+	require.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+
+	labels := `action="mock",code="OK",method="/pkg.Service/Method",rule="rule"`
+	assert.Contains(t, body, `groxy_requests_total{`+labels+`} 1`)
+	assert.Contains(t, body, `groxy_request_duration_seconds_sum{`+labels+`} 0.01`)
+	assert.Contains(t, body, `groxy_message_size_bytes_sum{action="mock",direction="received",method="/pkg.Service/Method",rule="rule"} 100`)
+	assert.Contains(t, body, `groxy_message_size_bytes_count{action="mock",direction="sent",method="/pkg.Service/Method",rule="rule"} 2`)
+	assert.Contains(t, body, `groxy_config_reloads_total{result="success"} 1`)
+	assert.Contains(t, body, `groxy_mirrored_requests_total{method="/pkg.Service/Method",result="mismatch",rule="rule",upstream="shadow"} 1`)
+	assert.Contains(t, body, `groxy_compared_requests_total{method="/pkg.Service/Method",result="match",rule="rule"} 1`)
+	assert.Contains(t, body, `groxy_config_reloads_total{result="failure"} 2`)
+	assert.Contains(t, body, `groxy_upstream_state{state="IDLE",target="localhost:1",upstream="backend"} 1`)
+	assert.Contains(t, body, `groxy_upstream_state{state="READY",target="localhost:1",upstream="backend"} 0`)
+	assert.Contains(t, body, `go_goroutines`)
+}
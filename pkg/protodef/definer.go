@@ -37,6 +37,8 @@ var defaultFuncs = sprig.FuncMap()
 type Definer struct {
 	loadFromOS bool
 	funcs      template.FuncMap
+	files      map[string]*desc.FileDescriptor // by path, including imports
+	resolver   Resolver
 }
 
 // NewDefiner returns a new Definer with the given options applied.
@@ -187,10 +189,13 @@ func (b *Definer) parseDefinition(def string) (*desc.FileDescriptor, error) {
 			}
 		},
 		LookupImport: func(s string) (*desc.FileDescriptor, error) {
-			if s != "groxypb/annotations.proto" {
-				return nil, fmt.Errorf("imports in snippets are not supported: %s", s)
+			if s == "groxypb/annotations.proto" {
+				return desc.WrapFile(groxypb.File_groxypb_annotations_proto)
 			}
-			return desc.WrapFile(groxypb.File_groxypb_annotations_proto)
+			if fd, ok := b.files[s]; ok {
+				return fd, nil
+			}
+			return nil, fmt.Errorf("unknown import %s, only groxypb and provided proto files can be imported", s)
 		},
 	}
 
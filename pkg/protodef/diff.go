@@ -0,0 +1,132 @@
+package protodef
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Diff returns the differences between the messages of the same type,
+// one per field, in the form "path: a != b". The path consists of the names
+// of the fields, separated by dots, with the indices of the list elements and
+// the keys of the map entries in brackets. Unknown fields are compared as bytes.
+func Diff(a, b protoreflect.Message) []string {
+	var res []string
+	diffMessage(&res, "", a, b)
+	return res
+}
+
+func diffMessage(res *[]string, path string, a, b protoreflect.Message) {
+	fields := a.Descriptor().Fields()
+	for i := range fields.Len() {
+		fd := fields.Get(i)
+		p := string(fd.Name())
+		if path != "" {
+			p = path + "." + p
+		}
+
+		switch {
+		case fd.IsList():
+			diffList(res, p, fd, a.Get(fd).List(), b.Get(fd).List())
+		case fd.IsMap():
+			diffMap(res, p, fd, a.Get(fd).Map(), b.Get(fd).Map())
+		case fd.Message() != nil:
+			switch ha, hb := a.Has(fd), b.Has(fd); {
+			case ha && hb:
+				diffMessage(res, p, a.Get(fd).Message(), b.Get(fd).Message())
+			case ha != hb:
+				*res = append(*res, fmt.Sprintf("%s: %s != %s", p, presence(ha), presence(hb)))
+			}
+		default:
+			va, vb := a.Get(fd), b.Get(fd)
+			switch ha, hb := a.Has(fd), b.Has(fd); {
+			case !va.Equal(vb):
+				*res = append(*res, fmt.Sprintf("%s: %s != %s", p, formatValue(fd, va), formatValue(fd, vb)))
+			case fd.HasPresence() && ha != hb:
+				*res = append(*res, fmt.Sprintf("%s: %s != %s", p, presence(ha), presence(hb)))
+			}
+		}
+	}
+
+	if !bytes.Equal(a.GetUnknown(), b.GetUnknown()) {
+		msg := "unknown fields differ"
+		if path != "" {
+			msg = path + ": " + msg
+		}
+		*res = append(*res, msg)
+	}
+}
+
+func diffList(res *[]string, path string, fd protoreflect.FieldDescriptor, a, b protoreflect.List) {
+	for i := range max(a.Len(), b.Len()) {
+		p := fmt.Sprintf("%s[%d]", path, i)
+		switch {
+		case i >= a.Len():
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, presence(false), formatValue(fd, b.Get(i))))
+		case i >= b.Len():
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, formatValue(fd, a.Get(i)), presence(false)))
+		case fd.Message() != nil:
+			diffMessage(res, p, a.Get(i).Message(), b.Get(i).Message())
+		case !a.Get(i).Equal(b.Get(i)):
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, formatValue(fd, a.Get(i)), formatValue(fd, b.Get(i))))
+		}
+	}
+}
+
+func diffMap(res *[]string, path string, fd protoreflect.FieldDescriptor, a, b protoreflect.Map) {
+	var keys []protoreflect.MapKey
+	collect := func(k protoreflect.MapKey, _ protoreflect.Value) bool {
+		if !slices.ContainsFunc(keys, func(key protoreflect.MapKey) bool { return key.Value().Equal(k.Value()) }) {
+			keys = append(keys, k)
+		}
+		return true
+	}
+	a.Range(collect)
+	b.Range(collect)
+	slices.SortFunc(keys, func(x, y protoreflect.MapKey) int { return strings.Compare(x.String(), y.String()) })
+
+	vd := fd.MapValue()
+	for _, k := range keys {
+		p := fmt.Sprintf("%s[%s]", path, k.String())
+		switch {
+		case !a.Has(k):
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, presence(false), formatValue(vd, b.Get(k))))
+		case !b.Has(k):
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, formatValue(vd, a.Get(k)), presence(false)))
+		case vd.Message() != nil:
+			diffMessage(res, p, a.Get(k).Message(), b.Get(k).Message())
+		case !a.Get(k).Equal(b.Get(k)):
+			*res = append(*res, fmt.Sprintf("%s: %s != %s", p, formatValue(vd, a.Get(k)), formatValue(vd, b.Get(k))))
+		}
+	}
+}
+
+// formatValue formats the value of the field, or the element of
+// the list or the map, for the diff.
+func formatValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) string {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return fmt.Sprintf("%q", v.String())
+	case protoreflect.BytesKind:
+		return fmt.Sprintf("%q", v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return fmt.Sprintf("%d", v.Enum())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return presence(true)
+	default:
+		return v.String()
+	}
+}
+
+func presence(ok bool) string {
+	if ok {
+		return "<set>"
+	}
+	return "<unset>"
+}
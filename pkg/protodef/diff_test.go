@@ -0,0 +1,65 @@
+package protodef
+
+import (
+	"testing"
+
+	"github.com/Semior001/groxy/pkg/protodef/testdata"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestDiff(t *testing.T) {
+	a := &testdata.Response{
+		Value:  "hello",
+		Enum:   testdata.Enum_STUB_ENUM_FIRST,
+		Nested: &testdata.Nested{NestedValue: "a"},
+		Nesteds: []*testdata.Nested{
+			{NestedValue: "same"},
+			{NestedValue: "first"},
+		},
+		NestedMap: map[string]*testdata.Nested{
+			"both":   {Enum: testdata.Enum_STUB_ENUM_FIRST},
+			"only-a": {},
+		},
+	}
+	b := &testdata.Response{
+		Value:  "bye",
+		Enum:   testdata.Enum_STUB_ENUM_SECOND,
+		Nested: &testdata.Nested{NestedValue: "b"},
+		Nesteds: []*testdata.Nested{
+			{NestedValue: "same"},
+			{NestedValue: "second"},
+			{NestedValue: "extra"},
+		},
+		NestedMap: map[string]*testdata.Nested{
+			"both":   {Enum: testdata.Enum_STUB_ENUM_SECOND},
+			"only-b": {},
+		},
+	}
+
+	assert.Equal(t, []string{
+		`nested.nested_value: "a" != "b"`,
+		`enum: STUB_ENUM_FIRST != STUB_ENUM_SECOND`,
+		`nesteds[1].nested_value: "first" != "second"`,
+		`nesteds[2]: <unset> != <set>`,
+		`nested_map[both].enum: STUB_ENUM_FIRST != STUB_ENUM_SECOND`,
+		`nested_map[only-a]: <set> != <unset>`,
+		`nested_map[only-b]: <unset> != <set>`,
+		`value: "hello" != "bye"`,
+	}, Diff(a.ProtoReflect(), b.ProtoReflect()))
+
+	t.Run("same", func(t *testing.T) {
+		assert.Empty(t, Diff(a.ProtoReflect(), a.ProtoReflect()))
+	})
+
+	t.Run("presence of the message", func(t *testing.T) {
+		assert.Equal(t, []string{"nested: <set> != <unset>"},
+			Diff((&testdata.Response{Nested: &testdata.Nested{}}).ProtoReflect(), (&testdata.Response{}).ProtoReflect()))
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		withUnknown := &testdata.Response{}
+		withUnknown.ProtoReflect().SetUnknown(protowire.AppendTag(nil, 100, protowire.VarintType))
+		assert.Equal(t, []string{"unknown fields differ"}, Diff(withUnknown.ProtoReflect(), (&testdata.Response{}).ProtoReflect()))
+	})
+}
@@ -0,0 +1,97 @@
+package protodef
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// googleAPIFiles are the files with the google.api.http annotations,
+// importable even if they're absent in the import paths.
+var googleAPIFiles = map[string]protoreflect.FileDescriptor{
+	"google/api/annotations.proto": annotations.File_google_api_annotations_proto,
+	"google/api/http.proto":        annotations.File_google_api_http_proto,
+}
+
+// ParseFiles parses the .proto files, looking them and their imports up
+// in the import paths. If no import paths are provided, files are looked
+// up relative to the current working directory.
+func ParseFiles(importPaths []string, files ...string) ([]*desc.FileDescriptor, error) {
+	p := protoparse.Parser{
+		ImportPaths: importPaths,
+		LookupImport: func(name string) (*desc.FileDescriptor, error) {
+			if fd, ok := googleAPIFiles[name]; ok {
+				return desc.WrapFile(fd)
+			}
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		},
+	}
+
+	fds, err := p.ParseFiles(files...)
+	if err != nil {
+		return nil, fmt.Errorf("parse proto files: %w", err)
+	}
+
+	return fds, nil
+}
+
+// LoadDescriptorSets reads the files with serialized FileDescriptorSet
+// messages, e.g. produced by "protoc --descriptor_set_out --include_imports",
+// and returns the descriptors of all files in them.
+func LoadDescriptorSets(files ...string) ([]*desc.FileDescriptor, error) {
+	var res []*desc.FileDescriptor
+	for _, f := range files {
+		bts, err := os.ReadFile(f) //nolint:gosec // this is on user's behalf
+		if err != nil {
+			return nil, fmt.Errorf("read descriptor set %q: %w", f, err)
+		}
+
+		set := &descriptorpb.FileDescriptorSet{}
+		if err = proto.Unmarshal(bts, set); err != nil {
+			return nil, fmt.Errorf("unmarshal descriptor set %q: %w", f, err)
+		}
+
+		fds, err := desc.CreateFileDescriptorsFromSet(set)
+		if err != nil {
+			return nil, fmt.Errorf("build descriptors from set %q: %w", f, err)
+		}
+
+		for _, fd := range fds {
+			res = append(res, fd)
+		}
+	}
+
+	return res, nil
+}
+
+// WithFiles makes the descriptors available to the definer: snippets
+// may import the files by their paths, and messages may be built by
+// the full names of the types, declared in the files or their imports.
+func WithFiles(fds ...*desc.FileDescriptor) Option {
+	return func(d *Definer) {
+		if d.files == nil {
+			d.files = map[string]*desc.FileDescriptor{}
+		}
+
+		var add func(fd *desc.FileDescriptor)
+		add = func(fd *desc.FileDescriptor) {
+			if _, ok := d.files[fd.GetName()]; ok {
+				return
+			}
+			d.files[fd.GetName()] = fd
+			for _, dep := range fd.GetDependencies() {
+				add(dep)
+			}
+		}
+
+		for _, fd := range fds {
+			add(fd)
+		}
+	}
+}
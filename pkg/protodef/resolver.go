@@ -0,0 +1,189 @@
+package protodef
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/cappuccinotm/slogx"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Resolver looks up the message descriptors by their full names.
+type Resolver interface {
+	FindMessage(ctx context.Context, name string) (*desc.MessageDescriptor, error)
+}
+
+// WithResolver sets the definer to resolve the message types, which are
+// not declared in the provided files, with the resolver.
+func WithResolver(r Resolver) Option { return func(d *Definer) { d.resolver = r } }
+
+// ReflectionResolver resolves the message types via gRPC reflection
+// services of the connections, in the order of the connections.
+// Resolved descriptors are cached for the lifetime of the resolver.
+type ReflectionResolver struct {
+	conns []grpc.ClientConnInterface
+
+	mu    sync.Mutex
+	cache map[string]*desc.MessageDescriptor
+}
+
+// NewReflectionResolver makes a new resolver over the given connections.
+func NewReflectionResolver(conns ...grpc.ClientConnInterface) *ReflectionResolver {
+	return &ReflectionResolver{conns: conns, cache: map[string]*desc.MessageDescriptor{}}
+}
+
+// FindMessage returns the descriptor of the message with the given full name
+// from the first connection that knows about it.
+// The lock is not held while querying the connections, so concurrent
+// lookups of the same type may resolve it more than once.
+func (r *ReflectionResolver) FindMessage(ctx context.Context, name string) (*desc.MessageDescriptor, error) {
+	r.mu.Lock()
+	md, ok := r.cache[name]
+	r.mu.Unlock()
+	if ok {
+		return md, nil
+	}
+
+	var errs []error
+	for _, cc := range r.conns {
+		md, err := r.resolve(ctx, cc, name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		r.mu.Lock()
+		r.cache[name] = md
+		r.mu.Unlock()
+		return md, nil
+	}
+
+	return nil, fmt.Errorf("resolve message type %q: %w", name, errors.Join(errs...))
+}
+
+func (r *ReflectionResolver) resolve(ctx context.Context, cc grpc.ClientConnInterface, name string) (*desc.MessageDescriptor, error) {
+	client := grpcreflect.NewClientAuto(ctx, cc)
+	defer client.Reset()
+
+	md, err := client.ResolveMessage(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+const (
+	// descriptorTimeout limits the resolution of the type, requested via
+	// Descriptor, as the callers use it outside the request handling.
+	descriptorTimeout = 5 * time.Second
+	// descriptorBackoff is the time, during which Descriptor doesn't
+	// try to resolve the type again after the failed attempt.
+	descriptorBackoff = 30 * time.Second
+)
+
+// lazy is a template of the message, which type is resolved
+// on the first use and is cached afterwards.
+type lazy struct {
+	definer *Definer
+	name    string
+	value   string
+
+	mu      sync.Mutex
+	tmpl    Template
+	retryAt time.Time // the time, before which Descriptor doesn't resolve the type
+}
+
+func (l *lazy) resolve(ctx context.Context) (Template, error) {
+	l.mu.Lock()
+	tmpl := l.tmpl
+	l.mu.Unlock()
+	if tmpl != nil {
+		return tmpl, nil
+	}
+
+	// the type is resolved without the lock, so that the requests
+	// are not blocked by the one that waits for the upstream
+	md, err := l.definer.resolver.FindMessage(ctx, l.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if tmpl, err = l.definer.buildTyped(md, l.value); err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.tmpl == nil { // keep the template, built by a concurrent request
+		l.tmpl = tmpl
+	}
+
+	return l.tmpl, nil
+}
+
+// DataMap resolves the type and extracts all known fields from the provided byte sequence.
+func (l *lazy) DataMap(ctx context.Context, bts []byte) (map[string]any, error) {
+	tmpl, err := l.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.DataMap(ctx, bts)
+}
+
+// Matches resolves the type and checks if the provided message matches the template.
+func (l *lazy) Matches(ctx context.Context, bts []byte) (bool, error) {
+	tmpl, err := l.resolve(ctx)
+	if err != nil {
+		return false, err
+	}
+	return tmpl.Matches(ctx, bts)
+}
+
+// Generate resolves the type and builds a new message out of the template.
+func (l *lazy) Generate(ctx context.Context, data map[string]any) (proto.Message, error) {
+	tmpl, err := l.resolve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return tmpl.Generate(ctx, data)
+}
+
+// Descriptor resolves the type and returns the descriptor of the message,
+// or nil, if the type can't be resolved. After the failure, the type
+// is not resolved again until the backoff passes.
+func (l *lazy) Descriptor(ctx context.Context) protoreflect.MessageDescriptor {
+	l.mu.Lock()
+	tmpl, retryAt := l.tmpl, l.retryAt
+	l.mu.Unlock()
+	if tmpl != nil {
+		return tmpl.Descriptor(ctx)
+	}
+	if time.Now().Before(retryAt) {
+		return nil
+	}
+
+	rctx, cancel := context.WithTimeout(ctx, descriptorTimeout)
+	defer cancel()
+
+	tmpl, err := l.resolve(rctx)
+	if err != nil {
+		// the type is not at fault, if the caller has gone away
+		if ctx.Err() == nil {
+			l.mu.Lock()
+			l.retryAt = time.Now().Add(descriptorBackoff)
+			l.mu.Unlock()
+		}
+		slog.WarnContext(ctx, "failed to resolve message type", slog.String("type", l.name), slogx.Error(err))
+		return nil
+	}
+	return tmpl.Descriptor(ctx)
+}
@@ -0,0 +1,137 @@
+package protodef
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/jhump/protoreflect/desc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/reflection"
+)
+
+func TestReflectionResolver(t *testing.T) {
+	srv := grpc.NewServer()
+	grpctest.RegisterExampleServiceServer(srv, &grpctest.Server{})
+	reflection.Register(srv)
+	addr := grpctest.StartServer(t, srv)
+	t.Cleanup(srv.Stop)
+
+	cc, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cc.Close() })
+
+	noReflection := grpc.NewServer()
+	noReflectionAddr := grpctest.StartServer(t, noReflection)
+	t.Cleanup(noReflection.Stop)
+
+	noReflectionCC, err := grpc.NewClient(noReflectionAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = noReflectionCC.Close() })
+
+	d := NewDefiner(WithResolver(NewReflectionResolver(noReflectionCC, cc)))
+	ctx := context.Background()
+
+	t.Run("resolved on first use", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.testdata.StreamResponse", `value: "{{ .value }}!"`)
+		require.NoError(t, err)
+
+		msg, err := tmpl.Generate(ctx, map[string]any{"value": "hello"})
+		require.NoError(t, err)
+		assertMessage(t, &grpctest.StreamResponse{Value: "hello!"}, msg)
+
+		require.NotNil(t, tmpl.Descriptor(ctx))
+		assert.Equal(t, "groxy.testdata.StreamResponse", string(tmpl.Descriptor(ctx).FullName()))
+	})
+
+	t.Run("descriptor resolved on demand", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.testdata.StreamRequest", `{"value": "ping"}`)
+		require.NoError(t, err)
+
+		require.NotNil(t, tmpl.Descriptor(ctx))
+		assert.Equal(t, "groxy.testdata.StreamRequest", string(tmpl.Descriptor(ctx).FullName()))
+	})
+
+	t.Run("matches", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.testdata.StreamRequest", `{"value": "ping"}`)
+		require.NoError(t, err)
+
+		ok, err := tmpl.Matches(ctx, marshal(t, &grpctest.StreamRequest{Value: "ping"}))
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		dm, err := tmpl.DataMap(ctx, marshal(t, &grpctest.StreamRequest{Value: "pong"}))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]any{"value": "pong"}, dm)
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.testdata.Unknown", `{}`)
+		require.NoError(t, err)
+
+		_, err = tmpl.Generate(ctx, nil)
+		assert.ErrorContains(t, err, `resolve message type "groxy.testdata.Unknown"`)
+		assert.Nil(t, tmpl.Descriptor(ctx))
+	})
+
+	t.Run("invalid template", func(t *testing.T) {
+		_, err := d.BuildType("groxy.testdata.StreamResponse", `{{ .value`)
+		assert.ErrorContains(t, err, "parse template")
+	})
+}
+
+func TestLazy_Descriptor(t *testing.T) {
+	t.Run("failure is not retried during the backoff", func(t *testing.T) {
+		res := &stubResolver{err: errors.New("no such type")}
+		d := NewDefiner(WithResolver(res))
+
+		tmpl, err := d.BuildType("groxy.testdata.Unknown", `{}`)
+		require.NoError(t, err)
+
+		assert.Nil(t, tmpl.Descriptor(context.Background()))
+		assert.Nil(t, tmpl.Descriptor(context.Background()))
+		assert.Equal(t, int32(1), res.calls.Load())
+	})
+
+	t.Run("resolution is bound by the caller's context", func(t *testing.T) {
+		res := &stubResolver{block: true}
+		d := NewDefiner(WithResolver(res))
+
+		tmpl, err := d.BuildType("groxy.testdata.Unknown", `{}`)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		assert.Nil(t, tmpl.Descriptor(ctx))
+		assert.Less(t, time.Since(start), time.Second)
+
+		// the failure is caused by the caller, so the type is resolved again
+		ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		assert.Nil(t, tmpl.Descriptor(ctx))
+		assert.Equal(t, int32(2), res.calls.Load())
+	})
+}
+
+type stubResolver struct {
+	err   error
+	block bool
+	calls atomic.Int32
+}
+
+func (r *stubResolver) FindMessage(ctx context.Context, _ string) (*desc.MessageDescriptor, error) {
+	r.calls.Add(1)
+	if r.block {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	return nil, r.err
+}
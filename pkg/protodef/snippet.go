@@ -0,0 +1,250 @@
+package protodef
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Snippet renders the message as a protobuf snippet with groxypb options,
+// which builds the same message.
+// The target message declares only the populated fields of the message,
+// while the referenced messages and enums are declared in full
+// next to the target, with their full names flattened.
+func Snippet(msg proto.Message) (string, error) {
+	m := msg.ProtoReflect()
+	md := m.Descriptor()
+
+	sb := &strings.Builder{}
+	_, _ = fmt.Fprintf(sb, "message %s {\n", md.Name())
+	_, _ = fmt.Fprintln(sb, "    option (groxypb.target) = true;")
+
+	deps := map[protoreflect.FullName]protoreflect.Descriptor{}
+
+	var fields []protoreflect.FieldDescriptor
+	values := map[protoreflect.FieldNumber]string{}
+
+	var err error
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		var val string
+		if val, err = snippetValue(fd, v); err != nil {
+			err = fmt.Errorf("render value of field %q: %w", fd.Name(), err)
+			return false
+		}
+
+		collectDeps(fd, deps)
+		fields = append(fields, fd)
+		values[fd.Number()] = fmt.Sprintf(" [(groxypb.value) = %s]", quote(val))
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	writeFields(sb, fields, values)
+	_, _ = fmt.Fprintln(sb, "}")
+
+	names := make([]string, 0, len(deps))
+	for name := range deps {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		_, _ = fmt.Fprintln(sb)
+		switch d := deps[protoreflect.FullName(name)].(type) {
+		case protoreflect.MessageDescriptor:
+			_, _ = fmt.Fprintf(sb, "message %s {\n", flatName(d.FullName()))
+			fields := make([]protoreflect.FieldDescriptor, 0, d.Fields().Len())
+			for i := 0; i < d.Fields().Len(); i++ {
+				fields = append(fields, d.Fields().Get(i))
+			}
+			writeFields(sb, fields, nil)
+			_, _ = fmt.Fprintln(sb, "}")
+		case protoreflect.EnumDescriptor:
+			_, _ = fmt.Fprintf(sb, "enum %s {\n", flatName(d.FullName()))
+			values := d.Values()
+			for i := 0; i < values.Len(); i++ {
+				// enum values are scoped to the package, thus prefix them with the enum name
+				_, _ = fmt.Fprintf(sb, "    %s_%s = %d;\n", flatName(d.FullName()), values.Get(i).Name(), values.Get(i).Number())
+			}
+			_, _ = fmt.Fprintln(sb, "}")
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// writeFields writes the field declarations, grouping the members of oneofs,
+// to preserve the presence of the fields with zero values.
+func writeFields(sb *strings.Builder, fields []protoreflect.FieldDescriptor, values map[protoreflect.FieldNumber]string) {
+	written := map[protoreflect.FullName]bool{}
+	for _, fd := range fields {
+		oneof := fd.ContainingOneof()
+		switch {
+		case oneof == nil:
+			_, _ = fmt.Fprintf(sb, "    %s %s = %d%s;\n", snippetFieldType(fd), fd.Name(), fd.Number(), values[fd.Number()])
+		case oneof.IsSynthetic():
+			_, _ = fmt.Fprintf(sb, "    optional %s %s = %d%s;\n", snippetFieldType(fd), fd.Name(), fd.Number(), values[fd.Number()])
+		case !written[oneof.FullName()]:
+			written[oneof.FullName()] = true
+			_, _ = fmt.Fprintf(sb, "    oneof %s {\n", oneof.Name())
+			for _, member := range fields {
+				if member.ContainingOneof() == oneof {
+					_, _ = fmt.Fprintf(sb, "        %s %s = %d%s;\n",
+						snippetFieldType(member), member.Name(), member.Number(), values[member.Number()])
+				}
+			}
+			_, _ = fmt.Fprintln(sb, "    }")
+		}
+	}
+}
+
+// collectDeps puts all messages and enums, referenced by the field,
+// into the deps map, recursively.
+func collectDeps(fd protoreflect.FieldDescriptor, deps map[protoreflect.FullName]protoreflect.Descriptor) {
+	if fd.IsMap() {
+		collectDeps(fd.MapValue(), deps)
+		return
+	}
+
+	switch {
+	case fd.Enum() != nil:
+		deps[fd.Enum().FullName()] = fd.Enum()
+	case fd.Message() != nil:
+		md := fd.Message()
+		if _, ok := deps[md.FullName()]; ok {
+			return
+		}
+		deps[md.FullName()] = md
+		for i := 0; i < md.Fields().Len(); i++ {
+			collectDeps(md.Fields().Get(i), deps)
+		}
+	}
+}
+
+func snippetFieldType(fd protoreflect.FieldDescriptor) string {
+	if fd.IsMap() {
+		return fmt.Sprintf("map<%s, %s>", scalarType(fd.MapKey()), scalarType(fd.MapValue()))
+	}
+	if fd.IsList() {
+		return "repeated " + scalarType(fd)
+	}
+	return scalarType(fd)
+}
+
+func scalarType(fd protoreflect.FieldDescriptor) string {
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		return flatName(fd.Enum().FullName())
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return flatName(fd.Message().FullName())
+	default:
+		return fd.Kind().String()
+	}
+}
+
+// flatName makes a name of the type, unique within the snippet.
+func flatName(name protoreflect.FullName) string {
+	return strings.ReplaceAll(string(name), ".", "_")
+}
+
+// snippetValue renders the value in the format, expected by the groxypb.value option.
+func snippetValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) (string, error) {
+	if !fd.IsList() && !fd.IsMap() {
+		switch fd.Kind() {
+		case protoreflect.EnumKind:
+			ev := fd.Enum().Values().ByNumber(v.Enum())
+			if ev == nil {
+				return "", fmt.Errorf("unknown enum value %d", v.Enum())
+			}
+			return flatName(fd.Enum().FullName()) + "_" + string(ev.Name()), nil
+		case protoreflect.BytesKind:
+			return base64.StdEncoding.EncodeToString(v.Bytes()), nil
+		case protoreflect.StringKind:
+			return v.String(), nil
+		case protoreflect.MessageKind, protoreflect.GroupKind: // rendered as JSON
+		default:
+			return fmt.Sprint(v.Interface()), nil
+		}
+	}
+
+	bts, err := json.Marshal(jsonValue(fd, v))
+	if err != nil {
+		return "", fmt.Errorf("marshal value: %w", err)
+	}
+
+	return string(bts), nil
+}
+
+// jsonValue converts the value to a plain Go value to be encoded as JSON.
+// Unlike protojson, it doesn't handle well-known types specially, as they
+// are declared as regular messages in the snippet, encodes 64-bit integers
+// as numbers, and uses proto names of the fields.
+func jsonValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch {
+	case fd.IsList():
+		l := v.List()
+		res := make([]any, 0, l.Len())
+		for i := 0; i < l.Len(); i++ {
+			res = append(res, jsonSingular(fd, l.Get(i), castedList))
+		}
+		return res
+	case fd.IsMap():
+		res := map[string]any{}
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			res[k.String()] = jsonSingular(fd.MapValue(), v, castedMap)
+			return true
+		})
+		return res
+	default:
+		return jsonSingular(fd, v, unmarshaled)
+	}
+}
+
+// valueMode describes how the value is going to be parsed by the Definer.
+type valueMode int
+
+const (
+	unmarshaled valueMode = iota // parsed as JSON into a message
+	castedList                   // element of a repeated scalar field, casted to the field type
+	castedMap                    // value of a map field, casted to the field type or parsed from a string
+)
+
+func jsonSingular(fd protoreflect.FieldDescriptor, v protoreflect.Value, mode valueMode) any {
+	switch fd.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		res := map[string]any{}
+		v.Message().Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			res[string(fd.Name())] = jsonValue(fd, v)
+			return true
+		})
+		return res
+	case protoreflect.EnumKind:
+		ev := fd.Enum().Values().ByNumber(v.Enum())
+		if mode == castedList || ev == nil {
+			return int32(v.Enum())
+		}
+		return flatName(fd.Enum().FullName()) + "_" + string(ev.Name())
+	case protoreflect.BytesKind:
+		if mode != unmarshaled { // casted from strings as is
+			return string(v.Bytes())
+		}
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	default:
+		return v.Interface()
+	}
+}
+
+// quote quotes the string as a protobuf string literal,
+// escaping the template delimiters.
+func quote(s string) string {
+	s = strings.ReplaceAll(s, "{{", `{{"{{"}}`)
+	return strconv.Quote(s)
+}
@@ -0,0 +1,76 @@
+package protodef
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/protodef/testdata"
+	"github.com/google/go-cmp/cmp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/testing/protocmp"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestSnippet(t *testing.T) {
+	st, err := structpb.NewStruct(map[string]any{
+		"name": "john",
+		"age":  42,
+		"tags": []any{"a", "b"},
+		"meta": map[string]any{"admin": true, "manager": nil},
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name string
+		msg  proto.Message
+	}{
+		{name: "empty", msg: &testdata.Response{}},
+		{name: "scalars", msg: &testdata.Response{Value: `quoted "{{ .value }}"` + "\n", Enum: testdata.Enum_STUB_ENUM_SECOND}},
+		{name: "nested", msg: &testdata.Response{
+			Nested:    &testdata.Nested{Enum: testdata.Enum_STUB_ENUM_FIRST, NestedValue: "nested"},
+			Nesteds:   []*testdata.Nested{{NestedValue: "first"}, {Enum: testdata.Enum_STUB_ENUM_SECOND}},
+			NestedMap: map[string]*testdata.Nested{"key": {NestedValue: "value", Enum: testdata.Enum_STUB_ENUM_FIRST}},
+		}},
+		{name: "well-known types", msg: &errdetails.RetryInfo{RetryDelay: durationpb.New(1500 * time.Millisecond)}},
+		{name: "recursive types", msg: st},
+		{name: "repeated and map scalars", msg: &errdetails.ErrorInfo{
+			Reason:   "REASON",
+			Domain:   "groxy",
+			Metadata: map[string]string{"key": "value", "other": "val"},
+		}},
+		{name: "repeated messages", msg: &errdetails.BadRequest{FieldViolations: []*errdetails.BadRequest_FieldViolation{
+			{Field: "name", Description: "required"},
+			{Field: "age", Description: "must be positive"},
+		}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snippet, err := Snippet(tt.msg)
+			require.NoError(t, err)
+			t.Log(snippet)
+
+			tmpl, err := BuildMessage(snippet)
+			require.NoError(t, err)
+
+			generated, err := tmpl.Generate(context.Background(), nil)
+			require.NoError(t, err)
+
+			bts, err := proto.Marshal(generated)
+			require.NoError(t, err)
+
+			got := tt.msg.ProtoReflect().New().Interface()
+			require.NoError(t, proto.Unmarshal(bts, got))
+			assert.Empty(t, cmpDiff(tt.msg, got))
+		})
+	}
+}
+
+func cmpDiff(want, got proto.Message) string {
+	return cmp.Diff(want, got, protocmp.Transform())
+}
@@ -21,6 +21,7 @@ type Template interface {
 	DataMap(ctx context.Context, bts []byte) (map[string]any, error)
 	Matches(ctx context.Context, bts []byte) (bool, error)
 	Generate(ctx context.Context, data map[string]any) (proto.Message, error)
+	Descriptor(ctx context.Context) protoreflect.MessageDescriptor
 }
 
 type templatedField struct {
@@ -42,7 +43,11 @@ type combined struct {
 
 // DataMap extracts all known fields from the provided byte sequence and returns them as a map.
 func (t *combined) DataMap(_ context.Context, bts []byte) (map[string]any, error) {
-	got := dynamic.NewMessage(t.desc)
+	return dataMap(t.desc, bts)
+}
+
+func dataMap(d *desc.MessageDescriptor, bts []byte) (map[string]any, error) {
+	got := dynamic.NewMessage(d)
 	if err := got.Unmarshal(bts); err != nil {
 		return nil, fmt.Errorf("unmarshal incoming message: %w", err)
 	}
@@ -140,6 +145,11 @@ func (t *combined) Generate(ctx context.Context, data map[string]any) (proto.Mes
 	return protoadapt.MessageV2Of(msg), nil
 }
 
+// Descriptor returns the descriptor of the message in the template.
+func (t *combined) Descriptor(context.Context) protoreflect.MessageDescriptor {
+	return t.desc.UnwrapMessage()
+}
+
 // Static is a Template that returns a static protobuf message without any modifications.
 func Static(msg proto.Message) Template {
 	return static{desc: msg.ProtoReflect().Descriptor(), msg: msg}
@@ -184,3 +194,6 @@ func (s static) Matches(_ context.Context, got []byte) (bool, error) {
 func (s static) Generate(context.Context, map[string]any) (proto.Message, error) {
 	return s.msg, nil
 }
+
+// Descriptor returns the descriptor of the static message.
+func (s static) Descriptor(context.Context) protoreflect.MessageDescriptor { return s.desc }
@@ -0,0 +1,150 @@
+package protodef
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/jhump/protoreflect/desc"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"gopkg.in/yaml.v3"
+)
+
+// BuildType seeks the message type with the given full name in the files,
+// provided to the definer, and returns a template of the message with the
+// given value. The value is a YAML or JSON object in the protobuf JSON
+// mapping and may contain templates.
+// If the type is not declared in the files, and the definer has a resolver,
+// the type is resolved on the first use of the template.
+func (b *Definer) BuildType(name, value string) (Template, error) {
+	md := b.findMessage(name)
+	switch {
+	case md != nil:
+		return b.buildTyped(md, value)
+	case b.resolver != nil:
+		// check the template beforehand, the type is resolved on the first use
+		if _, err := template.New("").Funcs(b.funcs).Parse(value); err != nil {
+			return nil, fmt.Errorf("parse template: %w", err)
+		}
+		return &lazy{definer: b, name: strings.TrimPrefix(name, "."), value: value}, nil
+	default:
+		return nil, fmt.Errorf("message type %q not found", name)
+	}
+}
+
+func (b *Definer) buildTyped(md *desc.MessageDescriptor, value string) (Template, error) {
+	tmpl, err := template.New("").Funcs(b.funcs).Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("parse template: %w", err)
+	}
+
+	t := &typed{desc: md}
+	if isTemplated(tmpl) {
+		t.tmpl = tmpl
+		return t, nil
+	}
+
+	if t.static, err = parseValue(md.UnwrapMessage(), value); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (b *Definer) findMessage(name string) *desc.MessageDescriptor {
+	name = strings.TrimPrefix(name, ".")
+	for _, fd := range b.files {
+		if md := fd.FindMessage(name); md != nil {
+			return md
+		}
+	}
+	return nil
+}
+
+// typed is a template of the message of the type, declared in the
+// user-provided files, with the value in the protobuf JSON mapping.
+type typed struct {
+	desc   *desc.MessageDescriptor
+	static *dynamicpb.Message // set if the value is not templated
+	tmpl   *template.Template // set if the value is templated
+}
+
+// DataMap extracts all known fields from the provided byte sequence and returns them as a map.
+func (t *typed) DataMap(_ context.Context, bts []byte) (map[string]any, error) {
+	return dataMap(t.desc, bts)
+}
+
+// Matches checks if every field, set in the value, is equal
+// to the one in the provided message. Other fields are ignored.
+func (t *typed) Matches(_ context.Context, bts []byte) (bool, error) {
+	if t.static == nil {
+		return false, fmt.Errorf("can't match against a templated value")
+	}
+
+	got := dynamicpb.NewMessage(t.desc.UnwrapMessage())
+	if err := proto.Unmarshal(bts, got); err != nil {
+		return false, fmt.Errorf("unmarshal incoming message: %w", err)
+	}
+
+	matches := true
+	t.static.Range(func(fd protoreflect.FieldDescriptor, want protoreflect.Value) bool {
+		matches = got.Has(fd) && got.Get(fd).Equal(want)
+		return matches
+	})
+
+	return matches, nil
+}
+
+// Generate builds a new protobuf message out of the value and the provided data.
+func (t *typed) Generate(ctx context.Context, data map[string]any) (proto.Message, error) {
+	if t.static != nil {
+		return proto.Clone(t.static), nil
+	}
+
+	input := map[string]any{"Context": ctx}
+	for k, v := range data {
+		input[k] = v
+	}
+
+	sb := &strings.Builder{}
+	if err := t.tmpl.Execute(sb, input); err != nil {
+		return nil, fmt.Errorf("execute template: %w", err)
+	}
+
+	return parseValue(t.desc.UnwrapMessage(), sb.String())
+}
+
+// Descriptor returns the descriptor of the message in the template.
+func (t *typed) Descriptor(context.Context) protoreflect.MessageDescriptor {
+	return t.desc.UnwrapMessage()
+}
+
+// parseValue parses the YAML or JSON value into the message of the given type.
+func parseValue(md protoreflect.MessageDescriptor, value string) (*dynamicpb.Message, error) {
+	msg := dynamicpb.NewMessage(md)
+
+	var v any
+	if err := yaml.Unmarshal([]byte(value), &v); err != nil {
+		return nil, fmt.Errorf("unmarshal value: %w", err)
+	}
+
+	if v == nil {
+		return msg, nil
+	}
+
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("marshal value to JSON: %w", err)
+	}
+
+	if err = protojson.Unmarshal(bts, msg); err != nil {
+		return nil, fmt.Errorf("unmarshal value into %s: %w", md.FullName(), err)
+	}
+
+	return msg, nil
+}
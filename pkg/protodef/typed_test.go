@@ -0,0 +1,157 @@
+package protodef
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Semior001/groxy/pkg/protodef/testdata"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestDefiner_BuildType(t *testing.T) {
+	fds, err := ParseFiles([]string{"testdata"}, "parse.gen.proto")
+	require.NoError(t, err)
+
+	d := NewDefiner(WithFiles(fds...))
+	ctx := context.Background()
+
+	t.Run("static value", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.runtime_generated.Response", `
+value: hello
+enum: STUB_ENUM_FIRST
+nested: { nestedValue: nested }
+nestedMap: { key: { enum: STUB_ENUM_SECOND } }
+`)
+		require.NoError(t, err)
+		assert.Equal(t, "groxy.runtime_generated.Response", string(tmpl.Descriptor(ctx).FullName()))
+
+		msg, err := tmpl.Generate(ctx, nil)
+		require.NoError(t, err)
+
+		assertMessage(t, &testdata.Response{
+			Value:     "hello",
+			Enum:      testdata.Enum_STUB_ENUM_FIRST,
+			Nested:    &testdata.Nested{NestedValue: "nested"},
+			NestedMap: map[string]*testdata.Nested{"key": {Enum: testdata.Enum_STUB_ENUM_SECOND}},
+		}, msg)
+	})
+
+	t.Run("templated value", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.runtime_generated.Response", `{"value": "{{ .value | upper }}"}`)
+		require.NoError(t, err)
+
+		msg, err := tmpl.Generate(ctx, map[string]any{"value": "hello"})
+		require.NoError(t, err)
+		assertMessage(t, &testdata.Response{Value: "HELLO"}, msg)
+
+		_, err = tmpl.Matches(ctx, nil)
+		assert.ErrorContains(t, err, "can't match against a templated value")
+	})
+
+	t.Run("matches set fields only", func(t *testing.T) {
+		tmpl, err := d.BuildType("groxy.runtime_generated.Response", `{value: hello, nested: {enum: STUB_ENUM_FIRST}}`)
+		require.NoError(t, err)
+
+		matches := func(msg proto.Message) bool {
+			bts, err := proto.Marshal(msg)
+			require.NoError(t, err)
+			ok, err := tmpl.Matches(ctx, bts)
+			require.NoError(t, err)
+			return ok
+		}
+
+		assert.True(t, matches(&testdata.Response{
+			Value:  "hello",
+			Enum:   testdata.Enum_STUB_ENUM_SECOND,
+			Nested: &testdata.Nested{Enum: testdata.Enum_STUB_ENUM_FIRST},
+		}))
+		assert.False(t, matches(&testdata.Response{Value: "hello"}))
+		assert.False(t, matches(&testdata.Response{
+			Value:  "hello",
+			Nested: &testdata.Nested{Enum: testdata.Enum_STUB_ENUM_FIRST, NestedValue: "other"},
+		}))
+
+		dm, err := tmpl.DataMap(ctx, marshal(t, &testdata.Response{Value: "hello"}))
+		require.NoError(t, err)
+		assert.Equal(t, "hello", dm["value"])
+	})
+
+	t.Run("unknown type", func(t *testing.T) {
+		_, err := d.BuildType("groxy.runtime_generated.Unknown", `{}`)
+		assert.ErrorContains(t, err, `message type "groxy.runtime_generated.Unknown" not found`)
+	})
+
+	t.Run("unknown field", func(t *testing.T) {
+		_, err := d.BuildType("groxy.runtime_generated.Response", `{unknown: 1}`)
+		assert.ErrorContains(t, err, "unknown")
+	})
+
+	t.Run("snippet importing the file", func(t *testing.T) {
+		tmpl, err := d.BuildTarget(`
+import "parse.gen.proto";
+
+message Target {
+	option (groxypb.target) = true;
+	groxy.runtime_generated.Nested nested = 3 [(groxypb.value) = '{"nested_value": "imported"}'];
+}`)
+		require.NoError(t, err)
+
+		msg, err := tmpl.Generate(ctx, nil)
+		require.NoError(t, err)
+		assertMessage(t, &testdata.Response{Nested: &testdata.Nested{NestedValue: "imported"}}, msg)
+	})
+
+	t.Run("snippet importing unknown file", func(t *testing.T) {
+		_, err := d.BuildTarget(`
+import "unknown.proto";
+
+message Target { option (groxypb.target) = true; }`)
+		assert.ErrorContains(t, err, "unknown.proto")
+	})
+}
+
+func TestLoadDescriptorSets(t *testing.T) {
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(testdata.File_pkg_protodef_testdata_parse_gen_proto),
+	}}
+	bts, err := proto.Marshal(set)
+	require.NoError(t, err)
+
+	fname := filepath.Join(t.TempDir(), "set.protoset")
+	require.NoError(t, os.WriteFile(fname, bts, 0o600))
+
+	fds, err := LoadDescriptorSets(fname)
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+
+	tmpl, err := NewDefiner(WithFiles(fds...)).BuildType("groxy.runtime_generated.Request", `value: hello`)
+	require.NoError(t, err)
+
+	msg, err := tmpl.Generate(context.Background(), nil)
+	require.NoError(t, err)
+	assertMessage(t, &testdata.Request{Value: "hello"}, msg)
+
+	_, err = LoadDescriptorSets(filepath.Join(t.TempDir(), "unknown.protoset"))
+	assert.Error(t, err)
+}
+
+// assertMessage checks that the message has the same wire representation as the expected one.
+func assertMessage(t *testing.T, want, got proto.Message) {
+	t.Helper()
+	res := want.ProtoReflect().New().Interface()
+	require.NoError(t, proto.Unmarshal(marshal(t, got), res))
+	assert.True(t, proto.Equal(want, res), "want: %v\ngot: %v", want, res)
+}
+
+func marshal(t *testing.T, msg proto.Message) []byte {
+	t.Helper()
+	bts, err := proto.Marshal(msg)
+	require.NoError(t, err)
+	return bts
+}
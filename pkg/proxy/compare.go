@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// compareMiddleware handles the requests, matched by the rule in the compare
+// mode, both with the mock and with the upstream. The client gets the response
+// of the one, set in the rule, while the copy of the request is replayed to
+// the other one in the background, once the client's call is done. The
+// responses are then compared field by field, with the type of the mock.
+func (s *Server) compareMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+
+		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
+		if !ok || match.Compare == nil {
+			return next(srv, stream)
+		}
+
+		mocked, forwarded := *match, *match
+		mocked.Forward, forwarded.Mock = nil, nil
+
+		returned, replayed := &forwarded, &mocked
+		if match.Compare.Return == discovery.CompareReturnMock {
+			returned, replayed = &mocked, &forwarded
+		}
+
+		var mu sync.Mutex
+		var reqs [][]byte
+		cs := &copyingStream{
+			ServerStream: grpcx.StreamWithContext(context.WithValue(ctx, ctxMatch, returned), stream),
+			onRecv: func(msg []byte) {
+				mu.Lock()
+				reqs = append(reqs, msg)
+				mu.Unlock()
+			},
+		}
+
+		err := next(srv, cs)
+		live := cs.outcome(err)
+
+		mu.Lock()
+		replay := &replayStream{reqs: reqs}
+		mu.Unlock()
+
+		go s.replay(ctx, next, srv, match, replayed, replay, live)
+
+		return err
+	}
+}
+
+// replay makes the call, which response isn't returned to the client, with
+// the copies of the requests, and reports the differences of its response
+// from the one, returned to the client.
+func (s *Server) replay(ctx context.Context, next grpc.StreamHandler, srv any,
+	match, replayed *discovery.Rule, stream *replayStream, live outcome) {
+	mtd, _ := grpc.Method(ctx)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), match.Compare.Timeout)
+	defer cancel()
+
+	stream.ctx = context.WithValue(context.WithValue(ctx, ctxMatch, replayed), ctxReplay, true)
+	err := next(srv, stream)
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+
+	other := stream.sent
+	other.status = status.Convert(err)
+
+	mock, upstream := other, live
+	if match.Compare.Return == discovery.CompareReturnMock {
+		mock, upstream = live, other
+	}
+
+	attrs := []any{slog.String("rule", match.Name)}
+
+	result := metrics.ResultMatch
+	switch {
+	case ctx.Err() != nil:
+		result = metrics.ResultError
+		slog.WarnContext(ctx, "failed to compare the mock with the upstream", append(attrs, slogx.Error(ctx.Err()))...)
+	case mock.tooLarge || upstream.tooLarge:
+		result = metrics.ResultTooLarge
+		slog.WarnContext(ctx, "responses are too large to compare the mock with the upstream", attrs...)
+	default:
+		if diff := diffOutcomes(s.types.Output(ctx, match, mtd), mock, upstream); len(diff) > 0 {
+			result = metrics.ResultMismatch
+			slog.WarnContext(ctx, "mock differs from the upstream", append(attrs, slog.Any("diff", diff))...)
+		} else {
+			slog.DebugContext(ctx, "mock matches the upstream", attrs...)
+		}
+	}
+
+	if s.metrics != nil {
+		s.metrics.ObserveCompare(metrics.Compare{Method: mtd, Rule: match.Name, Result: result})
+	}
+}
+
+// isReplay returns true if the call is replayed in the compare mode.
+// Such calls aren't made by the client, so they are neither traced,
+// as the span of the client's call is already ended, nor recorded.
+func isReplay(ctx context.Context) bool {
+	replay, _ := ctx.Value(ctxReplay).(bool)
+	return replay
+}
+
+// replayStream is the server stream, which receives the recorded
+// requests and keeps the sent responses. Headers and trailers are discarded.
+type replayStream struct {
+	ctx  context.Context
+	reqs [][]byte
+	sent outcome
+}
+
+// SetHeader does nothing.
+func (s *replayStream) SetHeader(metadata.MD) error { return nil }
+
+// SendHeader does nothing.
+func (s *replayStream) SendHeader(metadata.MD) error { return nil }
+
+// SetTrailer does nothing.
+func (s *replayStream) SetTrailer(metadata.MD) {}
+
+// Context returns the context of the replayed call.
+func (s *replayStream) Context() context.Context { return s.ctx }
+
+// SendMsg keeps the message.
+func (s *replayStream) SendMsg(m any) error {
+	msg, err := (grpcx.RawBytesCodec{}).Marshal(m)
+	if err != nil {
+		return err
+	}
+	s.sent.keep(msg)
+	return nil
+}
+
+// RecvMsg returns the next recorded request, or io.EOF once all of them are received.
+func (s *replayStream) RecvMsg(m any) error {
+	if len(s.reqs) == 0 {
+		return io.EOF
+	}
+
+	msg := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return (grpcx.RawBytesCodec{}).Unmarshal(msg, m)
+}
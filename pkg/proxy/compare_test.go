@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/Semior001/groxy/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+)
+
+func TestServer_compare(t *testing.T) {
+	upstreamReqs := make(chan string, 10)
+	upstreamConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			upstreamReqs <- req.Value
+			return &grpctest.StreamResponse{Value: req.Value}, nil
+		},
+		ClientStreamFunc: grpctest.Sum,
+	})
+
+	forward := &discovery.Forward{Targets: []discovery.ForwardTarget{{
+		Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: upstreamConn},
+	}}}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, md metadata.MD) discovery.Matches {
+			if uri == "/groxy.testdata.ExampleService/ClientStream" {
+				return discovery.Matches{{
+					Name:    "stream",
+					Mock:    &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "6"})},
+					Forward: forward,
+					Compare: &discovery.Compare{Return: discovery.CompareReturnUpstream, Timeout: time.Second},
+				}}
+			}
+
+			ret := discovery.CompareReturnUpstream
+			if r := md.Get("return"); len(r) > 0 {
+				ret = r[0]
+			}
+
+			return discovery.Matches{{
+				Name:    ret,
+				Mock:    &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "hello"})},
+				Forward: forward,
+				Compare: &discovery.Compare{Return: ret, Timeout: time.Second},
+			}}
+		},
+	}
+
+	m := metrics.New(nil)
+	cl := startProxy(t, matcher, WithMetrics(m))
+
+	compared := func(mtd, rule, result string, n int) func() bool {
+		return func() bool {
+			rec := httptest.NewRecorder()
+			m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+			return strings.Contains(rec.Body.String(), fmt.Sprintf(
+				`groxy_compared_requests_total{method="/groxy.testdata.ExampleService/%s",result=%q,rule=%q} %d`,
+				mtd, result, rule, n))
+		}
+	}
+
+	t.Run("match", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value)
+		assert.Equal(t, "hello", <-upstreamReqs)
+		assert.Eventually(t, compared("Unary", "upstream", metrics.ResultMatch, 1), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("mismatch, upstream returned", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "bye"})
+		require.NoError(t, err)
+		assert.Equal(t, "bye", resp.Value, "the client gets the upstream response")
+		assert.Equal(t, "bye", <-upstreamReqs)
+		assert.Eventually(t, compared("Unary", "upstream", metrics.ResultMismatch, 1), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("mismatch, mock returned", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "return", "mock")
+		resp, err := cl.Unary(ctx, &grpctest.StreamRequest{Value: "world"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value, "the client gets the mock response")
+		assert.Equal(t, "world", <-upstreamReqs, "the request is replayed to the upstream")
+		assert.Eventually(t, compared("Unary", "mock", metrics.ResultMismatch, 1), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		stream, err := cl.ClientStream(context.Background())
+		require.NoError(t, err)
+		for _, v := range []string{"1", "2", "3"} {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: v}))
+		}
+		resp, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.Equal(t, "6", resp.Value)
+		assert.Eventually(t, compared("ClientStream", "stream", metrics.ResultMatch, 1), time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestServer_compareReplay(t *testing.T) {
+	upstreamReqs := make(chan string, 1)
+	upstreamConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			upstreamReqs <- req.Value
+			return &grpctest.StreamResponse{Value: req.Value}, nil
+		},
+	}, func(s *grpc.Server) { reflection.Register(s) })
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches {
+			return discovery.Matches{{
+				Name: "mock",
+				Mock: &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "hello"})},
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{
+					Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: upstreamConn},
+				}}},
+				Compare: &discovery.Compare{Return: discovery.CompareReturnMock, Timeout: time.Second},
+			}}
+		},
+	}
+
+	m := metrics.New(nil)
+	rec := &recorder.Recorder{}
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	cl := startProxy(t, matcher, WithMetrics(m), WithRecorder(rec), WithTracing(tp, tracing.Propagator()))
+
+	resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	assert.Equal(t, "hello", <-upstreamReqs, "the request is replayed to the upstream")
+
+	require.Eventually(t, func() bool {
+		rw := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+		return strings.Contains(rw.Body.String(), `groxy_compared_requests_total{method="/groxy.testdata.ExampleService/Unary",result="match",rule="mock"} 1`)
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Never(t, func() bool { return len(rec.Config().Rules) > 0 }, 200*time.Millisecond, 10*time.Millisecond,
+		"the replayed call must not be recorded")
+	require.Len(t, spans.Ended(), 1, "the replayed call must not be traced")
+	assert.Equal(t, trace.SpanKindServer, spans.Ended()[0].SpanKind())
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// faultMiddleware injects the faults of the matched rule: delays the request,
+// aborts it or breaks the connection of the client in the middle of the response.
+func (s *Server) faultMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+
+		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
+		if !ok || match.Fault == nil {
+			return next(srv, stream)
+		}
+
+		if err := wait(ctx, match.Fault.Latency()); err != nil {
+			return err
+		}
+
+		if st := match.Fault.Aborts(); st != nil {
+			slog.DebugContext(ctx, "aborting the request", slog.String("code", st.Code().String()))
+			return st.Err()
+		}
+
+		if n, ok := match.Fault.ResetsAfter(); ok {
+			rs := &resetStream{ServerStream: stream, left: n, reset: func() { s.breakConn(ctx, true) }}
+			_ = next(srv, rs)
+			rs.once.Do(rs.reset) // the response has fewer messages, reset instead of the status
+			return status.Error(codes.Unavailable, "{groxy} connection reset by fault")
+		}
+
+		err := next(srv, stream)
+		if match.Fault.DropsTrailers() {
+			s.breakConn(ctx, false)
+			return status.Error(codes.Unavailable, "{groxy} connection closed by fault without trailers")
+		}
+
+		return err
+	}
+}
+
+// breakConn closes the connection of the client of the request.
+// If reset is set, the connection is reset, discarding the unsent data.
+func (s *Server) breakConn(ctx context.Context, reset bool) {
+	slog.DebugContext(ctx, "breaking the connection of the client", slog.Bool("reset", reset))
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || !s.conns.close(p.Addr, reset) {
+		slog.WarnContext(ctx, "connection of the client not found")
+	}
+}
+
+// resetStream resets the connection, when the given number of messages is sent.
+type resetStream struct {
+	grpc.ServerStream
+	left  int
+	reset func()
+	once  sync.Once
+}
+
+// SendMsg sends the message, if the limit is not reached, otherwise resets the connection.
+func (s *resetStream) SendMsg(m any) error {
+	if s.left <= 0 {
+		s.once.Do(s.reset)
+		return status.Error(codes.Unavailable, "{groxy} connection reset by fault")
+	}
+
+	s.left--
+	return s.ServerStream.SendMsg(m)
+}
+
+// The transport writes the sent messages to the connection asynchronously,
+// thus, before breaking the connection, the proxy waits for drainQuiet without
+// writes to it, so that the messages reach the client, but no longer than
+// drainTimeout, as the other requests might keep the connection busy.
+const (
+	drainQuiet   = 20 * time.Millisecond
+	drainTimeout = time.Second
+)
+
+// connections keeps the accepted connections by the addresses of the
+// clients, so that the faults can break the connection of the request.
+type connections struct {
+	mu    sync.Mutex
+	conns map[string]*trackedConn
+	seq   atomic.Uint64 // numbers the clients of unix sockets, which are usually unnamed
+}
+
+func newConnections() *connections {
+	return &connections{conns: map[string]*trackedConn{}}
+}
+
+// track returns the listener, which keeps the accepted connections.
+func (c *connections) track(l net.Listener) net.Listener {
+	return trackingListener{Listener: l, conns: c}
+}
+
+// close closes the connection of the client with the address, once the
+// data, queued by the transport, is written. It returns false, if the
+// connection is not found.
+func (c *connections) close(addr net.Addr, reset bool) bool {
+	c.mu.Lock()
+	conn, ok := c.conns[addr.String()]
+	c.mu.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	conn.drain()
+
+	if tcp, ok := conn.Conn.(*net.TCPConn); ok && reset {
+		_ = tcp.SetLinger(0) // send RST instead of FIN
+	}
+
+	_ = conn.Close()
+	return true
+}
+
+func (c *connections) add(conn net.Conn) *trackedConn {
+	tc := &trackedConn{Conn: conn, conns: c, addr: conn.RemoteAddr()}
+	if ua, ok := tc.addr.(*net.UnixAddr); ok {
+		tc.addr = &net.UnixAddr{Net: ua.Net, Name: fmt.Sprintf("%s#%d", ua.Name, c.seq.Add(1))}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns[tc.addr.String()] = tc
+	return tc
+}
+
+func (c *connections) remove(conn *trackedConn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conns[conn.addr.String()] == conn {
+		delete(c.conns, conn.addr.String())
+	}
+}
+
+// trackingListener adds the accepted connections to the tracked ones.
+type trackingListener struct {
+	net.Listener
+	conns *connections
+}
+
+// Accept accepts the connection and tracks it until it's closed.
+func (l trackingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.conns.add(conn), nil
+}
+
+// trackedConn removes itself from the tracked connections on close.
+type trackedConn struct {
+	net.Conn
+	conns     *connections
+	addr      net.Addr
+	lastWrite atomic.Int64 // unix time of the last write in nanoseconds
+}
+
+// Write writes the data and keeps the time of the write.
+func (c *trackedConn) Write(b []byte) (int, error) {
+	c.lastWrite.Store(time.Now().UnixNano())
+	return c.Conn.Write(b)
+}
+
+// drain waits until nothing has been written to the connection for drainQuiet.
+func (c *trackedConn) drain() {
+	start := time.Now()
+	for time.Since(start) < drainTimeout {
+		last := max(start.UnixNano(), c.lastWrite.Load())
+		idle := time.Since(time.Unix(0, last))
+		if idle >= drainQuiet {
+			return
+		}
+		time.Sleep(drainQuiet - idle)
+	}
+}
+
+// RemoteAddr returns the address of the client, unique among the tracked connections.
+func (c *trackedConn) RemoteAddr() net.Addr { return c.addr }
+
+// Close closes the connection and stops tracking it.
+func (c *trackedConn) Close() error {
+	c.conns.remove(c)
+	return c.Conn.Close()
+}
@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_fault(t *testing.T) {
+	var backendCalls atomic.Int32
+	backendConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			backendCalls.Add(1)
+			return &grpctest.StreamResponse{Value: "echo: " + req.Value}, nil
+		},
+	})
+
+	var stream []discovery.StreamMessage
+	for i := range 5 {
+		stream = append(stream, discovery.StreamMessage{
+			Body: protodef.Static(&grpctest.StreamResponse{Value: fmt.Sprintf("tick %d", i)}),
+		})
+	}
+
+	faults := map[string]*discovery.Fault{
+		"abort": {Abort: &discovery.FaultAbort{Percentage: 100, Status: status.New(codes.Unavailable, "injected")}},
+		"delay": {Delay: &discovery.FaultDelay{Percentage: 100, Latency: discovery.FixedLatency(100 * time.Millisecond)}},
+		"reset": {Reset: &discovery.FaultReset{Percentage: 100, After: 2}},
+		"drop":  {DropTrailers: 100},
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, md metadata.MD) discovery.Matches {
+			rule := &discovery.Rule{
+				Name:    "forward",
+				Match:   discovery.RequestMatcher{URI: regexp.MustCompile(".*")},
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: backendConn}}}},
+			}
+			if uri == "/groxy.testdata.ExampleService/ServerStream" {
+				rule = &discovery.Rule{Name: "stream", Mock: &discovery.Mock{Stream: stream}}
+			}
+			if vals := md.Get("fault"); len(vals) > 0 {
+				rule.Fault = faults[vals[0]]
+			}
+			return discovery.Matches{rule}
+		},
+	}
+
+	cl := startProxy(t, matcher)
+
+	withFault := func(name string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "fault", name)
+	}
+
+	t.Run("abort", func(t *testing.T) {
+		_, err := cl.Unary(withFault("abort"), &grpctest.StreamRequest{Value: "hello"})
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		assert.Equal(t, codes.Unavailable, st.Code())
+		assert.Equal(t, "injected", st.Message())
+		assert.Zero(t, backendCalls.Load(), "aborted request must not reach the upstream")
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		start := time.Now()
+		resp, err := cl.Unary(withFault("delay"), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "echo: hello", resp.Value)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		stream, err := cl.ServerStream(withFault("reset"), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+
+		received := 0
+		for ; ; received++ {
+			if _, err = stream.Recv(); err != nil {
+				break
+			}
+		}
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Equal(t, 2, received, "messages, sent before the reset, must reach the client")
+	})
+
+	t.Run("drop trailers", func(t *testing.T) {
+		_, err := cl.Unary(withFault("drop"), &grpctest.StreamRequest{Value: "hello"})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+
+		stream, err := cl.ServerStream(withFault("drop"), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+		for i := range 5 {
+			resp, err := stream.Recv()
+			require.NoError(t, err, "the response must be received without the trailers")
+			assert.Equal(t, fmt.Sprintf("tick %d", i), resp.Value)
+		}
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+
+	t.Run("without faults", func(t *testing.T) {
+		stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+		for i := range 5 {
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("tick %d", i), resp.Value)
+		}
+		_, err = stream.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// limits of the messages, kept in a single journal entry,
+// long-living streams would hold all of their messages otherwise
+const (
+	journalMessages = 100
+	journalBytes    = 1 << 20
+)
+
+// exchange accumulates the details of the request to be recorded
+// in the journal and reported to the metrics.
+type exchange struct {
+	rule      *discovery.Rule
+	received  [][]byte
+	size      int  // total size of the received messages
+	truncated bool // whether some of the messages weren't kept
+}
+
+// withExchange returns the exchange of the request, putting
+// a new one into the context, if there's none yet.
+func withExchange(ctx context.Context) (context.Context, *exchange) {
+	if ex, ok := ctx.Value(ctxExchange).(*exchange); ok {
+		return ctx, ex
+	}
+
+	ex := &exchange{}
+	return context.WithValue(ctx, ctxExchange, ex), ex
+}
+
+// journalMiddleware records every handled request into the journal.
+func (s *Server) journalMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+		start := time.Now()
+
+		ctx, ex := withExchange(ctx)
+		err := next(srv, recordingStream{ServerStream: grpcx.StreamWithContext(ctx, stream), ex: ex})
+
+		mtd, _ := grpc.Method(ctx)
+		md, _ := metadata.FromIncomingContext(ctx)
+		st := status.Convert(err)
+
+		entry := journal.Entry{
+			Time:      start,
+			Duration:  time.Since(start),
+			Method:    mtd,
+			Header:    md,
+			Status:    journal.Status{Code: st.Code().String(), Message: st.Message()},
+			Truncated: ex.truncated,
+		}
+
+		var d protoreflect.MessageDescriptor
+		if ex.rule != nil {
+			entry.Rule = ex.rule.Name
+			d = ruleDescriptor(ctx, ex.rule)
+		}
+
+		for _, msg := range ex.received {
+			entry.Messages = append(entry.Messages, decodeMessage(ctx, d, msg))
+		}
+
+		s.journal.Add(entry)
+		return err
+	}
+}
+
+// ruleDescriptor returns the descriptor of the messages, received
+// by the rule, or nil, if the rule doesn't describe them.
+func ruleDescriptor(ctx context.Context, rule *discovery.Rule) protoreflect.MessageDescriptor {
+	if rule.Match.Message != nil {
+		return rule.Match.Message.Descriptor(ctx)
+	}
+
+	if rule.Mock == nil {
+		return nil
+	}
+
+	for _, r := range rule.Mock.OnMessage {
+		if r.Match != nil {
+			return r.Match.Descriptor(ctx)
+		}
+	}
+
+	return nil
+}
+
+func decodeMessage(ctx context.Context, d protoreflect.MessageDescriptor, bts []byte) journal.Message {
+	if d == nil {
+		return journal.Message{Raw: bts}
+	}
+
+	msg := dynamicpb.NewMessage(d)
+	if err := proto.Unmarshal(bts, msg); err != nil {
+		slog.DebugContext(ctx, "failed to decode message for the journal", slogx.Error(err))
+		return journal.Message{Raw: bts}
+	}
+
+	body, err := protojson.Marshal(msg)
+	if err != nil {
+		slog.DebugContext(ctx, "failed to encode message for the journal", slogx.Error(err))
+		return journal.Message{Raw: bts}
+	}
+
+	return journal.Message{Body: body}
+}
+
+// recordingStream keeps the messages, received from the client, in the exchange,
+// until the limits of the journal entry are exceeded.
+type recordingStream struct {
+	grpc.ServerStream
+	ex *exchange
+}
+
+// RecvMsg receives the message and records it.
+func (s recordingStream) RecvMsg(m any) error {
+	var bts []byte
+	target := m
+	if target == nil { // the caller discards the message, but we still need to record it
+		target = &bts
+	}
+
+	if err := s.ServerStream.RecvMsg(target); err != nil {
+		return err
+	}
+
+	ptr, ok := target.(*[]byte)
+	if !ok {
+		return nil
+	}
+
+	if s.ex.truncated || len(s.ex.received) >= journalMessages || s.ex.size+len(*ptr) > journalBytes {
+		s.ex.truncated = true
+		return nil
+	}
+
+	s.ex.received = append(s.ex.received, *ptr)
+	s.ex.size += len(*ptr)
+
+	return nil
+}
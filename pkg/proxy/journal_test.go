@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_journal(t *testing.T) {
+	reqTmpl, err := protodef.BuildMessage(`message StreamRequest {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.matcher) = "value != ''"];
+	}`)
+	require.NoError(t, err)
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			switch uri {
+			case "/groxy.testdata.ExampleService/Unary":
+				return discovery.Matches{{
+					Name:  "unary",
+					Match: discovery.RequestMatcher{Message: reqTmpl},
+					Mock:  &discovery.Mock{Status: status.New(codes.NotFound, "not found")},
+				}}
+			case "/groxy.testdata.ExampleService/ClientStream":
+				return discovery.Matches{{
+					Name: "client stream",
+					Mock: &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "ok"})},
+				}}
+			default:
+				return nil
+			}
+		},
+	}
+
+	j := journal.New(10)
+	cl := startProxy(t, matcher, WithJournal(j))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-request-id", "42")
+	_, err = cl.Unary(ctx, &grpctest.StreamRequest{Value: "hello"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "unmatched"})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return j.Count(journal.Filter{}) == 2 }, time.Second, 10*time.Millisecond)
+	entries := j.List(journal.Filter{})
+
+	assert.Equal(t, "/groxy.testdata.ExampleService/Unary", entries[0].Method)
+	assert.Equal(t, "unary", entries[0].Rule)
+	assert.Equal(t, []string{"42"}, entries[0].Header.Get("x-request-id"))
+	assert.Equal(t, journal.Status{Code: "NotFound", Message: "not found"}, entries[0].Status)
+	require.Len(t, entries[0].Messages, 1)
+	assert.JSONEq(t, `{"value": "hello"}`, string(entries[0].Messages[0].Body))
+
+	assert.Equal(t, "/groxy.testdata.ExampleService/ServerStream", entries[1].Method)
+	assert.Empty(t, entries[1].Rule)
+	assert.Equal(t, "Internal", entries[1].Status.Code)
+
+	t.Run("truncate long stream", func(t *testing.T) {
+		stream, err := cl.ClientStream(context.Background())
+		require.NoError(t, err)
+		for i := 0; i < journalMessages+50; i++ {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "hello"}))
+		}
+		_, err = stream.CloseAndRecv()
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool { return j.Count(journal.Filter{}) == 3 }, time.Second, 10*time.Millisecond)
+		entry := j.List(journal.Filter{})[2]
+		assert.Equal(t, "client stream", entry.Rule)
+		assert.Len(t, entry.Messages, journalMessages)
+		assert.True(t, entry.Truncated)
+		assert.False(t, entries[0].Truncated)
+	})
+}
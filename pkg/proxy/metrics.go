@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// metricsMiddleware reports every handled request to the metrics.
+func (s *Server) metricsMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+		start := time.Now()
+
+		ctx, ex := withExchange(ctx)
+		mtd, _ := grpc.Method(ctx)
+		ms := &measuringStream{ServerStream: grpcx.StreamWithContext(ctx, stream), metrics: s.metrics, method: mtd, ex: ex}
+		err := next(srv, ms)
+		ms.flush()
+
+		req := metrics.Request{
+			Method:   methodLabel(mtd, ex.rule),
+			Action:   ruleAction(ex.rule),
+			Code:     status.Code(err),
+			Duration: time.Since(start),
+		}
+
+		if ex.rule != nil {
+			req.Rule = ex.rule.Name
+		}
+
+		s.metrics.ObserveRequest(req)
+		return err
+	}
+}
+
+// methodLabel returns the method to be reported, or
+// metrics.MethodUnknown, if no rule has been matched.
+func methodLabel(mtd string, rule *discovery.Rule) string {
+	if rule == nil {
+		return metrics.MethodUnknown
+	}
+	return mtd
+}
+
+// ruleAction returns the action, taken by the rule, or
+// metrics.ActionUnmatched, if no rule has been matched.
+func ruleAction(rule *discovery.Rule) string {
+	switch {
+	case rule == nil:
+		return metrics.ActionUnmatched
+	case rule.Compare != nil && rule.Compare.Return == discovery.CompareReturnUpstream:
+		return metrics.ActionForward // the client gets the response of the upstream
+	case rule.Mock != nil:
+		return metrics.ActionMock
+	case rule.Forward != nil:
+		return metrics.ActionForward
+	default:
+		return metrics.ActionUnmatched
+	}
+}
+
+// measuringStream reports the sizes of the received and sent messages
+// as they pass. As the labels depend on the matched rule, the sizes of the
+// messages, received before the rule is matched, are kept until then, which
+// is the first message at most, or until the request is finished.
+type measuringStream struct {
+	grpc.ServerStream
+	metrics *metrics.Metrics
+	method  string
+	ex      *exchange
+
+	mu      sync.Mutex
+	pending []int // sizes of the received messages, not reported yet
+}
+
+// RecvMsg receives the message and reports its size.
+func (s *measuringStream) RecvMsg(m any) error {
+	var bts []byte
+	target := m
+	if target == nil { // the caller discards the message, but we still need to measure it
+		target = &bts
+	}
+
+	if err := s.ServerStream.RecvMsg(target); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ex.rule == nil {
+		s.pending = append(s.pending, messageSize(target))
+		return nil
+	}
+
+	s.flushLocked()
+	s.observe(metrics.DirectionReceived, messageSize(target))
+	return nil
+}
+
+// SendMsg sends the message and reports its size.
+func (s *measuringStream) SendMsg(m any) error {
+	if err := s.ServerStream.SendMsg(m); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.flushLocked()
+	s.observe(metrics.DirectionSent, messageSize(m))
+	return nil
+}
+
+// flush reports the sizes of the messages, received before the rule is matched.
+func (s *measuringStream) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushLocked()
+}
+
+func (s *measuringStream) flushLocked() {
+	for _, size := range s.pending {
+		s.observe(metrics.DirectionReceived, size)
+	}
+	s.pending = nil
+}
+
+func (s *measuringStream) observe(direction string, size int) {
+	msg := metrics.Message{
+		Method:    methodLabel(s.method, s.ex.rule),
+		Action:    ruleAction(s.ex.rule),
+		Direction: direction,
+		Size:      size,
+	}
+
+	if s.ex.rule != nil {
+		msg.Rule = s.ex.rule.Name
+	}
+
+	s.metrics.ObserveMessage(msg)
+}
+
+// messageSize returns the size of the message in the wire format.
+func messageSize(m any) int {
+	switch m := m.(type) {
+	case []byte:
+		return len(m)
+	case *[]byte:
+		return len(*m)
+	case proto.Message:
+		return proto.Size(m)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_metrics(t *testing.T) {
+	reqTmpl, err := protodef.BuildMessage(`message StreamRequest {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.matcher) = "value != ''"];
+	}`)
+	require.NoError(t, err)
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			if uri != "/groxy.testdata.ExampleService/Unary" {
+				return nil
+			}
+			return discovery.Matches{{
+				Name:  "unary",
+				Match: discovery.RequestMatcher{Message: reqTmpl},
+				Mock:  &discovery.Mock{Status: status.New(codes.NotFound, "not found")},
+			}}
+		},
+	}
+
+	m := metrics.New(nil)
+	j := journal.New(10)
+	cl := startProxy(t, matcher, WithMetrics(m), WithJournal(j))
+
+	_, err = cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "unmatched"})
+	require.NoError(t, err)
+
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+		return rec.Body.String()
+	}
+
+	require.Eventually(t, func() bool {
+		return strings.Contains(scrape(), `groxy_requests_total{action="unmatched"`)
+	}, time.Second, 10*time.Millisecond)
+
+	body := scrape()
+	assert.Contains(t, body, `groxy_requests_total{action="mock",code="NotFound",method="/groxy.testdata.ExampleService/Unary",rule="unary"} 1`)
+	assert.Contains(t, body, `groxy_requests_total{action="unmatched",code="Internal",method="unknown",rule=""} 1`)
+	assert.NotContains(t, body, `ExampleService/ServerStream`, "methods of unmatched requests must not be reported")
+	// the message, received to match the rule, is reported once the rule is matched
+	assert.Contains(t, body, `groxy_message_size_bytes_count{action="mock",direction="received",method="/groxy.testdata.ExampleService/Unary",rule="unary"} 1`)
+	assert.Contains(t, body, `groxy_message_size_bytes_sum{action="mock",direction="received",method="/groxy.testdata.ExampleService/Unary",rule="unary"} 7`)
+
+	// the journal shares the exchange with the metrics
+	require.Eventually(t, func() bool { return j.Count(journal.Filter{}) == 2 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "unary", j.List(journal.Filter{})[0].Rule)
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/cappuccinotm/slogx"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
@@ -66,6 +67,37 @@ func PassMetadata() Middleware {
 	}
 }
 
+// ClientSubjectKey is the metadata key, under which the subject
+// of the verified client certificate is passed to the rules.
+const ClientSubjectKey = "groxy-client-subject"
+
+// ClientSubject puts the subject of the verified client certificate, if any,
+// into the incoming metadata under the ClientSubjectKey. The value, sent
+// by the client itself, is dropped, so it can't be forged and isn't passed
+// to the upstreams.
+func ClientSubject() Middleware {
+	return func(next grpc.StreamHandler) grpc.StreamHandler {
+		return func(srv any, stream grpc.ServerStream) error {
+			ctx := stream.Context()
+			inMD, _ := metadata.FromIncomingContext(ctx)
+			outMD, _ := metadata.FromOutgoingContext(ctx)
+			inMD, outMD = inMD.Copy(), outMD.Copy()
+			inMD.Delete(ClientSubjectKey)
+			outMD.Delete(ClientSubjectKey)
+
+			if p, ok := peer.FromContext(ctx); ok {
+				if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+					inMD.Set(ClientSubjectKey, info.State.VerifiedChains[0][0].Subject.String())
+				}
+			}
+
+			ctx = metadata.NewIncomingContext(ctx, inMD)
+			ctx = metadata.NewOutgoingContext(ctx, outMD)
+			return next(srv, grpcx.StreamWithContext(ctx, stream))
+		}
+	}
+}
+
 // Health serves the health check requests.
 func Health(h *health.Server) Middleware {
 	return func(next grpc.StreamHandler) grpc.StreamHandler {
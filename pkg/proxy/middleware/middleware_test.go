@@ -3,6 +3,9 @@ package middleware
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"log/slog"
 	"testing"
 
@@ -16,7 +19,9 @@ import (
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/peer"
 )
 
 func TestAppInfo(t *testing.T) {
@@ -136,3 +141,40 @@ func TestHealth(t *testing.T) {
 	})
 
 }
+
+func TestClientSubject(t *testing.T) {
+	run := func(t *testing.T, ctx context.Context) (in, out metadata.MD) {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(ClientSubjectKey, "CN=forged", "x-key", "value"))
+		ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs(ClientSubjectKey, "CN=forged"))
+
+		err := ClientSubject()(func(_ any, stream grpc.ServerStream) error {
+			in, _ = metadata.FromIncomingContext(stream.Context())
+			out, _ = metadata.FromOutgoingContext(stream.Context())
+			return nil
+		})(nil, &mocks.ServerStreamMock{ContextFunc: func() context.Context { return ctx }})
+		require.NoError(t, err)
+		return in, out
+	}
+
+	t.Run("verified client certificate", func(t *testing.T) {
+		ctx := peer.NewContext(context.Background(), &peer.Peer{
+			AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{
+					Subject: pkix.Name{CommonName: "alice", Organization: []string{"Acme"}},
+				}}},
+			}},
+		})
+
+		in, out := run(t, ctx)
+		assert.Equal(t, []string{"CN=alice,O=Acme"}, in.Get(ClientSubjectKey))
+		assert.Equal(t, []string{"value"}, in.Get("x-key"))
+		assert.Empty(t, out.Get(ClientSubjectKey))
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		in, out := run(t, context.Background())
+		assert.Empty(t, in.Get(ClientSubjectKey))
+		assert.Equal(t, []string{"value"}, in.Get("x-key"))
+		assert.Empty(t, out.Get(ClientSubjectKey))
+	})
+}
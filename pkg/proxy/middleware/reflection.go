@@ -26,9 +26,12 @@ import (
 // by upstreaming the first request to each one and finding the
 // one that doesn't respond a NotFound status and then piping
 // the response back to the client.
+// If RulesFunc is set, services, mocked by the rules,
+// are reflected alongside the upstreams' ones.
 type Reflector struct {
 	Logger        *slog.Logger
 	UpstreamsFunc func() []discovery.Upstream
+	RulesFunc     func() []*discovery.Rule
 }
 
 // SRIClient is a shorthand for a server reflection stream client.
@@ -100,6 +103,8 @@ func (r Reflector) Middleware(next grpc.StreamHandler) grpc.StreamHandler {
 				slog.String("target", upstream.Target()))
 		}
 
+		mocks := r.describeMocks(ctx)
+
 		for {
 			recv := any(&rapi1.ServerReflectionRequest{})
 			if alpha {
@@ -115,7 +120,7 @@ func (r Reflector) Middleware(next grpc.StreamHandler) grpc.StreamHandler {
 				return status.Error(codes.Internal, "{groxy} failed to receive message")
 			}
 
-			resp, err := r.reflect(ctx, r.asV1Request(recv), clients)
+			resp, err := r.reflect(ctx, r.asV1Request(recv), clients, mocks)
 			if err != nil {
 				if st := grpcx.StatusFromError(err); st != nil && grpcx.ClientCode(st.Code()) {
 					return status.Errorf(st.Code(), "{groxy} received from one of upstreams: %s", st.Message())
@@ -141,6 +146,7 @@ func (r Reflector) reflect(
 	ctx context.Context,
 	req *rapi1.ServerReflectionRequest,
 	ups []SRIClient,
+	mocks *mockDescriptors,
 ) (*rapi1.ServerReflectionResponse, error) {
 	resps := make([]*rapi1.ServerReflectionResponse, len(ups))
 	ewg, ctx := errgroup.WithContext(ctx)
@@ -183,6 +189,8 @@ func (r Reflector) reflect(
 		return nil, fmt.Errorf("reflect: %w", err)
 	}
 
+	resps = append(resps, mocks.reflect(req))
+
 	return r.mergeResponses(ctx, req, resps)
 }
 
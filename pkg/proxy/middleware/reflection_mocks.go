@@ -0,0 +1,345 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc/codes"
+	rapi1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// snippetFile is the path of the files, compiled from the protobuf snippets.
+const snippetFile = "groxy-runtime-gen.proto"
+
+// literalURI matches the URI regexps, which name exactly one method,
+// once the anchors and escapes are stripped.
+var literalURI = regexp.MustCompile(`^/?((?:[A-Za-z_]\w*\.)*[A-Za-z_]\w*)/([A-Za-z_]\w*)$`)
+
+// mockDescriptors contains the descriptors of the services, synthesized from the mock rules.
+type mockDescriptors struct {
+	files    *protoregistry.Files
+	services []string
+}
+
+type mockedService struct {
+	name    protoreflect.FullName
+	methods []*mockedMethod
+}
+
+type mockedMethod struct {
+	name                         string
+	input, output                protoreflect.MessageDescriptor
+	clientStreams, serverStreams bool
+}
+
+// describeMocks synthesizes the descriptors of the services from the mock rules:
+// the URI gives the service and method names, the request matcher gives
+// the input type and the response gives the output type. Rules, which
+// URIs are not literal method names, are skipped.
+func (r Reflector) describeMocks(ctx context.Context) *mockDescriptors {
+	res := &mockDescriptors{files: &protoregistry.Files{}}
+	if r.RulesFunc == nil {
+		return res
+	}
+
+	for _, svc := range mockedServices(ctx, r.RulesFunc()) {
+		if err := res.register(svc); err != nil {
+			r.Logger.WarnContext(ctx, "failed to describe mocked service",
+				slog.String("service", string(svc.name)),
+				slogx.Error(err))
+			continue
+		}
+		res.services = append(res.services, string(svc.name))
+	}
+
+	return res
+}
+
+// reflect responds the request with the synthesized descriptors.
+func (m *mockDescriptors) reflect(req *rapi1.ServerReflectionRequest) *rapi1.ServerReflectionResponse {
+	switch req := req.MessageRequest.(type) {
+	case *rapi1.ServerReflectionRequest_FileByFilename:
+		if fd, err := m.files.FindFileByPath(req.FileByFilename); err == nil {
+			return fileDescriptorResponse(fd)
+		}
+	case *rapi1.ServerReflectionRequest_FileContainingSymbol:
+		d, err := m.files.FindDescriptorByName(protoreflect.FullName(req.FileContainingSymbol))
+		if err == nil {
+			return fileDescriptorResponse(d.ParentFile())
+		}
+	case *rapi1.ServerReflectionRequest_ListServices:
+		if len(m.services) > 0 {
+			resp := &rapi1.ListServiceResponse{}
+			for _, name := range m.services {
+				resp.Service = append(resp.Service, &rapi1.ServiceResponse{Name: name})
+			}
+			return &rapi1.ServerReflectionResponse{
+				MessageResponse: &rapi1.ServerReflectionResponse_ListServicesResponse{ListServicesResponse: resp},
+			}
+		}
+	}
+
+	return &rapi1.ServerReflectionResponse{
+		MessageResponse: &rapi1.ServerReflectionResponse_ErrorResponse{
+			ErrorResponse: &rapi1.ErrorResponse{
+				ErrorCode:    int32(codes.NotFound),
+				ErrorMessage: "{groxy} not found among the mocks",
+			},
+		},
+	}
+}
+
+// register builds the file with the service and registers it along with
+// the files of the messages, used by the service.
+func (m *mockDescriptors) register(svc mockedService) error {
+	pkg, name := "", string(svc.name)
+	if idx := strings.LastIndex(name, "."); idx >= 0 {
+		pkg, name = name[:idx], name[idx+1:]
+	}
+
+	sdp := &descriptorpb.ServiceDescriptorProto{Name: proto.String(name)}
+	deps := map[string]bool{}
+
+	for _, mtd := range svc.methods {
+		in, err := m.message(svc.name, mtd.name, "request", mtd.input)
+		if err != nil {
+			return fmt.Errorf("register input type of method %q: %w", mtd.name, err)
+		}
+
+		out, err := m.message(svc.name, mtd.name, "response", mtd.output)
+		if err != nil {
+			return fmt.Errorf("register output type of method %q: %w", mtd.name, err)
+		}
+
+		deps[in.ParentFile().Path()], deps[out.ParentFile().Path()] = true, true
+		sdp.Method = append(sdp.Method, &descriptorpb.MethodDescriptorProto{
+			Name:            proto.String(mtd.name),
+			InputType:       proto.String("." + string(in.FullName())),
+			OutputType:      proto.String("." + string(out.FullName())),
+			ClientStreaming: proto.Bool(mtd.clientStreams),
+			ServerStreaming: proto.Bool(mtd.serverStreams),
+		})
+	}
+
+	// the service may be already declared in one of the loaded proto files
+	if _, err := m.files.FindDescriptorByName(svc.name); err == nil {
+		return nil
+	}
+
+	fdp := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("groxy/mocks/" + string(svc.name) + ".proto"),
+		Syntax:  proto.String("proto3"),
+		Service: []*descriptorpb.ServiceDescriptorProto{sdp},
+	}
+	if pkg != "" {
+		fdp.Package = proto.String(pkg)
+	}
+
+	for dep := range deps {
+		fdp.Dependency = append(fdp.Dependency, dep)
+	}
+	sort.Strings(fdp.Dependency)
+
+	fd, err := protodesc.NewFile(fdp, m.files)
+	if err != nil {
+		return fmt.Errorf("build service file: %w", err)
+	}
+
+	return m.files.RegisterFile(fd)
+}
+
+// message registers the file of the message type and returns the registered
+// descriptor. Messages, compiled from the snippets, are declared without
+// a package, thus they're moved into a package, unique for the method.
+// If the type is unknown, google.protobuf.Empty is used instead.
+func (m *mockDescriptors) message(svc protoreflect.FullName, mtd, kind string, md protoreflect.MessageDescriptor) (protoreflect.MessageDescriptor, error) {
+	if md == nil {
+		md = (&emptypb.Empty{}).ProtoReflect().Descriptor()
+	}
+
+	if md.ParentFile().Path() != snippetFile {
+		if err := m.registerFile(md.ParentFile()); err != nil {
+			return nil, err
+		}
+		return md, nil
+	}
+
+	pkg := strings.ToLower("groxy.mocks." + string(svc) + "." + mtd + "." + kind)
+	fdp := protodesc.ToFileDescriptorProto(md.ParentFile())
+	fdp.Name = proto.String(strings.ReplaceAll(pkg, ".", "/") + ".proto")
+	relocate(fdp, pkg)
+
+	imports := md.ParentFile().Imports()
+	for i := 0; i < imports.Len(); i++ {
+		if err := m.registerFile(imports.Get(i).FileDescriptor); err != nil {
+			return nil, err
+		}
+	}
+
+	fd, err := protodesc.NewFile(fdp, m.files)
+	if err != nil {
+		return nil, fmt.Errorf("build file of %s: %w", md.FullName(), err)
+	}
+
+	if err = m.files.RegisterFile(fd); err != nil {
+		return nil, fmt.Errorf("register file of %s: %w", md.FullName(), err)
+	}
+
+	return fd.Messages().ByName(md.Name()), nil
+}
+
+// registerFile registers the file along with its imports, if not registered yet.
+func (m *mockDescriptors) registerFile(fd protoreflect.FileDescriptor) error {
+	if _, err := m.files.FindFileByPath(fd.Path()); err == nil {
+		return nil
+	}
+
+	imports := fd.Imports()
+	for i := 0; i < imports.Len(); i++ {
+		if err := m.registerFile(imports.Get(i).FileDescriptor); err != nil {
+			return err
+		}
+	}
+
+	if err := m.files.RegisterFile(fd); err != nil {
+		return fmt.Errorf("register file %q: %w", fd.Path(), err)
+	}
+
+	return nil
+}
+
+// relocate moves the declarations of the package-less file into the package,
+// updating the references to the types, declared in the file.
+func relocate(fdp *descriptorpb.FileDescriptorProto, pkg string) {
+	local := map[string]bool{}
+	for _, md := range fdp.MessageType {
+		local[md.GetName()] = true
+	}
+	for _, ed := range fdp.EnumType {
+		local[ed.GetName()] = true
+	}
+
+	var walk func(md *descriptorpb.DescriptorProto)
+	walk = func(md *descriptorpb.DescriptorProto) {
+		for _, fd := range md.Field {
+			top, _, _ := strings.Cut(strings.TrimPrefix(fd.GetTypeName(), "."), ".")
+			if local[top] {
+				fd.TypeName = proto.String("." + pkg + fd.GetTypeName())
+			}
+		}
+		for _, nested := range md.NestedType {
+			walk(nested)
+		}
+	}
+
+	for _, md := range fdp.MessageType {
+		walk(md)
+	}
+
+	fdp.Package = proto.String(pkg)
+}
+
+// fileDescriptorResponse responds the file along with its transitive imports.
+func fileDescriptorResponse(fd protoreflect.FileDescriptor) *rapi1.ServerReflectionResponse {
+	resp := &rapi1.FileDescriptorResponse{}
+	seen := map[string]bool{}
+
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+
+		bts, err := proto.Marshal(protodesc.ToFileDescriptorProto(fd))
+		if err != nil { // should never happen, as the descriptor is built from the valid file
+			return
+		}
+		resp.FileDescriptorProto = append(resp.FileDescriptorProto, bts)
+
+		imports := fd.Imports()
+		for i := 0; i < imports.Len(); i++ {
+			add(imports.Get(i).FileDescriptor)
+		}
+	}
+	add(fd)
+
+	return &rapi1.ServerReflectionResponse{
+		MessageResponse: &rapi1.ServerReflectionResponse_FileDescriptorResponse{FileDescriptorResponse: resp},
+	}
+}
+
+// mockedServices groups the mock rules by the services and methods they mock.
+// The first rule, which defines the type, wins.
+func mockedServices(ctx context.Context, rules []*discovery.Rule) []mockedService {
+	var services []mockedService
+	svcIdx := map[protoreflect.FullName]int{}
+	mtdIdx := map[string]*mockedMethod{}
+
+	for _, rule := range rules {
+		if rule.Mock == nil || rule.Match.URI == nil {
+			continue
+		}
+
+		svcName, mtdName, ok := literalMethod(rule.Match.URI)
+		if !ok {
+			continue
+		}
+
+		idx, ok := svcIdx[svcName]
+		if !ok {
+			idx = len(services)
+			svcIdx[svcName] = idx
+			services = append(services, mockedService{name: svcName})
+		}
+
+		key := string(svcName) + "/" + mtdName
+		mtd, ok := mtdIdx[key]
+		if !ok {
+			mtd = &mockedMethod{name: mtdName}
+			mtdIdx[key] = mtd
+			services[idx].methods = append(services[idx].methods, mtd)
+		}
+
+		input, output := rule.MockTypes(ctx)
+		if mtd.input == nil {
+			mtd.input = input
+		}
+		if mtd.output == nil {
+			mtd.output = output
+		}
+
+		clientStreams, serverStreams := rule.Mock.Streams()
+		mtd.clientStreams = mtd.clientStreams || clientStreams
+		mtd.serverStreams = mtd.serverStreams || serverStreams
+	}
+
+	return services
+}
+
+// literalMethod extracts the service and method names from the URI regexp,
+// if it matches only one method, e.g. "^/pkg.Service/Method$".
+// Unescaped dots are treated as literal ones, as they're commonly left as is.
+func literalMethod(re *regexp.Regexp) (svc protoreflect.FullName, mtd string, ok bool) {
+	s := strings.TrimSuffix(strings.TrimPrefix(re.String(), "^"), "$")
+	s = strings.ReplaceAll(s, `\.`, ".")
+
+	m := literalURI.FindStringSubmatch(s)
+	if m == nil {
+		return "", "", false
+	}
+
+	return protoreflect.FullName(m[1]), m[2], true
+}
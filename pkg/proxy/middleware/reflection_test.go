@@ -17,6 +17,9 @@ import (
 	"google.golang.org/protobuf/proto"
 	"github.com/Semior001/groxy/pkg/grpcx"
 	"github.com/stretchr/testify/assert"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"regexp"
 )
 
 func TestReflector_MiddlewareUpstreamError(t *testing.T) {
@@ -222,3 +225,115 @@ func TestReflector_Middleware(t *testing.T) {
 		})
 	})
 }
+
+func TestReflector_MiddlewareMocks(t *testing.T) {
+	backend := grpc.NewServer()
+	grpctest.RegisterExampleServiceServer(backend, &grpctest.Server{})
+	reflection.Register(backend)
+	backendAddr := grpctest.StartServer(t, backend)
+	t.Cleanup(backend.GracefulStop)
+
+	upstreamConn, err := grpc.Dial(backendAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, upstreamConn.Close()) })
+
+	definer := protodef.NewDefiner()
+	build := func(def string) protodef.Template {
+		tmpl, err := definer.BuildTarget(def)
+		require.NoError(t, err)
+		return tmpl
+	}
+
+	reply := `message Reply {
+		option (groxypb.target) = true;
+		string text = 1 [(groxypb.value) = "hello"];
+		Nested nested = 2;
+	}
+	message Nested { int32 count = 1; }`
+
+	rules := []*discovery.Rule{
+		{
+			Match: discovery.RequestMatcher{
+				URI: regexp.MustCompile(`^/acme.mock.v1.Greeter/Hello$`),
+				Message: build(`message HelloRequest {
+					option (groxypb.target) = true;
+					string name = 1 [(groxypb.value) = "world"];
+				}`),
+			},
+			Mock: &discovery.Mock{Body: build(reply)},
+		},
+		{
+			Match: discovery.RequestMatcher{URI: regexp.MustCompile(`/acme\.mock\.v1\.Greeter/Watch`)},
+			Mock:  &discovery.Mock{Stream: []discovery.StreamMessage{{Body: build(reply)}}},
+		},
+		{ // not a literal method name
+			Match: discovery.RequestMatcher{URI: regexp.MustCompile(`^/acme.mock.v1.Other/.*$`)},
+			Mock:  &discovery.Mock{Body: build(reply)},
+		},
+		{ // forwarded, thus reflected by the upstream
+			Match:   discovery.RequestMatcher{URI: regexp.MustCompile(`^/acme.mock.v1.Forwarded/Call$`)},
+			Forward: &discovery.Forward{},
+		},
+	}
+
+	mw := Reflector{
+		UpstreamsFunc: func() []discovery.Upstream {
+			return []discovery.Upstream{discovery.ClientConn{
+				ConnName:        "backend",
+				ServeReflection: true,
+				ClientConn:      upstreamConn,
+			}}
+		},
+		RulesFunc: func() []*discovery.Rule { return rules },
+	}.Middleware(func(any, grpc.ServerStream) error {
+		return status.Error(codes.Internal, "should not be called")
+	})
+
+	srv := grpc.NewServer(grpc.UnknownServiceHandler(func(srv any, stream grpc.ServerStream) error {
+		return mw(srv, stream)
+	}))
+	srvAddr := grpctest.StartServer(t, srv)
+	t.Cleanup(srv.GracefulStop)
+
+	conn, err := grpc.Dial(srvAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, conn.Close()) })
+
+	client := grpcreflect.NewClientAuto(context.Background(), conn)
+	t.Cleanup(client.Reset)
+
+	services, err := client.ListServices()
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"acme.mock.v1.Greeter",
+		"groxy.testdata.ExampleService",
+		"grpc.reflection.v1.ServerReflection",
+		"grpc.reflection.v1alpha.ServerReflection",
+	}, services)
+
+	svc, err := client.ResolveService("acme.mock.v1.Greeter")
+	require.NoError(t, err)
+	require.Len(t, svc.GetMethods(), 2)
+
+	hello := svc.FindMethodByName("Hello")
+	require.NotNil(t, hello)
+	assert.False(t, hello.IsClientStreaming())
+	assert.False(t, hello.IsServerStreaming())
+	assert.Equal(t, "groxy.mocks.acme.mock.v1.greeter.hello.request.HelloRequest",
+		hello.GetInputType().GetFullyQualifiedName())
+	assert.Equal(t, "groxy.mocks.acme.mock.v1.greeter.hello.response.Reply",
+		hello.GetOutputType().GetFullyQualifiedName())
+	assert.Equal(t, "groxy.mocks.acme.mock.v1.greeter.hello.response.Nested",
+		hello.GetOutputType().FindFieldByName("nested").GetMessageType().GetFullyQualifiedName())
+
+	watch := svc.FindMethodByName("Watch")
+	require.NotNil(t, watch)
+	assert.False(t, watch.IsClientStreaming())
+	assert.True(t, watch.IsServerStreaming())
+	assert.Equal(t, "google.protobuf.Empty", watch.GetInputType().GetFullyQualifiedName())
+	assert.Equal(t, "groxy.mocks.acme.mock.v1.greeter.watch.response.Reply",
+		watch.GetOutputType().GetFullyQualifiedName())
+
+	_, err = client.ResolveService("groxy.testdata.ExampleService")
+	require.NoError(t, err)
+}
@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// mirrorBuffer is the number of the requests, waiting to be sent to the
+// shadow upstream. If the shadow upstream falls behind further, the
+// mirrored call is canceled, so that it never slows down the client.
+const mirrorBuffer = 64
+
+// Limits of the responses of the call, kept to be compared. Once either of
+// them is exceeded, the responses are dropped and aren't compared.
+const (
+	outcomeMessages = 100
+	outcomeBytes    = 1 << 20
+)
+
+// mirrorMiddleware sends the copies of the requests, matched by the rule
+// with the mirror, to the shadow upstream. Once both calls are done, the
+// responses of the shadow upstream are compared to the ones, sent to the
+// client, and discarded.
+func (s *Server) mirrorMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+
+		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
+		if !ok || match.Mirror == nil || !match.Mirror.Samples() {
+			return next(srv, stream)
+		}
+
+		sh := s.startShadow(ctx, match)
+		if firstRecv, _ := ctx.Value(ctxFirstRecv).([]byte); firstRecv != nil {
+			sh.send(firstRecv)
+		}
+
+		cs := &copyingStream{ServerStream: stream, onRecv: sh.send}
+		err := next(srv, cs)
+
+		sh.finish(cs.outcome(err))
+
+		return err
+	}
+}
+
+// outcome is the result of the call: the messages, sent in response, and the status.
+type outcome struct {
+	responses [][]byte
+	size      int  // total size of the responses
+	tooLarge  bool // the responses exceeded the limits and were dropped
+	status    *status.Status
+}
+
+// keep adds the response to the outcome, unless the
+// responses exceed the limits, in which case all of them are dropped.
+func (o *outcome) keep(msg []byte) {
+	if o.tooLarge {
+		return
+	}
+
+	o.size += len(msg)
+	if len(o.responses) == outcomeMessages || o.size > outcomeBytes {
+		o.responses, o.tooLarge = nil, true
+		return
+	}
+
+	o.responses = append(o.responses, msg)
+}
+
+// shadow is the mirrored call to the shadow upstream.
+type shadow struct {
+	cancel context.CancelFunc
+
+	mu      sync.Mutex
+	closed  bool
+	lagged  bool
+	reqs    chan []byte
+	primary chan outcome
+}
+
+// startShadow starts the mirrored call in the background. The call outlives
+// the request of the client up to the timeout of the mirror, to compare
+// the responses once both calls are done.
+func (s *Server) startShadow(ctx context.Context, rule *discovery.Rule) *shadow {
+	mtd, _ := grpc.Method(ctx)
+	shadowCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rule.Mirror.Timeout)
+
+	sh := &shadow{
+		cancel:  cancel,
+		reqs:    make(chan []byte, mirrorBuffer),
+		primary: make(chan outcome, 1),
+	}
+
+	go func() {
+		defer cancel()
+
+		got, err := callShadow(shadowCtx, rule.Mirror.Upstream, mtd, sh.reqs)
+		if err == nil && shadowCtx.Err() != nil {
+			err = shadowCtx.Err()
+		}
+
+		want := <-sh.primary
+
+		sh.mu.Lock()
+		if sh.lagged {
+			err = errors.New("shadow upstream fell behind the client")
+		}
+		sh.mu.Unlock()
+
+		s.reportMirror(ctx, rule, mtd, want, got, err)
+	}()
+
+	return sh
+}
+
+// send passes the copy of the request to the shadow upstream, if it keeps up.
+func (sh *shadow) send(msg []byte) {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	if sh.closed || sh.lagged {
+		return
+	}
+
+	select {
+	case sh.reqs <- msg:
+	default:
+		sh.lagged = true
+		sh.cancel()
+	}
+}
+
+// finish closes the requests to the shadow upstream and passes
+// the outcome of the primary call to compare with.
+func (sh *shadow) finish(primary outcome) {
+	sh.mu.Lock()
+	if !sh.closed {
+		sh.closed = true
+		close(sh.reqs)
+	}
+	sh.mu.Unlock()
+
+	sh.primary <- primary
+}
+
+// callShadow makes the call to the shadow upstream with the requests
+// from the channel and returns its outcome. The error is returned only
+// if the call couldn't be made.
+func callShadow(ctx context.Context, up discovery.Upstream, mtd string, reqs <-chan []byte) (outcome, error) {
+	upstream, err := up.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, mtd,
+		grpc.ForceCodec(grpcx.RawBytesCodec{}))
+	if err != nil {
+		return outcome{}, fmt.Errorf("create stream: %w", err)
+	}
+
+	go func() {
+		for msg := range reqs {
+			if err := upstream.SendMsg(msg); err != nil {
+				return // the error is returned by RecvMsg
+			}
+		}
+		_ = upstream.CloseSend()
+	}()
+
+	var res outcome
+	for {
+		var msg []byte
+		if err = upstream.RecvMsg(&msg); err != nil {
+			break
+		}
+		res.keep(msg)
+	}
+
+	if errors.Is(err, io.EOF) {
+		res.status = status.New(codes.OK, "")
+	} else {
+		res.status = status.Convert(err)
+	}
+
+	return res, nil
+}
+
+// reportMirror logs and counts the result of the comparison of the responses.
+func (s *Server) reportMirror(ctx context.Context, rule *discovery.Rule, mtd string, want, got outcome, err error) {
+	attrs := []any{slog.String("rule", rule.Name), slog.String("shadow_upstream", rule.Mirror.Upstream.Name())}
+
+	result := metrics.ResultMatch
+	switch {
+	case err != nil:
+		result = metrics.ResultError
+		slog.WarnContext(ctx, "failed to mirror the request", append(attrs, slogx.Error(err))...)
+	case want.tooLarge || got.tooLarge:
+		result = metrics.ResultTooLarge
+		slog.WarnContext(ctx, "responses are too large to compare with the shadow upstream", attrs...)
+	default:
+		// the call is done, but its types might still have to be reflected
+		typesCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), rule.Mirror.Timeout)
+		defer cancel()
+
+		if diff := diffOutcomes(s.types.Output(typesCtx, rule, mtd), want, got); len(diff) > 0 {
+			result = metrics.ResultMismatch
+			slog.WarnContext(ctx, "shadow upstream responded differently", append(attrs, slog.Any("diff", diff))...)
+		} else {
+			slog.DebugContext(ctx, "shadow upstream responded the same", attrs...)
+		}
+	}
+
+	if s.metrics != nil {
+		s.metrics.ObserveMirror(metrics.Mirror{
+			Method:   mtd,
+			Rule:     rule.Name,
+			Upstream: rule.Mirror.Upstream.Name(),
+			Result:   result,
+		})
+	}
+}
+
+// diffOutcomes describes the differences between the outcomes of the calls,
+// or returns nil if they're the same. Messages are compared field by field,
+// if their type is known, and byte by byte otherwise.
+func diffOutcomes(desc protoreflect.MessageDescriptor, a, b outcome) []string {
+	var res []string
+	if a.status.Code() != b.status.Code() {
+		res = append(res, fmt.Sprintf("status: %s != %s", a.status.Code(), b.status.Code()))
+	}
+
+	if len(a.responses) != len(b.responses) {
+		res = append(res, fmt.Sprintf("messages: %d != %d", len(a.responses), len(b.responses)))
+	}
+
+	for idx := range min(len(a.responses), len(b.responses)) {
+		if bytes.Equal(a.responses[idx], b.responses[idx]) {
+			continue
+		}
+
+		if desc == nil {
+			res = append(res, fmt.Sprintf("message #%d differs", idx))
+			continue
+		}
+
+		ma, mb := dynamicpb.NewMessage(desc), dynamicpb.NewMessage(desc)
+		if proto.Unmarshal(a.responses[idx], ma) != nil || proto.Unmarshal(b.responses[idx], mb) != nil {
+			res = append(res, fmt.Sprintf("message #%d differs", idx))
+			continue
+		}
+
+		for _, d := range protodef.Diff(ma, mb) {
+			res = append(res, fmt.Sprintf("message #%d: %s", idx, d))
+		}
+	}
+
+	return res
+}
+
+// copyingStream passes the copies of the received messages
+// to the callback and keeps the copies of the sent ones.
+type copyingStream struct {
+	grpc.ServerStream
+	onRecv func([]byte)
+
+	mu   sync.Mutex
+	sent outcome
+}
+
+// RecvMsg receives the message from the client and passes its copy to the callback.
+func (s *copyingStream) RecvMsg(m any) error {
+	var bts []byte
+	target := m
+	if target == nil { // the caller discards the message, but it still has to be copied
+		target = &bts
+	}
+
+	if err := s.ServerStream.RecvMsg(target); err != nil {
+		return err
+	}
+
+	if msg, err := (grpcx.RawBytesCodec{}).Marshal(target); err == nil {
+		s.onRecv(msg)
+	}
+
+	return nil
+}
+
+// SendMsg keeps the message and sends it to the client.
+func (s *copyingStream) SendMsg(m any) error {
+	if msg, err := (grpcx.RawBytesCodec{}).Marshal(m); err == nil {
+		s.mu.Lock()
+		s.sent.keep(msg)
+		s.mu.Unlock()
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
+
+// outcome returns the outcome of the call with the copies of the sent
+// messages and the status of the error, returned by the handler.
+func (s *copyingStream) outcome(err error) outcome {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := s.sent
+	res.responses = slices.Clone(res.responses)
+	res.status = status.Convert(err)
+	return res
+}
@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+func TestServer_mirror(t *testing.T) {
+	shadowReqs := make(chan string, 10)
+	shadowConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			shadowReqs <- req.Value
+			if req.Value == "slow" {
+				time.Sleep(300 * time.Millisecond)
+			}
+			return &grpctest.StreamResponse{Value: req.Value}, nil
+		},
+		ClientStreamFunc: grpctest.Sum,
+		ServerStreamFunc: func(req *grpctest.StreamRequest, stream grpctest.ExampleService_ServerStreamServer) error {
+			for range outcomeMessages + 1 {
+				if err := stream.Send(&grpctest.StreamResponse{Value: req.Value}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	})
+
+	mirror := &discovery.Mirror{
+		Upstream:   discovery.ClientConn{ConnName: "shadow", ClientConn: shadowConn},
+		Percentage: 100,
+		Timeout:    100 * time.Millisecond,
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			if uri == "/groxy.testdata.ExampleService/ServerStream" {
+				return discovery.Matches{{
+					Name:    "server stream",
+					Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: mirror.Upstream}}},
+					Mirror:  mirror,
+				}}
+			}
+			if uri == "/groxy.testdata.ExampleService/ClientStream" {
+				return discovery.Matches{{
+					Name:   "stream",
+					Mock:   &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "6"})},
+					Mirror: mirror,
+				}}
+			}
+			return discovery.Matches{{
+				Name:   "unary",
+				Mock:   &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "hello"})},
+				Mirror: mirror,
+			}}
+		},
+	}
+
+	m := metrics.New(nil)
+	cl := startProxy(t, matcher, WithMetrics(m))
+
+	mirrored := func(mtd, rule, result string) func() bool {
+		return func() bool {
+			rec := httptest.NewRecorder()
+			m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", http.NoBody))
+			return strings.Contains(rec.Body.String(), fmt.Sprintf(
+				`groxy_mirrored_requests_total{method="/groxy.testdata.ExampleService/%s",result=%q,rule=%q,upstream="shadow"} 1`,
+				mtd, result, rule))
+		}
+	}
+
+	t.Run("match", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value)
+		assert.Equal(t, "hello", <-shadowReqs)
+		assert.Eventually(t, mirrored("Unary", "unary", metrics.ResultMatch), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "bye"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value, "the client gets the primary response")
+		assert.Equal(t, "bye", <-shadowReqs)
+		assert.Eventually(t, mirrored("Unary", "unary", metrics.ResultMismatch), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		start := time.Now()
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "slow"})
+		require.NoError(t, err)
+		assert.Equal(t, "hello", resp.Value)
+		assert.Less(t, time.Since(start), 100*time.Millisecond, "the shadow doesn't slow down the client")
+		assert.Equal(t, "slow", <-shadowReqs)
+		assert.Eventually(t, mirrored("Unary", "unary", metrics.ResultError), time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("client stream", func(t *testing.T) {
+		stream, err := cl.ClientStream(context.Background())
+		require.NoError(t, err)
+		for _, v := range []string{"1", "2", "3"} {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: v}))
+		}
+		resp, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.Equal(t, "6", resp.Value)
+		assert.Eventually(t, mirrored("ClientStream", "stream", metrics.ResultMatch), time.Second, 10*time.Millisecond,
+			"the shadow gets all messages of the stream")
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "many"})
+		require.NoError(t, err)
+
+		received := 0
+		for {
+			if _, err = stream.Recv(); err != nil {
+				break
+			}
+			received++
+		}
+		require.ErrorIs(t, err, io.EOF)
+		assert.Equal(t, outcomeMessages+1, received, "the client gets all the messages")
+		assert.Eventually(t, mirrored("ServerStream", "server stream", metrics.ResultTooLarge), time.Second, 10*time.Millisecond)
+	})
+}
+
+func TestDiffOutcomes(t *testing.T) {
+	encode := func(v string) []byte {
+		bts, err := proto.Marshal(&grpctest.StreamResponse{Value: v})
+		require.NoError(t, err)
+		return bts
+	}
+
+	ok := status.New(codes.OK, "")
+	desc := (&grpctest.StreamResponse{}).ProtoReflect().Descriptor()
+
+	tbl := []struct {
+		name string
+		desc protoreflect.MessageDescriptor
+		a, b outcome
+		want []string
+	}{
+		{
+			name: "same",
+			desc: desc,
+			a:    outcome{responses: [][]byte{encode("a")}, status: ok},
+			b:    outcome{responses: [][]byte{encode("a")}, status: ok},
+		},
+		{
+			name: "fields",
+			desc: desc,
+			a:    outcome{responses: [][]byte{encode("a"), encode("b")}, status: ok},
+			b:    outcome{responses: [][]byte{encode("a"), encode("c")}, status: ok},
+			want: []string{`message #1: value: "b" != "c"`},
+		},
+		{
+			name: "unknown type",
+			a:    outcome{responses: [][]byte{encode("a")}, status: ok},
+			b:    outcome{responses: [][]byte{encode("b")}, status: ok},
+			want: []string{"message #0 differs"},
+		},
+		{
+			name: "status and messages",
+			desc: desc,
+			a:    outcome{responses: [][]byte{encode("a")}, status: ok},
+			b:    outcome{status: status.New(codes.NotFound, "")},
+			want: []string{"status: OK != NotFound", "messages: 1 != 0"},
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, diffOutcomes(tt.desc, tt.a, tt.b))
+		})
+	}
+}
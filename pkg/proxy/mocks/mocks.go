@@ -12,31 +12,50 @@ import (
 
 // MatcherMock is a mock implementation of proxy.Matcher.
 //
-// 	func TestSomethingThatUsesMatcher(t *testing.T) {
+//	func TestSomethingThatUsesMatcher(t *testing.T) {
 //
-// 		// make and configure a mocked proxy.Matcher
-// 		mockedMatcher := &MatcherMock{
-// 			MatchMetadataFunc: func(s string, mD metadata.MD) discovery.Matches {
-// 				panic("mock out the MatchMetadata method")
-// 			},
-// 			UpstreamsFunc: func() []discovery.Upstream {
-// 				panic("mock out the Upstreams method")
-// 			},
-// 		}
+//		// make and configure a mocked proxy.Matcher
+//		mockedMatcher := &MatcherMock{
+//			AdvanceScenarioFunc: func(rule *discovery.Rule, stringToV map[string]any) map[string]any {
+//				panic("mock out the AdvanceScenario method")
+//			},
+//			MatchMetadataFunc: func(s string, mD metadata.MD) discovery.Matches {
+//				panic("mock out the MatchMetadata method")
+//			},
+//			RulesFunc: func() []*discovery.Rule {
+//				panic("mock out the Rules method")
+//			},
+//			UpstreamsFunc: func() []discovery.Upstream {
+//				panic("mock out the Upstreams method")
+//			},
+//		}
 //
-// 		// use mockedMatcher in code that requires proxy.Matcher
-// 		// and then make assertions.
+//		// use mockedMatcher in code that requires proxy.Matcher
+//		// and then make assertions.
 //
-// 	}
+//	}
 type MatcherMock struct {
+	// AdvanceScenarioFunc mocks the AdvanceScenario method.
+	AdvanceScenarioFunc func(rule *discovery.Rule, stringToV map[string]any) map[string]any
+
 	// MatchMetadataFunc mocks the MatchMetadata method.
 	MatchMetadataFunc func(s string, mD metadata.MD) discovery.Matches
 
+	// RulesFunc mocks the Rules method.
+	RulesFunc func() []*discovery.Rule
+
 	// UpstreamsFunc mocks the Upstreams method.
 	UpstreamsFunc func() []discovery.Upstream
 
 	// calls tracks calls to the methods.
 	calls struct {
+		// AdvanceScenario holds details about calls to the AdvanceScenario method.
+		AdvanceScenario []struct {
+			// Rule is the rule argument value.
+			Rule *discovery.Rule
+			// StringToV is the stringToV argument value.
+			StringToV map[string]any
+		}
 		// MatchMetadata holds details about calls to the MatchMetadata method.
 		MatchMetadata []struct {
 			// S is the s argument value.
@@ -44,12 +63,53 @@ type MatcherMock struct {
 			// MD is the mD argument value.
 			MD metadata.MD
 		}
+		// Rules holds details about calls to the Rules method.
+		Rules []struct {
+		}
 		// Upstreams holds details about calls to the Upstreams method.
 		Upstreams []struct {
 		}
 	}
-	lockMatchMetadata sync.RWMutex
-	lockUpstreams     sync.RWMutex
+	lockAdvanceScenario sync.RWMutex
+	lockMatchMetadata   sync.RWMutex
+	lockRules           sync.RWMutex
+	lockUpstreams       sync.RWMutex
+}
+
+// AdvanceScenario calls AdvanceScenarioFunc.
+func (mock *MatcherMock) AdvanceScenario(rule *discovery.Rule, stringToV map[string]any) map[string]any {
+	if mock.AdvanceScenarioFunc == nil {
+		panic("MatcherMock.AdvanceScenarioFunc: method is nil but Matcher.AdvanceScenario was just called")
+	}
+	callInfo := struct {
+		Rule      *discovery.Rule
+		StringToV map[string]any
+	}{
+		Rule:      rule,
+		StringToV: stringToV,
+	}
+	mock.lockAdvanceScenario.Lock()
+	mock.calls.AdvanceScenario = append(mock.calls.AdvanceScenario, callInfo)
+	mock.lockAdvanceScenario.Unlock()
+	return mock.AdvanceScenarioFunc(rule, stringToV)
+}
+
+// AdvanceScenarioCalls gets all the calls that were made to AdvanceScenario.
+// Check the length with:
+//
+//	len(mockedMatcher.AdvanceScenarioCalls())
+func (mock *MatcherMock) AdvanceScenarioCalls() []struct {
+	Rule      *discovery.Rule
+	StringToV map[string]any
+} {
+	var calls []struct {
+		Rule      *discovery.Rule
+		StringToV map[string]any
+	}
+	mock.lockAdvanceScenario.RLock()
+	calls = mock.calls.AdvanceScenario
+	mock.lockAdvanceScenario.RUnlock()
+	return calls
 }
 
 // MatchMetadata calls MatchMetadataFunc.
@@ -72,7 +132,8 @@ func (mock *MatcherMock) MatchMetadata(s string, mD metadata.MD) discovery.Match
 
 // MatchMetadataCalls gets all the calls that were made to MatchMetadata.
 // Check the length with:
-//     len(mockedMatcher.MatchMetadataCalls())
+//
+//	len(mockedMatcher.MatchMetadataCalls())
 func (mock *MatcherMock) MatchMetadataCalls() []struct {
 	S  string
 	MD metadata.MD
@@ -87,6 +148,33 @@ func (mock *MatcherMock) MatchMetadataCalls() []struct {
 	return calls
 }
 
+// Rules calls RulesFunc.
+func (mock *MatcherMock) Rules() []*discovery.Rule {
+	if mock.RulesFunc == nil {
+		panic("MatcherMock.RulesFunc: method is nil but Matcher.Rules was just called")
+	}
+	callInfo := struct {
+	}{}
+	mock.lockRules.Lock()
+	mock.calls.Rules = append(mock.calls.Rules, callInfo)
+	mock.lockRules.Unlock()
+	return mock.RulesFunc()
+}
+
+// RulesCalls gets all the calls that were made to Rules.
+// Check the length with:
+//
+//	len(mockedMatcher.RulesCalls())
+func (mock *MatcherMock) RulesCalls() []struct {
+} {
+	var calls []struct {
+	}
+	mock.lockRules.RLock()
+	calls = mock.calls.Rules
+	mock.lockRules.RUnlock()
+	return calls
+}
+
 // Upstreams calls UpstreamsFunc.
 func (mock *MatcherMock) Upstreams() []discovery.Upstream {
 	if mock.UpstreamsFunc == nil {
@@ -102,7 +190,8 @@ func (mock *MatcherMock) Upstreams() []discovery.Upstream {
 
 // UpstreamsCalls gets all the calls that were made to Upstreams.
 // Check the length with:
-//     len(mockedMatcher.UpstreamsCalls())
+//
+//	len(mockedMatcher.UpstreamsCalls())
 func (mock *MatcherMock) UpstreamsCalls() []struct {
 } {
 	var calls []struct {
@@ -115,34 +204,34 @@ func (mock *MatcherMock) UpstreamsCalls() []struct {
 
 // ServerStreamMock is a mock implementation of proxy.ServerStream.
 //
-// 	func TestSomethingThatUsesServerStream(t *testing.T) {
+//	func TestSomethingThatUsesServerStream(t *testing.T) {
 //
-// 		// make and configure a mocked proxy.ServerStream
-// 		mockedServerStream := &ServerStreamMock{
-// 			ContextFunc: func() context.Context {
-// 				panic("mock out the Context method")
-// 			},
-// 			RecvMsgFunc: func(m any) error {
-// 				panic("mock out the RecvMsg method")
-// 			},
-// 			SendHeaderFunc: func(mD metadata.MD) error {
-// 				panic("mock out the SendHeader method")
-// 			},
-// 			SendMsgFunc: func(m any) error {
-// 				panic("mock out the SendMsg method")
-// 			},
-// 			SetHeaderFunc: func(mD metadata.MD) error {
-// 				panic("mock out the SetHeader method")
-// 			},
-// 			SetTrailerFunc: func(mD metadata.MD)  {
-// 				panic("mock out the SetTrailer method")
-// 			},
-// 		}
+//		// make and configure a mocked proxy.ServerStream
+//		mockedServerStream := &ServerStreamMock{
+//			ContextFunc: func() context.Context {
+//				panic("mock out the Context method")
+//			},
+//			RecvMsgFunc: func(m any) error {
+//				panic("mock out the RecvMsg method")
+//			},
+//			SendHeaderFunc: func(mD metadata.MD) error {
+//				panic("mock out the SendHeader method")
+//			},
+//			SendMsgFunc: func(m any) error {
+//				panic("mock out the SendMsg method")
+//			},
+//			SetHeaderFunc: func(mD metadata.MD) error {
+//				panic("mock out the SetHeader method")
+//			},
+//			SetTrailerFunc: func(mD metadata.MD)  {
+//				panic("mock out the SetTrailer method")
+//			},
+//		}
 //
-// 		// use mockedServerStream in code that requires proxy.ServerStream
-// 		// and then make assertions.
+//		// use mockedServerStream in code that requires proxy.ServerStream
+//		// and then make assertions.
 //
-// 	}
+//	}
 type ServerStreamMock struct {
 	// ContextFunc mocks the Context method.
 	ContextFunc func() context.Context
@@ -216,7 +305,8 @@ func (mock *ServerStreamMock) Context() context.Context {
 
 // ContextCalls gets all the calls that were made to Context.
 // Check the length with:
-//     len(mockedServerStream.ContextCalls())
+//
+//	len(mockedServerStream.ContextCalls())
 func (mock *ServerStreamMock) ContextCalls() []struct {
 } {
 	var calls []struct {
@@ -245,7 +335,8 @@ func (mock *ServerStreamMock) RecvMsg(m any) error {
 
 // RecvMsgCalls gets all the calls that were made to RecvMsg.
 // Check the length with:
-//     len(mockedServerStream.RecvMsgCalls())
+//
+//	len(mockedServerStream.RecvMsgCalls())
 func (mock *ServerStreamMock) RecvMsgCalls() []struct {
 	M any
 } {
@@ -276,7 +367,8 @@ func (mock *ServerStreamMock) SendHeader(mD metadata.MD) error {
 
 // SendHeaderCalls gets all the calls that were made to SendHeader.
 // Check the length with:
-//     len(mockedServerStream.SendHeaderCalls())
+//
+//	len(mockedServerStream.SendHeaderCalls())
 func (mock *ServerStreamMock) SendHeaderCalls() []struct {
 	MD metadata.MD
 } {
@@ -307,7 +399,8 @@ func (mock *ServerStreamMock) SendMsg(m any) error {
 
 // SendMsgCalls gets all the calls that were made to SendMsg.
 // Check the length with:
-//     len(mockedServerStream.SendMsgCalls())
+//
+//	len(mockedServerStream.SendMsgCalls())
 func (mock *ServerStreamMock) SendMsgCalls() []struct {
 	M any
 } {
@@ -338,7 +431,8 @@ func (mock *ServerStreamMock) SetHeader(mD metadata.MD) error {
 
 // SetHeaderCalls gets all the calls that were made to SetHeader.
 // Check the length with:
-//     len(mockedServerStream.SetHeaderCalls())
+//
+//	len(mockedServerStream.SetHeaderCalls())
 func (mock *ServerStreamMock) SetHeaderCalls() []struct {
 	MD metadata.MD
 } {
@@ -369,7 +463,8 @@ func (mock *ServerStreamMock) SetTrailer(mD metadata.MD) {
 
 // SetTrailerCalls gets all the calls that were made to SetTrailer.
 // Check the length with:
-//     len(mockedServerStream.SetTrailerCalls())
+//
+//	len(mockedServerStream.SetTrailerCalls())
 func (mock *ServerStreamMock) SetTrailerCalls() []struct {
 	MD metadata.MD
 } {
@@ -1,6 +1,16 @@
 package proxy
 
-import "google.golang.org/grpc"
+import (
+	"crypto/tls"
+	"os"
+
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
 
 // Option is a functional option for the server.
 type Option func(*Server)
@@ -15,11 +25,45 @@ func WithGRPCServerOptions(opts ...grpc.ServerOption) Option {
 	return func(o *Server) { o.serverOpts = append(o.serverOpts, opts...) }
 }
 
+// WithTLS enables TLS on the listener with the given configuration.
+func WithTLS(cfg *tls.Config) Option { return func(s *Server) { s.tls = cfg } }
+
+// WithWeb enables serving gRPC-Web, Connect and HTTP/JSON requests on the same listeners.
+func WithWeb() Option { return func(s *Server) { s.web = true } }
+
+// WithAllowedOrigins sets the origins, which browsers are allowed to make
+// gRPC-Web, Connect and HTTP/JSON requests from, "*" allows any origin.
+// By default, only the origins of the loopback hosts are allowed.
+func WithAllowedOrigins(origins ...string) Option {
+	return func(s *Server) { s.origins = origins }
+}
+
+// WithSocketMode sets the file mode of the unix sockets to listen on.
+func WithSocketMode(mode os.FileMode) Option { return func(s *Server) { s.socketMode = mode } }
+
 // WithSignature enables the gRPC server signature metadata.
 func WithSignature() Option { return func(s *Server) { s.signature = true } }
 
 // WithReflection enables the gRPC server reflection merger.
 func WithReflection() Option { return func(s *Server) { s.reflection = true } }
 
+// WithJournal enables recording of the handled requests into the journal.
+func WithJournal(j *journal.Journal) Option { return func(s *Server) { s.journal = j } }
+
+// WithMetrics enables reporting of the handled requests to the metrics.
+func WithMetrics(m *metrics.Metrics) Option { return func(s *Server) { s.metrics = m } }
+
+// WithTracing enables tracing of the handled requests and of the calls
+// to the upstreams, continuing the traces, propagated by the clients.
+func WithTracing(tp trace.TracerProvider, p propagation.TextMapPropagator) Option {
+	return func(s *Server) {
+		s.tracer = tp.Tracer(tracerName)
+		s.propagator = p
+	}
+}
+
+// WithRecorder enables recording of the forwarded requests as mock rules.
+func WithRecorder(r *recorder.Recorder) Option { return func(s *Server) { s.recorder = r } }
+
 // Debug sets the debug mode.
 func Debug() Option { return func(s *Server) { s.debug = true } }
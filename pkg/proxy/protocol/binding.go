@@ -0,0 +1,218 @@
+package protocol
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// binding describes how the HTTP request is mapped onto the gRPC method.
+type binding struct {
+	method   string                        // full name of the method, e.g. "/package.Service/Method"
+	desc     protoreflect.MethodDescriptor // descriptor of the method, if known
+	vars     map[string]string             // values of the path variables by the field paths
+	body     string                        // request field to put the body into, "*" for the whole message
+	response string                        // response field to render, the whole message if empty
+}
+
+var directMethodRe = regexp.MustCompile(`^/[^/]+/[^/]+$`)
+
+// route finds the gRPC method, the JSON request is addressed to. The request
+// is either a POST to the method's path, e.g. "/package.Service/Method", or
+// matches one of the google.api.http rules of the known services.
+func (h Handler) route(r *http.Request, contentType string) (binding, bool) {
+	if contentType != "" && contentType != "application/json" {
+		return binding{}, false
+	}
+
+	if r.Method == http.MethodPost && contentType == "application/json" && directMethodRe.MatchString(r.URL.Path) {
+		return binding{method: r.URL.Path, body: "*"}, true
+	}
+
+	path := r.URL.EscapedPath()
+	for _, svc := range h.Descriptors.Services(r.Context()) {
+		methods := svc.Methods()
+		for i := 0; i < methods.Len(); i++ {
+			mtd := methods.Get(i)
+			rule := httpRule(mtd)
+			if rule == nil {
+				continue
+			}
+
+			for _, b := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				vars, ok := matchRule(b, r.Method, path)
+				if !ok {
+					continue
+				}
+
+				return binding{
+					method:   fmt.Sprintf("/%s/%s", svc.FullName(), mtd.Name()),
+					desc:     mtd,
+					vars:     vars,
+					body:     b.GetBody(),
+					response: b.GetResponseBody(),
+				}, true
+			}
+		}
+	}
+
+	return binding{}, false
+}
+
+// httpRule returns the google.api.http option of the method, if any.
+// Options are re-read with the global registry, as the descriptors
+// built in runtime keep the extensions as unknown fields.
+func httpRule(mtd protoreflect.MethodDescriptor) *annotations.HttpRule {
+	bts, err := proto.Marshal(mtd.Options())
+	if err != nil || len(bts) == 0 {
+		return nil
+	}
+
+	opts := &descriptorpb.MethodOptions{}
+	if err = (proto.UnmarshalOptions{Resolver: protoregistry.GlobalTypes}).Unmarshal(bts, opts); err != nil {
+		return nil
+	}
+
+	rule, _ := proto.GetExtension(opts, annotations.E_Http).(*annotations.HttpRule)
+	return rule
+}
+
+// matchRule matches the HTTP method and the escaped path to the rule
+// and returns the values of the path variables.
+func matchRule(rule *annotations.HttpRule, method, path string) (map[string]string, bool) {
+	var ruleMethod, tmpl string
+	switch p := rule.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		ruleMethod, tmpl = http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		ruleMethod, tmpl = http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		ruleMethod, tmpl = http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		ruleMethod, tmpl = http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		ruleMethod, tmpl = http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		ruleMethod, tmpl = p.Custom.GetKind(), p.Custom.GetPath()
+	default:
+		return nil, false
+	}
+
+	if ruleMethod != method {
+		return nil, false
+	}
+
+	pt, err := compileTemplate(tmpl)
+	if err != nil {
+		return nil, false
+	}
+
+	m := pt.re.FindStringSubmatch(path)
+	if m == nil {
+		return nil, false
+	}
+
+	vars := make(map[string]string, len(pt.fields))
+	for i, field := range pt.fields {
+		v, err := url.PathUnescape(m[i+1])
+		if err != nil {
+			return nil, false
+		}
+		vars[field] = v
+	}
+
+	return vars, true
+}
+
+// pathTemplate is the compiled path template of the google.api.http rule.
+type pathTemplate struct {
+	re     *regexp.Regexp
+	fields []string // field paths of the variables, in order of the capture groups
+}
+
+// templates caches the compiled path templates.
+var templates sync.Map // map[string]*pathTemplate
+
+// compileTemplate compiles the path template, e.g. "/v1/{name=shelves/*}/books:get",
+// into the regular expression, capturing the values of the variables.
+func compileTemplate(tmpl string) (*pathTemplate, error) {
+	if pt, ok := templates.Load(tmpl); ok {
+		return pt.(*pathTemplate), nil
+	}
+
+	if !strings.HasPrefix(tmpl, "/") {
+		return nil, fmt.Errorf("template %q must start with a slash", tmpl)
+	}
+
+	path, verb := tmpl[1:], ""
+	if i := strings.LastIndex(path, ":"); i > strings.LastIndex(path, "}") {
+		path, verb = path[:i], path[i:]
+	}
+
+	pt := &pathTemplate{}
+	sb := &strings.Builder{}
+	_, _ = sb.WriteString("^")
+
+	for path != "" {
+		_, _ = sb.WriteString("/")
+
+		if !strings.HasPrefix(path, "{") {
+			seg, rest, _ := strings.Cut(path, "/")
+			_, _ = sb.WriteString(segmentRe(seg))
+			path = rest
+			continue
+		}
+
+		end := strings.Index(path, "}")
+		if end < 0 {
+			return nil, fmt.Errorf("variable in template %q is not closed", tmpl)
+		}
+
+		field, segs, ok := strings.Cut(path[1:end], "=")
+		if !ok {
+			segs = "*"
+		}
+
+		re := make([]string, 0, strings.Count(segs, "/")+1)
+		for _, seg := range strings.Split(segs, "/") {
+			re = append(re, segmentRe(seg))
+		}
+
+		_, _ = fmt.Fprintf(sb, "(%s)", strings.Join(re, "/"))
+		pt.fields = append(pt.fields, field)
+
+		path = strings.TrimPrefix(path[end+1:], "/")
+	}
+
+	_, _ = sb.WriteString(regexp.QuoteMeta(verb) + "$")
+
+	re, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("compile template %q: %w", tmpl, err)
+	}
+	pt.re = re
+
+	templates.Store(tmpl, pt)
+	return pt, nil
+}
+
+// segmentRe returns the regular expression of the template segment.
+func segmentRe(seg string) string {
+	switch seg {
+	case "*":
+		return `[^/]+`
+	case "**":
+		return `.+`
+	default:
+		return regexp.QuoteMeta(seg)
+	}
+}
@@ -0,0 +1,215 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// connectCodes maps the gRPC codes to the Connect codes and HTTP statuses.
+var connectCodes = map[codes.Code]struct {
+	name   string
+	status int
+}{
+	codes.Canceled:           {"canceled", 499},
+	codes.Unknown:            {"unknown", http.StatusInternalServerError},
+	codes.InvalidArgument:    {"invalid_argument", http.StatusBadRequest},
+	codes.DeadlineExceeded:   {"deadline_exceeded", http.StatusGatewayTimeout},
+	codes.NotFound:           {"not_found", http.StatusNotFound},
+	codes.AlreadyExists:      {"already_exists", http.StatusConflict},
+	codes.PermissionDenied:   {"permission_denied", http.StatusForbidden},
+	codes.ResourceExhausted:  {"resource_exhausted", http.StatusTooManyRequests},
+	codes.FailedPrecondition: {"failed_precondition", http.StatusBadRequest},
+	codes.Aborted:            {"aborted", http.StatusConflict},
+	codes.OutOfRange:         {"out_of_range", http.StatusBadRequest},
+	codes.Unimplemented:      {"unimplemented", http.StatusNotImplemented},
+	codes.Internal:           {"internal", http.StatusInternalServerError},
+	codes.Unavailable:        {"unavailable", http.StatusServiceUnavailable},
+	codes.DataLoss:           {"data_loss", http.StatusInternalServerError},
+	codes.Unauthenticated:    {"unauthenticated", http.StatusUnauthorized},
+}
+
+// connectError is the JSON representation of the error in the Connect protocol.
+type connectError struct {
+	Code    string               `json:"code"`
+	Message string               `json:"message,omitempty"`
+	Details []connectErrorDetail `json:"details,omitempty"`
+}
+
+type connectErrorDetail struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// newConnectError converts the status into the Connect error
+// and returns it along with the corresponding HTTP status.
+func newConnectError(st *status.Status) (e *connectError, httpStatus int) {
+	code, ok := connectCodes[st.Code()]
+	if !ok {
+		code = connectCodes[codes.Unknown]
+	}
+
+	e = &connectError{Code: code.name, Message: st.Message()}
+	for _, d := range st.Proto().GetDetails() {
+		e.Details = append(e.Details, connectErrorDetail{
+			Type:  strings.TrimPrefix(d.GetTypeUrl(), "type.googleapis.com/"),
+			Value: base64.RawStdEncoding.EncodeToString(d.GetValue()),
+		})
+	}
+
+	return e, code.status
+}
+
+// checkEncoding returns an error if the request is compressed.
+func checkEncoding(r *http.Request, header string) error {
+	if enc := r.Header.Get(header); enc != "" && enc != "identity" {
+		return status.Errorf(codes.Unimplemented, "compression %q is not supported", enc)
+	}
+	return nil
+}
+
+// connectUnary implements the unary Connect protocol. The response is
+// buffered, as the HTTP status depends on the status of the call.
+type connectUnary struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	read bool
+
+	hdr  metadata.MD
+	body []byte
+	sent bool
+}
+
+func newConnectUnary(w http.ResponseWriter, r *http.Request) *connectUnary {
+	return &connectUnary{w: w, r: r}
+}
+
+func (t *connectUnary) recv() ([]byte, error) {
+	if t.read {
+		return nil, io.EOF
+	}
+	t.read = true
+
+	if err := checkEncoding(t.r, "Content-Encoding"); err != nil {
+		return nil, err
+	}
+
+	msg, err := io.ReadAll(io.LimitReader(t.r.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "read message: %v", err)
+	}
+
+	if len(msg) > maxMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "message is larger than max (%d)", maxMessageSize)
+	}
+
+	return msg, nil
+}
+
+func (t *connectUnary) header(md metadata.MD) error {
+	t.hdr = md
+	return nil
+}
+
+func (t *connectUnary) send(msg []byte) error {
+	if t.sent {
+		return status.Error(codes.Internal, "unary response has more than one message")
+	}
+	t.body, t.sent = msg, true
+	return nil
+}
+
+func (t *connectUnary) finish(trailer metadata.MD, st *status.Status) error {
+	if st.Code() == codes.OK && !t.sent {
+		st = status.New(codes.Internal, "{groxy} unary response has no message")
+	}
+
+	writeMetadata(t.w.Header(), "", t.hdr)
+	writeMetadata(t.w.Header(), "Trailer-", trailer)
+
+	if st.Code() != codes.OK {
+		e, httpStatus := newConnectError(st)
+		t.w.Header().Set("Content-Type", "application/json")
+		t.w.WriteHeader(httpStatus)
+		if err := json.NewEncoder(t.w).Encode(e); err != nil {
+			return status.Errorf(codes.Unavailable, "write response: %v", err)
+		}
+		return nil
+	}
+
+	t.w.Header().Set("Content-Type", "application/proto")
+	t.w.WriteHeader(http.StatusOK)
+	if _, err := t.w.Write(t.body); err != nil {
+		return status.Errorf(codes.Unavailable, "write response: %v", err)
+	}
+
+	return nil
+}
+
+// connectStream implements the streaming Connect protocol. The status
+// and the trailers are sent in the end-of-stream message.
+type connectStream struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+func newConnectStream(w http.ResponseWriter, r *http.Request) *connectStream {
+	return &connectStream{w: w, r: r}
+}
+
+func (t *connectStream) recv() ([]byte, error) {
+	if err := checkEncoding(t.r, "Connect-Content-Encoding"); err != nil {
+		return nil, err
+	}
+	return readEnvelope(t.r.Body)
+}
+
+func (t *connectStream) header(md metadata.MD) error {
+	t.w.Header().Set("Content-Type", "application/connect+proto")
+	writeMetadata(t.w.Header(), "", md)
+	t.w.WriteHeader(http.StatusOK)
+	return flush(t.w)
+}
+
+func (t *connectStream) send(msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return status.Errorf(codes.ResourceExhausted,
+			"message is larger than max (%d vs. %d)", len(msg), maxMessageSize)
+	}
+	return t.write(envelope(0, msg))
+}
+
+func (t *connectStream) finish(trailer metadata.MD, st *status.Status) error {
+	var end struct {
+		Error    *connectError       `json:"error,omitempty"`
+		Metadata map[string][]string `json:"metadata,omitempty"`
+	}
+
+	if st.Code() != codes.OK {
+		end.Error, _ = newConnectError(st)
+	}
+
+	if md := responseMetadata(trailer); len(md) > 0 {
+		end.Metadata = md
+	}
+
+	bts, err := json.Marshal(end)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal end of stream: %v", err)
+	}
+
+	return t.write(envelope(flagEndStream, bts))
+}
+
+func (t *connectStream) write(frame []byte) error {
+	if _, err := t.w.Write(frame); err != nil {
+		return status.Errorf(codes.Unavailable, "write response: %v", err)
+	}
+	return flush(t.w)
+}
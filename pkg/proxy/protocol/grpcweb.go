@@ -0,0 +1,103 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// grpcWeb implements the gRPC-Web protocol, either binary or text
+// (base64-encoded) one. Trailers are sent in the last frame of the body.
+type grpcWeb struct {
+	w    http.ResponseWriter
+	body io.Reader
+	text bool
+}
+
+func newGRPCWeb(w http.ResponseWriter, r *http.Request, text bool) *grpcWeb {
+	t := &grpcWeb{w: w, body: r.Body, text: text}
+	if text {
+		t.body = base64.NewDecoder(base64.StdEncoding, r.Body)
+	}
+	return t
+}
+
+func (t *grpcWeb) recv() ([]byte, error) { return readEnvelope(t.body) }
+
+func (t *grpcWeb) header(md metadata.MD) error {
+	contentType := "application/grpc-web+proto"
+	if t.text {
+		contentType = "application/grpc-web-text+proto"
+	}
+
+	t.w.Header().Set("Content-Type", contentType)
+	writeMetadata(t.w.Header(), "", md)
+	t.w.WriteHeader(http.StatusOK)
+	return flush(t.w)
+}
+
+func (t *grpcWeb) send(msg []byte) error {
+	if len(msg) > maxMessageSize {
+		return status.Errorf(codes.ResourceExhausted,
+			"message is larger than max (%d vs. %d)", len(msg), maxMessageSize)
+	}
+	return t.write(envelope(0, msg))
+}
+
+func (t *grpcWeb) finish(trailer metadata.MD, st *status.Status) error {
+	buf := &bytes.Buffer{}
+	_, _ = fmt.Fprintf(buf, "grpc-status: %d\r\n", st.Code())
+	if st.Message() != "" {
+		_, _ = fmt.Fprintf(buf, "grpc-message: %s\r\n", encodeGRPCMessage(st.Message()))
+	}
+
+	if len(st.Details()) > 0 {
+		bts, err := proto.Marshal(st.Proto())
+		if err != nil {
+			return status.Errorf(codes.Internal, "marshal status details: %v", err)
+		}
+		_, _ = fmt.Fprintf(buf, "grpc-status-details-bin: %s\r\n", base64.RawStdEncoding.EncodeToString(bts))
+	}
+
+	for k, vs := range responseMetadata(trailer) {
+		for _, v := range vs {
+			_, _ = fmt.Fprintf(buf, "%s: %s\r\n", k, v)
+		}
+	}
+
+	return t.write(envelope(flagTrailer, buf.Bytes()))
+}
+
+func (t *grpcWeb) write(frame []byte) error {
+	if t.text {
+		frame = []byte(base64.StdEncoding.EncodeToString(frame))
+	}
+
+	if _, err := t.w.Write(frame); err != nil {
+		return status.Errorf(codes.Unavailable, "write response: %v", err)
+	}
+
+	return flush(t.w)
+}
+
+// encodeGRPCMessage percent-encodes the status message,
+// as required by the gRPC protocol.
+func encodeGRPCMessage(msg string) string {
+	buf := &bytes.Buffer{}
+	for i := 0; i < len(msg); i++ {
+		c := msg[i]
+		if c >= ' ' && c <= '~' && c != '%' {
+			buf.WriteByte(c)
+			continue
+		}
+		_, _ = fmt.Fprintf(buf, "%%%02X", c)
+	}
+	return buf.String()
+}
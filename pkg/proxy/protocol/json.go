@@ -0,0 +1,387 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Method describes the types of the method, needed to transcode
+// the JSON request and response.
+type Method struct {
+	// Input is the type of the request message. If nil, the request
+	// body is ignored and an empty message is passed to the handler.
+	Input protoreflect.MessageDescriptor
+	// Output is the type of the response message. If nil, only
+	// the responses without messages, e.g. errors, are rendered.
+	Output protoreflect.MessageDescriptor
+	// ServerStreaming is true, if the method sends a stream of messages.
+	ServerStreaming bool
+}
+
+// Descriptors resolves the descriptors of the served methods.
+type Descriptors interface {
+	// Method returns the types of the method with the given full name,
+	// e.g. "/package.Service/Method", requested with the given metadata.
+	Method(ctx context.Context, name string, md metadata.MD) (Method, error)
+	// Services returns the known services, which methods might be
+	// annotated with the google.api.http rules.
+	Services(ctx context.Context) []protoreflect.ServiceDescriptor
+}
+
+// transcode resolves the types of the method and serves the JSON request.
+func (h Handler) transcode(w http.ResponseWriter, r *http.Request, b binding) {
+	mtd := Method{}
+	if b.desc != nil {
+		mtd.Input, mtd.Output = b.desc.Input(), b.desc.Output()
+		mtd.ServerStreaming = b.desc.IsStreamingServer()
+	} else {
+		md, err := incomingMetadata(r)
+		if err != nil {
+			writeJSONError(w, status.New(codes.InvalidArgument, err.Error()))
+			return
+		}
+
+		if mtd, err = h.Descriptors.Method(r.Context(), b.method, md); err != nil {
+			writeJSONError(w, status.Convert(err))
+			return
+		}
+	}
+
+	h.serve(r, b.method, &jsonTranscoder{w: w, r: r, b: b, m: mtd})
+}
+
+// jsonTranscoder converts the JSON request into the protobuf message
+// and renders the protobuf response as JSON. Unary responses are buffered,
+// as the HTTP status depends on the status of the call, while streamed ones
+// are written as newline-delimited JSON objects.
+type jsonTranscoder struct {
+	w    http.ResponseWriter
+	r    *http.Request
+	b    binding
+	m    Method
+	read bool
+
+	hdr     metadata.MD
+	body    []byte
+	sent    bool
+	started bool // the streamed response has been started
+}
+
+func (t *jsonTranscoder) recv() ([]byte, error) {
+	if t.read {
+		return nil, io.EOF
+	}
+	t.read = true
+
+	if t.m.Input == nil {
+		return []byte{}, nil
+	}
+
+	if err := checkEncoding(t.r, "Content-Encoding"); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(t.r.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "read message: %v", err)
+	}
+
+	if len(body) > maxMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted, "message is larger than max (%d)", maxMessageSize)
+	}
+
+	msg := dynamicpb.NewMessage(t.m.Input)
+	if err = t.unmarshalBody(msg, body); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unmarshal body: %v", err)
+	}
+
+	for path, v := range t.b.vars {
+		if err = setField(msg, path, v); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "set path variable: %v", err)
+		}
+	}
+
+	if t.b.body != "*" {
+		for path, vs := range t.r.URL.Query() {
+			for _, v := range vs {
+				if err = setField(msg, path, v); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "set query parameter: %v", err)
+				}
+			}
+		}
+	}
+
+	bts, err := proto.Marshal(msg)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "marshal message: %v", err)
+	}
+
+	return bts, nil
+}
+
+// unmarshalBody puts the request body either into the whole message
+// or into its field, as specified by the binding.
+func (t *jsonTranscoder) unmarshalBody(msg *dynamicpb.Message, body []byte) error {
+	if t.b.body == "" || len(bytes.TrimSpace(body)) == 0 {
+		return nil
+	}
+
+	if t.b.body != "*" {
+		fd := findField(msg.Descriptor(), t.b.body)
+		if fd == nil {
+			return fmt.Errorf("unknown body field %q", t.b.body)
+		}
+
+		// wrap the body, so that protojson handles any kind of the field
+		body = fmt.Appendf(nil, "{%q:%s}", fd.JSONName(), body)
+	}
+
+	return protojson.Unmarshal(body, msg)
+}
+
+func (t *jsonTranscoder) header(md metadata.MD) error {
+	t.hdr = md
+	return nil
+}
+
+func (t *jsonTranscoder) send(msg []byte) error {
+	bts, err := t.render(msg)
+	if err != nil {
+		return err
+	}
+
+	if !t.m.ServerStreaming {
+		if t.sent {
+			return status.Error(codes.Internal, "unary response has more than one message")
+		}
+		t.body, t.sent = bts, true
+		return nil
+	}
+
+	if !t.started {
+		t.start(http.StatusOK)
+	}
+
+	if _, err = t.w.Write(append(bts, '\n')); err != nil {
+		return status.Errorf(codes.Unavailable, "write response: %v", err)
+	}
+
+	return flush(t.w)
+}
+
+// render converts the protobuf response into JSON, leaving only the
+// response body field, if it's specified by the binding.
+func (t *jsonTranscoder) render(msg []byte) ([]byte, error) {
+	if t.m.Output == nil {
+		return nil, status.Error(codes.Internal, "{groxy} unknown response type")
+	}
+
+	out := dynamicpb.NewMessage(t.m.Output)
+	if err := proto.Unmarshal(msg, out); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmarshal response: %v", err)
+	}
+
+	bts, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(out)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "marshal response: %v", err)
+	}
+
+	if t.b.response == "" {
+		return bts, nil
+	}
+
+	fd := findField(t.m.Output, t.b.response)
+	if fd == nil {
+		return nil, status.Errorf(codes.Internal, "unknown response body field %q", t.b.response)
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(bts, &fields); err != nil {
+		return nil, status.Errorf(codes.Internal, "extract response body field: %v", err)
+	}
+
+	return fields[fd.JSONName()], nil
+}
+
+func (t *jsonTranscoder) finish(trailer metadata.MD, st *status.Status) error {
+	if t.started {
+		// the status and the trailers are sent after the streamed messages
+		writeMetadata(t.w.Header(), http.TrailerPrefix+"Grpc-Trailer-", trailer)
+		if st.Code() == codes.OK {
+			return nil
+		}
+
+		bts, err := json.Marshal(map[string]json.RawMessage{"error": statusJSON(st)})
+		if err != nil {
+			return status.Errorf(codes.Internal, "marshal error: %v", err)
+		}
+
+		if _, err = t.w.Write(append(bts, '\n')); err != nil {
+			return status.Errorf(codes.Unavailable, "write response: %v", err)
+		}
+		return flush(t.w)
+	}
+
+	if st.Code() == codes.OK && !t.m.ServerStreaming && !t.sent {
+		st = status.New(codes.Internal, "{groxy} unary response has no message")
+	}
+
+	writeMetadata(t.w.Header(), "Grpc-Trailer-", trailer)
+
+	if st.Code() != codes.OK {
+		writeMetadata(t.w.Header(), "Grpc-Metadata-", t.hdr)
+		writeJSONError(t.w, st)
+		return nil
+	}
+
+	t.start(http.StatusOK)
+	if _, err := t.w.Write(t.body); err != nil {
+		return status.Errorf(codes.Unavailable, "write response: %v", err)
+	}
+
+	return nil
+}
+
+// start writes the header of the response.
+func (t *jsonTranscoder) start(code int) {
+	t.started = true
+	t.w.Header().Set("Content-Type", "application/json")
+	writeMetadata(t.w.Header(), "Grpc-Metadata-", t.hdr)
+	t.w.WriteHeader(code)
+}
+
+// writeJSONError writes the status as google.rpc.Status in JSON
+// with the HTTP status, corresponding to the code of the status.
+func writeJSONError(w http.ResponseWriter, st *status.Status) {
+	code, ok := connectCodes[st.Code()]
+	if !ok {
+		code = connectCodes[codes.Unknown]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code.status)
+	_, _ = w.Write(append(statusJSON(st), '\n'))
+}
+
+// statusJSON renders the status in JSON. If the details of the status
+// are of unknown types, only the code and the message are rendered.
+func statusJSON(st *status.Status) []byte {
+	if bts, err := protojson.Marshal(st.Proto()); err == nil {
+		return bts
+	}
+
+	bts, _ := json.Marshal(struct {
+		Code    codes.Code `json:"code"`
+		Message string     `json:"message"`
+	}{Code: st.Code(), Message: st.Message()})
+
+	return bts
+}
+
+// findField looks up the field by either its proto or JSON name.
+func findField(md protoreflect.MessageDescriptor, name string) protoreflect.FieldDescriptor {
+	if fd := md.Fields().ByName(protoreflect.Name(name)); fd != nil {
+		return fd
+	}
+	return md.Fields().ByJSONName(name)
+}
+
+// setField sets the value of the field, addressed by the dot-separated
+// path, e.g. "user.name", parsing the value by the field's kind.
+// Values of the repeated fields are appended.
+func setField(msg protoreflect.Message, path, value string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := findField(msg.Descriptor(), name)
+		if fd == nil {
+			return fmt.Errorf("unknown field %q", path)
+		}
+
+		if i < len(names)-1 {
+			if fd.Message() == nil || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %q is not a message", strings.Join(names[:i+1], "."))
+			}
+			msg = msg.Mutable(fd).Message()
+			continue
+		}
+
+		if fd.IsMap() {
+			return fmt.Errorf("map field %q can't be set from a string", path)
+		}
+
+		v, err := parseValue(fd, value)
+		if err != nil {
+			return fmt.Errorf("parse field %q: %w", path, err)
+		}
+
+		if fd.IsList() {
+			msg.Mutable(fd).List().Append(v)
+			return nil
+		}
+
+		msg.Set(fd, v)
+	}
+
+	return nil
+}
+
+// parseValue parses the string representation of the field value.
+// Messages, e.g. well-known types, are parsed from their JSON string form.
+func parseValue(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := decodeBinary(s)
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		msg := dynamicpb.NewMessage(fd.Message())
+		if err := protojson.Unmarshal([]byte(strconv.Quote(s)), msg); err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfMessage(msg), nil
+	default:
+		return protoreflect.Value{}, fmt.Errorf("unsupported kind %s", fd.Kind())
+	}
+}
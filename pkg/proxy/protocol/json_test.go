@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+type staticDescriptors struct {
+	services []protoreflect.ServiceDescriptor
+	method   Method
+}
+
+func (d staticDescriptors) Method(context.Context, string, metadata.MD) (Method, error) {
+	return d.method, nil
+}
+
+func (d staticDescriptors) Services(context.Context) []protoreflect.ServiceDescriptor {
+	return d.services
+}
+
+func TestHandler_JSON(t *testing.T) {
+	fds, err := protodef.ParseFiles([]string{"testdata"}, "library.proto")
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+
+	svc := fds[0].UnwrapFile().Services().ByName("Library")
+	require.NotNil(t, svc)
+	book := fds[0].UnwrapFile().Messages().ByName("Book")
+	require.NotNil(t, book)
+
+	ts := httptest.NewServer(Handler{Stream: echo, Descriptors: staticDescriptors{
+		services: []protoreflect.ServiceDescriptor{svc},
+		method:   Method{Input: book, Output: book},
+	}})
+	defer ts.Close()
+
+	call := func(t *testing.T, method, path, body string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		require.NoError(t, err)
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(bts)
+	}
+
+	field := func(t *testing.T, body, name string) any {
+		t.Helper()
+		var m map[string]any
+		require.NoError(t, json.Unmarshal([]byte(body), &m))
+		return m[name]
+	}
+
+	t.Run("method path", func(t *testing.T) {
+		resp, body := call(t, http.MethodPost, "/test.Service/Echo", `{"title":"Dune","labels":["sci-fi"]}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "header", resp.Header.Get("Grpc-Metadata-X-Header"))
+		assert.Equal(t, "trailer", resp.Header.Get("Grpc-Trailer-X-Trailer"))
+		assert.Equal(t, "Dune", field(t, body, "title"))
+		assert.Equal(t, []any{"sci-fi"}, field(t, body, "labels"))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		resp, body := call(t, http.MethodPost, "/test.Service/Fail", `{"title":"Dune"}`)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.JSONEq(t, `{"code":5,"message":"not 100% found"}`, body)
+	})
+
+	t.Run("invalid body", func(t *testing.T) {
+		resp, body := call(t, http.MethodPost, "/test.Service/Echo", `{"unknown":1}`)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, body, "unmarshal body")
+	})
+
+	t.Run("path variables and query parameters", func(t *testing.T) {
+		resp, body := call(t, http.MethodGet, "/v1/shelves/1/books/2?"+
+			"id=3&kind=NOVEL&labels=a&labels=b&author.firstName=Frank&published_at=1965-08-01T00:00:00Z", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.JSONEq(t, `{
+			"name": "shelves/1/books/2",
+			"id": "3",
+			"title": "",
+			"labels": ["a", "b"],
+			"kind": "NOVEL",
+			"publishedAt": "1965-08-01T00:00:00Z",
+			"author": {"firstName": "Frank"}
+		}`, body)
+	})
+
+	t.Run("additional binding with body field", func(t *testing.T) {
+		resp, body := call(t, http.MethodPost, "/v1/shelves/1/books/2:label", `["classic"]`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.Equal(t, "shelves/1/books/2", field(t, body, "name"))
+		assert.Equal(t, []any{"classic"}, field(t, body, "labels"))
+	})
+
+	t.Run("response body field", func(t *testing.T) {
+		resp, body := call(t, http.MethodPatch, "/v1/books/7", `{"title":"Dune Messiah"}`)
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		assert.JSONEq(t, `"Dune Messiah"`, body)
+	})
+
+	t.Run("server streaming", func(t *testing.T) {
+		resp, body := call(t, http.MethodGet, "/v1/books?title=Dune", "")
+		require.Equal(t, http.StatusOK, resp.StatusCode, body)
+		lines := strings.Split(strings.TrimSpace(body), "\n")
+		require.Len(t, lines, 1)
+		assert.Equal(t, "Dune", field(t, lines[0], "title"))
+	})
+
+	t.Run("unknown query parameter", func(t *testing.T) {
+		resp, body := call(t, http.MethodGet, "/v1/books?unknown=1", "")
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Contains(t, body, `unknown field \"unknown\"`)
+	})
+
+	t.Run("not bound", func(t *testing.T) {
+		resp, _ := call(t, http.MethodGet, "/v2/books", "")
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	})
+}
+
+func TestMatchRule(t *testing.T) {
+	tbl := []struct {
+		tmpl, path string
+		vars       map[string]string
+	}{
+		{tmpl: "/v1/books", path: "/v1/books", vars: map[string]string{}},
+		{tmpl: "/v1/books", path: "/v1/books/1"},
+		{tmpl: "/v1/books/{id}", path: "/v1/books/1", vars: map[string]string{"id": "1"}},
+		{tmpl: "/v1/books/{id}", path: "/v1/books/1/2"},
+		{tmpl: "/v1/{name=books/*}", path: "/v1/books/1", vars: map[string]string{"name": "books/1"}},
+		{tmpl: "/v1/{name=files/**}", path: "/v1/files/a/b%20c", vars: map[string]string{"name": "files/a/b c"}},
+		{tmpl: "/v1/*/books/{book.id}:get", path: "/v1/x/books/1:get", vars: map[string]string{"book.id": "1"}},
+		{tmpl: "/v1/*/books/{book.id}:get", path: "/v1/x/books/1"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.tmpl+" "+tt.path, func(t *testing.T) {
+			rule := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: tt.tmpl}}
+
+			vars, ok := matchRule(rule, http.MethodGet, tt.path)
+			assert.Equal(t, tt.vars != nil, ok)
+			assert.Equal(t, tt.vars, vars)
+
+			_, ok = matchRule(rule, http.MethodPost, tt.path)
+			assert.False(t, ok, "must not match another HTTP method")
+		})
+	}
+
+	_, err := compileTemplate("v1/books")
+	assert.ErrorContains(t, err, "must start with a slash")
+
+	_, err = compileTemplate("/v1/{name")
+	assert.ErrorContains(t, err, "is not closed")
+}
@@ -0,0 +1,488 @@
+// Package protocol translates gRPC-Web, Connect and HTTP/JSON requests
+// into gRPC server streams, so that they are served by the same stream
+// handler as the native gRPC requests.
+package protocol
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// maxMessageSize is the maximum size of a received message,
+// the same as the default one of the gRPC server.
+const maxMessageSize = 4 << 20
+
+// Handler serves native gRPC, gRPC-Web, Connect and HTTP/JSON requests
+// over HTTP/1.1 and HTTP/2.
+type Handler struct {
+	GRPC   http.Handler       // serves native gRPC requests
+	Stream grpc.StreamHandler // serves translated gRPC-Web, Connect and HTTP/JSON requests
+
+	// Descriptors resolves the types of the methods to transcode
+	// HTTP/JSON requests. If nil, HTTP/JSON requests are rejected.
+	Descriptors Descriptors
+
+	// AllowedOrigins are the origins, which browsers are allowed to make
+	// cross-origin requests from, "*" allows any origin.
+	// If empty, only the origins of the loopback hosts are allowed.
+	AllowedOrigins []string
+}
+
+// ServeHTTP routes the request by its content type.
+func (h Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Add("Vary", "Origin")
+		if h.allowOrigin(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", "*")
+		}
+	}
+
+	if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", r.Header.Get("Access-Control-Request-Headers"))
+		w.Header().Set("Access-Control-Max-Age", "7200")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if r.ProtoMajor == 2 && (contentType == "application/grpc" || strings.HasPrefix(contentType, "application/grpc+")) {
+		h.GRPC.ServeHTTP(w, r)
+		return
+	}
+
+	if h.Descriptors != nil {
+		if b, ok := h.route(r, contentType); ok {
+			_ = http.NewResponseController(w).EnableFullDuplex()
+			h.transcode(w, r, b)
+			return
+		}
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST requests are supported", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var t transport
+	switch contentType {
+	case "application/grpc-web", "application/grpc-web+proto":
+		t = newGRPCWeb(w, r, false)
+	case "application/grpc-web-text", "application/grpc-web-text+proto":
+		t = newGRPCWeb(w, r, true)
+	case "application/proto":
+		t = newConnectUnary(w, r)
+	case "application/connect+proto":
+		t = newConnectStream(w, r)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported content type %q", contentType), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// let the handler read the request while writing the response over HTTP/1.1
+	_ = http.NewResponseController(w).EnableFullDuplex()
+
+	h.serve(r, r.URL.Path, t)
+}
+
+// allowOrigin reports whether the cross-origin requests from the origin are allowed.
+func (h Handler) allowOrigin(origin string) bool {
+	if len(h.AllowedOrigins) == 0 {
+		u, err := url.Parse(origin)
+		if err != nil {
+			return false
+		}
+
+		if u.Hostname() == "localhost" {
+			return true
+		}
+
+		ip := net.ParseIP(u.Hostname())
+		return ip != nil && ip.IsLoopback()
+	}
+
+	for _, allowed := range h.AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serve runs the stream handler over the translated request to the method.
+func (h Handler) serve(r *http.Request, method string, t transport) {
+	ctx := r.Context()
+	ss := &serverStream{ctx: ctx, t: t, method: method}
+
+	timeout, err := requestTimeout(r.Header)
+	if err != nil {
+		_ = ss.finish(status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	p := &peer.Peer{Addr: remoteAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{
+			State:          *r.TLS,
+			CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.PrivacyAndIntegrity},
+		}
+	}
+
+	md, err := incomingMetadata(r)
+	if err != nil {
+		_ = ss.finish(status.New(codes.InvalidArgument, err.Error()))
+		return
+	}
+
+	ctx = peer.NewContext(ctx, p)
+	ctx = metadata.NewIncomingContext(ctx, md)
+	ctx = grpc.NewContextWithServerTransportStream(ctx, transportStream{ss})
+	ss.ctx = ctx
+
+	err = h.Stream(nil, ss)
+	st, ok := status.FromError(err)
+	if !ok {
+		st = status.New(codes.Unknown, err.Error())
+	}
+
+	if ctx.Err() != nil && st.Code() == codes.OK {
+		st = status.FromContextError(ctx.Err())
+	}
+
+	_ = ss.finish(st)
+}
+
+// transport reads the request and writes the response in the
+// format of the particular protocol.
+type transport interface {
+	// recv reads the next message of the request,
+	// io.EOF if there are no more messages.
+	recv() ([]byte, error)
+	// header writes the response header.
+	header(md metadata.MD) error
+	// send writes the message to the response.
+	send(msg []byte) error
+	// finish completes the response with the trailer and the status.
+	finish(trailer metadata.MD, st *status.Status) error
+}
+
+// serverStream implements grpc.ServerStream over the transport.
+type serverStream struct {
+	ctx    context.Context
+	t      transport
+	method string
+
+	mu         sync.Mutex
+	hdr        metadata.MD
+	trailer    metadata.MD
+	headerSent bool
+}
+
+func (s *serverStream) Context() context.Context { return s.ctx }
+
+func (s *serverStream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headerSent {
+		return status.Error(codes.Internal, "header has been already sent")
+	}
+
+	s.hdr = metadata.Join(s.hdr, md)
+	return nil
+}
+
+func (s *serverStream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.headerSent {
+		return status.Error(codes.Internal, "header has been already sent")
+	}
+
+	s.hdr = metadata.Join(s.hdr, md)
+	return s.sendHeader()
+}
+
+func (s *serverStream) SetTrailer(md metadata.MD) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.trailer = metadata.Join(s.trailer, md)
+}
+
+func (s *serverStream) SendMsg(m any) error {
+	bts, err := grpcx.RawBytesCodec{}.Marshal(m)
+	if err != nil {
+		return status.Errorf(codes.Internal, "marshal message: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.headerSent {
+		if err = s.sendHeader(); err != nil {
+			return err
+		}
+	}
+
+	return s.t.send(bts)
+}
+
+func (s *serverStream) RecvMsg(m any) error {
+	bts, err := s.t.recv()
+	if err != nil {
+		return err
+	}
+
+	if err = (grpcx.RawBytesCodec{}).Unmarshal(bts, m); err != nil {
+		return status.Errorf(codes.Internal, "unmarshal message: %v", err)
+	}
+
+	return nil
+}
+
+// finish sends the header, if it hasn't been sent yet, and completes the response.
+func (s *serverStream) finish(st *status.Status) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.headerSent {
+		if err := s.sendHeader(); err != nil {
+			return err
+		}
+	}
+
+	return s.t.finish(s.trailer, st)
+}
+
+func (s *serverStream) sendHeader() error {
+	s.headerSent = true
+	return s.t.header(s.hdr)
+}
+
+// transportStream exposes the stream as grpc.ServerTransportStream,
+// so that grpc.Method and grpc.SetHeader work with the stream context.
+type transportStream struct{ *serverStream }
+
+func (s transportStream) Method() string { return s.method }
+
+func (s transportStream) SetTrailer(md metadata.MD) error {
+	s.serverStream.SetTrailer(md)
+	return nil
+}
+
+// remoteAddr is the address of the client, as reported by the HTTP server.
+type remoteAddr string
+
+func (a remoteAddr) Network() string { return "tcp" }
+func (a remoteAddr) String() string  { return string(a) }
+
+// skipHeaders are the HTTP headers, not passed into the incoming metadata.
+var skipHeaders = map[string]struct{}{
+	"connection":           {},
+	"keep-alive":           {},
+	"proxy-connection":     {},
+	"transfer-encoding":    {},
+	"upgrade":              {},
+	"te":                   {},
+	"content-length":       {},
+	"content-encoding":     {},
+	"accept-encoding":      {},
+	"grpc-timeout":         {},
+	"grpc-encoding":        {},
+	"grpc-accept-encoding": {},
+	"x-grpc-web":           {},
+}
+
+// incomingMetadata converts the HTTP headers of the request into
+// the gRPC metadata, the same way as the native gRPC server does.
+func incomingMetadata(r *http.Request) (metadata.MD, error) {
+	md := metadata.MD{}
+	for k, vs := range r.Header {
+		k = strings.ToLower(k)
+		if _, skip := skipHeaders[k]; skip || strings.HasPrefix(k, "connect-") {
+			continue
+		}
+
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				bts, err := decodeBinary(v)
+				if err != nil {
+					return nil, fmt.Errorf("decode binary header %q: %w", k, err)
+				}
+				v = string(bts)
+			}
+			md.Append(k, v)
+		}
+	}
+
+	md.Set(":authority", r.Host)
+	return md, nil
+}
+
+// reservedKeys are the metadata keys, not written into the response.
+var reservedKeys = map[string]struct{}{
+	"content-type":            {},
+	"content-length":          {},
+	"te":                      {},
+	"grpc-status":             {},
+	"grpc-message":            {},
+	"grpc-status-details-bin": {},
+	"grpc-encoding":           {},
+	"grpc-accept-encoding":    {},
+}
+
+// responseMetadata returns the metadata to be sent to the client,
+// without the reserved keys and with the binary values encoded in base64.
+func responseMetadata(md metadata.MD) metadata.MD {
+	res := metadata.MD{}
+	for k, vs := range md {
+		if _, ok := reservedKeys[k]; ok || strings.HasPrefix(k, ":") {
+			continue
+		}
+
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
+			res.Append(k, v)
+		}
+	}
+	return res
+}
+
+// writeMetadata writes the metadata into the HTTP header,
+// prepending the prefix to the keys.
+func writeMetadata(h http.Header, prefix string, md metadata.MD) {
+	for k, vs := range responseMetadata(md) {
+		for _, v := range vs {
+			h.Add(prefix+k, v)
+		}
+	}
+}
+
+// decodeBinary decodes the base64 value of the binary header,
+// either padded or not.
+func decodeBinary(v string) ([]byte, error) {
+	if len(v)%4 == 0 {
+		return base64.StdEncoding.DecodeString(v)
+	}
+	return base64.RawStdEncoding.DecodeString(v)
+}
+
+var grpcTimeoutRe = regexp.MustCompile(`^(\d{1,8})([HMSmun])$`)
+
+var grpcTimeoutUnits = map[string]time.Duration{
+	"H": time.Hour,
+	"M": time.Minute,
+	"S": time.Second,
+	"m": time.Millisecond,
+	"u": time.Microsecond,
+	"n": time.Nanosecond,
+}
+
+// requestTimeout parses the timeout of the request, either from
+// the gRPC-Web "grpc-timeout" or from the Connect "connect-timeout-ms" header.
+// Returns zero, if the timeout is not set.
+func requestTimeout(h http.Header) (time.Duration, error) {
+	if v := h.Get("Grpc-Timeout"); v != "" {
+		m := grpcTimeoutRe.FindStringSubmatch(v)
+		if m == nil {
+			return 0, fmt.Errorf("invalid grpc-timeout %q", v)
+		}
+		n, _ := strconv.ParseInt(m[1], 10, 64) // validated by the regexp
+		return time.Duration(n) * grpcTimeoutUnits[m[2]], nil
+	}
+
+	if v := h.Get("Connect-Timeout-Ms"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 || len(v) > 10 {
+			return 0, fmt.Errorf("invalid connect-timeout-ms %q", v)
+		}
+		return time.Duration(n) * time.Millisecond, nil
+	}
+
+	return 0, nil
+}
+
+// envelope flags, shared by gRPC-Web and Connect
+const (
+	flagCompressed = 0x01
+	flagEndStream  = 0x02 // Connect end-of-stream message
+	flagTrailer    = 0x80 // gRPC-Web trailer frame
+)
+
+// readEnvelope reads the length-prefixed message. Returns io.EOF,
+// if there are no more messages.
+func readEnvelope(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, status.Errorf(codes.InvalidArgument, "read message prefix: %v", err)
+	}
+
+	if prefix[0]&flagCompressed != 0 {
+		return nil, status.Error(codes.Unimplemented, "compressed messages are not supported")
+	}
+
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, status.Errorf(codes.ResourceExhausted,
+			"message is larger than max (%d vs. %d)", size, maxMessageSize)
+	}
+
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "read message: %v", err)
+	}
+
+	return msg, nil
+}
+
+// envelope prepends the flags and the length to the message.
+func envelope(flags byte, msg []byte) []byte {
+	buf := make([]byte, 5, 5+len(msg))
+	buf[0] = flags
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(msg))) //nolint:gosec // messages are limited by the transports
+	return append(buf, msg...)
+}
+
+// flush sends the buffered response to the client.
+func flush(w http.ResponseWriter) error {
+	if err := http.NewResponseController(w).Flush(); err != nil {
+		return status.Errorf(codes.Unavailable, "flush response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,364 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// echo replies with each received message, prefixed with the
+// value of the "x-prefix" header. Method "/test.Service/Fail" fails
+// after echoing the messages.
+func echo(_ any, stream grpc.ServerStream) error {
+	ctx := stream.Context()
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	mtd, ok := grpc.Method(ctx)
+	if !ok {
+		return status.Error(codes.Internal, "no method")
+	}
+
+	if _, ok = ctx.Deadline(); ok {
+		md.Set("x-prefix", "deadline:")
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs("x-header", "header")); err != nil {
+		return err
+	}
+	stream.SetTrailer(metadata.Pairs("x-trailer", "trailer"))
+
+	for {
+		var msg []byte
+		if err := stream.RecvMsg(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return err
+		}
+
+		prefix := strings.Join(md.Get("x-prefix"), "")
+		if err := stream.SendMsg(append([]byte(prefix), msg...)); err != nil {
+			return err
+		}
+	}
+
+	if mtd == "/test.Service/Fail" {
+		return status.Error(codes.NotFound, "not 100% found")
+	}
+
+	return nil
+}
+
+func TestHandler_GRPCWeb(t *testing.T) {
+	ts := httptest.NewServer(Handler{Stream: echo})
+	defer ts.Close()
+
+	call := func(t *testing.T, mtd, contentType string, body []byte) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodPost, ts.URL+mtd, bytes.NewReader(body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("X-Prefix", "echo:")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, bts
+	}
+
+	body := append(envelope(0, []byte("first")), envelope(0, []byte("second"))...)
+
+	t.Run("binary", func(t *testing.T) {
+		resp, bts := call(t, "/test.Service/Echo", "application/grpc-web+proto", body)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/grpc-web+proto", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "header", resp.Header.Get("X-Header"))
+
+		frames := readFrames(t, bytes.NewReader(bts))
+		require.Len(t, frames, 3)
+		assert.Equal(t, frame{flags: 0, msg: "echo:first"}, frames[0])
+		assert.Equal(t, frame{flags: 0, msg: "echo:second"}, frames[1])
+		assert.Equal(t, frame{flags: flagTrailer, msg: "grpc-status: 0\r\nx-trailer: trailer\r\n"}, frames[2])
+	})
+
+	t.Run("text", func(t *testing.T) {
+		resp, bts := call(t, "/test.Service/Fail", "application/grpc-web-text",
+			[]byte(base64.StdEncoding.EncodeToString(body)))
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/grpc-web-text+proto", resp.Header.Get("Content-Type"))
+
+		// each frame is encoded separately, so decode it by quantums
+		var decoded []byte
+		for i := 0; i < len(bts); i += 4 {
+			b, err := base64.StdEncoding.DecodeString(string(bts[i : i+4]))
+			require.NoError(t, err)
+			decoded = append(decoded, b...)
+		}
+
+		frames := readFrames(t, bytes.NewReader(decoded))
+		require.Len(t, frames, 3)
+		assert.Equal(t, frame{flags: 0, msg: "echo:first"}, frames[0])
+		assert.Equal(t, frame{flags: 0, msg: "echo:second"}, frames[1])
+		assert.Equal(t, frame{
+			flags: flagTrailer,
+			msg:   "grpc-status: 5\r\ngrpc-message: not 100%25 found\r\nx-trailer: trailer\r\n",
+		}, frames[2])
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		_, bts := call(t, "/test.Service/Echo", "application/grpc-web", envelope(flagCompressed, []byte("zip")))
+		frames := readFrames(t, bytes.NewReader(bts))
+		require.Len(t, frames, 1)
+		assert.Contains(t, frames[0].msg, "grpc-status: 12\r\n")
+	})
+}
+
+func TestHandler_ConnectUnary(t *testing.T) {
+	ts := httptest.NewServer(Handler{Stream: echo})
+	defer ts.Close()
+
+	t.Run("ok", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/test.Service/Echo", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/proto")
+		req.Header.Set("Connect-Protocol-Version", "1")
+		req.Header.Set("Connect-Timeout-Ms", "1000")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "application/proto", resp.Header.Get("Content-Type"))
+		assert.Equal(t, "header", resp.Header.Get("X-Header"))
+		assert.Equal(t, "trailer", resp.Header.Get("Trailer-X-Trailer"))
+		assert.Equal(t, "deadline:hello", string(bts))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/test.Service/Fail", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/proto")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+		assert.JSONEq(t, `{"code":"not_found","message":"not 100% found"}`, string(bts))
+	})
+
+	t.Run("invalid timeout", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/test.Service/Echo", strings.NewReader("hello"))
+		require.NoError(t, err)
+		req.Header.Set("Content-Type", "application/proto")
+		req.Header.Set("Connect-Timeout-Ms", "soon")
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.JSONEq(t, `{"code":"invalid_argument","message":"invalid connect-timeout-ms \"soon\""}`, string(bts))
+	})
+}
+
+func TestHandler_ConnectStream(t *testing.T) {
+	ts := httptest.NewServer(Handler{Stream: echo})
+	defer ts.Close()
+
+	body := append(envelope(0, []byte("first")), envelope(0, []byte("second"))...)
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/test.Service/Fail", bytes.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/connect+proto")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/connect+proto", resp.Header.Get("Content-Type"))
+	assert.Equal(t, "header", resp.Header.Get("X-Header"))
+
+	frames := readFrames(t, resp.Body)
+	require.Len(t, frames, 3)
+	assert.Equal(t, frame{flags: 0, msg: "first"}, frames[0])
+	assert.Equal(t, frame{flags: 0, msg: "second"}, frames[1])
+	assert.Equal(t, byte(flagEndStream), frames[2].flags)
+	assert.JSONEq(t, `{
+		"error": {"code": "not_found", "message": "not 100% found"},
+		"metadata": {"x-trailer": ["trailer"]}
+	}`, frames[2].msg)
+}
+
+func TestHandler_ServeHTTP(t *testing.T) {
+	var grpcCalled bool
+	h := Handler{
+		GRPC:   http.HandlerFunc(func(http.ResponseWriter, *http.Request) { grpcCalled = true }),
+		Stream: echo,
+	}
+
+	t.Run("native gRPC", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/test.Service/Echo", http.NoBody)
+		req.ProtoMajor = 2
+		req.Header.Set("Content-Type", "application/grpc+proto")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		assert.True(t, grpcCalled)
+	})
+
+	t.Run("unsupported content type", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/test.Service/Echo", http.NoBody)
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	})
+
+	t.Run("not a POST", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/test.Service/Echo", http.NoBody)
+		req.Header.Set("Content-Type", "application/proto")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	})
+
+	t.Run("CORS preflight", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, "/test.Service/Echo", http.NoBody)
+		req.Header.Set("Origin", "http://localhost:3000")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type,x-grpc-web")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+		assert.Equal(t, "http://localhost:3000", rec.Header().Get("Access-Control-Allow-Origin"))
+		assert.Equal(t, "content-type,x-grpc-web", rec.Header().Get("Access-Control-Allow-Headers"))
+	})
+
+	t.Run("CORS from foreign origin", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, "/test.Service/Echo", http.NoBody)
+		req.Header.Set("Origin", "https://evil.example.com")
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Empty(t, rec.Header().Get("Access-Control-Allow-Origin"))
+	})
+}
+
+func TestHandler_allowOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    bool
+	}{
+		{name: "localhost by default", origin: "http://localhost:3000", want: true},
+		{name: "loopback IPv4 by default", origin: "http://127.0.0.1:3000", want: true},
+		{name: "loopback IPv6 by default", origin: "http://[::1]:3000", want: true},
+		{name: "foreign by default", origin: "https://example.com"},
+		{name: "listed", allowed: []string{"https://example.com"}, origin: "https://example.com", want: true},
+		{name: "not listed", allowed: []string{"https://example.com"}, origin: "http://localhost:3000"},
+		{name: "any", allowed: []string{"*"}, origin: "https://example.com", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Handler{AllowedOrigins: tt.allowed}.allowOrigin(tt.origin))
+		})
+	}
+}
+
+func TestIncomingMetadata(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/test.Service/Echo", http.NoBody)
+	req.Host = "example.com"
+	req.Header.Set("Content-Type", "application/grpc-web")
+	req.Header.Set("Connect-Protocol-Version", "1")
+	req.Header.Set("Grpc-Timeout", "1S")
+	req.Header.Set("X-Key", "value")
+	req.Header.Set("X-Key-Bin", base64.StdEncoding.EncodeToString([]byte("binary")))
+
+	md, err := incomingMetadata(req)
+	require.NoError(t, err)
+	assert.Equal(t, metadata.MD{
+		":authority":   {"example.com"},
+		"content-type": {"application/grpc-web"},
+		"x-key":        {"value"},
+		"x-key-bin":    {"binary"},
+	}, md)
+
+	req.Header.Set("X-Key-Bin", "!")
+	_, err = incomingMetadata(req)
+	assert.ErrorContains(t, err, `decode binary header "x-key-bin"`)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tbl := []struct {
+		header, value string
+		expected      time.Duration
+		err           string
+	}{
+		{header: "Grpc-Timeout", value: "5S", expected: 5 * time.Second},
+		{header: "Grpc-Timeout", value: "100m", expected: 100 * time.Millisecond},
+		{header: "Grpc-Timeout", value: "2H", expected: 2 * time.Hour},
+		{header: "Grpc-Timeout", value: "5s", err: `invalid grpc-timeout "5s"`},
+		{header: "Connect-Timeout-Ms", value: "250", expected: 250 * time.Millisecond},
+		{header: "Connect-Timeout-Ms", value: "-1", err: `invalid connect-timeout-ms "-1"`},
+		{header: "X-Unrelated", value: "5S"},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.header+"="+tt.value, func(t *testing.T) {
+			d, err := requestTimeout(http.Header{tt.header: {tt.value}})
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, d)
+		})
+	}
+}
+
+type frame struct {
+	flags byte
+	msg   string
+}
+
+func readFrames(t *testing.T, r io.Reader) []frame {
+	t.Helper()
+	var frames []frame
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(r, prefix[:]); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			return frames
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		_, err := io.ReadFull(r, msg)
+		require.NoError(t, err)
+		frames = append(frames, frame{flags: prefix[0], msg: string(msg)})
+	}
+}
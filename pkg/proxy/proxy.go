@@ -2,21 +2,36 @@
 package proxy
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"context"
 
 	"github.com/Semior001/groxy/pkg/discovery"
 	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/journal"
+	"github.com/Semior001/groxy/pkg/metrics"
+	"github.com/Semior001/groxy/pkg/protodef"
 	"github.com/Semior001/groxy/pkg/proxy/middleware"
+	"github.com/Semior001/groxy/pkg/proxy/protocol"
+	"github.com/Semior001/groxy/pkg/recorder"
 	"github.com/cappuccinotm/slogx"
+	"github.com/samber/lo"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/metadata"
@@ -33,6 +48,11 @@ type ServerStream grpc.ServerStream
 type Matcher interface {
 	MatchMetadata(string, metadata.MD) discovery.Matches // returns matches based on the method and metadata.
 	Upstreams() []discovery.Upstream                     // returns all upstreams registered in the matcher
+	Rules() []*discovery.Rule                            // returns all rules registered in the matcher
+
+	// AdvanceScenario transitions the scenario of the matched rule, if any,
+	// and returns the data stored in the scenario.
+	AdvanceScenario(*discovery.Rule, map[string]any) map[string]any
 }
 
 // Server is a gRPC server.
@@ -40,13 +60,26 @@ type Server struct {
 	version string
 
 	serverOpts []grpc.ServerOption
+	tls        *tls.Config
 	matcher    Matcher
+	journal    *journal.Journal
+	metrics    *metrics.Metrics
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	recorder   *recorder.Recorder
+	recordings chan recording // exchanges, waiting to be recorded
+	recorded   chan struct{}  // closed once all the exchanges are recorded
+	types      *descriptors // types of the methods, reflected from the upstreams
+	conns      *connections // accepted connections, broken by the faults
 
 	signature  bool
 	reflection bool
+	web        bool
+	origins    []string // allowed origins of the web requests
 	debug      bool
-	l          net.Listener
+	socketMode os.FileMode
 	grpc       *grpc.Server
+	http       *http.Server // serves gRPC-Web, Connect and HTTP/JSON along with gRPC, if enabled
 }
 
 // NewServer creates a new server.
@@ -54,21 +87,33 @@ func NewServer(m Matcher, opts ...Option) *Server {
 	s := &Server{
 		matcher:   m,
 		signature: false,
+		conns:     newConnections(),
+		types:     newDescriptors(m),
 	}
 
 	for _, opt := range opts {
 		opt(s)
 	}
 
+	if s.recorder != nil {
+		s.recordings, s.recorded = make(chan recording, recordBuffer), make(chan struct{})
+		go s.recordExchanges(s.recordings)
+	}
+
 	return s
 }
 
-// Listen starts the server on the given address.
+// Listen starts the server on the given addresses, either TCP ones,
+// e.g. "localhost:8080", or unix sockets, e.g. "unix:///tmp/groxy.sock".
 // Blocking call.
-func (s *Server) Listen(addr string) (err error) {
-	slog.Info("starting gRPC server", slog.Any("addr", addr))
+func (s *Server) Listen(addrs ...string) (err error) {
+	slog.Info("starting gRPC server", slog.Any("addrs", addrs))
 	defer slog.Warn("gRPC server stopped", slogx.Error(err))
 
+	if len(addrs) == 0 {
+		return errors.New("no addresses to listen on")
+	}
+
 	healthHandler := health.NewServer()
 	healthHandler.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
 
@@ -76,44 +121,218 @@ func (s *Server) Listen(addr string) (err error) {
 		return status.Error(codes.Internal, "{groxy} didn't match request to any rule")
 	}
 
-	s.grpc = grpc.NewServer(append(s.serverOpts,
-		grpc.ForceServerCodec(grpcx.RawBytesCodec{}),
-		grpc.UnknownServiceHandler(middleware.Wrap(noMatchHandler,
-			middleware.Recoverer("{groxy} panic"),
-			middleware.Maybe(s.signature, middleware.AppInfo("groxy", "Semior001", s.version)),
-			middleware.Log(s.debug, "/grpc.reflection."),
-			middleware.PassMetadata(),
-			middleware.Health(healthHandler),
-			middleware.Maybe(s.reflection, middleware.Chain(
-				middleware.Reflector{
-					Logger:        slog.Default().With(slog.String("subsystem", "reflection")),
-					UpstreamsFunc: s.matcher.Upstreams,
-				}.Middleware,
-			)),
-			s.matchMiddleware,
-			s.mockMiddleware, s.forwardMiddleware,
+	serverOpts := s.serverOpts
+	if s.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(s.tls)))
+	}
+
+	handler := middleware.Wrap(noMatchHandler,
+		middleware.Recoverer("{groxy} panic"),
+		middleware.Maybe(s.signature, middleware.AppInfo("groxy", "Semior001", s.version)),
+		middleware.Log(s.debug, "/grpc.reflection."),
+		middleware.PassMetadata(),
+		middleware.ClientSubject(),
+		middleware.Health(healthHandler),
+		middleware.Maybe(s.reflection, middleware.Chain(
+			middleware.Reflector{
+				Logger:        slog.Default().With(slog.String("subsystem", "reflection")),
+				UpstreamsFunc: s.matcher.Upstreams,
+				RulesFunc:     s.matcher.Rules,
+			}.Middleware,
 		)),
+		middleware.Maybe(s.tracer != nil, s.tracingMiddleware),
+		middleware.Maybe(s.metrics != nil, s.metricsMiddleware),
+		middleware.Maybe(s.journal != nil, s.journalMiddleware),
+		s.matchMiddleware,
+		s.rateLimitMiddleware,
+		s.faultMiddleware,
+		s.throttleMiddleware,
+		s.mirrorMiddleware,
+		s.compareMiddleware,
+		s.mockMiddleware, s.forwardMiddleware,
+	)
+
+	s.grpc = grpc.NewServer(append(serverOpts,
+		grpc.ForceServerCodec(grpcx.RawBytesCodec{}),
+		grpc.UnknownServiceHandler(handler),
 	)...)
 
-	if s.l, err = net.Listen("tcp", addr); err != nil {
-		return fmt.Errorf("register listener: %w", err)
+	if s.web {
+		s.http = &http.Server{
+			Handler: protocol.Handler{
+				GRPC:           s.grpc,
+				Stream:         handler,
+				Descriptors:    s.types,
+				AllowedOrigins: s.origins,
+			},
+			TLSConfig:         s.tls,
+			Protocols:         &http.Protocols{},
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+		s.http.Protocols.SetHTTP1(true)
+		s.http.Protocols.SetHTTP2(true)
+		s.http.Protocols.SetUnencryptedHTTP2(true) // native gRPC clients use HTTP/2 with prior knowledge
 	}
 
-	if err = s.grpc.Serve(s.l); err != nil {
-		return fmt.Errorf("serve: %w", err)
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		l, err := s.listen(addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return fmt.Errorf("register listener %q: %w", addr, err)
+		}
+		listeners = append(listeners, s.conns.track(l))
 	}
 
-	return nil
+	ewg := &errgroup.Group{}
+	for _, l := range listeners {
+		ewg.Go(func() error {
+			if err := s.serve(l); err != nil {
+				s.stop() // don't keep serving on the rest of the listeners
+				return fmt.Errorf("serve on %s: %w", l.Addr(), err)
+			}
+			return nil
+		})
+	}
+
+	return ewg.Wait()
+}
+
+// serve serves the requests on the listener, either by the gRPC server
+// or by the HTTP server, if gRPC-Web, Connect and HTTP/JSON are enabled.
+func (s *Server) serve(l net.Listener) error {
+	if s.http == nil {
+		return s.grpc.Serve(l)
+	}
+
+	var err error
+	if s.tls != nil {
+		err = s.http.ServeTLS(l, "", "")
+	} else {
+		err = s.http.Serve(l)
+	}
+
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// stop stops the server immediately.
+func (s *Server) stop() {
+	if s.http != nil {
+		_ = s.http.Close()
+	}
+	s.grpc.Stop()
+}
+
+// listen opens the listener on the address. Unix sockets, left after
+// an unclean shutdown, are replaced, while sockets are removed on close.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix://")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if fi, err := os.Stat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("file %s exists and is not a socket", path)
+		}
+
+		if conn, err := net.Dial("unix", path); err == nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("socket %s is already in use", path)
+		}
+
+		if err = os.Remove(path); err != nil {
+			return nil, fmt.Errorf("remove stale socket: %w", err)
+		}
+	}
+
+	if s.socketMode == 0 {
+		return net.Listen("unix", path)
+	}
+
+	return listenUnix(path, s.socketMode)
+}
+
+// listenUnix listens on the unix socket with the given mode. The socket is
+// created in a private directory and is moved to the path once its mode is
+// set, so that it's never accessible with the default permissions.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".groxy")
+	if err != nil {
+		return nil, fmt.Errorf("make private directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	l.SetUnlinkOnClose(false) // the socket is unlinked by its final path
+
+	if err = os.Chmod(tmp, mode); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("change socket mode: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("move socket: %w", err)
+	}
+
+	return movedListener{UnixListener: l, path: path}, nil
+}
+
+// movedListener is a unix listener, which socket has been moved to the path.
+type movedListener struct {
+	*net.UnixListener
+	path string
+}
+
+// Addr returns the final address of the socket.
+func (l movedListener) Addr() net.Addr { return &net.UnixAddr{Name: l.path, Net: "unix"} }
+
+// Close stops listening and removes the socket.
+func (l movedListener) Close() error {
+	err := l.UnixListener.Close()
+	if rmErr := os.Remove(l.path); rmErr != nil && !errors.Is(rmErr, os.ErrNotExist) {
+		err = errors.Join(err, fmt.Errorf("remove socket: %w", rmErr))
+	}
+	return err
 }
 
 // Close stops the server.
-func (s *Server) Close() { s.grpc.GracefulStop() }
+func (s *Server) Close() {
+	if s.http != nil {
+		if err := s.http.Shutdown(context.Background()); err != nil {
+			slog.Warn("failed to shutdown HTTP server", slogx.Error(err))
+		}
+	}
+	if s.grpc != nil { // the server is not built, if Listen failed early
+		s.grpc.GracefulStop()
+	}
+
+	if s.recordings != nil { // no handlers are running anymore
+		close(s.recordings)
+		s.recordings = nil
+		<-s.recorded
+	}
+}
 
 type contextKey string
 
 var (
 	ctxMatch     = contextKey("match")
 	ctxFirstRecv = contextKey("first_recv")
+	ctxScenario  = contextKey("scenario")
+	ctxExchange  = contextKey("exchange")
+	ctxReplay    = contextKey("replay") // the call is replayed by the compare mode
 )
 
 func (s *Server) matchMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
@@ -140,9 +359,7 @@ func (s *Server) matchMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 
 		match := matches[0]
 		if !matches.NeedsDeeperMatch() {
-			slog.DebugContext(ctx, "matched", slog.Any("match", match))
-			ctx = context.WithValue(ctx, ctxMatch, match)
-			return next(srv, grpcx.StreamWithContext(ctx, stream))
+			return s.matched(ctx, match, srv, stream, next)
 		}
 
 		var firstRecv []byte
@@ -156,12 +373,41 @@ func (s *Server) matchMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 			return next(srv, stream)
 		}
 
-		slog.DebugContext(ctx, "matched", slog.Any("match", match))
-		ctx = context.WithValue(ctx, ctxMatch, match)
-		return next(srv, grpcx.StreamWithContext(ctx, stream))
+		return s.matched(ctx, match, srv, stream, next)
 	}
 }
 
+// matched puts the matched rule into the context, advances the
+// scenario of the rule, if any, and calls the next handler.
+func (s *Server) matched(
+	ctx context.Context,
+	match *discovery.Rule,
+	srv any,
+	stream grpc.ServerStream,
+	next grpc.StreamHandler,
+) error {
+	slog.DebugContext(ctx, "matched", slog.Any("match", match))
+	ctx = context.WithValue(ctx, ctxMatch, match)
+	if ex, ok := ctx.Value(ctxExchange).(*exchange); ok {
+		ex.rule = match
+	}
+
+	if match.Scenario != nil {
+		data, err := requestData(ctx, match)
+		if err != nil {
+			return err
+		}
+
+		scenario := s.matcher.AdvanceScenario(match, data)
+		slog.DebugContext(ctx, "advanced scenario",
+			slog.String("scenario", match.Scenario.Name),
+			slog.String("new_state", match.Scenario.NewState))
+		ctx = context.WithValue(ctx, ctxScenario, scenario)
+	}
+
+	return next(srv, grpcx.StreamWithContext(ctx, stream))
+}
+
 func (s *Server) mockMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 	return func(srv any, stream grpc.ServerStream) error {
 		ctx := stream.Context()
@@ -175,16 +421,8 @@ func (s *Server) mockMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 			return next(srv, stream)
 		}
 
-		if match.Mock.Wait > 0 {
-			slog.DebugContext(ctx, "waiting before responding", slog.Any("wait", match.Mock.Wait))
-			select {
-			case <-ctx.Done():
-				slog.WarnContext(ctx, "context done while waiting",
-					slog.Any("wait", match.Mock.Wait),
-					slogx.Error(ctx.Err()))
-				return status.Error(codes.Canceled, "{groxy} context done while waiting")
-			case <-time.After(match.Mock.Wait):
-			}
+		if err := wait(ctx, match.Mock.Wait); err != nil {
+			return err
 		}
 
 		if len(match.Mock.Header) > 0 {
@@ -197,33 +435,36 @@ func (s *Server) mockMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 			stream.SetTrailer(match.Mock.Trailer)
 		}
 
+		data, err := requestData(ctx, match)
+		if err != nil {
+			return err
+		}
+
+		if len(match.Mock.OnMessage) > 0 {
+			if data, err = react(ctx, stream, match, data); err != nil {
+				return err
+			}
+		}
+
 		switch {
 		case match.Mock.Body != nil:
-			var data map[string]any
-
-			firstRecv := ctx.Value(ctxFirstRecv)
-			if firstRecv != nil && match.Match.Message != nil {
-				dm, err := match.Match.Message.DataMap(ctx, firstRecv.([]byte))
-				if err != nil {
-					slog.WarnContext(ctx, "failed to extract data from the first message", slogx.Error(err))
-					return status.Errorf(codes.Internal, "{groxy} failed to extract data from the first message: %v", err)
-				}
-				data = dm
+			if err = sendTemplate(ctx, stream, match.Mock.Body, data); err != nil {
+				return err
 			}
-
-			msg, err := match.Mock.Body.Generate(ctx, data)
-			if err != nil {
-				slog.WarnContext(ctx, "failed to generate mock body", slogx.Error(err))
-				return status.Errorf(codes.Internal, "{groxy} failed to generate mock body: %v", err)
+		case len(match.Mock.Stream) > 0:
+			if err = sendStream(ctx, stream, match.Mock.Stream, data); err != nil {
+				return err
 			}
+		case match.Mock.Status == nil && len(match.Mock.OnMessage) == 0:
+			return status.Error(codes.Internal, "{groxy} empty mock")
+		}
 
-			if err = stream.SendMsg(msg); err != nil {
-				return status.Errorf(codes.Internal, "{groxy} failed to send message: %v", err)
-			}
-		case match.Mock.Status != nil:
+		if match.Mock.Status != nil {
 			return match.Mock.Status.Err()
-		default:
-			return status.Error(codes.Internal, "{groxy} empty mock")
+		}
+
+		if len(match.Mock.OnMessage) > 0 {
+			return nil // the stream has been already read till the end
 		}
 
 		// dump the rest of the stream
@@ -239,8 +480,164 @@ func (s *Server) mockMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 	}
 }
 
+// requestData extracts the data from the first RECV message
+// to be used in the mock templates. If the rule is a part of a scenario,
+// the data stored in the scenario is put under the "Scenario" key.
+// The subject of the verified client certificate, if any, is put
+// under the "ClientSubject" key.
+func requestData(ctx context.Context, match *discovery.Rule) (map[string]any, error) {
+	var data map[string]any
+	if scenario, ok := ctx.Value(ctxScenario).(map[string]any); ok {
+		data = map[string]any{"Scenario": scenario}
+	}
+
+	if subj := metadata.ValueFromIncomingContext(ctx, middleware.ClientSubjectKey); len(subj) > 0 {
+		data = lo.Assign(data, map[string]any{"ClientSubject": subj[0]})
+	}
+
+	firstRecv := ctx.Value(ctxFirstRecv)
+	if firstRecv == nil || match.Match.Message == nil {
+		return data, nil
+	}
+
+	dm, err := match.Match.Message.DataMap(ctx, firstRecv.([]byte))
+	if err != nil {
+		slog.WarnContext(ctx, "failed to extract data from the first message", slogx.Error(err))
+		return nil, status.Errorf(codes.Internal, "{groxy} failed to extract data from the first message: %v", err)
+	}
+
+	return lo.Assign(data, dm), nil
+}
+
+// react reads the downstream messages until the downstream closes its side
+// of the stream and replies to each of them according to the first matched reaction.
+// It returns the base data, merged with the data of the last received message
+// and the data of all received messages under the "Received" key.
+func react(ctx context.Context, stream grpc.ServerStream, match *discovery.Rule, base map[string]any) (map[string]any, error) {
+	decoder := match.Match.Message
+	for _, r := range match.Mock.OnMessage {
+		if decoder != nil {
+			break
+		}
+		decoder = r.Match
+	}
+
+	var received []map[string]any
+	data := lo.Assign(base, map[string]any{"Received": received})
+
+	firstRecv, _ := ctx.Value(ctxFirstRecv).([]byte)
+	for idx := 0; ; idx++ {
+		msg := firstRecv
+		if idx > 0 || firstRecv == nil {
+			if err := stream.RecvMsg(&msg); err != nil {
+				if errors.Is(err, io.EOF) {
+					return data, nil
+				}
+				return nil, status.Errorf(codes.Internal, "{groxy} failed to read message #%d: %v", idx, err)
+			}
+		}
+
+		curr := map[string]any{}
+		if decoder != nil {
+			dm, err := decoder.DataMap(ctx, msg)
+			if err != nil {
+				slog.WarnContext(ctx, "failed to extract data from the message", slog.Int("index", idx), slogx.Error(err))
+				return nil, status.Errorf(codes.Internal, "{groxy} failed to extract data from message #%d: %v", idx, err)
+			}
+			curr = dm
+		}
+
+		received = append(received, curr)
+		data = lo.Assign(base, curr, map[string]any{"RecvIndex": idx, "Received": received})
+
+		reaction, ok := findReaction(ctx, match.Mock.OnMessage, msg)
+		if !ok {
+			slog.DebugContext(ctx, "no reaction matched the message", slog.Int("index", idx))
+			continue
+		}
+
+		if err := sendStream(ctx, stream, reaction.Reply, data); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func findReaction(ctx context.Context, reactions []discovery.Reaction, msg []byte) (discovery.Reaction, bool) {
+	for _, r := range reactions {
+		if r.Match == nil {
+			return r, true
+		}
+
+		ok, err := r.Match.Matches(ctx, msg)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to match message against a reaction", slogx.Error(err))
+			continue
+		}
+
+		if ok {
+			return r, true
+		}
+	}
+
+	return discovery.Reaction{}, false
+}
+
+func sendStream(ctx context.Context, stream grpc.ServerStream, msgs []discovery.StreamMessage, data map[string]any) error {
+	idx := 0
+	for _, msg := range msgs {
+		n, err := msg.Count(data)
+		if err != nil {
+			slog.WarnContext(ctx, "failed to evaluate the number of messages", slogx.Error(err))
+			return status.Errorf(codes.Internal, "{groxy} failed to evaluate the number of messages: %v", err)
+		}
+
+		for range n {
+			if err = wait(ctx, msg.Wait); err != nil {
+				return err
+			}
+
+			if err = sendTemplate(ctx, stream, msg.Body, lo.Assign(data, map[string]any{"Index": idx})); err != nil {
+				return err
+			}
+
+			idx++
+		}
+	}
+
+	return nil
+}
+
+func sendTemplate(ctx context.Context, stream grpc.ServerStream, tmpl protodef.Template, data map[string]any) error {
+	msg, err := tmpl.Generate(ctx, data)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to generate mock body", slogx.Error(err))
+		return status.Errorf(codes.Internal, "{groxy} failed to generate mock body: %v", err)
+	}
+
+	if err = stream.SendMsg(msg); err != nil {
+		return status.Errorf(codes.Internal, "{groxy} failed to send message: %v", err)
+	}
+
+	return nil
+}
+
+func wait(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	slog.DebugContext(ctx, "waiting before responding", slog.Any("wait", d))
+	select {
+	case <-ctx.Done():
+		slog.WarnContext(ctx, "context done while waiting", slog.Any("wait", d), slogx.Error(ctx.Err()))
+		return status.Error(codes.Canceled, "{groxy} context done while waiting")
+	case <-time.After(d):
+		return nil
+	}
+}
+
 func (s *Server) forwardMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
-	return func(_ any, stream grpc.ServerStream) error {
+	return func(_ any, stream grpc.ServerStream) (err error) {
 		ctx := stream.Context()
 
 		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
@@ -248,57 +645,92 @@ func (s *Server) forwardMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
 			return next(nil, stream)
 		}
 
+		md, _ := metadata.FromIncomingContext(ctx)
+		up := match.Forward.Pick(md)
+
 		ctx = plantHeader(ctx, match.Forward.Header)
 
 		mtd, _ := grpc.Method(ctx)
-		desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
-
-		upstreamHeader, upstreamTrailer := metadata.New(nil), metadata.New(nil)
+		uri := mtd
 
 		if match.Forward.Rewrite != "" {
 			mtd = match.Match.URI.ReplaceAllString(mtd, match.Forward.Rewrite)
 		}
 
-		upstream, err := match.Forward.Upstream.NewStream(ctx, desc, mtd,
-			grpc.ForceCodec(grpcx.RawBytesCodec{}),
-			grpc.Header(&upstreamHeader),
-			grpc.Trailer(&upstreamTrailer))
-		if err != nil {
-			return status.Errorf(codes.Internal, "{groxy} failed to create upstream: %v", err)
+		if s.tracer != nil && !isReplay(ctx) {
+			var span trace.Span
+			ctx, span = s.startForwardSpan(ctx, up, mtd)
+			defer func() { endSpan(span, err, clientError) }()
 		}
 
-		if firstRecv, _ := ctx.Value(ctxFirstRecv).([]byte); firstRecv != nil {
-			if err = upstream.SendMsg(firstRecv); err != nil {
-				return status.Errorf(codes.Internal,
-					"{groxy} failed to send the first message to the upstream: %v", err)
-			}
+		if match.Forward.Retry != nil {
+			return s.forwardWithRetry(ctx, stream, up, uri, mtd, match.Forward.Retry)
 		}
 
-		defer func() {
-			stream.SetTrailer(metadata.Join(upstreamHeader, upstreamTrailer))
+		return s.forward(ctx, stream, up, uri, mtd)
+	}
+}
 
-			if err = upstream.CloseSend(); err != nil {
-				slog.WarnContext(ctx, "failed to close the upstream",
-					slog.String("upstream_name", match.Forward.Upstream.Name()),
-					slogx.Error(err))
-			}
+// forward makes a single call to the upstream and pipes the messages
+// between it and the client.
+func (s *Server) forward(ctx context.Context, stream grpc.ServerStream,
+	up discovery.Upstream, uri, mtd string) (err error) {
+	desc := &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}
+	upstreamHeader, upstreamTrailer := metadata.New(nil), metadata.New(nil)
+
+	upstream, err := up.NewStream(ctx, desc, mtd,
+		grpc.ForceCodec(grpcx.RawBytesCodec{}),
+		grpc.Header(&upstreamHeader),
+		grpc.Trailer(&upstreamTrailer))
+	if err != nil {
+		return status.Errorf(codes.Internal, "{groxy} failed to create upstream: %v", err)
+	}
+
+	firstRecv, _ := ctx.Value(ctxFirstRecv).([]byte)
+	if firstRecv != nil {
+		if err = upstream.SendMsg(firstRecv); err != nil {
+			return status.Errorf(codes.Internal,
+				"{groxy} failed to send the first message to the upstream: %v", err)
+		}
+	}
+
+	if s.recorder != nil && !isReplay(ctx) {
+		ex := &recorder.Exchange{URI: uri, Method: mtd, Upstream: up}
+		if firstRecv != nil {
+			ex.Requests = append(ex.Requests, firstRecv)
+		}
+		stream = tapStream{ServerStream: stream, ex: ex}
+
+		defer func() { // runs after the upstream header and trailer are set
+			ex.Header, ex.Trailer = upstreamHeader, upstreamTrailer
+			s.record(ctx, *ex, err)
 		}()
+	}
 
-		if err = grpcx.Pipe(upstream, stream); err != nil {
-			if errors.Is(err, io.EOF) {
-				return eofStatus(upstream)
-			}
-			if st := grpcx.StatusFromError(err); st != nil {
-				return st.Err()
-			}
-			slog.WarnContext(ctx, "failed to pipe",
-				slog.String("upstream_name", match.Forward.Upstream.Name()),
-				slogx.Error(err))
-			return status.Errorf(codes.Internal, "{groxy} failed to pipe messages to the upstream")
+	defer func() {
+		stream.SetTrailer(metadata.Join(upstreamHeader, upstreamTrailer))
+
+		if cerr := upstream.CloseSend(); cerr != nil {
+			slog.WarnContext(ctx, "failed to close the upstream",
+				slog.String("upstream_name", up.Name()),
+				slogx.Error(cerr))
 		}
+	}()
 
-		return nil
+	if err = grpcx.Pipe(upstream, stream); err != nil {
+		if errors.Is(err, io.EOF) {
+			return eofStatus(upstream)
+		}
+		if st := grpcx.StatusFromError(err); st != nil {
+			return st.Err()
+		}
+		slog.WarnContext(ctx, "failed to pipe",
+			slog.String("upstream_name", up.Name()),
+			slogx.Error(err))
+		return status.Errorf(codes.Internal, "{groxy} failed to pipe messages to the upstream")
 	}
+
+	return nil
 }
 
 func eofStatus(upstream grpc.ClientStream) (err error) {
@@ -1,23 +1,39 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/Semior001/groxy/pkg/discovery"
 	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
 	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/middleware"
 	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/Semior001/groxy/pkg/tlsx"
+	"github.com/expr-lang/expr"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 )
 
 func TestServer_handle(t *testing.T) {
@@ -43,7 +59,49 @@ func TestServer_handle(t *testing.T) {
 		grpc.WithTransportCredentials(insecure.NewCredentials()))
 	require.NoError(t, err)
 
+	tick, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "tick {{.Index}}"];
+	}`)
+	require.NoError(t, err)
+
+	three, err := expr.Compile("3", expr.AsInt())
+	require.NoError(t, err)
+
+	pong, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "pong #{{.RecvIndex}}"];
+	}`)
+	require.NoError(t, err)
+
+	summary, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "received {{len .Received}}, last: {{.value}}"];
+	}`)
+	require.NoError(t, err)
+
+	scenarioTmpl, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "order {{.Scenario.id}}"];
+	}`)
+	require.NoError(t, err)
+
+	scenarioReply, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "order {{.Scenario.id}} #{{.RecvIndex}}"];
+	}`)
+	require.NoError(t, err)
+
+	scenarioSummary, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "order {{.Scenario.id}}, received {{len .Received}}"];
+	}`)
+	require.NoError(t, err)
+
 	matcher := &mocks.MatcherMock{
+		AdvanceScenarioFunc: func(*discovery.Rule, map[string]any) map[string]any {
+			return map[string]any{"id": "42"}
+		},
 		UpstreamsFunc: func() []discovery.Upstream {
 			return []discovery.Upstream{discovery.ClientConn{
 				ConnName:        "backend",
@@ -80,11 +138,11 @@ func TestServer_handle(t *testing.T) {
 						URI:     regexp.MustCompile("groxy.testdata.ExampleService/Unary"),
 						Message: protodef.Static(&grpctest.StreamRequest{Value: "forward"}),
 					},
-					Forward: &discovery.Forward{Upstream: discovery.ClientConn{
+					Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{
 						ConnName:        "backend",
 						ServeReflection: true,
 						ClientConn:      backendConn,
-					}},
+					}}}},
 				},
 				{
 					Name: "groxy.testdata.ExampleService/Unary (mock with response)",
@@ -96,38 +154,90 @@ func TestServer_handle(t *testing.T) {
 						Body: protodef.Static(&grpctest.StreamResponse{Value: "test"}),
 					},
 				},
+				{
+					Name: "groxy.testdata.ExampleService/Unary (mock with scenario)",
+					Match: discovery.RequestMatcher{
+						URI:     regexp.MustCompile("groxy.testdata.ExampleService/Unary"),
+						Message: protodef.Static(&grpctest.StreamRequest{Value: "scenario"}),
+					},
+					Scenario: &discovery.Scenario{Name: "orders", RequiredState: "created"},
+					Mock:     &discovery.Mock{Body: scenarioTmpl},
+				},
+				{
+					Name: "groxy.testdata.ExampleService/ServerStream (mock with stream)",
+					Match: discovery.RequestMatcher{
+						URI:     regexp.MustCompile("groxy.testdata.ExampleService/ServerStream"),
+						Message: protodef.Static(&grpctest.StreamRequest{Value: "mock"}),
+					},
+					Mock: &discovery.Mock{
+						Stream: []discovery.StreamMessage{
+							{Body: protodef.Static(&grpctest.StreamResponse{Value: "first"})},
+							{Body: tick, Wait: time.Millisecond, Repeat: three},
+						},
+						Status: status.New(codes.Aborted, "stream ended"),
+					},
+				},
+				{
+					Name: "groxy.testdata.ExampleService/BiDirectional (mock with reactions)",
+					Match: discovery.RequestMatcher{
+						URI:     regexp.MustCompile("groxy.testdata.ExampleService/BiDirectional"),
+						Message: protodef.Static(&grpctest.StreamRequest{Value: "hello"}),
+					},
+					Mock: &discovery.Mock{
+						OnMessage: []discovery.Reaction{
+							{
+								Match: protodef.Static(&grpctest.StreamRequest{Value: "ping"}),
+								Reply: []discovery.StreamMessage{{Body: pong}},
+							},
+							{}, // consume everything else silently
+						},
+						Body: summary,
+					},
+				},
+				{
+					Name: "groxy.testdata.ExampleService/BiDirectional (mock with scenario reactions)",
+					Match: discovery.RequestMatcher{
+						URI:     regexp.MustCompile("groxy.testdata.ExampleService/BiDirectional"),
+						Message: protodef.Static(&grpctest.StreamRequest{Value: "order"}),
+					},
+					Scenario: &discovery.Scenario{Name: "orders", RequiredState: "created"},
+					Mock: &discovery.Mock{
+						OnMessage: []discovery.Reaction{{Reply: []discovery.StreamMessage{{Body: scenarioReply}}}},
+						Body:      scenarioSummary,
+					},
+				},
 				{
 					Name: "groxy.testdata.ExampleService/BiDirectional (forward to backend)",
 					Match: discovery.RequestMatcher{
 						URI: regexp.MustCompile("groxy.testdata.ExampleService/BiDirectional"),
 					},
-					Forward: &discovery.Forward{Upstream: discovery.ClientConn{
+					Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{
 						ConnName:        "backend",
 						ServeReflection: true,
 						ClientConn:      backendConn,
-					}},
+					}}}},
 				},
 				{
 					Name: "groxy.testdata.ExampleService/ClientStream (forward to backend)",
 					Match: discovery.RequestMatcher{
 						URI: regexp.MustCompile("groxy.testdata.ExampleService/ClientStream"),
 					},
-					Forward: &discovery.Forward{Upstream: discovery.ClientConn{
+					Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{
 						ConnName:        "backend",
 						ServeReflection: true,
 						ClientConn:      backendConn,
-					}},
+					}}}},
 				},
 				{
 					Name: "groxy.testdata.ExampleService/ServerStream (forward to backend)",
 					Match: discovery.RequestMatcher{
 						URI: regexp.MustCompile("groxy.testdata.ExampleService/ServerStream"),
 					},
-					Forward: &discovery.Forward{Upstream: discovery.ClientConn{
+					Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{
 						ConnName:        "backend",
 						ServeReflection: true,
 						ClientConn:      backendConn,
-					}},
+					}}}},
 				},
 			}
 		},
@@ -175,6 +285,73 @@ func TestServer_handle(t *testing.T) {
 		require.Equal(t, "test", (*md)["test"][0])
 	})
 
+	t.Run("mock with scenario", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "scenario"})
+		require.NoError(t, err)
+		assert.Equal(t, "order 42", resp.Value)
+		require.Len(t, matcher.AdvanceScenarioCalls(), 1)
+		assert.Equal(t, "orders", matcher.AdvanceScenarioCalls()[0].Rule.Scenario.Name)
+	})
+
+	t.Run("mock with stream", func(t *testing.T) {
+		stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "mock"})
+		require.NoError(t, err)
+
+		for _, want := range []string{"first", "tick 1", "tick 2", "tick 3"} {
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, want, resp.Value)
+		}
+
+		_, err = stream.Recv()
+		st, ok := status.FromError(err)
+		require.True(t, ok)
+		assert.Equal(t, codes.Aborted, st.Code())
+		assert.Equal(t, "stream ended", st.Message())
+	})
+
+	t.Run("mock with reactions", func(t *testing.T) {
+		stream, err := cl.BiDirectional(context.Background())
+		require.NoError(t, err)
+
+		require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "hello"}))
+		for i := 1; i <= 2; i++ {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "ping"}))
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("pong #%d", i), resp.Value)
+		}
+		require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "bye"}))
+		require.NoError(t, stream.CloseSend())
+
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "received 4, last: bye", resp.Value)
+
+		_, err = stream.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("mock with scenario reactions", func(t *testing.T) {
+		stream, err := cl.BiDirectional(context.Background())
+		require.NoError(t, err)
+
+		for i := range 2 {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "order"}))
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("order 42 #%d", i), resp.Value, "the reply must see the scenario data")
+		}
+		require.NoError(t, stream.CloseSend())
+
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "order 42, received 2", resp.Value, "the final body must see the scenario data")
+
+		_, err = stream.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
 	t.Run("forward to the backend", func(t *testing.T) {
 		t.Run("unary", func(t *testing.T) {
 			resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "forward"})
@@ -230,3 +407,386 @@ func TestServer_handle(t *testing.T) {
 		})
 	})
 }
+
+func TestServer_forwardSplit(t *testing.T) {
+	var targets []discovery.ForwardTarget
+	for _, name := range []string{"stable", "canary"} {
+		backendConn := startBackend(t, &grpctest.Server{
+			UnaryFunc: func(context.Context, *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+				return &grpctest.StreamResponse{Value: name}, nil
+			},
+		})
+
+		targets = append(targets, discovery.ForwardTarget{
+			Upstream: discovery.ClientConn{ConnName: name, ClientConn: backendConn},
+			Weight:   1,
+		})
+	}
+
+	rule := &discovery.Rule{
+		Name:    "split",
+		Match:   discovery.RequestMatcher{URI: regexp.MustCompile(".*")},
+		Forward: &discovery.Forward{Targets: targets, HashKey: "x-user-id"},
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc:     func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches { return discovery.Matches{rule} },
+	}
+
+	cl := startProxy(t, matcher)
+
+	seen := map[string]bool{}
+	for i := range 20 {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "x-user-id", strconv.Itoa(i))
+
+		resp, err := cl.Unary(ctx, &grpctest.StreamRequest{})
+		require.NoError(t, err)
+		seen[resp.Value] = true
+
+		for range 3 {
+			again, err := cl.Unary(ctx, &grpctest.StreamRequest{})
+			require.NoError(t, err)
+			assert.Equal(t, resp.Value, again.Value, "requests of the same user go to the same upstream")
+		}
+	}
+	assert.Equal(t, map[string]bool{"stable": true, "canary": true}, seen)
+}
+
+func TestServer_tls(t *testing.T) {
+	ca, err := tlsx.NewCA("test CA")
+	require.NoError(t, err)
+
+	serverCert, err := ca.Issue("groxy", "localhost")
+	require.NoError(t, err)
+
+	clientCert, err := ca.Issue("billing")
+	require.NoError(t, err)
+
+	body, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "{{ .ClientSubject }}"];
+	}`)
+	require.NoError(t, err)
+
+	reply, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "{{ .ClientSubject }} #{{ .RecvIndex }}"];
+	}`)
+	require.NoError(t, err)
+
+	billing := map[string]*regexp.Regexp{middleware.ClientSubjectKey: regexp.MustCompile("^CN=billing$")}
+	rules := []*discovery.Rule{
+		{
+			Name: "billing",
+			Match: discovery.RequestMatcher{
+				URI:              regexp.MustCompile("/groxy.testdata.ExampleService/Unary"),
+				IncomingMetadata: billing,
+			},
+			Mock: &discovery.Mock{Body: body},
+		},
+		{
+			Name: "billing reactions",
+			Match: discovery.RequestMatcher{
+				URI:              regexp.MustCompile("/groxy.testdata.ExampleService/BiDirectional"),
+				IncomingMetadata: billing,
+			},
+			Mock: &discovery.Mock{OnMessage: []discovery.Reaction{{Reply: []discovery.StreamMessage{{Body: reply}}}}},
+		},
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, md metadata.MD) discovery.Matches {
+			var res discovery.Matches
+			for _, rule := range rules {
+				if rule.Match.Matches(uri, md) {
+					res = append(res, rule)
+				}
+			}
+			return res
+		},
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, ca.PEM(), 0o600))
+
+	certs := &tlsx.Server{
+		Certificate:  &serverCert,
+		ClientCAFile: caFile,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	require.NoError(t, certs.Load())
+
+	srv := NewServer(matcher, WithTLS(certs.Config()))
+	addr := freeAddr(t)
+
+	go func() {
+		assert.NoError(t, srv.Listen(addr))
+	}()
+	defer srv.Close()
+
+	dialTLS := func(t *testing.T, certs ...tls.Certificate) grpctest.ExampleServiceClient {
+		cc, err := grpc.NewClient(addr,
+			grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{
+				RootCAs:      ca.Pool(),
+				Certificates: certs,
+				MinVersion:   tls.VersionTLS12,
+			})))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = cc.Close() })
+		return grpctest.NewExampleServiceClient(cc)
+	}
+
+	t.Run("client certificate", func(t *testing.T) {
+		resp, err := dialTLS(t, clientCert).Unary(context.Background(), &grpctest.StreamRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "CN=billing", resp.Value)
+	})
+
+	t.Run("client certificate in reactions", func(t *testing.T) {
+		stream, err := dialTLS(t, clientCert).BiDirectional(context.Background())
+		require.NoError(t, err)
+
+		for i := range 2 {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: "ping"}))
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("CN=billing #%d", i), resp.Value, "the reply must see the client subject")
+		}
+		require.NoError(t, stream.CloseSend())
+
+		_, err = stream.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("forged subject", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), middleware.ClientSubjectKey, "CN=billing")
+		_, err := dialTLS(t).Unary(ctx, &grpctest.StreamRequest{})
+		assert.Equal(t, codes.Internal, status.Code(err))
+		assert.Contains(t, status.Convert(err).Message(), "didn't match request to any rule")
+	})
+
+	t.Run("plaintext", func(t *testing.T) {
+		_, err := grpctest.NewExampleServiceClient(dial(t, addr)).Unary(context.Background(), &grpctest.StreamRequest{})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+	})
+}
+
+func TestServer_web(t *testing.T) {
+	body, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "mocked"];
+	}`)
+	require.NoError(t, err)
+
+	matcher := &mocks.MatcherMock{
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			if uri != "/groxy.testdata.ExampleService/Unary" {
+				return nil
+			}
+			return discovery.Matches{{Name: "mock", Mock: &discovery.Mock{Body: body}}}
+		},
+		RulesFunc: func() []*discovery.Rule { return nil },
+	}
+
+	srv := NewServer(matcher, WithWeb())
+	addr := freeAddr(t)
+
+	done := make(chan error)
+	go func() { done <- srv.Listen(addr) }()
+
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	req, err := proto.Marshal(&grpctest.StreamRequest{Value: "hello"})
+	require.NoError(t, err)
+
+	post := func(t *testing.T, contentType string, body []byte) *http.Response {
+		t.Helper()
+		resp, err := http.Post("http://"+addr+"/groxy.testdata.ExampleService/Unary", contentType, bytes.NewReader(body))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = resp.Body.Close() })
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, 1, resp.ProtoMajor, "must be served over HTTP/1.1")
+		return resp
+	}
+
+	t.Run("gRPC", func(t *testing.T) {
+		cc, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		defer cc.Close()
+
+		resp, err := grpctest.NewExampleServiceClient(cc).Unary(context.Background(), &grpctest.StreamRequest{})
+		require.NoError(t, err)
+		assert.Equal(t, "mocked", resp.Value)
+	})
+
+	t.Run("gRPC-Web", func(t *testing.T) {
+		frame := append([]byte{0, 0, 0, 0, byte(len(req))}, req...)
+		resp := post(t, "application/grpc-web+proto", frame)
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Greater(t, len(bts), 5)
+
+		size := int(binary.BigEndian.Uint32(bts[1:5]))
+		msg := &grpctest.StreamResponse{}
+		require.NoError(t, proto.Unmarshal(bts[5:5+size], msg))
+		assert.Equal(t, "mocked", msg.Value)
+		assert.Equal(t, "grpc-status: 0\r\n", string(bts[5+size+5:]))
+	})
+
+	t.Run("Connect", func(t *testing.T) {
+		resp := post(t, "application/proto", req)
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+
+		msg := &grpctest.StreamResponse{}
+		require.NoError(t, proto.Unmarshal(bts, msg))
+		assert.Equal(t, "mocked", msg.Value)
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		resp := post(t, "application/json", []byte(`{"value":"hello"}`))
+		assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		bts, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.JSONEq(t, `{"value":"mocked"}`, string(bts))
+	})
+
+	srv.Close()
+	require.NoError(t, <-done)
+}
+
+func TestServer_Listen(t *testing.T) {
+	body, err := protodef.BuildMessage(`message StreamResponse {
+		option (groxypb.target) = true;
+		string value = 1 [(groxypb.value) = "mocked"];
+	}`)
+	require.NoError(t, err)
+
+	matcher := &mocks.MatcherMock{
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches {
+			return discovery.Matches{{Name: "mock", Mock: &discovery.Mock{Body: body}}}
+		},
+	}
+
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "groxy.sock")
+
+	// socket, left after an unclean shutdown
+	stale, err := net.Listen("unix", sock)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	srv := NewServer(matcher, WithSocketMode(0o600))
+	addr := freeAddr(t)
+
+	done := make(chan error)
+	go func() { done <- srv.Listen(addr, "unix://"+sock) }()
+
+	require.Eventually(t, func() bool {
+		fi, err := os.Stat(sock)
+		return err == nil && fi.Mode().Perm() == 0o600
+	}, time.Second, 10*time.Millisecond)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "private directory of the socket must be removed")
+
+	for _, target := range []string{addr, "unix://" + sock} {
+		cc, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+
+		resp, err := grpctest.NewExampleServiceClient(cc).Unary(context.Background(), &grpctest.StreamRequest{})
+		require.NoError(t, err, target)
+		assert.Equal(t, "mocked", resp.Value)
+		require.NoError(t, cc.Close())
+	}
+
+	t.Run("socket in use", func(t *testing.T) {
+		err := NewServer(matcher).Listen("unix://" + sock)
+		assert.ErrorContains(t, err, "is already in use")
+	})
+
+	t.Run("not a socket", func(t *testing.T) {
+		file := filepath.Join(dir, "file")
+		require.NoError(t, os.WriteFile(file, nil, 0o600))
+		err := NewServer(matcher).Listen("unix://" + file)
+		assert.ErrorContains(t, err, "exists and is not a socket")
+	})
+
+	t.Run("no addresses", func(t *testing.T) {
+		srv := NewServer(matcher, WithRecorder(&recorder.Recorder{}))
+		assert.ErrorContains(t, srv.Listen(), "no addresses to listen on")
+		assert.NotPanics(t, srv.Close, "server must close, even if it has never started")
+	})
+
+	srv.Close()
+	require.NoError(t, <-done)
+
+	_, err = os.Stat(sock)
+	assert.ErrorIs(t, err, os.ErrNotExist, "socket must be removed on close")
+}
+
+// startBackend serves the test service with the handlers and returns the
+// connection to it. Register, if set, registers additional services.
+func startBackend(t *testing.T, impl *grpctest.Server, register ...func(*grpc.Server)) *grpc.ClientConn {
+	t.Helper()
+
+	srv := grpc.NewServer()
+	grpctest.RegisterExampleServiceServer(srv, impl)
+	for _, r := range register {
+		r(srv)
+	}
+
+	addr := grpctest.StartServer(t, srv)
+	t.Cleanup(srv.Stop)
+
+	return dial(t, addr)
+}
+
+// startProxy serves the proxy with the matcher and the options on a free
+// port and returns the client of the test service, connected to it.
+func startProxy(t *testing.T, matcher Matcher, opts ...Option) grpctest.ExampleServiceClient {
+	t.Helper()
+
+	addr := freeAddr(t)
+	srv := NewServer(matcher, opts...)
+	go func() { assert.NoError(t, srv.Listen(addr)) }()
+	t.Cleanup(srv.Close)
+
+	return grpctest.NewExampleServiceClient(dial(t, addr))
+}
+
+// dial connects to the address without TLS.
+func dial(t *testing.T, addr string) *grpc.ClientConn {
+	t.Helper()
+
+	cc, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = cc.Close() })
+
+	return cc
+}
+
+// freeAddr returns the local address with a free port.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	port := l.Addr().(*net.TCPAddr).Port
+	require.NoError(t, l.Close())
+
+	return fmt.Sprintf("localhost:%d", port)
+}
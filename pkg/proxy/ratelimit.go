@@ -0,0 +1,43 @@
+package proxy
+
+import (
+	"log/slog"
+	"net"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+// rateLimitMiddleware rejects the requests, exceeding the rate or
+// the concurrency limits of the matched rule.
+func (s *Server) rateLimitMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+
+		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
+		if !ok || match.RateLimit == nil {
+			return next(srv, stream)
+		}
+
+		mtd, _ := grpc.Method(ctx)
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		var addr net.Addr
+		if p, ok := peer.FromContext(ctx); ok {
+			addr = p.Addr
+		}
+
+		key := match.RateLimit.Key.Of(mtd, md, addr)
+		release, err := match.RateLimit.Acquire(key)
+		if err != nil {
+			slog.DebugContext(ctx, "request limited", slog.String("key", key), slogx.Error(err))
+			return err
+		}
+		defer release()
+
+		return next(srv, stream)
+	}
+}
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_rateLimit(t *testing.T) {
+	slow := &discovery.Rule{
+		Name:      "slow",
+		Mock:      &discovery.Mock{Wait: 200 * time.Millisecond, Body: protodef.Static(&grpctest.StreamResponse{Value: "slow"})},
+		RateLimit: &discovery.RateLimit{Key: discovery.RateLimitKey{By: discovery.RateLimitByMethod}, MaxConcurrent: 1},
+	}
+	limited := &discovery.Rule{
+		Name: "limited",
+		Mock: &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{Value: "ok"})},
+		RateLimit: &discovery.RateLimit{
+			Key:   discovery.RateLimitKey{By: discovery.RateLimitByHeader, Header: "x-user-id"},
+			Rate:  1,
+			Burst: 1,
+		},
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			if uri == "/groxy.testdata.ExampleService/Unary" {
+				return discovery.Matches{limited}
+			}
+			return discovery.Matches{slow}
+		},
+	}
+
+	cl := startProxy(t, matcher)
+
+	t.Run("rate", func(t *testing.T) {
+		user := func(id string) context.Context {
+			return metadata.AppendToOutgoingContext(context.Background(), "x-user-id", id)
+		}
+
+		_, err := cl.Unary(user("1"), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+
+		_, err = cl.Unary(user("1"), &grpctest.StreamRequest{Value: "hello"})
+		st := status.Convert(err)
+		assert.Equal(t, codes.ResourceExhausted, st.Code())
+		require.Len(t, st.Details(), 1)
+		assert.IsType(t, &errdetails.RetryInfo{}, st.Details()[0])
+
+		_, err = cl.Unary(user("2"), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err, "another user has its own bucket")
+	})
+
+	t.Run("concurrency", func(t *testing.T) {
+		stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "first"})
+		require.NoError(t, err)
+		time.Sleep(50 * time.Millisecond) // let the first request take the slot
+
+		second, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "second"})
+		require.NoError(t, err)
+		_, err = second.Recv()
+		assert.Equal(t, codes.ResourceExhausted, status.Code(err))
+
+		resp, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, "slow", resp.Value)
+
+		third, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "third"})
+		require.NoError(t, err)
+		resp, err = third.Recv()
+		require.NoError(t, err, "the slot is released after the first request")
+		assert.Equal(t, "slow", resp.Value)
+	})
+}
@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// recordBuffer is the number of the exchanges, waiting to be recorded.
+// If the recorder falls behind further, the exchanges are dropped,
+// so that it never slows down the client.
+const recordBuffer = 64
+
+// recording is the forwarded exchange, waiting to be recorded.
+type recording struct {
+	ctx context.Context
+	ex  recorder.Exchange
+}
+
+// record passes the forwarded exchange to the recorder in the background.
+func (s *Server) record(ctx context.Context, ex recorder.Exchange, err error) {
+	ex.Status = status.Convert(err)
+
+	select {
+	// the client may have already gone, but the upstream is still there
+	case s.recordings <- recording{ctx: context.WithoutCancel(ctx), ex: ex}:
+	default:
+		slog.WarnContext(ctx, "recorder fell behind, the exchange is dropped",
+			slog.String("uri", ex.URI),
+			slog.String("upstream_name", ex.Upstream.Name()))
+	}
+}
+
+// recordExchanges passes the exchanges to the recorder one by one,
+// until the channel is closed.
+func (s *Server) recordExchanges(recordings <-chan recording) {
+	defer close(s.recorded)
+
+	for r := range recordings {
+		if err := s.recorder.Record(r.ctx, r.ex); err != nil {
+			slog.WarnContext(r.ctx, "failed to record the exchange",
+				slog.String("uri", r.ex.URI),
+				slog.String("upstream_name", r.ex.Upstream.Name()),
+				slogx.Error(err))
+		}
+	}
+}
+
+// tapStream keeps all messages, passed through the stream, in the exchange.
+// Messages are received and sent in different goroutines,
+// so the exchange must be read only after the stream is done.
+type tapStream struct {
+	grpc.ServerStream
+	ex *recorder.Exchange
+}
+
+// RecvMsg receives the message from the client and records it.
+func (s tapStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+
+	if ptr, ok := m.(*[]byte); ok {
+		s.ex.Requests = append(s.ex.Requests, *ptr)
+	}
+
+	return nil
+}
+
+// SendMsg records the message and sends it to the client.
+func (s tapStream) SendMsg(m any) error {
+	if bts, ok := m.([]byte); ok {
+		s.ex.Responses = append(s.ex.Responses, bts)
+	}
+
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+)
+
+func TestServer_record(t *testing.T) {
+	backendConn := startBackend(t, &grpctest.Server{
+		ServerStreamFunc: grpctest.Flood,
+		UnaryFunc: func(ctx context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			_ = grpc.SetHeader(ctx, metadata.Pairs("x-backend", "test"))
+			return &grpctest.StreamResponse{Value: "echo: " + req.Value}, nil
+		},
+	}, func(s *grpc.Server) { reflection.Register(s) })
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches {
+			return discovery.Matches{{
+				Name:    "forward",
+				Match:   discovery.RequestMatcher{URI: regexp.MustCompile(".*")},
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: backendConn}}}},
+			}}
+		},
+	}
+
+	rec := &recorder.Recorder{}
+	cl := startProxy(t, matcher, WithRecorder(rec))
+
+	resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello", resp.Value)
+
+	stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "2"})
+	require.NoError(t, err)
+	for {
+		if _, err = stream.Recv(); err != nil {
+			require.ErrorIs(t, err, io.EOF)
+			break
+		}
+	}
+
+	require.Eventually(t, func() bool { return len(rec.Config().Rules) == 2 }, time.Second, 10*time.Millisecond)
+	rules := rec.Config().Rules
+
+	assert.Equal(t, `^/groxy\.testdata\.ExampleService/Unary$`, rules[0].Match.URI)
+	require.NotNil(t, rules[0].Match.Body)
+	assert.Contains(t, *rules[0].Match.Body, `string value = 1 [(groxypb.value) = "hello"];`)
+	require.NotNil(t, rules[0].Respond.Body)
+	assert.Contains(t, *rules[0].Respond.Body, `string value = 1 [(groxypb.value) = "echo: hello"];`)
+	require.NotNil(t, rules[0].Respond.Metadata)
+	assert.Equal(t, map[string]string{"x-backend": "test"}, rules[0].Respond.Metadata.Header)
+
+	assert.Equal(t, `^/groxy\.testdata\.ExampleService/ServerStream$`, rules[1].Match.URI)
+	require.Len(t, rules[1].Respond.Stream, 2)
+	assert.Contains(t, rules[1].Respond.Stream[1].Body, `string value = 1 [(groxypb.value) = "1"];`)
+	assert.Nil(t, rules[1].Respond.Status)
+}
+
+func TestServer_recordInBackground(t *testing.T) {
+	backendConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			return &grpctest.StreamResponse{Value: req.Value}, nil
+		},
+	}, func(s *grpc.Server) { reflectionpb.RegisterServerReflectionServer(s, hungReflection{}) })
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches {
+			return discovery.Matches{{
+				Name:    "forward",
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: backendConn}}}},
+			}}
+		},
+	}
+
+	cl := startProxy(t, matcher, WithRecorder(&recorder.Recorder{Timeout: time.Second}))
+
+	start := time.Now()
+	resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "hello", resp.Value)
+	assert.Less(t, time.Since(start), 500*time.Millisecond, "recording must not delay the client")
+}
+
+// hungReflection is the reflection service, which never responds.
+type hungReflection struct {
+	reflectionpb.UnimplementedServerReflectionServer
+}
+
+func (hungReflection) ServerReflectionInfo(stream reflectionpb.ServerReflection_ServerReflectionInfoServer) error {
+	<-stream.Context().Done()
+	return stream.Context().Err()
+}
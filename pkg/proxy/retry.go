@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/recorder"
+	"github.com/cappuccinotm/slogx"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// retryBuffer is the total size of the requests, buffered to be
+// replayed on the retries. Calls with larger requests aren't retried.
+const retryBuffer = 256 << 10
+
+// forwardWithRetry forwards the request to the upstream according to the
+// retry policy. The requests are buffered until the client closes its side
+// of the stream, to be replayed on each attempt. The first attempt, which
+// responds with a message or fails with the code, which isn't retryable,
+// is committed and its responses are passed to the client. Once the
+// requests exceed the retryBuffer, the request is forwarded without retries.
+func (s *Server) forwardWithRetry(ctx context.Context, stream grpc.ServerStream,
+	up discovery.Upstream, uri, mtd string, policy *discovery.Retry) (err error) {
+	firstRecv, _ := ctx.Value(ctxFirstRecv).([]byte)
+
+	var received [][]byte
+	for size := len(firstRecv); ; {
+		var msg []byte
+		if err = stream.RecvMsg(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if st := grpcx.StatusFromError(err); st != nil {
+				return st.Err()
+			}
+			return status.Errorf(codes.Internal, "{groxy} failed to read the request: %v", err)
+		}
+		received = append(received, msg)
+
+		if size += len(msg); size > retryBuffer {
+			slog.DebugContext(ctx, "requests exceed the retry buffer, forwarding without retries",
+				slog.String("upstream_name", up.Name()),
+				slog.Int("size", size))
+			return s.forward(ctx, &bufferedStream{ServerStream: stream, reqs: received}, up, uri, mtd)
+		}
+	}
+
+	reqs := received
+	if firstRecv != nil {
+		reqs = append([][]byte{firstRecv}, received...)
+	}
+
+	var ex *recorder.Exchange
+	if s.recorder != nil && !isReplay(ctx) {
+		ex = &recorder.Exchange{URI: uri, Method: mtd, Upstream: up, Requests: reqs}
+		stream = tapStream{ServerStream: stream, ex: ex}
+		defer func() { s.record(ctx, *ex, err) }()
+	}
+
+	var att *attempt
+	if policy.HedgeDelay > 0 {
+		att = hedge(ctx, up, mtd, reqs, policy)
+	} else {
+		att = retry(ctx, up, mtd, reqs, policy)
+	}
+	defer att.cancel()
+
+	defer func() {
+		stream.SetTrailer(metadata.Join(att.header, att.trailer))
+		if ex != nil {
+			ex.Header, ex.Trailer = att.header, att.trailer
+		}
+	}()
+
+	if att.err != nil {
+		return upstreamError(att.err)
+	}
+
+	if att.first == nil {
+		return nil // the upstream responded without messages
+	}
+
+	msg := att.first
+	for {
+		if err = stream.SendMsg(msg); err != nil {
+			slog.WarnContext(ctx, "failed to send the response to the client",
+				slog.String("upstream_name", up.Name()),
+				slogx.Error(err))
+			return status.Errorf(codes.Internal, "{groxy} failed to pipe messages to the upstream")
+		}
+
+		msg = nil
+		if err = att.stream.RecvMsg(&msg); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return upstreamError(err)
+		}
+	}
+}
+
+// bufferedStream is the server stream, which returns the buffered
+// requests before receiving the rest of them from the client.
+type bufferedStream struct {
+	grpc.ServerStream
+	reqs [][]byte
+}
+
+// RecvMsg returns the next buffered request, or receives it from the client.
+func (s *bufferedStream) RecvMsg(m any) error {
+	if len(s.reqs) == 0 {
+		return s.ServerStream.RecvMsg(m)
+	}
+
+	msg := s.reqs[0]
+	s.reqs = s.reqs[1:]
+	return (grpcx.RawBytesCodec{}).Unmarshal(msg, m)
+}
+
+// retry makes the attempts one by one, with the backoff between them,
+// until one of them is committed or the attempts are over.
+func retry(ctx context.Context, up discovery.Upstream, mtd string, reqs [][]byte, policy *discovery.Retry) *attempt {
+	for num := 1; ; num++ {
+		att := newAttempt(ctx, num, policy)
+		att.run(up, mtd, reqs)
+
+		if num >= policy.MaxAttempts || !att.retryable(ctx, policy) {
+			return att
+		}
+		att.cancel()
+
+		delay := policy.Delay(num + 1)
+		slog.DebugContext(ctx, "retrying the failed attempt",
+			slog.String("upstream_name", up.Name()),
+			slog.Int("attempt", num),
+			slog.Duration("delay", delay),
+			slogx.Error(att.err))
+
+		select {
+		case <-ctx.Done():
+			return att
+		case <-time.After(delay):
+		}
+	}
+}
+
+// hedge starts the attempts concurrently: the next one is started once
+// the hedge delay passes without a response, or as soon as one of the
+// attempts fails with the retryable code. The first committed attempt
+// wins, the rest are canceled.
+func hedge(ctx context.Context, up discovery.Upstream, mtd string, reqs [][]byte, policy *discovery.Retry) *attempt {
+	done := make(chan *attempt, policy.MaxAttempts)
+	var started []*attempt
+	start := func() {
+		att := newAttempt(ctx, len(started)+1, policy)
+		started = append(started, att)
+		go func() {
+			att.run(up, mtd, reqs)
+			done <- att
+		}()
+	}
+
+	timer := time.NewTimer(policy.HedgeDelay)
+	defer timer.Stop()
+
+	start()
+	for finished := 0; ; {
+		select {
+		case att := <-done:
+			finished++
+			if !att.retryable(ctx, policy) || finished == policy.MaxAttempts {
+				for _, other := range started {
+					if other != att {
+						other.cancel()
+					}
+				}
+				return att
+			}
+
+			att.cancel()
+			slog.DebugContext(ctx, "hedged attempt failed",
+				slog.String("upstream_name", up.Name()),
+				slog.Int("attempt", att.num),
+				slogx.Error(att.err))
+
+			if len(started) < policy.MaxAttempts && ctx.Err() == nil {
+				start()
+				timer.Reset(policy.HedgeDelay)
+			}
+		case <-timer.C:
+			if len(started) < policy.MaxAttempts && ctx.Err() == nil {
+				slog.DebugContext(ctx, "hedging the request",
+					slog.String("upstream_name", up.Name()),
+					slog.Int("attempt", len(started)+1))
+				start()
+				timer.Reset(policy.HedgeDelay)
+			}
+		}
+	}
+}
+
+// attempt is a single call to the upstream, made on behalf of the client.
+type attempt struct {
+	num    int
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	stream          grpc.ClientStream
+	header, trailer metadata.MD
+
+	first []byte // the first response, nil if the call is done without messages
+	err   error  // the error of the call, if it failed before the first response
+}
+
+// newAttempt prepares the attempt with the per-try timeout of the policy.
+func newAttempt(ctx context.Context, num int, policy *discovery.Retry) *attempt {
+	att := &attempt{num: num, header: metadata.New(nil), trailer: metadata.New(nil)}
+	if policy.PerTryTimeout > 0 {
+		att.ctx, att.cancel = context.WithTimeout(ctx, policy.PerTryTimeout)
+	} else {
+		att.ctx, att.cancel = context.WithCancel(ctx)
+	}
+	return att
+}
+
+// run sends the requests to the upstream and waits for the first response.
+func (a *attempt) run(up discovery.Upstream, mtd string, reqs [][]byte) {
+	a.stream, a.err = up.NewStream(a.ctx, &grpc.StreamDesc{ClientStreams: true, ServerStreams: true}, mtd,
+		grpc.ForceCodec(grpcx.RawBytesCodec{}),
+		grpc.Header(&a.header),
+		grpc.Trailer(&a.trailer))
+	if a.err != nil {
+		return
+	}
+
+	for _, msg := range reqs {
+		if err := a.stream.SendMsg(msg); err != nil {
+			break // the status of the call is returned by RecvMsg
+		}
+	}
+	_ = a.stream.CloseSend()
+
+	if err := a.stream.RecvMsg(&a.first); err != nil {
+		a.first = nil
+		if !errors.Is(err, io.EOF) {
+			a.err = err
+		}
+	}
+}
+
+// retryable reports whether the attempt has failed and may be retried,
+// either due to the code or to the per-try timeout.
+func (a *attempt) retryable(ctx context.Context, policy *discovery.Retry) bool {
+	switch {
+	case a.err == nil || ctx.Err() != nil:
+		return false
+	case errors.Is(a.ctx.Err(), context.DeadlineExceeded):
+		return true
+	default:
+		return policy.Retryable(status.Code(a.err))
+	}
+}
+
+// upstreamError converts the error of the upstream call to the status to return to the client.
+func upstreamError(err error) error {
+	if st := grpcx.StatusFromError(err); st != nil {
+		return st.Err()
+	}
+	return status.Errorf(codes.Internal, "{groxy} failed to call the upstream: %v", err)
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_forwardRetry(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+
+	upstreamConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(_ context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			mu.Lock()
+			calls[req.Value]++
+			n := calls[req.Value]
+			mu.Unlock()
+
+			switch {
+			case req.Value == "flaky" && n < 3, req.Value == "down":
+				return nil, status.Error(codes.Unavailable, "try again")
+			case req.Value == "invalid":
+				return nil, status.Error(codes.InvalidArgument, "invalid")
+			case strings.HasPrefix(req.Value, "slow") && n == 1:
+				time.Sleep(500 * time.Millisecond)
+			}
+			return &grpctest.StreamResponse{Value: req.Value}, nil
+		},
+		ClientStreamFunc: func(stream grpctest.ExampleService_ClientStreamServer) error {
+			md, _ := metadata.FromIncomingContext(stream.Context())
+			name := "stream " + strings.Join(md.Get("stream"), "")
+
+			mu.Lock()
+			calls[name]++
+			n := calls[name]
+			mu.Unlock()
+
+			if n == 1 { // the first attempt fails once all the requests are received
+				for {
+					if _, err := stream.Recv(); err != nil {
+						return status.Error(codes.Unavailable, "try again")
+					}
+				}
+			}
+			return grpctest.Sum(stream)
+		},
+	})
+
+	targets := []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: upstreamConn}}}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(_ string, md metadata.MD) discovery.Matches {
+			retry := &discovery.Retry{
+				MaxAttempts:   3,
+				Codes:         []codes.Code{codes.Unavailable},
+				PerTryTimeout: 100 * time.Millisecond,
+				Backoff:       10 * time.Millisecond,
+				MaxBackoff:    20 * time.Millisecond,
+			}
+			if len(md.Get("hedge")) > 0 {
+				retry.PerTryTimeout, retry.HedgeDelay = 0, 50*time.Millisecond
+			}
+			return discovery.Matches{{Forward: &discovery.Forward{Targets: targets, Retry: retry}}}
+		},
+	}
+
+	cl := startProxy(t, matcher)
+
+	callsOf := func(v string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return calls[v]
+	}
+
+	t.Run("retried until success", func(t *testing.T) {
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "flaky"})
+		require.NoError(t, err)
+		assert.Equal(t, "flaky", resp.Value)
+		assert.Equal(t, 3, callsOf("flaky"))
+	})
+
+	t.Run("attempts exhausted", func(t *testing.T) {
+		_, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "down"})
+		assert.Equal(t, codes.Unavailable, status.Code(err))
+		assert.Equal(t, 3, callsOf("down"))
+	})
+
+	t.Run("not retryable", func(t *testing.T) {
+		_, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "invalid"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		assert.Equal(t, 1, callsOf("invalid"))
+	})
+
+	t.Run("per-try timeout", func(t *testing.T) {
+		start := time.Now()
+		resp, err := cl.Unary(context.Background(), &grpctest.StreamRequest{Value: "slow"})
+		require.NoError(t, err)
+		assert.Equal(t, "slow", resp.Value)
+		assert.Less(t, time.Since(start), 400*time.Millisecond, "the slow attempt is abandoned")
+		assert.Equal(t, 2, callsOf("slow"))
+	})
+
+	t.Run("hedged", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "hedge", "true")
+		start := time.Now()
+		resp, err := cl.Unary(ctx, &grpctest.StreamRequest{Value: "slow-hedged"})
+		require.NoError(t, err)
+		assert.Equal(t, "slow-hedged", resp.Value)
+		assert.Less(t, time.Since(start), 400*time.Millisecond, "the hedged attempt wins")
+		assert.Equal(t, 2, callsOf("slow-hedged"))
+	})
+
+	sum := func(t *testing.T, name string, values ...string) (string, error) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), "stream", name)
+		stream, err := cl.ClientStream(ctx)
+		require.NoError(t, err)
+		for _, v := range values {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: v}))
+		}
+		resp, err := stream.CloseAndRecv()
+		return resp.GetValue(), err
+	}
+
+	t.Run("client stream", func(t *testing.T) {
+		res, err := sum(t, "small", "1", "2", "3")
+		require.NoError(t, err)
+		assert.Equal(t, "6", res, "all buffered messages are replayed")
+		assert.Equal(t, 2, callsOf("stream small"))
+	})
+
+	t.Run("requests exceed the buffer", func(t *testing.T) {
+		// leading zeros make the values large, while keeping them summable
+		large := make([]string, 5)
+		for i := range large {
+			large[i] = strings.Repeat("0", retryBuffer/4) + "1"
+		}
+
+		_, err := sum(t, "large", large...)
+		assert.Equal(t, codes.Unavailable, status.Code(err), "the failed attempt isn't retried")
+		assert.Equal(t, 1, callsOf("stream large"))
+
+		res, err := sum(t, "large", large...)
+		require.NoError(t, err)
+		assert.Equal(t, "5", res, "all messages are forwarded")
+		assert.Equal(t, 2, callsOf("stream large"))
+	})
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// throttleMiddleware limits the rate of the messages of the matched rule,
+// received from and sent to the client, either mocked or forwarded.
+func (s *Server) throttleMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+
+		match, ok := ctx.Value(ctxMatch).(*discovery.Rule)
+		if !ok || match.Throttle == nil {
+			return next(srv, stream)
+		}
+
+		ts := &throttledStream{
+			ServerStream: stream,
+			requests:     newPacer(match.Throttle.Requests),
+			responses:    newPacer(match.Throttle.Responses),
+		}
+
+		// the first message has been already received to match the request
+		if firstRecv, ok := ctx.Value(ctxFirstRecv).([]byte); ok {
+			if err := ts.requests.wait(ctx, len(firstRecv)); err != nil {
+				return err
+			}
+		}
+
+		return next(srv, ts)
+	}
+}
+
+// throttledStream paces the messages, received from and sent to the client.
+type throttledStream struct {
+	grpc.ServerStream
+	requests  *pacer
+	responses *pacer
+}
+
+// RecvMsg receives the message and holds it until the pacer lets it pass.
+func (s *throttledStream) RecvMsg(m any) error {
+	var bts []byte
+	target := m
+	if target == nil { // the caller discards the message, but we still need to measure it
+		target = &bts
+	}
+
+	if err := s.ServerStream.RecvMsg(target); err != nil {
+		return err
+	}
+
+	return s.requests.wait(s.Context(), messageSize(target))
+}
+
+// SendMsg holds the message until the pacer lets it pass and sends it.
+func (s *throttledStream) SendMsg(m any) error {
+	if err := s.responses.wait(s.Context(), messageSize(m)); err != nil {
+		return err
+	}
+	return s.ServerStream.SendMsg(m)
+}
+
+// pacer spaces the messages out in time to keep them within the limits.
+// Nil pacer doesn't limit the messages.
+type pacer struct {
+	limits discovery.ThrottleLimits
+
+	mu   sync.Mutex
+	next time.Time // the earliest time the next message can pass
+}
+
+func newPacer(limits *discovery.ThrottleLimits) *pacer {
+	if limits == nil {
+		return nil
+	}
+	return &pacer{limits: *limits}
+}
+
+// wait blocks until the message of the given size can pass.
+func (p *pacer) wait(ctx context.Context, size int) error {
+	if p == nil {
+		return nil
+	}
+
+	d := p.reserve(time.Now(), size)
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return status.Error(codes.Canceled, "{groxy} context done while throttling")
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reserve reserves the time slot for the message of the given size and
+// returns the duration to wait for it. The message passes after the delay,
+// once the previous messages have passed, and takes the time to be
+// transferred. The next message can't pass earlier than the message rate allows.
+func (p *pacer) reserve(now time.Time, size int) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	at := now.Add(p.limits.Delay)
+	if at.Before(p.next) {
+		at = p.next
+	}
+
+	if p.limits.BytesPerSecond > 0 {
+		at = at.Add(time.Duration(float64(size) / float64(p.limits.BytesPerSecond) * float64(time.Second)))
+	}
+
+	p.next = at
+	if p.limits.MessagesPerSecond > 0 {
+		p.next = at.Add(time.Duration(float64(time.Second) / p.limits.MessagesPerSecond))
+	}
+
+	return at.Sub(now)
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestServer_throttle(t *testing.T) {
+	backendConn := startBackend(t, &grpctest.Server{ClientStreamFunc: grpctest.Sum})
+
+	var stream []discovery.StreamMessage
+	for i := range 5 {
+		stream = append(stream, discovery.StreamMessage{
+			Body: protodef.Static(&grpctest.StreamResponse{Value: fmt.Sprintf("tick %d", i)}),
+		})
+	}
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(uri string, _ metadata.MD) discovery.Matches {
+			if uri == "/groxy.testdata.ExampleService/ServerStream" {
+				return discovery.Matches{{
+					Name:     "stream",
+					Mock:     &discovery.Mock{Stream: stream},
+					Throttle: &discovery.Throttle{Responses: &discovery.ThrottleLimits{MessagesPerSecond: 20}},
+				}}
+			}
+			return discovery.Matches{{
+				Name:     "forward",
+				Match:    discovery.RequestMatcher{URI: regexp.MustCompile(".*")},
+				Forward:  &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: backendConn}}}},
+				Throttle: &discovery.Throttle{Requests: &discovery.ThrottleLimits{BytesPerSecond: 100, Delay: 10 * time.Millisecond}},
+			}}
+		},
+	}
+
+	cl := startProxy(t, matcher)
+
+	t.Run("mocked responses", func(t *testing.T) {
+		start := time.Now()
+		stream, err := cl.ServerStream(context.Background(), &grpctest.StreamRequest{Value: "hello"})
+		require.NoError(t, err)
+
+		for i := range 5 {
+			resp, err := stream.Recv()
+			require.NoError(t, err)
+			assert.Equal(t, fmt.Sprintf("tick %d", i), resp.Value)
+		}
+		_, err = stream.Recv()
+		assert.ErrorIs(t, err, io.EOF)
+
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "4 gaps of 50ms between 5 messages")
+	})
+
+	t.Run("forwarded requests", func(t *testing.T) {
+		start := time.Now()
+		stream, err := cl.ClientStream(context.Background())
+		require.NoError(t, err)
+
+		for _, v := range []string{"1", "2", "3"} {
+			require.NoError(t, stream.Send(&grpctest.StreamRequest{Value: v}))
+		}
+
+		resp, err := stream.CloseAndRecv()
+		require.NoError(t, err)
+		assert.Equal(t, "6", resp.Value)
+
+		// 3 messages of 3 bytes at 100 B/s, each delayed by 10ms
+		assert.GreaterOrEqual(t, time.Since(start), 90*time.Millisecond)
+	})
+}
+
+func TestPacer(t *testing.T) {
+	now := time.Now()
+
+	tbl := []struct {
+		name   string
+		limits discovery.ThrottleLimits
+		sizes  []int
+		want   []time.Duration
+	}{
+		{
+			name:   "bytes per second",
+			limits: discovery.ThrottleLimits{BytesPerSecond: 1000},
+			sizes:  []int{100, 500, 0},
+			want:   []time.Duration{100 * time.Millisecond, 600 * time.Millisecond, 600 * time.Millisecond},
+		},
+		{
+			name:   "messages per second",
+			limits: discovery.ThrottleLimits{MessagesPerSecond: 10},
+			sizes:  []int{100, 100, 100},
+			want:   []time.Duration{0, 100 * time.Millisecond, 200 * time.Millisecond},
+		},
+		{
+			name:   "delay",
+			limits: discovery.ThrottleLimits{Delay: 50 * time.Millisecond},
+			sizes:  []int{100, 100},
+			want:   []time.Duration{50 * time.Millisecond, 50 * time.Millisecond},
+		},
+		{
+			name:   "all limits",
+			limits: discovery.ThrottleLimits{BytesPerSecond: 1000, MessagesPerSecond: 5, Delay: 10 * time.Millisecond},
+			sizes:  []int{100, 100},
+			want:   []time.Duration{110 * time.Millisecond, 410 * time.Millisecond},
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPacer(&tt.limits)
+			for i, size := range tt.sizes {
+				assert.Equal(t, tt.want[i], p.reserve(now, size), "message #%d", i)
+			}
+		})
+	}
+
+	t.Run("no limits", func(t *testing.T) {
+		var p *pacer
+		assert.NoError(t, p.wait(context.Background(), 100))
+	})
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx"
+	"github.com/Semior001/groxy/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// tracerName is the name of the instrumentation, reported in the spans.
+const tracerName = "github.com/Semior001/groxy/pkg/proxy"
+
+// tracingMiddleware continues the trace of the client, if any, with the
+// server span of the request, annotated with the matched rule and the action.
+func (s *Server) tracingMiddleware(next grpc.StreamHandler) grpc.StreamHandler {
+	return func(srv any, stream grpc.ServerStream) error {
+		ctx := stream.Context()
+		mtd, _ := grpc.Method(ctx)
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		ctx = s.propagator.Extract(ctx, tracing.MetadataCarrier(md))
+
+		ctx, span := s.tracer.Start(ctx, strings.TrimPrefix(mtd, "/"),
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(rpcAttributes(mtd)...))
+
+		ctx, ex := withExchange(ctx)
+		err := next(srv, grpcx.StreamWithContext(ctx, stream))
+
+		span.SetAttributes(attribute.String("groxy.action", ruleAction(ex.rule)))
+		if ex.rule != nil {
+			span.SetAttributes(attribute.String("groxy.rule", ex.rule.Name))
+		}
+
+		endSpan(span, err, serverError)
+		return err
+	}
+}
+
+// startForwardSpan starts the client span of the call to the upstream
+// and injects its context into the outgoing metadata.
+func (s *Server) startForwardSpan(ctx context.Context, up discovery.Upstream, mtd string) (context.Context, trace.Span) {
+	ctx, span := s.tracer.Start(ctx, strings.TrimPrefix(mtd, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(rpcAttributes(mtd)...),
+		trace.WithAttributes(
+			attribute.String("groxy.upstream", up.Name()),
+			semconv.ServerAddress(up.Target()),
+		))
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		md = metadata.New(nil)
+	}
+	s.propagator.Inject(ctx, tracing.MetadataCarrier(md))
+
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+// rpcAttributes returns the semantic attributes of the gRPC method.
+func rpcAttributes(mtd string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{semconv.RPCSystemGRPC}
+	if svc, name, ok := strings.Cut(strings.TrimPrefix(mtd, "/"), "/"); ok {
+		attrs = append(attrs, semconv.RPCService(svc), semconv.RPCMethod(name))
+	}
+	return attrs
+}
+
+// endSpan records the status code of the call and ends the span.
+// The span is marked as failed, if the code is considered an error.
+func endSpan(span trace.Span, err error, isError func(codes.Code) bool) {
+	st := status.Convert(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(st.Code())))
+	if isError(st.Code()) {
+		span.SetStatus(otelcodes.Error, st.Message())
+	}
+	span.End()
+}
+
+// serverError reports whether the code is an error of the server,
+// rather than a legitimate reply to the client, as defined
+// by the semantic conventions for gRPC.
+func serverError(code codes.Code) bool {
+	switch code {
+	case codes.Unknown, codes.DeadlineExceeded, codes.Unimplemented,
+		codes.Internal, codes.Unavailable, codes.DataLoss:
+		return true
+	default:
+		return false
+	}
+}
+
+// clientError reports whether the code is an error of the call to the upstream.
+func clientError(code codes.Code) bool { return code != codes.OK }
@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/Semior001/groxy/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestServer_tracing(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+
+	backendMD := make(chan metadata.MD, 1)
+	backendConn := startBackend(t, &grpctest.Server{
+		UnaryFunc: func(ctx context.Context, req *grpctest.StreamRequest) (*grpctest.StreamResponse, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			backendMD <- md
+			return &grpctest.StreamResponse{Value: "echo: " + req.Value}, nil
+		},
+	})
+
+	matcher := &mocks.MatcherMock{
+		UpstreamsFunc: func() []discovery.Upstream { return nil },
+		MatchMetadataFunc: func(string, metadata.MD) discovery.Matches {
+			return discovery.Matches{{
+				Name:    "forward",
+				Match:   discovery.RequestMatcher{URI: regexp.MustCompile(".*")},
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: discovery.ClientConn{ConnName: "backend", ClientConn: backendConn}}}},
+			}}
+		},
+	}
+
+	spans := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans))
+	cl := startProxy(t, matcher, WithTracing(tp, tracing.Propagator()))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "b3", traceID+"-00f067aa0ba902b7-1")
+	resp, err := cl.Unary(ctx, &grpctest.StreamRequest{Value: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, "echo: hello", resp.Value)
+
+	require.Eventually(t, func() bool { return len(spans.Ended()) == 2 }, time.Second, 10*time.Millisecond)
+	client, server := spans.Ended()[0], spans.Ended()[1]
+
+	assert.Equal(t, "groxy.testdata.ExampleService/Unary", server.Name())
+	assert.Equal(t, trace.SpanKindServer, server.SpanKind())
+	assert.Equal(t, traceID, server.SpanContext().TraceID().String(), "must continue the trace of the client")
+	assert.Equal(t, "00f067aa0ba902b7", server.Parent().SpanID().String())
+	assert.Contains(t, server.Attributes(), attribute.String("groxy.rule", "forward"))
+	assert.Contains(t, server.Attributes(), attribute.String("groxy.action", "forward"))
+
+	assert.Equal(t, trace.SpanKindClient, client.SpanKind())
+	assert.Equal(t, server.SpanContext().SpanID(), client.Parent().SpanID())
+	assert.Contains(t, client.Attributes(), attribute.String("groxy.upstream", "backend"))
+
+	md := <-backendMD
+	assert.Equal(t, []string{fmt.Sprintf("00-%s-%s-01", traceID, client.SpanContext().SpanID())},
+		md.Get("traceparent"), "upstream must receive the context of the client span")
+	assert.Equal(t, []string{fmt.Sprintf("%s-%s-1", traceID, client.SpanContext().SpanID())},
+		md.Get("b3"), "b3 header of the client must be replaced")
+	assert.Equal(t, []string{client.SpanContext().SpanID().String()}, md.Get("x-b3-spanid"))
+}
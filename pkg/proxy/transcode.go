@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/proxy/protocol"
+	"github.com/cappuccinotm/slogx"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"github.com/samber/lo"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// reflectionTTL is the time, during which the services,
+// reflected from the upstream, are cached.
+const reflectionTTL = time.Minute
+
+// descriptors resolves the types of the methods for the HTTP/JSON
+// transcoding and the comparison of the responses: mocked methods are described by the types of the matched
+// rule, forwarded ones by the reflection of the upstream. Services,
+// declared in the files of the rules, are used as a fallback.
+type descriptors struct {
+	matcher Matcher
+
+	mu        sync.Mutex
+	reflected map[string]reflectedServices // by the name and the target of the upstream
+}
+
+type reflectedServices struct {
+	services []protoreflect.ServiceDescriptor
+	expires  time.Time
+}
+
+func newDescriptors(m Matcher) *descriptors {
+	return &descriptors{matcher: m, reflected: map[string]reflectedServices{}}
+}
+
+// Method returns the types of the method, which the request will be handled by.
+func (d *descriptors) Method(ctx context.Context, name string, md metadata.MD) (protocol.Method, error) {
+	for _, rule := range d.matcher.MatchMetadata(name, md) {
+		switch {
+		case rule.Mock != nil:
+			input, output := rule.MockTypes(ctx)
+			_, serverStreams := rule.Mock.Streams()
+			if mtd := findMethod(d.ruleServices(ctx), name); mtd != nil {
+				input, _ = lo.Coalesce(input, mtd.Input())
+				output, _ = lo.Coalesce(output, mtd.Output())
+				serverStreams = serverStreams || mtd.IsStreamingServer()
+			}
+			return protocol.Method{Input: input, Output: output, ServerStreaming: serverStreams}, nil
+		case rule.Forward != nil:
+			if mtd := d.forwarded(ctx, rule, name); mtd != nil {
+				return methodOf(mtd), nil
+			}
+		}
+	}
+
+	if mtd := findMethod(d.ruleServices(ctx), name); mtd != nil {
+		return methodOf(mtd), nil
+	}
+
+	return protocol.Method{}, status.Errorf(codes.Unimplemented, "{groxy} types of %s are unknown", name)
+}
+
+// Output returns the type of the response to the method, handled by the
+// rule, or nil if it's unknown. Besides the types of the mock and the files
+// of the rules, the type is looked up in the reflection of the upstreams,
+// which the rule forwards or mirrors the request to.
+func (d *descriptors) Output(ctx context.Context, rule *discovery.Rule, name string) protoreflect.MessageDescriptor {
+	if _, output := rule.MockTypes(ctx); output != nil {
+		return output
+	}
+
+	mtd := findMethod(d.ruleServices(ctx), name)
+	if mtd == nil && rule.Forward != nil {
+		mtd = d.forwarded(ctx, rule, name)
+	}
+	if mtd == nil && rule.Mirror != nil {
+		mtd = findMethod(d.upstreamServices(ctx, rule.Mirror.Upstream), name)
+	}
+
+	if mtd == nil {
+		return nil
+	}
+	return mtd.Output()
+}
+
+// forwarded looks up the method, which the rule forwards the request to,
+// in the reflection of the targets.
+func (d *descriptors) forwarded(ctx context.Context, rule *discovery.Rule, name string) protoreflect.MethodDescriptor {
+	uri := name
+	if rule.Forward.Rewrite != "" {
+		uri = rule.Match.URI.ReplaceAllString(uri, rule.Forward.Rewrite)
+	}
+
+	for _, t := range rule.Forward.Targets {
+		if mtd := findMethod(d.upstreamServices(ctx, t.Upstream), uri); mtd != nil {
+			return mtd
+		}
+	}
+
+	return nil
+}
+
+// Services returns the services, declared in the files of the rules
+// and reflected from the upstreams.
+func (d *descriptors) Services(ctx context.Context) []protoreflect.ServiceDescriptor {
+	res := d.ruleServices(ctx)
+	for _, up := range d.matcher.Upstreams() {
+		res = append(res, d.upstreamServices(ctx, up)...)
+	}
+	return res
+}
+
+// ruleServices returns the services, declared in the files,
+// which the messages of the rules are defined in.
+func (d *descriptors) ruleServices(ctx context.Context) []protoreflect.ServiceDescriptor {
+	var res []protoreflect.ServiceDescriptor
+	seen := map[protoreflect.FullName]struct{}{}
+
+	for _, rule := range d.matcher.Rules() {
+		input, output := rule.MockTypes(ctx)
+		for _, msg := range []protoreflect.MessageDescriptor{input, output} {
+			if msg == nil {
+				continue
+			}
+
+			services := msg.ParentFile().Services()
+			for i := 0; i < services.Len(); i++ {
+				svc := services.Get(i)
+				if _, ok := seen[svc.FullName()]; ok {
+					continue
+				}
+				seen[svc.FullName()] = struct{}{}
+				res = append(res, svc)
+			}
+		}
+	}
+
+	return res
+}
+
+// upstreamServices returns the services, reflected from the upstream,
+// if it serves reflection. Results are cached for reflectionTTL.
+func (d *descriptors) upstreamServices(ctx context.Context, up discovery.Upstream) []protoreflect.ServiceDescriptor {
+	if !up.Reflection() {
+		return nil
+	}
+
+	key := up.Name() + "@" + up.Target()
+
+	d.mu.Lock()
+	cached, ok := d.reflected[key]
+	d.mu.Unlock()
+
+	if ok && time.Now().Before(cached.expires) {
+		return cached.services
+	}
+
+	services, err := reflectServices(ctx, up)
+	if err != nil {
+		slog.WarnContext(ctx, "failed to reflect upstream services",
+			slog.String("upstream", up.Name()),
+			slogx.Error(err))
+	}
+
+	d.mu.Lock()
+	d.reflected[key] = reflectedServices{services: services, expires: time.Now().Add(reflectionTTL)}
+	d.mu.Unlock()
+
+	return services
+}
+
+// reflectServices lists and resolves the services of the upstream,
+// except the reflection and health ones.
+func reflectServices(ctx context.Context, up discovery.Upstream) ([]protoreflect.ServiceDescriptor, error) {
+	client := grpcreflect.NewClientAuto(ctx, up)
+	defer client.Reset()
+
+	names, err := client.ListServices()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []protoreflect.ServiceDescriptor
+	for _, name := range names {
+		if strings.HasPrefix(name, "grpc.reflection.") || strings.HasPrefix(name, "grpc.health.") {
+			continue
+		}
+
+		sd, err := client.ResolveService(name)
+		if err != nil {
+			return res, err
+		}
+
+		res = append(res, sd.UnwrapService())
+	}
+
+	return res, nil
+}
+
+// findMethod looks up the method by its full name, e.g. "/package.Service/Method".
+func findMethod(services []protoreflect.ServiceDescriptor, name string) protoreflect.MethodDescriptor {
+	svcName, mtdName, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if !ok {
+		return nil
+	}
+
+	for _, svc := range services {
+		if string(svc.FullName()) != svcName {
+			continue
+		}
+
+		if mtd := svc.Methods().ByName(protoreflect.Name(mtdName)); mtd != nil {
+			return mtd
+		}
+	}
+
+	return nil
+}
+
+func methodOf(mtd protoreflect.MethodDescriptor) protocol.Method {
+	return protocol.Method{
+		Input:           mtd.Input(),
+		Output:          mtd.Output(),
+		ServerStreaming: mtd.IsStreamingServer(),
+	}
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/Semior001/groxy/pkg/proxy/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+func TestDescriptors_Output(t *testing.T) {
+	conn := startBackend(t, &grpctest.Server{}, func(s *grpc.Server) { reflection.Register(s) })
+	reflected := discovery.ClientConn{ConnName: "reflected", ClientConn: conn, ServeReflection: true}
+	opaque := discovery.ClientConn{ConnName: "opaque", ClientConn: conn}
+
+	d := newDescriptors(&mocks.MatcherMock{RulesFunc: func() []*discovery.Rule { return nil }})
+
+	tbl := []struct {
+		name string
+		rule *discovery.Rule
+		mtd  string
+		want string
+	}{
+		{
+			name: "mock",
+			rule: &discovery.Rule{Mock: &discovery.Mock{Body: protodef.Static(&grpctest.StreamResponse{})}},
+			mtd:  "/groxy.testdata.ExampleService/Unknown",
+			want: "groxy.testdata.StreamResponse",
+		},
+		{
+			name: "forwarded",
+			rule: &discovery.Rule{Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: reflected}}}},
+			mtd:  "/groxy.testdata.ExampleService/Unary",
+			want: "groxy.testdata.StreamResponse",
+		},
+		{
+			name: "forwarded with rewrite",
+			rule: &discovery.Rule{
+				Match:   discovery.RequestMatcher{URI: regexp.MustCompile(`^/legacy\.Service/(.*)$`)},
+				Forward: &discovery.Forward{Rewrite: "/groxy.testdata.ExampleService/$1", Targets: []discovery.ForwardTarget{{Upstream: reflected}}},
+			},
+			mtd:  "/legacy.Service/ServerStream",
+			want: "groxy.testdata.StreamResponse",
+		},
+		{
+			name: "mirrored",
+			rule: &discovery.Rule{
+				Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: opaque}}},
+				Mirror:  &discovery.Mirror{Upstream: reflected},
+			},
+			mtd:  "/groxy.testdata.ExampleService/Unary",
+			want: "groxy.testdata.StreamResponse",
+		},
+		{
+			name: "upstream without reflection",
+			rule: &discovery.Rule{Forward: &discovery.Forward{Targets: []discovery.ForwardTarget{{Upstream: opaque}}}},
+			mtd:  "/groxy.testdata.ExampleService/Unary",
+		},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			output := d.Output(context.Background(), tt.rule, tt.mtd)
+			if tt.want == "" {
+				assert.Nil(t, output)
+				return
+			}
+			require.NotNil(t, output)
+			assert.Equal(t, tt.want, string(output.FullName()))
+		})
+	}
+}
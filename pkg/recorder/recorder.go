@@ -0,0 +1,273 @@
+// Package recorder records the exchanges, forwarded to the upstreams,
+// and renders them as mock rules to be replayed later.
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/Semior001/groxy/pkg/protodef"
+	"github.com/jhump/protoreflect/grpcreflect"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// Exchange is a single call, forwarded to the upstream.
+type Exchange struct {
+	URI       string             // method, requested by the client
+	Method    string             // method, requested from the upstream, may differ from URI if rewritten
+	Upstream  discovery.Upstream // upstream, the call was forwarded to
+	Requests  [][]byte           // messages, sent by the client
+	Responses [][]byte           // messages, sent by the upstream
+	Header    metadata.MD        // header, sent by the upstream
+	Trailer   metadata.MD        // trailer, sent by the upstream
+	Status    *status.Status     // final status of the call
+}
+
+// resolveTimeout is the default limit of the resolution
+// of the method via the reflection of the upstream.
+const resolveTimeout = 5 * time.Second
+
+// Recorder keeps the recorded exchanges as mock rules.
+// Exchanges with the same URI and the same first request
+// are recorded once, the latest one wins.
+// Zero value is ready to use.
+type Recorder struct {
+	// Timeout limits the resolution of the method via the
+	// reflection of the upstream, 5 seconds if not set.
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	rules []fileprovider.Rule
+	index map[string]int // key of the exchange -> index of the rule
+
+	dmu       sync.Mutex
+	methods   map[string]method // upstream target + method -> descriptors
+	resolving singleflight.Group
+}
+
+type method struct {
+	input, output protoreflect.MessageDescriptor
+	serverStreams bool
+}
+
+// Record renders the exchange as a mock rule and keeps it.
+// Descriptors of the messages are resolved via the reflection of the upstream.
+func (r *Recorder) Record(ctx context.Context, ex Exchange) error {
+	mtd, err := r.resolve(ctx, ex.Upstream, ex.Method)
+	if err != nil {
+		return fmt.Errorf("resolve method %q: %w", ex.Method, err)
+	}
+
+	rule, err := render(ex, mtd)
+	if err != nil {
+		return fmt.Errorf("render rule: %w", err)
+	}
+
+	key := ex.URI
+	if len(ex.Requests) > 0 {
+		key += "\x00" + string(ex.Requests[0])
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.index == nil {
+		r.index = map[string]int{}
+	}
+
+	if idx, ok := r.index[key]; ok {
+		r.rules[idx] = rule
+		return nil
+	}
+
+	r.index[key] = len(r.rules)
+	r.rules = append(r.rules, rule)
+	return nil
+}
+
+// Config returns the recorded rules as a configuration, ready to be
+// served by the file provider.
+func (r *Recorder) Config() fileprovider.Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return fileprovider.Config{Version: "1", Rules: append([]fileprovider.Rule{}, r.rules...)}
+}
+
+// Clear removes all recorded rules.
+func (r *Recorder) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rules, r.index = nil, nil
+}
+
+// resolve returns the descriptors of the method, caching them per upstream.
+// Concurrent resolutions of the same method share the reflection call.
+func (r *Recorder) resolve(ctx context.Context, upstream discovery.Upstream, name string) (method, error) {
+	key := upstream.Target() + name
+
+	r.dmu.Lock()
+	mtd, ok := r.methods[key]
+	r.dmu.Unlock()
+
+	if ok {
+		return mtd, nil
+	}
+
+	res, err, _ := r.resolving.Do(key, func() (any, error) {
+		timeout := r.Timeout
+		if timeout <= 0 {
+			timeout = resolveTimeout
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		mtd, err := reflectMethod(ctx, upstream, name)
+		if err != nil {
+			return method{}, err
+		}
+
+		r.dmu.Lock()
+		defer r.dmu.Unlock()
+
+		if r.methods == nil {
+			r.methods = map[string]method{}
+		}
+		r.methods[key] = mtd
+
+		return mtd, nil
+	})
+	if err != nil {
+		return method{}, err
+	}
+
+	return res.(method), nil
+}
+
+// reflectMethod resolves the descriptors of the method via the reflection of the upstream.
+func reflectMethod(ctx context.Context, upstream discovery.Upstream, name string) (method, error) {
+	svcName, mtdName, ok := strings.Cut(strings.TrimPrefix(name, "/"), "/")
+	if !ok {
+		return method{}, fmt.Errorf("malformed method name")
+	}
+
+	client := grpcreflect.NewClientAuto(ctx, upstream)
+	defer client.Reset()
+
+	svc, err := client.ResolveService(svcName)
+	if err != nil {
+		return method{}, fmt.Errorf("resolve service %q: %w", svcName, err)
+	}
+
+	md := svc.FindMethodByName(mtdName)
+	if md == nil {
+		return method{}, fmt.Errorf("method %q not found in service %q", mtdName, svcName)
+	}
+
+	return method{
+		input:         md.GetInputType().UnwrapMessage(),
+		output:        md.GetOutputType().UnwrapMessage(),
+		serverStreams: md.IsServerStreaming(),
+	}, nil
+}
+
+// render builds a mock rule, which responds the same way the upstream did.
+func render(ex Exchange, mtd method) (rule fileprovider.Rule, err error) {
+	rule.Match.URI = "^" + regexp.QuoteMeta(ex.URI) + "$"
+
+	if len(ex.Requests) > 0 {
+		body, err := snippet(mtd.input, ex.Requests[0])
+		if err != nil {
+			return rule, fmt.Errorf("render request: %w", err)
+		}
+		rule.Match.Body = &body
+	}
+
+	resp := &fileprovider.Respond{}
+	for idx, bts := range ex.Responses {
+		body, err := snippet(mtd.output, bts)
+		if err != nil {
+			return rule, fmt.Errorf("render response #%d: %w", idx, err)
+		}
+		resp.Stream = append(resp.Stream, fileprovider.StreamMessage{Body: body})
+	}
+
+	st := ex.Status
+	if st == nil {
+		st = status.New(codes.OK, "")
+	}
+
+	switch {
+	case st.Code() != codes.OK:
+		resp.Status = &fileprovider.Status{Code: codeName(st.Code()), Message: st.Message()}
+	case !mtd.serverStreams && len(resp.Stream) == 1:
+		resp.Body, resp.Stream = &resp.Stream[0].Body, nil
+	case len(resp.Stream) == 0:
+		return rule, fmt.Errorf("no responses from the upstream")
+	}
+
+	header, trailer := plainMetadata(ex.Header), plainMetadata(ex.Trailer)
+	if len(header) > 0 || len(trailer) > 0 {
+		resp.Metadata = &fileprovider.Metadata{Header: header, Trailer: trailer}
+	}
+
+	rule.Respond = resp
+	return rule, nil
+}
+
+func snippet(d protoreflect.MessageDescriptor, bts []byte) (string, error) {
+	msg := dynamicpb.NewMessage(d)
+	if err := proto.Unmarshal(bts, msg); err != nil {
+		return "", fmt.Errorf("unmarshal %s: %w", d.FullName(), err)
+	}
+
+	return protodef.Snippet(msg)
+}
+
+// plainMetadata flattens the metadata, dropping the reserved
+// and transport-specific keys, which are set by gRPC itself.
+func plainMetadata(md metadata.MD) map[string]string {
+	res := map[string]string{}
+	for k, vals := range md {
+		if k == "content-type" || strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || len(vals) == 0 {
+			continue
+		}
+		res[k] = strings.Join(vals, ",")
+	}
+
+	if len(res) == 0 {
+		return nil
+	}
+
+	return res
+}
+
+// codeName returns the name of the code, as it's expected in the config,
+// e.g. "NOT_FOUND" for codes.NotFound.
+func codeName(c codes.Code) string {
+	sb := &strings.Builder{}
+	prev := rune(0)
+	for _, r := range c.String() {
+		if unicode.IsUpper(r) && unicode.IsLower(prev) {
+			sb.WriteRune('_')
+		}
+		sb.WriteRune(unicode.ToUpper(r))
+		prev = r
+	}
+	return sb.String()
+}
@@ -0,0 +1,185 @@
+package recorder
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Semior001/groxy/pkg/discovery"
+	"github.com/Semior001/groxy/pkg/discovery/fileprovider"
+	"github.com/Semior001/groxy/pkg/grpcx/grpctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestRecorder_Record(t *testing.T) {
+	backendSrv := grpc.NewServer()
+	grpctest.RegisterExampleServiceServer(backendSrv, &grpctest.Server{})
+	reflection.Register(backendSrv)
+	addr := grpctest.StartServer(t, backendSrv)
+	t.Cleanup(backendSrv.Stop)
+
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	upstream := discovery.ClientConn{ConnName: "backend", ClientConn: conn}
+
+	marshal := func(msg proto.Message) []byte {
+		bts, err := proto.Marshal(msg)
+		require.NoError(t, err)
+		return bts
+	}
+
+	rec := &Recorder{}
+	ctx := context.Background()
+
+	require.NoError(t, rec.Record(ctx, Exchange{
+		URI:       "/groxy.testdata.ExampleService/Unary",
+		Method:    "/groxy.testdata.ExampleService/Unary",
+		Upstream:  upstream,
+		Requests:  [][]byte{marshal(&grpctest.StreamRequest{Value: "old"})},
+		Responses: [][]byte{marshal(&grpctest.StreamResponse{Value: "stale"})},
+	}))
+	require.NoError(t, rec.Record(ctx, Exchange{
+		URI:       "/groxy.testdata.ExampleService/Unary",
+		Method:    "/groxy.testdata.ExampleService/Unary",
+		Upstream:  upstream,
+		Requests:  [][]byte{marshal(&grpctest.StreamRequest{Value: "old"})},
+		Responses: [][]byte{marshal(&grpctest.StreamResponse{Value: "{{ hello }}"})},
+		Header:    metadata.Pairs("x-test", "header", "content-type", "application/grpc"),
+		Trailer:   metadata.Pairs("x-test", "trailer"),
+	}))
+	require.NoError(t, rec.Record(ctx, Exchange{
+		URI:       "/groxy.testdata.ExampleService/ServerStream",
+		Method:    "/groxy.testdata.ExampleService/ServerStream",
+		Upstream:  upstream,
+		Requests:  [][]byte{marshal(&grpctest.StreamRequest{Value: "2"})},
+		Responses: [][]byte{marshal(&grpctest.StreamResponse{Value: "0"}), marshal(&grpctest.StreamResponse{Value: "1"})},
+		Status:    status.New(codes.DataLoss, "lost"),
+	}))
+	require.NoError(t, rec.Record(ctx, Exchange{
+		URI:      "/renamed.Service/Unary",
+		Method:   "/groxy.testdata.ExampleService/Unary",
+		Upstream: upstream,
+		Requests: [][]byte{marshal(&grpctest.StreamRequest{})},
+		Status:   status.New(codes.NotFound, "not found"),
+	}))
+
+	err = rec.Record(ctx, Exchange{
+		URI:      "/unknown.Service/Unary",
+		Method:   "/unknown.Service/Unary",
+		Upstream: upstream,
+	})
+	require.Error(t, err)
+
+	cfg := rec.Config()
+	require.Len(t, cfg.Rules, 3)
+
+	assert.Equal(t, `^/groxy\.testdata\.ExampleService/Unary$`, cfg.Rules[0].Match.URI)
+	require.NotNil(t, cfg.Rules[0].Respond.Metadata)
+	assert.Equal(t, map[string]string{"x-test": "header"}, cfg.Rules[0].Respond.Metadata.Header)
+	assert.Equal(t, map[string]string{"x-test": "trailer"}, cfg.Rules[0].Respond.Metadata.Trailer)
+	assert.Nil(t, cfg.Rules[0].Respond.Status)
+	assert.Empty(t, cfg.Rules[0].Respond.Stream)
+
+	assert.Len(t, cfg.Rules[1].Respond.Stream, 2)
+	assert.Nil(t, cfg.Rules[1].Respond.Body)
+	assert.Equal(t, &fileprovider.Status{Code: "DATA_LOSS", Message: "lost"}, cfg.Rules[1].Respond.Status)
+
+	assert.Nil(t, cfg.Rules[2].Respond.Body)
+	assert.Equal(t, &fileprovider.Status{Code: "NOT_FOUND", Message: "not found"}, cfg.Rules[2].Respond.Status)
+
+	// recorded rules must be valid and respond with the same messages
+	st, err := fileprovider.BuildState(ctx, "recorded", cfg)
+	require.NoError(t, err)
+	require.Len(t, st.Rules, 3)
+
+	ok, err := st.Rules[0].Match.Message.Matches(ctx, marshal(&grpctest.StreamRequest{Value: "old"}))
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	ok, err = st.Rules[0].Match.Message.Matches(ctx, marshal(&grpctest.StreamRequest{Value: "new"}))
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	msg, err := st.Rules[0].Mock.Body.Generate(ctx, nil)
+	require.NoError(t, err)
+	resp := &grpctest.StreamResponse{}
+	require.NoError(t, proto.Unmarshal(marshal(msg), resp))
+	assert.Equal(t, "{{ hello }}", resp.Value)
+
+	for idx, sm := range st.Rules[1].Mock.Stream {
+		msg, err = sm.Body.Generate(ctx, nil)
+		require.NoError(t, err)
+		require.NoError(t, proto.Unmarshal(marshal(msg), resp))
+		assert.Equal(t, []string{"0", "1"}[idx], resp.Value)
+	}
+
+	rec.Clear()
+	assert.Empty(t, rec.Config().Rules)
+}
+
+func TestRecorder_RecordHungReflection(t *testing.T) {
+	dial := func(srv *grpc.Server) discovery.Upstream {
+		addr := grpctest.StartServer(t, srv)
+		t.Cleanup(srv.Stop)
+
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		return discovery.ClientConn{ConnName: addr, ClientConn: conn}
+	}
+
+	reflecting := grpc.NewServer()
+	grpctest.RegisterExampleServiceServer(reflecting, &grpctest.Server{})
+	reflection.Register(reflecting)
+	healthy := dial(reflecting)
+
+	called := make(chan struct{}, 1)
+	hung := dial(grpc.NewServer(grpc.UnknownServiceHandler(func(_ any, stream grpc.ServerStream) error {
+		select {
+		case called <- struct{}{}:
+		default:
+		}
+		<-stream.Context().Done()
+		return stream.Context().Err()
+	})))
+
+	resp, err := proto.Marshal(&grpctest.StreamResponse{Value: "ok"})
+	require.NoError(t, err)
+
+	rec := &Recorder{Timeout: 200 * time.Millisecond}
+	ex := Exchange{
+		URI:       "/groxy.testdata.ExampleService/Unary",
+		Method:    "/groxy.testdata.ExampleService/Unary",
+		Responses: [][]byte{resp},
+	}
+
+	hungErr := make(chan error, 1)
+	go func() {
+		ex := ex
+		ex.Upstream = hung
+		hungErr <- rec.Record(context.Background(), ex)
+	}()
+	<-called
+
+	ex.Upstream = healthy
+	require.NoError(t, rec.Record(context.Background(), ex), "hung reflection must not block other upstreams")
+	assert.Len(t, rec.Config().Rules, 1)
+
+	select {
+	case err := <-hungErr:
+		require.Error(t, err, "hung reflection must time out")
+	case <-time.After(time.Second):
+		t.Fatal("hung reflection didn't time out")
+	}
+}
@@ -0,0 +1,70 @@
+package tlsx
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCA_Issue(t *testing.T) {
+	ca, err := NewCA("test CA")
+	require.NoError(t, err)
+
+	block, _ := pem.Decode(ca.PEM())
+	require.NotNil(t, block)
+	caCert, err := x509.ParseCertificate(block.Bytes)
+	require.NoError(t, err)
+	assert.Equal(t, "test CA", caCert.Subject.CommonName)
+	assert.True(t, caCert.IsCA)
+
+	cert, err := ca.Issue("server", "localhost", "127.0.0.1", "::1")
+	require.NoError(t, err)
+	require.Len(t, cert.Certificate, 2)
+	assert.Equal(t, "server", cert.Leaf.Subject.CommonName)
+	assert.Equal(t, []string{"localhost"}, cert.Leaf.DNSNames)
+	assert.Len(t, cert.Leaf.IPAddresses, 2)
+
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		_, err = cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName:   host,
+			Roots:     ca.Pool(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		})
+		assert.NoError(t, err, host)
+	}
+
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{
+		Roots:     ca.Pool(),
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	assert.NoError(t, err)
+
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: ca.Pool()})
+	assert.Error(t, err)
+
+	other, err := NewCA("other CA")
+	require.NoError(t, err)
+	_, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "localhost", Roots: other.Pool()})
+	assert.Error(t, err)
+}
+
+func TestServer_Certificate(t *testing.T) {
+	ca, err := NewCA("test CA")
+	require.NoError(t, err)
+
+	cert, err := ca.Issue("server", "localhost")
+	require.NoError(t, err)
+
+	srv := &Server{Certificate: &cert}
+	require.NoError(t, srv.Load())
+
+	cfg, err := srv.Config().GetConfigForClient(nil)
+	require.NoError(t, err)
+	require.Len(t, cfg.Certificates, 1)
+	assert.Equal(t, cert.Certificate, cfg.Certificates[0].Certificate)
+
+	assert.EqualError(t, (&Server{}).Load(), "no certificate provided")
+}
@@ -0,0 +1,189 @@
+// Package tlsx provides TLS configurations, which certificates
+// are reloaded from the files once they change.
+package tlsx
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cappuccinotm/slogx"
+)
+
+// ParseClientAuth parses the client authentication mode:
+// "none", "request", "require-any", "verify-if-given" or "require-and-verify".
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require-any":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-and-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	default:
+		return tls.NoClientCert, fmt.Errorf("unknown client auth mode %q", s)
+	}
+}
+
+// Server keeps the server certificate and, optionally, the pool of CAs
+// to verify the client certificates, reloading them once the files change.
+// If the certificate files are not set, the in-memory Certificate is used.
+type Server struct {
+	CertFile      string
+	KeyFile       string
+	Certificate   *tls.Certificate
+	ClientCAFile  string // if empty, client certificates are not verified
+	ClientAuth    tls.ClientAuthType
+	CheckInterval time.Duration // if not positive, the files are not reloaded
+	HTTP1         bool          // whether to advertise HTTP/1.1 for gRPC-Web and Connect clients
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modif     map[string]time.Time // file name -> last modification time
+}
+
+// Load loads the certificates from the files.
+func (s *Server) Load() error {
+	modif := map[string]time.Time{}
+	for _, f := range s.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return fmt.Errorf("stat %q: %w", f, err)
+		}
+		modif[f] = fi.ModTime()
+	}
+
+	cert := s.Certificate
+	if s.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(s.CertFile, s.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load key pair: %w", err)
+		}
+		cert = &pair
+	}
+
+	if cert == nil {
+		return fmt.Errorf("no certificate provided")
+	}
+
+	var clientCAs *x509.CertPool
+	if s.ClientCAFile != "" {
+		bts, err := os.ReadFile(s.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("read client CA: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(bts) {
+			return fmt.Errorf("no certificates found in client CA %q", s.ClientCAFile)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.cert, s.clientCAs, s.modif = cert, clientCAs, modif
+	return nil
+}
+
+// Run reloads the certificates once any of the files changes,
+// until the context is canceled. Certificates must be loaded before.
+// Failed reloads are logged and the previous certificates are kept.
+func (s *Server) Run(ctx context.Context) error {
+	if s.CheckInterval <= 0 {
+		slog.InfoContext(ctx, "reloading of TLS certificates is disabled")
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ticker := time.NewTicker(s.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+
+			if err := s.Load(); err != nil {
+				slog.WarnContext(ctx, "failed to reload TLS certificates", slogx.Error(err))
+				continue
+			}
+
+			slog.InfoContext(ctx, "reloaded TLS certificates", slog.String("cert", s.CertFile))
+		}
+	}
+}
+
+// Config returns the TLS configuration, which always uses
+// the latest loaded certificates.
+func (s *Server) Config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			s.mu.RLock()
+			defer s.mu.RUnlock()
+
+			if s.cert == nil {
+				return nil, fmt.Errorf("certificates are not loaded")
+			}
+
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*s.cert},
+				ClientCAs:    s.clientCAs,
+				ClientAuth:   s.ClientAuth,
+				NextProtos:   s.nextProtos(),
+			}, nil
+		},
+	}
+}
+
+func (s *Server) nextProtos() []string {
+	if s.HTTP1 {
+		return []string{"h2", "http/1.1"}
+	}
+	return []string{"h2"}
+}
+
+// changed returns true if any of the files has been modified since the last load.
+func (s *Server) changed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, f := range s.files() {
+		fi, err := os.Stat(f)
+		if err != nil { // file may be in the middle of the replacement
+			continue
+		}
+		if !fi.ModTime().Equal(s.modif[f]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Server) files() []string {
+	var files []string
+	if s.CertFile != "" {
+		files = append(files, s.CertFile, s.KeyFile)
+	}
+	if s.ClientCAFile != "" {
+		files = append(files, s.ClientCAFile)
+	}
+	return files
+}
@@ -0,0 +1,170 @@
+package tlsx
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseClientAuth(t *testing.T) {
+	for s, expected := range map[string]tls.ClientAuthType{
+		"none":               tls.NoClientCert,
+		"request":            tls.RequestClientCert,
+		"require-any":        tls.RequireAnyClientCert,
+		"verify-if-given":    tls.VerifyClientCertIfGiven,
+		"require-and-verify": tls.RequireAndVerifyClientCert,
+	} {
+		auth, err := ParseClientAuth(s)
+		require.NoError(t, err)
+		assert.Equal(t, expected, auth, s)
+	}
+
+	_, err := ParseClientAuth("unknown")
+	assert.EqualError(t, err, `unknown client auth mode "unknown"`)
+}
+
+func TestServer(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	caFile := filepath.Join(dir, "ca.pem")
+
+	writeCert(t, certFile, keyFile, "first")
+	writeCert(t, caFile, filepath.Join(dir, "ca-key.pem"), "ca")
+
+	srv := &Server{
+		CertFile:      certFile,
+		KeyFile:       keyFile,
+		ClientCAFile:  caFile,
+		ClientAuth:    tls.RequireAndVerifyClientCert,
+		CheckInterval: 10 * time.Millisecond,
+		HTTP1:         true,
+	}
+
+	cfg := srv.Config()
+	_, err := cfg.GetConfigForClient(nil)
+	require.EqualError(t, err, "certificates are not loaded")
+
+	require.NoError(t, srv.Load())
+
+	commonName := func() string {
+		cfg, err := cfg.GetConfigForClient(nil)
+		require.NoError(t, err)
+		require.Len(t, cfg.Certificates, 1)
+		cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+		require.NoError(t, err)
+		return cert.Subject.CommonName
+	}
+
+	actual, err := cfg.GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, actual.ClientAuth)
+	assert.NotNil(t, actual.ClientCAs)
+	assert.Equal(t, []string{"h2", "http/1.1"}, actual.NextProtos)
+	assert.Equal(t, "first", commonName())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- srv.Run(ctx) }()
+
+	// broken files are not applied
+	require.NoError(t, os.WriteFile(certFile, []byte("garbage"), 0o600))
+	bumpModTime(t, certFile)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, "first", commonName())
+
+	writeCert(t, certFile, keyFile, "second")
+	bumpModTime(t, certFile, keyFile)
+	assert.Eventually(t, func() bool { return commonName() == "second" }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.ErrorIs(t, <-done, context.Canceled)
+}
+
+func TestServer_RunDisabled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// non-positive interval must not panic, but disable the reloading
+	err := (&Server{CheckInterval: 0}).Run(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestServer_NextProtos(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "server")
+
+	// HTTP/1.1 is advertised only if the web requests are served
+	srv := &Server{CertFile: certFile, KeyFile: keyFile}
+	require.NoError(t, srv.Load())
+	cfg, err := srv.Config().GetConfigForClient(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"h2"}, cfg.NextProtos)
+}
+
+func TestServer_LoadError(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "server")
+
+	err := (&Server{CertFile: certFile, KeyFile: filepath.Join(dir, "unknown.pem")}).Load()
+	assert.ErrorContains(t, err, "unknown.pem")
+
+	caFile := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, []byte("garbage"), 0o600))
+	err = (&Server{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile}).Load()
+	assert.EqualError(t, err, `no certificates found in client CA "`+caFile+`"`)
+}
+
+func writeCert(t *testing.T, certFile, keyFile, cn string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		DNSNames:              []string{"localhost"},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
+
+var bumps int
+
+// bumpModTime makes sure the modification time changes,
+// regardless of the resolution of the file system clock.
+func bumpModTime(t *testing.T, files ...string) {
+	t.Helper()
+	bumps++
+	ts := time.Now().Add(time.Duration(bumps) * time.Minute)
+	for _, f := range files {
+		require.NoError(t, os.Chtimes(f, ts, ts))
+	}
+}
@@ -0,0 +1,89 @@
+// Package tracing sets up the OpenTelemetry tracing and propagates
+// the trace context through the gRPC metadata.
+package tracing
+
+import (
+	"context"
+	"fmt"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc/metadata"
+)
+
+// Config defines how the spans are sampled and exported.
+type Config struct {
+	Endpoint    string  // address of the OTLP/gRPC collector, e.g. "localhost:4317"
+	Insecure    bool    // connect to the collector without TLS
+	SampleRatio float64 // ratio of the sampled traces, started by gRoxy
+	Version     string  // version of gRoxy, reported in the resource
+}
+
+// NewProvider creates the tracer provider, which exports the spans to the
+// OTLP/gRPC collector. Traces, started by the clients, are sampled as the
+// clients decided. The provider must be shut down to flush the spans.
+func NewProvider(ctx context.Context, cfg Config) (*sdktrace.TracerProvider, error) {
+	opts := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(cfg.Endpoint)}
+	if cfg.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("create exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("groxy"), semconv.ServiceVersion(cfg.Version)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("build resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	), nil
+}
+
+// Propagator returns the propagator of the W3C trace context and baggage
+// and of the B3 headers, either single or multiple ones. Both B3 encodings
+// are injected, so that the headers of the client, whichever encoding it
+// has used, are replaced by the ones of the proxy span.
+func Propagator() propagation.TextMapPropagator {
+	return propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+		b3.New(b3.WithInjectEncoding(b3.B3SingleHeader|b3.B3MultipleHeader)),
+	)
+}
+
+// MetadataCarrier adapts the gRPC metadata to propagation.TextMapCarrier.
+type MetadataCarrier metadata.MD
+
+// Get returns the first value of the key.
+func (c MetadataCarrier) Get(key string) string {
+	if vals := metadata.MD(c).Get(key); len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// Set replaces the values of the key.
+func (c MetadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+// Keys returns the keys of the metadata.
+func (c MetadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
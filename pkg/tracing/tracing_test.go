@@ -0,0 +1,102 @@
+package tracing
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+	collectorpb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// collector is an in-process OTLP/gRPC collector, which keeps the names of the received spans.
+type collector struct {
+	collectorpb.UnimplementedTraceServiceServer
+	mu    sync.Mutex
+	spans []string
+}
+
+func (c *collector) Export(_ context.Context, req *collectorpb.ExportTraceServiceRequest) (*collectorpb.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.GetResourceSpans() {
+		for _, ss := range rs.GetScopeSpans() {
+			for _, span := range ss.GetSpans() {
+				c.spans = append(c.spans, span.GetName())
+			}
+		}
+	}
+	return &collectorpb.ExportTraceServiceResponse{}, nil
+}
+
+func TestNewProvider(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+
+	col := &collector{}
+	srv := grpc.NewServer()
+	collectorpb.RegisterTraceServiceServer(srv, col)
+	go func() { _ = srv.Serve(l) }()
+	defer srv.Stop()
+
+	ctx := context.Background()
+	tp, err := NewProvider(ctx, Config{Endpoint: l.Addr().String(), Insecure: true, SampleRatio: 1})
+	require.NoError(t, err)
+
+	_, span := tp.Tracer("test").Start(ctx, "pkg.Service/Method")
+	span.End()
+
+	require.NoError(t, tp.Shutdown(ctx)) // flushes the spans
+
+	col.mu.Lock()
+	defer col.mu.Unlock()
+	assert.Equal(t, []string{"pkg.Service/Method"}, col.spans)
+}
+
+func TestPropagator(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+
+	tbl := []struct {
+		name string
+		md   metadata.MD
+	}{
+		{name: "W3C", md: metadata.Pairs("traceparent", "00-"+traceID+"-"+spanID+"-01")},
+		{name: "B3 single", md: metadata.Pairs("b3", traceID+"-"+spanID+"-1")},
+		{name: "B3 multiple", md: metadata.Pairs(
+			"x-b3-traceid", traceID,
+			"x-b3-spanid", spanID,
+			"x-b3-sampled", "1",
+		)},
+	}
+
+	for _, tt := range tbl {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := Propagator().Extract(context.Background(), MetadataCarrier(tt.md))
+			sc := trace.SpanContextFromContext(ctx)
+			assert.Equal(t, traceID, sc.TraceID().String())
+			assert.Equal(t, spanID, sc.SpanID().String())
+			assert.True(t, sc.IsSampled())
+			assert.True(t, sc.IsRemote())
+		})
+	}
+
+	t.Run("inject", func(t *testing.T) {
+		ctx := Propagator().Extract(context.Background(), MetadataCarrier(tbl[0].md))
+
+		md := metadata.New(nil)
+		Propagator().Inject(ctx, MetadataCarrier(md))
+		assert.Equal(t, []string{"00-" + traceID + "-" + spanID + "-01"}, md.Get("traceparent"))
+		assert.Equal(t, []string{traceID + "-" + spanID + "-1"}, md.Get("b3"))
+		assert.Equal(t, []string{traceID}, md.Get("x-b3-traceid"))
+		assert.Equal(t, []string{spanID}, md.Get("x-b3-spanid"))
+		assert.Equal(t, []string{"1"}, md.Get("x-b3-sampled"))
+	})
+}